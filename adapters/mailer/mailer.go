@@ -0,0 +1,105 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+//Sender delivers messages to users
+type Sender interface {
+	Send(ctx context.Context, m *Message) error
+}
+
+//LogSender writes all messages to the standard logger. Only use this for local development
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, m *Message) error {
+	log.Printf("Mail to %v\nSubject: %v\n\n%v", m.To, m.Subject, m.Body)
+	return nil
+}
+
+//FileSender stores each message as json file in Dir. Messages can be read back with Messages
+type FileSender struct {
+	Dir string
+}
+
+func (f FileSender) Send(ctx context.Context, m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to serialize message : %v", err)
+	}
+	name := fmt.Sprintf("%020d-%v.json", time.Now().UnixNano(), strings.NewReplacer("/", "_", "\\", "_").Replace(m.To))
+	if err := ioutil.WriteFile(filepath.Join(f.Dir, name), data, 0600); err != nil {
+		return fmt.Errorf("failed to write message : %v", err)
+	}
+	return nil
+}
+
+//Messages returns all messages sent to to, oldest first
+func (f FileSender) Messages(to string) ([]*Message, error) {
+	files, err := ioutil.ReadDir(f.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %v : %v", f.Dir, err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	var messages []*Message
+	for _, v := range files {
+		if v.IsDir() || filepath.Ext(v.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(f.Dir, v.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v : %v", v.Name(), err)
+		}
+		m := &Message{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("failed to parse %v : %v", v.Name(), err)
+		}
+		if m.To == to {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+//NewFileSender creates dir if it does not exist
+func NewFileSender(dir string) (*FileSender, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create mail dir : %v", err)
+	}
+	return &FileSender{Dir: dir}, nil
+}
+
+//SMTPSender delivers messages via an SMTP relay
+type SMTPSender struct {
+	//Addr of the relay in host:port form
+	Addr string
+	From string
+	//Auth may be nil if the relay does not require authentication
+	Auth smtp.Auth
+}
+
+func (s SMTPSender) Send(ctx context.Context, m *Message) error {
+	msg := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%v\r\n",
+		s.From, m.To, m.Subject, m.Body)
+	if err := smtp.SendMail(s.Addr, s.Auth, s.From, []string{m.To}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send mail to %v : %v", m.To, err)
+	}
+	return nil
+}
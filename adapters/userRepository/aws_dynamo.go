@@ -2,7 +2,9 @@ package userRepository
 
 import (
 	"UserService/domain"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -10,11 +12,17 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"log"
+	"strconv"
 	"time"
 )
 
 const dynamoTimeout = 10 * time.Second
 
+//deletedUserTTLGrace delays the TTL expiry of deleted users beyond their retention. Deleted users are
+//purged by PurgeDeleted together with their devices and wrappings, TTL only removes the users left over
+//if no purger runs
+const deletedUserTTLGrace = 7 * 24 * time.Hour
+
 //awsErrorsIs returns true is err is and awsError with code awsErrCode. Safe to call on nil err value
 func awsErrorIs(err error, awsErrCode string) bool {
 	if err == nil {
@@ -28,12 +36,160 @@ func awsErrorIs(err error, awsErrCode string) bool {
 	return awsErr.Code() == awsErrCode
 }
 
+//isConditionFailed returns true if err cancelled a transaction because the condition of one of its items
+//failed. Transactions cancelled by throttling or conflicting transactions return false
+func isConditionFailed(err error) bool {
+	var canceled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, v := range canceled.CancellationReasons {
+		if aws.StringValue(v.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
+
 const TableUser = "Users"
 const TableUserPkName = "PublicKeyPKIX"
 
 const TableEmailToPublicKey = "EmailToUserPk"
 const TableEmailToPublicKeyPkName = "Email"
 
+const TableVerificationTokens = "VerificationTokens"
+const TableVerificationTokensPkName = "TokenHash"
+
+const TableDevices = "Devices"
+const TableDevicesPkName = "OwnerEmail"
+const TableDevicesSkName = "ID"
+
+const TableDevicePkToDevice = "DevicePkToDevice"
+const TableDevicePkToDevicePkName = "PublicKeyPKIX"
+
+const TableEnrollments = "Enrollments"
+const TableEnrollmentsPkName = "OwnerEmail"
+const TableEnrollmentsSkName = "ID"
+
+const TableRecoveryWrappings = "RecoveryWrappings"
+const TableRecoveryWrappingsPkName = "OwnerEmail"
+const TableRecoveryWrappingsSkName = "ID"
+
+const TableRecoveryAudits = "RecoveryAudits"
+const TableRecoveryAuditsPkName = "OwnerEmail"
+const TableRecoveryAuditsSkName = "ID"
+
+const TableOrganizations = "Organizations"
+const TableOrganizationsPkName = "ID"
+
+const TableDomainToOrganization = "DomainToOrganization"
+const TableDomainToOrganizationPkName = "EmailDomain"
+
+const TableEscrowWrappings = "EscrowWrappings"
+const TableEscrowWrappingsPkName = "OwnerEmail"
+
+const TableGroups = "Groups"
+const TableGroupsPkName = "ID"
+
+//TableGroupMembers and TableMemberGroups hold the same memberships keyed by group and by member
+const TableGroupMembers = "GroupMembers"
+const TableGroupMembersPkName = "GroupID"
+const TableGroupMembersSkName = "MemberEmail"
+
+const TableMemberGroups = "MemberGroups"
+const TableMemberGroupsPkName = "MemberEmail"
+const TableMemberGroupsSkName = "GroupID"
+
+//TableGroupKeys is keyed by the group id and epoch joined by groupEpochKey
+const TableGroupKeys = "GroupKeys"
+const TableGroupKeysPkName = "GroupEpoch"
+const TableGroupKeysSkName = "MemberEmail"
+
+//TableKeyLog holds all entries of the key transparency log under the hash key keyLogID, ordered by
+//their index
+const TableKeyLog = "KeyLog"
+const TableKeyLogPkName = "LogID"
+const TableKeyLogSkName = "LogIndex"
+
+//TableAuditLog stores each audit entry under the partitions of its day and of the involved users, see
+//auditPartitions
+const TableAuditLog = "AuditLog"
+const TableAuditLogPkName = "Partition"
+const TableAuditLogSkName = "EntryKey"
+
+//TableUserEvents is the outbox of user events under the hash key userEventStream, ordered by their
+//sequence. The item with sequence 0 holds the last assigned sequence
+const TableUserEvents = "UserEvents"
+const TableUserEventsPkName = "StreamName"
+const TableUserEventsSkName = "EventSeq"
+
+const TableWebhooks = "Webhooks"
+const TableWebhooksPkName = "ID"
+
+const TableWebhookDeliveries = "WebhookDeliveries"
+const TableWebhookDeliveriesPkName = "WebhookID"
+const TableWebhookDeliveriesSkName = "EventSeq"
+
+//TableCursors holds named progress markers like the last user event enqueued for webhooks
+const TableCursors = "Cursors"
+const TableCursorsPkName = "CursorName"
+
+//TableUserResidencies is the global index of the regions storing the users, see ResidencyRepo
+const TableUserResidencies = "UserResidencies"
+const TableUserResidenciesPkName = "Email"
+
+//TableRegionTombstones records the deletes from the user tables in the regions of global tables, see
+//RegionalDynamo. The hash key joins the table and the key of the deleted item
+const TableRegionTombstones = "RegionTombstones"
+const TableRegionTombstonesPkName = "ItemKey"
+
+//TableUserFences marks the users whose writes are fenced while they are moved to another backend, see
+//UserMoveRepo
+const TableUserFences = "UserFences"
+const TableUserFencesPkName = "Email"
+
+//ttlAttributes maps table names to the attribute holding the unix expiry time for dynamodb TTL
+var ttlAttributes = map[string]string{
+	TableUser:               "PurgeAtUnix",
+	TableEmailToPublicKey:   "PurgeAtUnix",
+	TableVerificationTokens: "ExpiresAtUnix",
+	TableEnrollments:        "ExpiresAtUnix",
+	TableUserEvents:         "ExpiresAtUnix",
+	TableRegionTombstones:   "ExpiresAtUnix",
+}
+
+//keyedTable returns the create request for a table with a hash key and an optional range key
+//skName. Key types are dynamodb attribute types like "S" or "B"
+func keyedTable(name, pkName, pkType, skName, skType string) *dynamodb.CreateTableInput {
+	in := &dynamodb.CreateTableInput{
+		TableName: aws.String(name),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String(pkName),
+				AttributeType: aws.String(pkType),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(pkName),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		BillingMode: aws.String("PAY_PER_REQUEST"),
+	}
+	if skName != "" {
+		in.AttributeDefinitions = append(in.AttributeDefinitions, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(skName),
+			AttributeType: aws.String(skType),
+		})
+		in.KeySchema = append(in.KeySchema, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String(skName),
+			KeyType:       aws.String("RANGE"),
+		})
+	}
+	return in
+}
+
 var createRequests = []*dynamodb.CreateTableInput{
 	{
 		TableName: aws.String(TableUser),
@@ -67,29 +223,69 @@ var createRequests = []*dynamodb.CreateTableInput{
 		},
 		BillingMode: aws.String("PAY_PER_REQUEST"),
 	},
+	{
+		TableName: aws.String(TableVerificationTokens),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String(TableVerificationTokensPkName),
+				AttributeType: aws.String("B"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(TableVerificationTokensPkName),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		BillingMode: aws.String("PAY_PER_REQUEST"),
+	},
+	keyedTable(TableDevices, TableDevicesPkName, "S", TableDevicesSkName, "S"),
+	keyedTable(TableDevicePkToDevice, TableDevicePkToDevicePkName, "B", "", ""),
+	keyedTable(TableEnrollments, TableEnrollmentsPkName, "S", TableEnrollmentsSkName, "S"),
+	keyedTable(TableRecoveryWrappings, TableRecoveryWrappingsPkName, "S", TableRecoveryWrappingsSkName, "S"),
+	keyedTable(TableRecoveryAudits, TableRecoveryAuditsPkName, "S", TableRecoveryAuditsSkName, "S"),
+	keyedTable(TableOrganizations, TableOrganizationsPkName, "S", "", ""),
+	keyedTable(TableDomainToOrganization, TableDomainToOrganizationPkName, "S", "", ""),
+	keyedTable(TableEscrowWrappings, TableEscrowWrappingsPkName, "S", "", ""),
+	keyedTable(TableGroups, TableGroupsPkName, "S", "", ""),
+	keyedTable(TableGroupMembers, TableGroupMembersPkName, "S", TableGroupMembersSkName, "S"),
+	keyedTable(TableMemberGroups, TableMemberGroupsPkName, "S", TableMemberGroupsSkName, "S"),
+	keyedTable(TableGroupKeys, TableGroupKeysPkName, "S", TableGroupKeysSkName, "S"),
+	keyedTable(TableKeyLog, TableKeyLogPkName, "S", TableKeyLogSkName, "N"),
+	keyedTable(TableAuditLog, TableAuditLogPkName, "S", TableAuditLogSkName, "S"),
+	keyedTable(TableUserEvents, TableUserEventsPkName, "S", TableUserEventsSkName, "N"),
+	keyedTable(TableWebhooks, TableWebhooksPkName, "S", "", ""),
+	keyedTable(TableWebhookDeliveries, TableWebhookDeliveriesPkName, "S", TableWebhookDeliveriesSkName, "N"),
+	keyedTable(TableCursors, TableCursorsPkName, "S", "", ""),
+	keyedTable(TableUserResidencies, TableUserResidenciesPkName, "S", "", ""),
+	keyedTable(TableRegionTombstones, TableRegionTombstonesPkName, "S", "", ""),
+	keyedTable(TableUserFences, TableUserFencesPkName, "S", "", ""),
 }
 
+//EmailToPkEntry maps the normalized email (see domain.NormalizeEmail) to the users public key
 type EmailToPkEntry struct {
 	Email      string
 	PrimaryKey []byte
+	//PurgeAtUnix is used as dynamo TTL attribute for deleted users
+	PurgeAtUnix int64 `dynamodbav:",omitempty"`
 }
 
-func (a AwsDynamoUserRepo) doesUserExist(ctx context.Context, email string) error {
+func (a AwsDynamoUserRepo) doesUserExist(ctx context.Context, normalizedEmail string) error {
 	//check if user already exists
-	_, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(TableEmailToPublicKey),
 		Key: map[string]*dynamodb.AttributeValue{
 			TableEmailToPublicKeyPkName: {
-				S: aws.String(email),
+				S: aws.String(normalizedEmail),
 			},
 		},
 	})
 	if err != nil {
-		if awsErrorIs(err, dynamodb.ErrCodeDuplicateItemException) {
-			return fmt.Errorf("failed to insert user : %w", ErrAlreadyExists)
-		}
 		return err
 	}
+	if result.Item != nil {
+		return fmt.Errorf("failed to insert user : %w", ErrAlreadyExists)
+	}
 	return nil
 }
 
@@ -112,14 +308,61 @@ func createTable(db *dynamodb.DynamoDB, createIn *dynamodb.CreateTableInput) err
 	return nil
 }
 
+//enableTTL turns on dynamodb TTL for table using attribute, if not already enabled
+func enableTTL(db *dynamodb.DynamoDB, table, attribute string) error {
+	desc, err := db.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{TableName: aws.String(table)})
+	if err != nil {
+		return fmt.Errorf("DescribeTimeToLive failed: %v", err)
+	}
+	if desc.TimeToLiveDescription != nil {
+		switch aws.StringValue(desc.TimeToLiveDescription.TimeToLiveStatus) {
+		case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+			return nil
+		}
+	}
+	_, err = db.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateTimeToLive failed: %v", err)
+	}
+	return nil
+}
+
 type AwsDynamoUserRepo struct {
-	db *dynamodb.DynamoDB
+	db DynamoClient
+	//resilience retries the calls of db and trips its circuit breaker
+	resilience *DynamoResilience
+	//Retention is the time after which deleted users are removed by PurgeDeleted
+	Retention time.Duration
+	//EventRetention is the time after which user events are removed by dynamodb TTL
+	EventRetention time.Duration
+	//home takes the tables needing a single writer across the regions of global tables: the key log,
+	//the cursors, the webhooks and the outbox the events are relayed to. Nil uses db
+	home DynamoClient
+	//eventStream is the hash key the events of the writes of this repo go to, empty for userEventStream
+	eventStream string
 }
 
-func (a AwsDynamoUserRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error) {
-	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
-	defer cancel()
+//homeDB returns the client of the tables that are written by a single region
+func (a AwsDynamoUserRepo) homeDB() DynamoClient {
+	if a.home != nil {
+		return a.home
+	}
+	return a.db
+}
 
+//purgeAtUnix returns the TTL expiry of a user deleted at deletedAt
+func (a AwsDynamoUserRepo) purgeAtUnix(deletedAt time.Time) int64 {
+	return deletedAt.Add(a.Retention + deletedUserTTLGrace).Unix()
+}
+
+//getUserDTO fetches the stored user entry for PKIXPublicKey, including deleted users
+func (a AwsDynamoUserRepo) getUserDTO(ctx context.Context, PKIXPublicKey []byte) (*UserDTODB, error) {
 	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(TableUser),
 		Key: map[string]*dynamodb.AttributeValue{
@@ -141,25 +384,16 @@ func (a AwsDynamoUserRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*
 	if err := dynamodbattribute.UnmarshalMap(result.Item, dbUser); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to UserDTODB : %v", err)
 	}
-
-	user, err := dbUser.toUser()
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal UserDTODB entry to user : %v", err)
-	}
-	return user, nil
-
+	return dbUser, nil
 }
 
-func (a AwsDynamoUserRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
-	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
-	defer cancel()
-
-	//user TableEmailToPublicKey to get Public Key for email address, then
+//getEmailEntry fetches the TableEmailToPublicKey entry for the normalized email
+func (a AwsDynamoUserRepo) getEmailEntry(ctx context.Context, normalizedEmail string) (*EmailToPkEntry, error) {
 	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(TableEmailToPublicKey),
 		Key: map[string]*dynamodb.AttributeValue{
 			TableEmailToPublicKeyPkName: {
-				S: aws.String(email),
+				S: aws.String(normalizedEmail),
 			},
 		},
 	})
@@ -175,6 +409,43 @@ func (a AwsDynamoUserRepo) GetByEmail(ctx context.Context, email string) (*domai
 	if err := dynamodbattribute.UnmarshalMap(result.Item, emailToPk); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to EmailToPkEntry : %v", err)
 	}
+	return emailToPk, nil
+}
+
+func (a AwsDynamoUserRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	dbUser, err := a.getUserDTO(ctx, PKIXPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if dbUser.DeletedAt != nil {
+		return nil, fmt.Errorf("failed to fetch user : %w", ErrNotFound)
+	}
+
+	user, err := dbUser.toUser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal UserDTODB entry to user : %v", err)
+	}
+	return user, nil
+
+}
+
+func (a AwsDynamoUserRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+
+	//user TableEmailToPublicKey to get Public Key for email address, then
+	emailToPk, err := a.getEmailEntry(ctx, normalizedEmail)
+	if err != nil {
+		return nil, err
+	}
 
 	//User Public Key to get User
 	return a.GetByPk(ctx, emailToPk.PrimaryKey)
@@ -185,10 +456,6 @@ func (a AwsDynamoUserRepo) Create(ctx context.Context, u *domain.User) (*domain.
 	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
 	defer cancel()
 
-	if err := a.doesUserExist(ctx, u.Email); err != nil {
-		return nil, err
-	}
-
 	//update time stamps
 	u.CreatedAt = time.Now()
 	u.UpdatedAt = u.CreatedAt
@@ -198,33 +465,43 @@ func (a AwsDynamoUserRepo) Create(ctx context.Context, u *domain.User) (*domain.
 	if err != nil {
 		return nil, fmt.Errorf("failed to serialize user for DB : %v", err)
 	}
+
+	if err := a.doesUserExist(ctx, dbUser.NormalizedEmail); err != nil {
+		return nil, err
+	}
 	userAwsMap, err := dynamodbattribute.MarshalMap(dbUser)
 	if err != nil {
 		return nil, fmt.Errorf("failed to serialize user for dynamodb : %v", err)
 	}
 	userToPkAwsMap, err := dynamodbattribute.MarshalMap(&EmailToPkEntry{
-		Email:      dbUser.Email,
+		Email:      dbUser.NormalizedEmail,
 		PrimaryKey: dbUser.PublicKeyPKIX,
 	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize email to pk entry for dynamodb : %v", err)
+	}
 
-	//do atomic insert
-	_, err = a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
-		TransactItems: []*dynamodb.TransactWriteItem{
-			{
-				Put: &dynamodb.Put{
-					Item:      userAwsMap,
-					TableName: aws.String(TableUser),
-				},
+	//do atomic insert, the conditions guard against reused keys and concurrent creates for the same email
+	err = a.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				Item:                userAwsMap,
+				TableName:           aws.String(TableUser),
+				ConditionExpression: aws.String("attribute_not_exists(" + TableUserPkName + ")"),
 			},
-			{
-				Put: &dynamodb.Put{
-					Item:      userToPkAwsMap,
-					TableName: aws.String(TableEmailToPublicKey),
-				},
+		},
+		{
+			Put: &dynamodb.Put{
+				Item:                userToPkAwsMap,
+				TableName:           aws.String(TableEmailToPublicKey),
+				ConditionExpression: aws.String("attribute_not_exists(" + TableEmailToPublicKeyPkName + ")"),
 			},
 		},
-	})
+	}, userEventOf(domain.UserEventCreated, dbUser))
 	if err != nil {
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("failed to insert user : %w", ErrAlreadyExists)
+		}
 		return nil, fmt.Errorf("failed to insert user : %v", err)
 	}
 
@@ -232,11 +509,61 @@ func (a AwsDynamoUserRepo) Create(ctx context.Context, u *domain.User) (*domain.
 
 }
 
+func (a AwsDynamoUserRepo) Update(ctx context.Context, u *domain.User) (*domain.User, error) {
+	current, err := a.GetByEmail(ctx, u.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user : %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	currentDB, err := userToDTODB(current)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert user to db representation : %v", err)
+	}
+	u.CreatedAt = current.CreatedAt
+	u.UpdatedAt = time.Now()
+	dbUser, err := userToDTODB(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user for DB : %v", err)
+	}
+	if !bytes.Equal(currentDB.PublicKeyPKIX, dbUser.PublicKeyPKIX) {
+		return nil, fmt.Errorf("public key can not be changed by update")
+	}
+
+	userAwsMap, err := dynamodbattribute.MarshalMap(dbUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user for dynamodb : %v", err)
+	}
+	err = a.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{
+		fenceCheck(dbUser.NormalizedEmail),
+		{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(TableUser),
+				Item:                userAwsMap,
+				ConditionExpression: aws.String("attribute_exists(" + TableUserPkName + ")"),
+			},
+		},
+	}, userEventOf(domain.UserEventUpdated, dbUser))
+	err = a.fencedError(ctx, err, dbUser.NormalizedEmail)
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return nil, fmt.Errorf("failed to update user : %w", err)
+		}
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("failed to update user : %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to update user : %v", err)
+	}
+	return u, nil
+}
+
 func (a AwsDynamoUserRepo) DeleteByEmail(ctx context.Context, email string) error {
 
 	user, err := a.GetByEmail(ctx, email)
 	if err != nil {
-		return fmt.Errorf("failed to delete user : %v", err)
+		return fmt.Errorf("failed to delete user : %w", err)
 	}
 
 	userDB, err := userToDTODB(user)
@@ -244,54 +571,383 @@ func (a AwsDynamoUserRepo) DeleteByEmail(ctx context.Context, email string) erro
 		return fmt.Errorf("failed to convert user to db representation : %v", err)
 	}
 
+	now := time.Now()
+	deletedAt, err := dynamodbattribute.Marshal(now)
+	if err != nil {
+		return fmt.Errorf("failed to serialize deletion time : %v", err)
+	}
+	purgeAt := &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(a.purgeAtUnix(now), 10))}
+
+	//do atomic soft delete, both entries expire by TTL after the retention and its grace
+	err = a.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{
+		fenceCheck(userDB.NormalizedEmail),
+		{
+			Update: &dynamodb.Update{
+				Key: map[string]*dynamodb.AttributeValue{
+					TableEmailToPublicKeyPkName: {
+						S: aws.String(userDB.NormalizedEmail),
+					},
+				},
+				TableName:                 aws.String(TableEmailToPublicKey),
+				UpdateExpression:          aws.String("SET PurgeAtUnix = :p"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":p": purgeAt},
+			},
+		},
+		{
+			Update: &dynamodb.Update{
+				Key: map[string]*dynamodb.AttributeValue{
+					TableUserPkName: {
+						B: userDB.PublicKeyPKIX,
+					},
+				},
+				TableName:           aws.String(TableUser),
+				UpdateExpression:    aws.String("SET DeletedAt = :d, PurgeAtUnix = :p"),
+				ConditionExpression: aws.String("attribute_not_exists(DeletedAt)"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":d": deletedAt,
+					":p": purgeAt,
+				},
+			},
+		},
+	}, userEventOf(domain.UserEventDeleted, userDB))
+	err = a.fencedError(ctx, err, userDB.NormalizedEmail)
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return fmt.Errorf("failed to delete user : %w", err)
+		}
+		return fmt.Errorf("failed to delete user : %v", err)
+	}
+
+	return nil
+}
+
+func (a AwsDynamoUserRepo) Restore(ctx context.Context, email string, deletedAfter time.Time) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	emailToPk, err := a.getEmailEntry(ctx, normalizedEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore user : %w", err)
+	}
+	dbUser, err := a.getUserDTO(ctx, emailToPk.PrimaryKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore user : %w", err)
+	}
+	if dbUser.DeletedAt == nil || !dbUser.DeletedAt.After(deletedAfter) {
+		return nil, fmt.Errorf("failed to restore user : %w", ErrNotFound)
+	}
+	restored := *dbUser
+	restored.DeletedAt = nil
+
+	err = a.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{
+		fenceCheck(normalizedEmail),
+		{
+			Update: &dynamodb.Update{
+				Key: map[string]*dynamodb.AttributeValue{
+					TableEmailToPublicKeyPkName: {
+						S: aws.String(normalizedEmail),
+					},
+				},
+				TableName:        aws.String(TableEmailToPublicKey),
+				UpdateExpression: aws.String("REMOVE PurgeAtUnix"),
+			},
+		},
+		{
+			Update: &dynamodb.Update{
+				Key: map[string]*dynamodb.AttributeValue{
+					TableUserPkName: {
+						B: dbUser.PublicKeyPKIX,
+					},
+				},
+				TableName:           aws.String(TableUser),
+				UpdateExpression:    aws.String("REMOVE DeletedAt, PurgeAtUnix"),
+				ConditionExpression: aws.String("attribute_exists(DeletedAt)"),
+			},
+		},
+	}, userEventOf(domain.UserEventRestored, &restored))
+	err = a.fencedError(ctx, err, normalizedEmail)
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return nil, fmt.Errorf("failed to restore user : %w", err)
+		}
+		return nil, fmt.Errorf("failed to restore user : %v", err)
+	}
+
+	user, err := restored.toUser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal UserDTODB entry to user : %v", err)
+	}
+	return user, nil
+}
+
+//queryByHashKey passes all items of table with the hash key value key to fn
+func (a AwsDynamoUserRepo) queryByHashKey(ctx context.Context, table, pkName, key string, fn func(item map[string]*dynamodb.AttributeValue) error) error {
+	var fnErr error
+	err := a.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String(pkName + " = :k"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":k": {S: aws.String(key)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if fnErr = fn(item); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+//purgeEntries removes both table entries of a user, all its devices, recovery and escrow wrappings
+//as well as its group memberships
+func (a AwsDynamoUserRepo) purgeEntries(ctx context.Context, u *UserDTODB) error {
+	normalizedEmail, PKIXPublicKey := u.NormalizedEmail, u.PublicKeyPKIX
+	if err := a.purgeDevices(ctx, normalizedEmail); err != nil {
+		return err
+	}
+	if err := a.purgeRecoveryWrappings(ctx, normalizedEmail); err != nil {
+		return err
+	}
+	if err := a.purgeEscrowWrapping(ctx, normalizedEmail); err != nil {
+		return err
+	}
+	if err := a.purgeGroupMemberships(ctx, normalizedEmail); err != nil {
+		return err
+	}
 	//do atomic delete
-	_, err = a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
-		TransactItems: []*dynamodb.TransactWriteItem{
-			{
-				Delete: &dynamodb.Delete{
-					Key: map[string]*dynamodb.AttributeValue{
-						TableEmailToPublicKeyPkName: {
-							S: aws.String(email),
-						},
+	err := a.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{
+		{
+			Delete: &dynamodb.Delete{
+				Key: map[string]*dynamodb.AttributeValue{
+					TableEmailToPublicKeyPkName: {
+						S: aws.String(normalizedEmail),
 					},
-					TableName: aws.String(TableEmailToPublicKey),
 				},
+				TableName: aws.String(TableEmailToPublicKey),
 			},
-			{
-				Delete: &dynamodb.Delete{
-					Key: map[string]*dynamodb.AttributeValue{
-						TableUserPkName: {
-							B: userDB.PublicKeyPKIX,
-						},
+		},
+		{
+			Delete: &dynamodb.Delete{
+				Key: map[string]*dynamodb.AttributeValue{
+					TableUserPkName: {
+						B: PKIXPublicKey,
 					},
-					TableName: aws.String(TableUser),
 				},
+				TableName: aws.String(TableUser),
+			},
+		},
+	}, userEventOf(domain.UserEventPurged, u))
+	if err != nil {
+		return fmt.Errorf("failed to purge user : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) PurgeByEmail(ctx context.Context, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return fmt.Errorf("failed to normalize email : %v", err)
+	}
+	emailToPk, err := a.getEmailEntry(ctx, normalizedEmail)
+	if err != nil {
+		return fmt.Errorf("failed to purge user : %w", err)
+	}
+	dbUser, err := a.getUserDTO(ctx, emailToPk.PrimaryKey)
+	if err != nil {
+		return fmt.Errorf("failed to purge user : %w", err)
+	}
+	return a.purgeEntries(ctx, dbUser)
+}
+
+//PurgeDeleted removes the deleted users together with their devices, wrappings and group memberships. It
+//has to run periodically, the TTL of deleted users is only a backstop that leaves these behind
+func (a AwsDynamoUserRepo) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	var expired []*UserDTODB
+	err := a.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(TableUser),
+		FilterExpression: aws.String("attribute_exists(DeletedAt)"),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			dbUser := &UserDTODB{}
+			if err := dynamodbattribute.UnmarshalMap(item, dbUser); err != nil {
+				log.Printf("skipping malformed user entry : %v", err)
+				continue
+			}
+			if dbUser.DeletedAt != nil && dbUser.DeletedAt.Before(deletedBefore) {
+				expired = append(expired, dbUser)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan %v : %v", TableUser, err)
+	}
+
+	purged := 0
+	for _, v := range expired {
+		if err := a.purgeEntries(ctx, v); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (a AwsDynamoUserRepo) CreateToken(ctx context.Context, t *domain.VerificationToken) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	tokenAwsMap, err := dynamodbattribute.MarshalMap(tokenToDTODB(t))
+	if err != nil {
+		return fmt.Errorf("failed to serialize token for dynamodb : %v", err)
+	}
+	_, err = a.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(TableVerificationTokens),
+		Item:                tokenAwsMap,
+		ConditionExpression: aws.String("attribute_not_exists(" + TableVerificationTokensPkName + ")"),
+	})
+	if err != nil {
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return fmt.Errorf("failed to insert token : %w", ErrAlreadyExists)
+		}
+		return fmt.Errorf("failed to insert token : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) ConsumeToken(ctx context.Context, tokenHash []byte, email string, purpose domain.VerificationPurpose) (*domain.VerificationToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	//deleting with ALL_OLD makes consumption atomic, the condition keeps tokens presented for another
+	//email or purpose
+	result, err := a.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(TableVerificationTokens),
+		Key: map[string]*dynamodb.AttributeValue{
+			TableVerificationTokensPkName: {
+				B: tokenHash,
 			},
 		},
+		ConditionExpression: aws.String("Email = :e AND Purpose = :p"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":e": {S: aws.String(email)},
+			":p": {S: aws.String(string(purpose))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to delete user : %v", err)
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return nil, fmt.Errorf("failed to fetch token : %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to delete token : %v", err)
+	}
+	if result.Attributes == nil {
+		return nil, fmt.Errorf("failed to fetch token : %w", ErrNotFound)
+	}
+	dbToken := &VerificationTokenDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, dbToken); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to VerificationTokenDTODB : %v", err)
 	}
+	return dbToken.toToken(), nil
+}
 
+//PurgeExpiredTokens is a no-op, expired tokens are removed by dynamodb TTL
+func (a AwsDynamoUserRepo) PurgeExpiredTokens(ctx context.Context, now time.Time) (int, error) {
+	return 0, nil
+}
+
+func (a AwsDynamoUserRepo) ScanTokens(ctx context.Context, fn func(t *domain.VerificationToken) error) error {
+	var fnErr error
+	err := a.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String(TableVerificationTokens)},
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				dbToken := &VerificationTokenDTODB{}
+				if err := dynamodbattribute.UnmarshalMap(item, dbToken); err != nil {
+					log.Printf("skipping malformed token entry : %v", err)
+					continue
+				}
+				if fnErr = fn(dbToken.toToken()); fnErr != nil {
+					return false
+				}
+			}
+			return true
+		})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to scan %v : %v", TableVerificationTokens, err)
+	}
 	return nil
 }
 
+//NewAwsDynamoUserRepo disables the retries of the sdk, the calls are retried by the DynamoResilience of
+//the repo instead
 func NewAwsDynamoUserRepo(sess *session.Session) (*AwsDynamoUserRepo, error) {
-	db := dynamodb.New(sess)
+	db := dynamodb.New(sess, aws.NewConfig().WithMaxRetries(0))
+	return newAwsDynamoUserRepo(db)
+}
+
+//NewAwsDynamoUserRepoInRegion creates a repo with the tables in region, independent of the region of sess
+func NewAwsDynamoUserRepoInRegion(sess *session.Session, region string) (*AwsDynamoUserRepo, error) {
+	db := dynamodb.New(sess, aws.NewConfig().WithRegion(region).WithMaxRetries(0))
 	return newAwsDynamoUserRepo(db)
 }
 
 func NewAwsLocalDynamoUserRepo(sess *session.Session) (*AwsDynamoUserRepo, error) {
-	db := dynamodb.New(sess, aws.NewConfig().WithEndpoint("http://localhost:8000"))
+	db := dynamodb.New(sess, aws.NewConfig().WithEndpoint("http://localhost:8000").WithMaxRetries(0))
 	return newAwsDynamoUserRepo(db)
 }
 
-func newAwsDynamoUserRepo(db *dynamodb.DynamoDB) (*AwsDynamoUserRepo, error) {
+//NewAwsDynamoUserRepoWithClient creates a repo using the existing tables of client, e.g. a FakeDynamo.
+//A nil resilience selects the defaults
+func NewAwsDynamoUserRepoWithClient(client DynamoClient, resilience *DynamoResilience) *AwsDynamoUserRepo {
+	if resilience == nil {
+		resilience = &DynamoResilience{}
+	}
+	return &AwsDynamoUserRepo{
+		db:             &resilientDynamoClient{client: client, resilience: resilience},
+		resilience:     resilience,
+		Retention:      DefaultRetention,
+		EventRetention: DefaultEventRetention,
+	}
+}
+
+//Healthy returns ErrUnavailable while the circuit breaker of the repo is open
+func (a AwsDynamoUserRepo) Healthy() error {
+	return a.resilience.Healthy()
+}
+
+//setupTables creates the missing tables of the repo and enables their TTL
+func setupTables(db *dynamodb.DynamoDB) error {
 	for _, v := range createRequests {
 		if err := createTable(db, v); err != nil {
-			return nil, fmt.Errorf("error setting up tables : %v", err)
+			return fmt.Errorf("error setting up tables : %v", err)
+		}
+		if attribute, ok := ttlAttributes[*v.TableName]; ok {
+			if err := enableTTL(db, *v.TableName, attribute); err != nil {
+				return fmt.Errorf("error setting up ttl for %v : %v", *v.TableName, err)
+			}
 		}
 	}
-	repo := &AwsDynamoUserRepo{db: db}
-	return repo, nil
+	return nil
+}
+
+func newAwsDynamoUserRepo(db *dynamodb.DynamoDB) (*AwsDynamoUserRepo, error) {
+	if err := setupTables(db); err != nil {
+		return nil, err
+	}
+	return NewAwsDynamoUserRepoWithClient(db, nil), nil
 }
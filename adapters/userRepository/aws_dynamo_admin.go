@@ -0,0 +1,284 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"log"
+	"sort"
+	"time"
+)
+
+//ListUsers scans the whole user table to order the matches, which is acceptable for the rare calls of the
+//admin tooling. Passes over all users use ScanUsers instead
+func (a AwsDynamoUserRepo) ListUsers(ctx context.Context, filter domain.UserFilter) ([]*domain.User, error) {
+	type match struct {
+		normalizedEmail string
+		user            *domain.User
+	}
+	var matches []match
+	err := a.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String(TableUser)},
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				dbUser := &UserDTODB{}
+				if err := dynamodbattribute.UnmarshalMap(item, dbUser); err != nil {
+					log.Printf("skipping malformed user entry : %v", err)
+					continue
+				}
+				if filter.After != "" && dbUser.NormalizedEmail <= filter.After {
+					continue
+				}
+				user, err := dbUser.toUser()
+				if err != nil {
+					log.Printf("skipping malformed user entry : %v", err)
+					continue
+				}
+				if filter.Matches(dbUser.NormalizedEmail, user) {
+					matches = append(matches, match{dbUser.NormalizedEmail, user})
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %v : %v", TableUser, err)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].normalizedEmail < matches[j].normalizedEmail
+	})
+	if filter.Limit > 0 && len(matches) > filter.Limit {
+		matches = matches[:filter.Limit]
+	}
+	users := make([]*domain.User, 0, len(matches))
+	for _, v := range matches {
+		users = append(users, v.user)
+	}
+	return users, nil
+}
+
+//ScanUsers streams one scan of the user table, the pages are followed by their LastEvaluatedKey
+func (a AwsDynamoUserRepo) ScanUsers(ctx context.Context, fn func(u *domain.User) error) error {
+	var fnErr error
+	err := a.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String(TableUser)},
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				dbUser := &UserDTODB{}
+				if err := dynamodbattribute.UnmarshalMap(item, dbUser); err != nil {
+					log.Printf("skipping malformed user entry : %v", err)
+					continue
+				}
+				user, err := dbUser.toUser()
+				if err != nil {
+					log.Printf("skipping malformed user entry : %v", err)
+					continue
+				}
+				if fnErr = fn(user); fnErr != nil {
+					return false
+				}
+			}
+			return true
+		})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to scan %v : %v", TableUser, err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) FindByEmail(ctx context.Context, email string) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	emailToPk, err := a.getEmailEntry(ctx, normalizedEmail)
+	if err != nil {
+		return nil, err
+	}
+	dbUser, err := a.getUserDTO(ctx, emailToPk.PrimaryKey)
+	if err != nil {
+		return nil, err
+	}
+	return dbUser.toUser()
+}
+
+//RotateUserKey moves the user entry to the new key, as the user table is keyed by the public key
+func (a AwsDynamoUserRepo) RotateUserKey(ctx context.Context, u *domain.User) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	dbUser, err := userToDTODB(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user for DB : %v", err)
+	}
+	emailToPk, err := a.getEmailEntry(ctx, dbUser.NormalizedEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate key : %w", err)
+	}
+	current, err := a.getUserDTO(ctx, emailToPk.PrimaryKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate key : %w", err)
+	}
+	if current.DeletedAt != nil {
+		return nil, fmt.Errorf("failed to rotate key : %w", ErrNotFound)
+	}
+	if _, err := a.GetDeviceByPk(ctx, dbUser.PublicKeyPKIX); err == nil {
+		return nil, fmt.Errorf("failed to rotate key : %w", ErrAlreadyExists)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to rotate key : %v", err)
+	}
+
+	rotated := *current
+	rotated.PublicKeyPKIX = dbUser.PublicKeyPKIX
+	rotated.WrappedPrivateKey = dbUser.WrappedPrivateKey
+	rotated.WrappedMasterKey = dbUser.WrappedMasterKey
+	rotated.UpdatedAt = time.Now()
+	userAwsMap, err := dynamodbattribute.MarshalMap(&rotated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user for dynamodb : %v", err)
+	}
+
+	//do atomic move, the conditions guard against reused keys and concurrent deletes or rotations
+	err = a.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{
+		fenceCheck(current.NormalizedEmail),
+		{
+			Put: &dynamodb.Put{
+				Item:                userAwsMap,
+				TableName:           aws.String(TableUser),
+				ConditionExpression: aws.String("attribute_not_exists(" + TableUserPkName + ")"),
+			},
+		},
+		{
+			Delete: &dynamodb.Delete{
+				Key: map[string]*dynamodb.AttributeValue{
+					TableUserPkName: {B: current.PublicKeyPKIX},
+				},
+				TableName:           aws.String(TableUser),
+				ConditionExpression: aws.String("attribute_exists(" + TableUserPkName + ") AND attribute_not_exists(DeletedAt)"),
+			},
+		},
+		{
+			Update: &dynamodb.Update{
+				Key: map[string]*dynamodb.AttributeValue{
+					TableEmailToPublicKeyPkName: {S: aws.String(current.NormalizedEmail)},
+				},
+				TableName:           aws.String(TableEmailToPublicKey),
+				UpdateExpression:    aws.String("SET PrimaryKey = :n"),
+				ConditionExpression: aws.String("PrimaryKey = :o"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":n": {B: rotated.PublicKeyPKIX},
+					":o": {B: current.PublicKeyPKIX},
+				},
+			},
+		},
+	}, userEventOf(domain.UserEventKeyRotated, &rotated))
+	err = a.fencedError(ctx, err, current.NormalizedEmail)
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return nil, fmt.Errorf("failed to rotate key : %w", err)
+		}
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("failed to rotate key : %w", ErrAlreadyExists)
+		}
+		return nil, fmt.Errorf("failed to rotate key : %v", err)
+	}
+	return rotated.toUser()
+}
+
+//ImportUser writes the user and its email entry in one transaction. Deleted users keep their TTL counted
+//from their deletion
+func (a AwsDynamoUserRepo) ImportUser(ctx context.Context, u *domain.User, overwrite bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	dbUser, err := userToDTODB(u)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize user for DB : %v", err)
+	}
+	existing, err := a.getEmailEntry(ctx, dbUser.NormalizedEmail)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, fmt.Errorf("failed to import user : %v", err)
+	}
+	if existing != nil && !overwrite {
+		return false, fmt.Errorf("failed to import user : %w", ErrAlreadyExists)
+	}
+	if _, err := a.GetDeviceByPk(ctx, dbUser.PublicKeyPKIX); err == nil {
+		return false, fmt.Errorf("failed to import user : %w", ErrAlreadyExists)
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, fmt.Errorf("failed to import user : %v", err)
+	}
+
+	emailEntry := &EmailToPkEntry{
+		Email:      dbUser.NormalizedEmail,
+		PrimaryKey: dbUser.PublicKeyPKIX,
+	}
+	if dbUser.DeletedAt != nil {
+		dbUser.PurgeAtUnix = a.purgeAtUnix(*dbUser.DeletedAt)
+		emailEntry.PurgeAtUnix = dbUser.PurgeAtUnix
+	}
+	userAwsMap, err := dynamodbattribute.MarshalMap(dbUser)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize user for dynamodb : %v", err)
+	}
+	emailAwsMap, err := dynamodbattribute.MarshalMap(emailEntry)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize email to pk entry for dynamodb : %v", err)
+	}
+
+	//the conditions guard against keys of other users and concurrent changes of the email entry
+	emailPut := &dynamodb.Put{
+		Item:                emailAwsMap,
+		TableName:           aws.String(TableEmailToPublicKey),
+		ConditionExpression: aws.String("attribute_not_exists(" + TableEmailToPublicKeyPkName + ")"),
+	}
+	items := []*dynamodb.TransactWriteItem{
+		fenceCheck(dbUser.NormalizedEmail),
+		{
+			Put: &dynamodb.Put{
+				Item:                userAwsMap,
+				TableName:           aws.String(TableUser),
+				ConditionExpression: aws.String("attribute_not_exists(" + TableUserPkName + ") OR NormalizedEmail = :e"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":e": {S: aws.String(dbUser.NormalizedEmail)},
+				},
+			},
+		},
+		{Put: emailPut},
+	}
+	if existing != nil {
+		emailPut.ConditionExpression = aws.String("PrimaryKey = :o")
+		emailPut.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":o": {B: existing.PrimaryKey},
+		}
+		if !bytes.Equal(existing.PrimaryKey, dbUser.PublicKeyPKIX) {
+			items = append(items, &dynamodb.TransactWriteItem{
+				Delete: &dynamodb.Delete{
+					Key: map[string]*dynamodb.AttributeValue{
+						TableUserPkName: {B: existing.PrimaryKey},
+					},
+					TableName: aws.String(TableUser),
+				},
+			})
+		}
+	}
+	err = a.transactWithEvents(ctx, items, userEventOf(domain.UserEventImported, dbUser))
+	err = a.fencedError(ctx, err, dbUser.NormalizedEmail)
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return false, fmt.Errorf("failed to import user : %w", err)
+		}
+		if isConditionFailed(err) {
+			return false, fmt.Errorf("failed to import user : %w", ErrAlreadyExists)
+		}
+		return false, fmt.Errorf("failed to import user : %v", err)
+	}
+	return existing != nil, nil
+}
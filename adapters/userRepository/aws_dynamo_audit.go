@@ -0,0 +1,135 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"time"
+)
+
+const auditDayLayout = "2006-01-02"
+
+func auditDayPartition(t time.Time) string {
+	return "day#" + t.UTC().Format(auditDayLayout)
+}
+
+func auditUserPartition(email string) string {
+	return "user#" + email
+}
+
+//auditPartitions returns the partitions an entry is stored in. Every entry is stored in the partition
+//of its day, to query by time, and in the partitions of its actor and target, to query by user
+func auditPartitions(e *domain.AuditEntry) []string {
+	partitions := []string{auditDayPartition(e.Time)}
+	for _, v := range []string{e.ActorEmail, e.TargetEmail} {
+		if p := auditUserPartition(v); v != "" && p != partitions[len(partitions)-1] {
+			partitions = append(partitions, p)
+		}
+	}
+	return partitions
+}
+
+//auditEntryKey sorts entries by time within a partition
+func auditEntryKey(t time.Time, id string) string {
+	return fmt.Sprintf("%020d#%v", t.UnixNano(), id)
+}
+
+//auditKeyBound is the smallest entry key at t. The zero time is mapped to the unix epoch
+func auditKeyBound(t time.Time) string {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+func (a AwsDynamoUserRepo) AppendAuditEntry(ctx context.Context, e *domain.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var items []*dynamodb.TransactWriteItem
+	for _, p := range auditPartitions(e) {
+		dbEntry := auditEntryToDTODB(e)
+		dbEntry.Partition = p
+		dbEntry.EntryKey = auditEntryKey(e.Time, e.ID)
+		entryAwsMap, err := dynamodbattribute.MarshalMap(dbEntry)
+		if err != nil {
+			return fmt.Errorf("failed to serialize audit entry for dynamodb : %v", err)
+		}
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TableAuditLog),
+				Item:      entryAwsMap,
+			},
+		})
+	}
+	_, err := a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		return fmt.Errorf("failed to insert audit entry : %v", err)
+	}
+	return nil
+}
+
+//queryAuditPartition appends the entries of partition between from and to to entries until limit is reached
+func (a AwsDynamoUserRepo) queryAuditPartition(ctx context.Context, partition string, from, to time.Time, limit int, entries []*domain.AuditEntry) ([]*domain.AuditEntry, error) {
+	var fnErr error
+	err := a.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TableAuditLog),
+		KeyConditionExpression: aws.String(TableAuditLogPkName + " = :p AND " + TableAuditLogSkName + " BETWEEN :f AND :t"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":p": {S: aws.String(partition)},
+			":f": {S: aws.String(auditKeyBound(from))},
+			":t": {S: aws.String(auditKeyBound(to))},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			dbEntry := &AuditEntryDTODB{}
+			if fnErr = dynamodbattribute.UnmarshalMap(item, dbEntry); fnErr != nil {
+				return false
+			}
+			entries = append(entries, dbEntry.toAuditEntry())
+			if len(entries) == limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, fnErr
+}
+
+func (a AwsDynamoUserRepo) QueryAuditEntries(ctx context.Context, filter domain.AuditFilter) ([]*domain.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	to := filter.To
+	if to.IsZero() {
+		to = time.Now().Add(time.Second)
+	}
+	var entries []*domain.AuditEntry
+	var err error
+	if filter.Email != "" {
+		entries, err = a.queryAuditPartition(ctx, auditUserPartition(filter.Email), filter.From, to, filter.Limit, entries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch audit entries : %v", err)
+		}
+		return entries, nil
+	}
+	if filter.From.IsZero() {
+		return nil, fmt.Errorf("failed to fetch audit entries : a start time is required without email")
+	}
+	for day := filter.From.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		entries, err = a.queryAuditPartition(ctx, auditDayPartition(day), filter.From, to, filter.Limit, entries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch audit entries : %v", err)
+		}
+		if len(entries) == filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
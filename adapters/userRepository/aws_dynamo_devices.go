@@ -0,0 +1,261 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"time"
+)
+
+//DevicePkToDeviceEntry maps a device public key to the key of the device in TableDevices
+type DevicePkToDeviceEntry struct {
+	PublicKeyPKIX []byte
+	OwnerEmail    string
+	ID            string
+}
+
+func deviceKey(ownerEmail, deviceID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		TableDevicesPkName: {S: aws.String(ownerEmail)},
+		TableDevicesSkName: {S: aws.String(deviceID)},
+	}
+}
+
+func (a AwsDynamoUserRepo) AddDevice(ctx context.Context, device *domain.Device) (*domain.Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	device.CreatedAt = time.Now()
+	device.LastSeenAt = device.CreatedAt
+	dbDevice, err := deviceToDTODB(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize device for DB : %v", err)
+	}
+	deviceAwsMap, err := dynamodbattribute.MarshalMap(dbDevice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize device for dynamodb : %v", err)
+	}
+	pkAwsMap, err := dynamodbattribute.MarshalMap(&DevicePkToDeviceEntry{
+		PublicKeyPKIX: dbDevice.PublicKeyPKIX,
+		OwnerEmail:    dbDevice.OwnerEmail,
+		ID:            dbDevice.ID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize device pk entry for dynamodb : %v", err)
+	}
+
+	//do atomic insert, the conditions guard against reused ids and keys
+	err = a.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{
+		fenceCheck(dbDevice.OwnerEmail),
+		{
+			Put: &dynamodb.Put{
+				Item:                deviceAwsMap,
+				TableName:           aws.String(TableDevices),
+				ConditionExpression: aws.String("attribute_not_exists(" + TableDevicesSkName + ")"),
+			},
+		},
+		{
+			Put: &dynamodb.Put{
+				Item:                pkAwsMap,
+				TableName:           aws.String(TableDevicePkToDevice),
+				ConditionExpression: aws.String("attribute_not_exists(" + TableDevicePkToDevicePkName + ")"),
+			},
+		},
+	}, deviceEventOf(domain.UserEventDeviceAdded, dbDevice))
+	err = a.fencedError(ctx, err, dbDevice.OwnerEmail)
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return nil, fmt.Errorf("failed to insert device : %w", err)
+		}
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("failed to insert device : %w", ErrAlreadyExists)
+		}
+		return nil, fmt.Errorf("failed to insert device : %v", err)
+	}
+	return device, nil
+}
+
+func (a AwsDynamoUserRepo) ListDevices(ctx context.Context, ownerEmail string) ([]*domain.Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var devices []*domain.Device
+	var convErr error
+	err := a.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TableDevices),
+		KeyConditionExpression: aws.String(TableDevicesPkName + " = :o"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":o": {S: aws.String(ownerEmail)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			dbDevice := &DeviceDTODB{}
+			if convErr = dynamodbattribute.UnmarshalMap(item, dbDevice); convErr != nil {
+				return false
+			}
+			var device *domain.Device
+			if device, convErr = dbDevice.toDevice(); convErr != nil {
+				return false
+			}
+			devices = append(devices, device)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch devices : %v", err)
+	}
+	if convErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to device : %v", convErr)
+	}
+	return devices, nil
+}
+
+func (a AwsDynamoUserRepo) GetDeviceByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableDevicePkToDevice),
+		Key: map[string]*dynamodb.AttributeValue{
+			TableDevicePkToDevicePkName: {B: PKIXPublicKey},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch device : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch device : %w", ErrNotFound)
+	}
+	pkEntry := &DevicePkToDeviceEntry{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, pkEntry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to DevicePkToDeviceEntry : %v", err)
+	}
+
+	result, err = a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableDevices),
+		Key:       deviceKey(pkEntry.OwnerEmail, pkEntry.ID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch device : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch device : %w", ErrNotFound)
+	}
+	dbDevice := &DeviceDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbDevice); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to DeviceDTODB : %v", err)
+	}
+	return dbDevice.toDevice()
+}
+
+func (a AwsDynamoUserRepo) RevokeDevice(ctx context.Context, ownerEmail, deviceID string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	revokedAt, err := dynamodbattribute.Marshal(time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to serialize revocation time : %v", err)
+	}
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableDevices),
+		Key:       deviceKey(ownerEmail, deviceID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch device : %v", err)
+	}
+	if result.Item == nil {
+		return fmt.Errorf("failed to revoke device : %w", ErrNotFound)
+	}
+	dbDevice := &DeviceDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbDevice); err != nil {
+		return fmt.Errorf("failed to unmarshal dynamodb entry to DeviceDTODB : %v", err)
+	}
+	err = a.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{
+		fenceCheck(ownerEmail),
+		{
+			Update: &dynamodb.Update{
+				TableName:           aws.String(TableDevices),
+				Key:                 deviceKey(ownerEmail, deviceID),
+				UpdateExpression:    aws.String("SET RevokedAt = :r REMOVE WrappedMasterKey"),
+				ConditionExpression: aws.String("attribute_exists(" + TableDevicesSkName + ") AND attribute_not_exists(RevokedAt)"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":r": revokedAt,
+				},
+			},
+		},
+	}, deviceEventOf(domain.UserEventDeviceRevoked, dbDevice))
+	err = a.fencedError(ctx, err, ownerEmail)
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return fmt.Errorf("failed to revoke device : %w", err)
+		}
+		if isConditionFailed(err) {
+			return fmt.Errorf("failed to revoke device : %w", ErrNotFound)
+		}
+		return fmt.Errorf("failed to revoke device : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) TouchDevice(ctx context.Context, ownerEmail, deviceID string, lastSeen time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	lastSeenAttr, err := dynamodbattribute.Marshal(lastSeen)
+	if err != nil {
+		return fmt.Errorf("failed to serialize last seen time : %v", err)
+	}
+	_, err = a.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(TableDevices),
+		Key:                 deviceKey(ownerEmail, deviceID),
+		UpdateExpression:    aws.String("SET LastSeenAt = :l"),
+		ConditionExpression: aws.String("attribute_exists(" + TableDevicesSkName + ")"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":l": lastSeenAttr,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update device : %v", err)
+	}
+	return nil
+}
+
+//purgeDevices removes all devices of ownerEmail including their public key entries
+func (a AwsDynamoUserRepo) purgeDevices(ctx context.Context, ownerEmail string) error {
+	devices, err := a.ListDevices(ctx, ownerEmail)
+	if err != nil {
+		return err
+	}
+	for _, v := range devices {
+		dbDevice, err := deviceToDTODB(v)
+		if err != nil {
+			return fmt.Errorf("failed to convert device to db representation : %v", err)
+		}
+		_, err = a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{
+					Delete: &dynamodb.Delete{
+						Key:       deviceKey(ownerEmail, dbDevice.ID),
+						TableName: aws.String(TableDevices),
+					},
+				},
+				{
+					Delete: &dynamodb.Delete{
+						Key: map[string]*dynamodb.AttributeValue{
+							TableDevicePkToDevicePkName: {B: dbDevice.PublicKeyPKIX},
+						},
+						TableName: aws.String(TableDevicePkToDevice),
+					},
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to purge device %v : %v", dbDevice.ID, err)
+		}
+	}
+	return nil
+}
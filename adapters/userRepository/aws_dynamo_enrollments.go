@@ -0,0 +1,143 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"time"
+)
+
+func enrollmentKey(ownerEmail, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		TableEnrollmentsPkName: {S: aws.String(ownerEmail)},
+		TableEnrollmentsSkName: {S: aws.String(id)},
+	}
+}
+
+func (a AwsDynamoUserRepo) CreateEnrollment(ctx context.Context, e *domain.Enrollment) (*domain.Enrollment, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	e.CreatedAt = time.Now()
+	dbEnrollment, err := enrollmentToDTODB(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize enrollment for DB : %v", err)
+	}
+	enrollmentAwsMap, err := dynamodbattribute.MarshalMap(dbEnrollment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize enrollment for dynamodb : %v", err)
+	}
+	err = a.transactFenced(ctx, dbEnrollment.OwnerEmail, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:           aws.String(TableEnrollments),
+			Item:                enrollmentAwsMap,
+			ConditionExpression: aws.String("attribute_not_exists(" + TableEnrollmentsSkName + ")"),
+		},
+	})
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return nil, fmt.Errorf("failed to insert enrollment : %w", err)
+		}
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("failed to insert enrollment : %w", ErrAlreadyExists)
+		}
+		return nil, fmt.Errorf("failed to insert enrollment : %v", err)
+	}
+	return e, nil
+}
+
+func (a AwsDynamoUserRepo) GetEnrollment(ctx context.Context, ownerEmail, id string) (*domain.Enrollment, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableEnrollments),
+		Key:       enrollmentKey(ownerEmail, id),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch enrollment : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch enrollment : %w", ErrNotFound)
+	}
+	dbEnrollment := &EnrollmentDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbEnrollment); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to EnrollmentDTODB : %v", err)
+	}
+	return dbEnrollment.toEnrollment()
+}
+
+func (a AwsDynamoUserRepo) ListEnrollments(ctx context.Context, ownerEmail string) ([]*domain.Enrollment, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var enrollments []*domain.Enrollment
+	var convErr error
+	err := a.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TableEnrollments),
+		KeyConditionExpression: aws.String(TableEnrollmentsPkName + " = :o"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":o": {S: aws.String(ownerEmail)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			dbEnrollment := &EnrollmentDTODB{}
+			if convErr = dynamodbattribute.UnmarshalMap(item, dbEnrollment); convErr != nil {
+				return false
+			}
+			var enrollment *domain.Enrollment
+			if enrollment, convErr = dbEnrollment.toEnrollment(); convErr != nil {
+				return false
+			}
+			enrollments = append(enrollments, enrollment)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch enrollments : %v", err)
+	}
+	if convErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to enrollment : %v", convErr)
+	}
+	return enrollments, nil
+}
+
+func (a AwsDynamoUserRepo) ApproveEnrollment(ctx context.Context, ownerEmail, id, deviceID string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	err := a.transactFenced(ctx, ownerEmail, &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName:           aws.String(TableEnrollments),
+			Key:                 enrollmentKey(ownerEmail, id),
+			UpdateExpression:    aws.String("SET #s = :approved, DeviceID = :d"),
+			ConditionExpression: aws.String("#s = :pending"),
+			//State is a reserved word
+			ExpressionAttributeNames: map[string]*string{"#s": aws.String("State")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":approved": {S: aws.String(string(domain.EnrollmentStateApproved))},
+				":pending":  {S: aws.String(string(domain.EnrollmentStatePending))},
+				":d":        {S: aws.String(deviceID)},
+			},
+		},
+	})
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return fmt.Errorf("failed to approve enrollment : %w", err)
+		}
+		if isConditionFailed(err) {
+			return fmt.Errorf("failed to approve enrollment : %w", ErrNotFound)
+		}
+		return fmt.Errorf("failed to approve enrollment : %v", err)
+	}
+	return nil
+}
+
+//PurgeExpiredEnrollments is a no-op, expired enrollments are removed by dynamodb TTL
+func (a AwsDynamoUserRepo) PurgeExpiredEnrollments(ctx context.Context, now time.Time) (int, error) {
+	return 0, nil
+}
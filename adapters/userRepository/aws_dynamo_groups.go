@@ -0,0 +1,336 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"sort"
+	"strconv"
+)
+
+func groupMemberKey(groupID, memberEmail string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		TableGroupMembersPkName: {S: aws.String(groupID)},
+		TableGroupMembersSkName: {S: aws.String(memberEmail)},
+	}
+}
+
+//memberPuts returns the conditional puts storing m in both membership tables
+func memberPuts(m *domain.GroupMember) ([]*dynamodb.TransactWriteItem, error) {
+	memberAwsMap, err := dynamodbattribute.MarshalMap(groupMemberToDTODB(m))
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize group member for dynamodb : %v", err)
+	}
+	return []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				Item:                memberAwsMap,
+				TableName:           aws.String(TableGroupMembers),
+				ConditionExpression: aws.String("attribute_not_exists(" + TableGroupMembersSkName + ")"),
+			},
+		},
+		{
+			Put: &dynamodb.Put{
+				Item:                memberAwsMap,
+				TableName:           aws.String(TableMemberGroups),
+				ConditionExpression: aws.String("attribute_not_exists(" + TableMemberGroupsSkName + ")"),
+			},
+		},
+	}, nil
+}
+
+func (a AwsDynamoUserRepo) CreateGroup(ctx context.Context, g *domain.Group) (*domain.Group, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	g.KeyEpoch = 1
+	groupAwsMap, err := dynamodbattribute.MarshalMap(groupToDTODB(g))
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize group for dynamodb : %v", err)
+	}
+	items, err := memberPuts(&domain.GroupMember{GroupID: g.ID, MemberEmail: g.OwnerEmail, AddedAt: g.CreatedAt})
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			Item:                groupAwsMap,
+			TableName:           aws.String(TableGroups),
+			ConditionExpression: aws.String("attribute_not_exists(" + TableGroupsPkName + ")"),
+		},
+	})
+	_, err = a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("failed to insert group : %w", ErrAlreadyExists)
+		}
+		return nil, fmt.Errorf("failed to insert group : %v", err)
+	}
+	return g, nil
+}
+
+func (a AwsDynamoUserRepo) GetGroup(ctx context.Context, id string) (*domain.Group, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableGroups),
+		Key: map[string]*dynamodb.AttributeValue{
+			TableGroupsPkName: {S: aws.String(id)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch group : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch group : %w", ErrNotFound)
+	}
+	dbGroup := &GroupDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbGroup); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to GroupDTODB : %v", err)
+	}
+	return dbGroup.toGroup(), nil
+}
+
+func (a AwsDynamoUserRepo) AddGroupMember(ctx context.Context, m *domain.GroupMember) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	items, err := memberPuts(m)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		if isConditionFailed(err) {
+			return fmt.Errorf("failed to insert group member : %w", ErrAlreadyExists)
+		}
+		return fmt.Errorf("failed to insert group member : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) RemoveGroupMember(ctx context.Context, groupID, memberEmail string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	_, err := a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Delete: &dynamodb.Delete{
+					Key:                 groupMemberKey(groupID, memberEmail),
+					TableName:           aws.String(TableGroupMembers),
+					ConditionExpression: aws.String("attribute_exists(" + TableGroupMembersSkName + ")"),
+				},
+			},
+			{
+				Delete: &dynamodb.Delete{
+					Key: map[string]*dynamodb.AttributeValue{
+						TableMemberGroupsPkName: {S: aws.String(memberEmail)},
+						TableMemberGroupsSkName: {S: aws.String(groupID)},
+					},
+					TableName: aws.String(TableMemberGroups),
+				},
+			},
+			{
+				Update: &dynamodb.Update{
+					Key: map[string]*dynamodb.AttributeValue{
+						TableGroupsPkName: {S: aws.String(groupID)},
+					},
+					TableName:        aws.String(TableGroups),
+					UpdateExpression: aws.String("SET KeyEpoch = KeyEpoch + :one"),
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":one": {N: aws.String("1")},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return fmt.Errorf("failed to delete group member : %w", ErrNotFound)
+		}
+		return fmt.Errorf("failed to delete group member : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) listMemberships(ctx context.Context, table, pkName, key string) ([]*domain.GroupMember, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var members []*domain.GroupMember
+	err := a.queryByHashKey(ctx, table, pkName, key, func(item map[string]*dynamodb.AttributeValue) error {
+		dbMember := &GroupMemberDTODB{}
+		if err := dynamodbattribute.UnmarshalMap(item, dbMember); err != nil {
+			return err
+		}
+		members = append(members, dbMember.toGroupMember())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch group members : %v", err)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].AddedAt.Before(members[j].AddedAt)
+	})
+	return members, nil
+}
+
+func (a AwsDynamoUserRepo) ListGroupMembers(ctx context.Context, groupID string) ([]*domain.GroupMember, error) {
+	return a.listMemberships(ctx, TableGroupMembers, TableGroupMembersPkName, groupID)
+}
+
+func (a AwsDynamoUserRepo) ListGroupsOfMember(ctx context.Context, memberEmail string) ([]*domain.GroupMember, error) {
+	return a.listMemberships(ctx, TableMemberGroups, TableMemberGroupsPkName, memberEmail)
+}
+
+//maxGroupKeyPutsPerTransaction leaves room for the epoch check and the fence checks of the members in a
+//transaction of at most 100 items
+const maxGroupKeyPutsPerTransaction = 49
+
+func (a AwsDynamoUserRepo) PutGroupKeyWrappings(ctx context.Context, groupID string, epoch int64, wrappings []*domain.GroupKeyWrapping) error {
+	epochCheck := &dynamodb.TransactWriteItem{
+		ConditionCheck: &dynamodb.ConditionCheck{
+			Key: map[string]*dynamodb.AttributeValue{
+				TableGroupsPkName: {S: aws.String(groupID)},
+			},
+			TableName:           aws.String(TableGroups),
+			ConditionExpression: aws.String("KeyEpoch = :e"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":e": {N: aws.String(strconv.FormatInt(epoch, 10))},
+			},
+		},
+	}
+	err := a.putGroupKeyWrappings(ctx, epochCheck, wrappings)
+	if isConditionFailed(err) {
+		return fmt.Errorf("failed to store group key wrappings : %w", ErrStaleEpoch)
+	}
+	return err
+}
+
+func (a AwsDynamoUserRepo) StoreGroupKeyWrappings(ctx context.Context, wrappings []*domain.GroupKeyWrapping) error {
+	return a.putGroupKeyWrappings(ctx, nil, wrappings)
+}
+
+//putGroupKeyWrappings writes the wrappings unless their members are fenced. Large groups are written in
+//chunks, each one checking epochCheck again if it is set
+func (a AwsDynamoUserRepo) putGroupKeyWrappings(ctx context.Context, epochCheck *dynamodb.TransactWriteItem, wrappings []*domain.GroupKeyWrapping) error {
+	for start := 0; start < len(wrappings); start += maxGroupKeyPutsPerTransaction {
+		end := start + maxGroupKeyPutsPerTransaction
+		if end > len(wrappings) {
+			end = len(wrappings)
+		}
+		var items []*dynamodb.TransactWriteItem
+		if epochCheck != nil {
+			items = append(items, epochCheck)
+		}
+		var members []string
+		for _, v := range wrappings[start:end] {
+			wrappingAwsMap, err := dynamodbattribute.MarshalMap(groupKeyWrappingToDTODB(v))
+			if err != nil {
+				return fmt.Errorf("failed to serialize group key wrapping for dynamodb : %v", err)
+			}
+			items = append(items, fenceCheck(v.MemberEmail), &dynamodb.TransactWriteItem{
+				Put: &dynamodb.Put{
+					Item:      wrappingAwsMap,
+					TableName: aws.String(TableGroupKeys),
+				},
+			})
+			members = append(members, v.MemberEmail)
+		}
+		ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+		_, err := a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		err = a.fencedError(ctx, err, members...)
+		cancel()
+		if err != nil {
+			if errors.Is(err, ErrUserMoving) {
+				return fmt.Errorf("failed to store group key wrappings : %w", err)
+			}
+			if isConditionFailed(err) {
+				return err
+			}
+			return fmt.Errorf("failed to store group key wrappings : %v", err)
+		}
+	}
+	return nil
+}
+
+func groupKeyKey(groupID string, epoch int64, memberEmail string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		TableGroupKeysPkName: {S: aws.String(groupEpochKey(groupID, epoch))},
+		TableGroupKeysSkName: {S: aws.String(memberEmail)},
+	}
+}
+
+func (a AwsDynamoUserRepo) GetGroupKeyWrapping(ctx context.Context, groupID string, epoch int64, memberEmail string) (*domain.GroupKeyWrapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableGroupKeys),
+		Key:       groupKeyKey(groupID, epoch, memberEmail),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch group key wrapping : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch group key wrapping : %w", ErrNotFound)
+	}
+	dbWrapping := &GroupKeyWrappingDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbWrapping); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to GroupKeyWrappingDTODB : %v", err)
+	}
+	return dbWrapping.toGroupKeyWrapping(), nil
+}
+
+func (a AwsDynamoUserRepo) ListGroupKeyWrappings(ctx context.Context, groupID string, epoch int64) ([]*domain.GroupKeyWrapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var wrappings []*domain.GroupKeyWrapping
+	err := a.queryByHashKey(ctx, TableGroupKeys, TableGroupKeysPkName, groupEpochKey(groupID, epoch), func(item map[string]*dynamodb.AttributeValue) error {
+		dbWrapping := &GroupKeyWrappingDTODB{}
+		if err := dynamodbattribute.UnmarshalMap(item, dbWrapping); err != nil {
+			return err
+		}
+		wrappings = append(wrappings, dbWrapping.toGroupKeyWrapping())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch group key wrappings : %v", err)
+	}
+	return wrappings, nil
+}
+
+//purgeGroupMemberships removes memberEmail from all its groups, bumping their key epochs, and drops
+//the group keys wrapped for it
+func (a AwsDynamoUserRepo) purgeGroupMemberships(ctx context.Context, memberEmail string) error {
+	memberships, err := a.ListGroupsOfMember(ctx, memberEmail)
+	if err != nil {
+		return err
+	}
+	for _, v := range memberships {
+		group, err := a.GetGroup(ctx, v.GroupID)
+		if err != nil {
+			return err
+		}
+		for epoch := int64(1); epoch <= group.KeyEpoch; epoch++ {
+			_, err := a.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(TableGroupKeys),
+				Key:       groupKeyKey(v.GroupID, epoch, memberEmail),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to purge group key of %v : %v", v.GroupID, err)
+			}
+		}
+		if err := a.RemoveGroupMember(ctx, v.GroupID, memberEmail); err != nil {
+			return fmt.Errorf("failed to purge membership in %v : %v", v.GroupID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"strconv"
+)
+
+//keyLogID is the hash key of all key log entries. Key changes are rare enough for a single partition
+const keyLogID = "keys"
+
+//keyLogSize returns the number of entries in the key log
+func (a AwsDynamoUserRepo) keyLogSize(ctx context.Context) (int64, error) {
+	result, err := a.homeDB().QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TableKeyLog),
+		KeyConditionExpression: aws.String(TableKeyLogPkName + " = :l"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":l": {S: aws.String(keyLogID)},
+		},
+		ScanIndexForward: aws.Bool(false),
+		ConsistentRead:   aws.Bool(true),
+		Limit:            aws.Int64(1),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(result.Items) == 0 {
+		return 0, nil
+	}
+	last := &KeyLogEntryDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Items[0], last); err != nil {
+		return 0, err
+	}
+	return last.LogIndex + 1, nil
+}
+
+func (a AwsDynamoUserRepo) GetKeyLogCursor(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.homeDB().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(TableCursors),
+		Key:            map[string]*dynamodb.AttributeValue{TableCursorsPkName: {S: aws.String(keyLogCursorName)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch key log cursor : %v", err)
+	}
+	if result.Item == nil {
+		return 0, nil
+	}
+	cursor := &CursorDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, cursor); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal dynamodb entry to CursorDTODB : %v", err)
+	}
+	return cursor.LastSeq, nil
+}
+
+//AppendKeyLogEntries writes the entries and the cursor in one transaction. A transaction holds at most 100
+//items, so entries has to be shorter than that
+func (a AwsDynamoUserRepo) AppendKeyLogEntries(ctx context.Context, after, cursor int64, entries []*domain.KeyLogEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	size, err := a.keyLogSize(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch key log size : %v", err)
+	}
+	condition := "LastSeq = :a"
+	if after == 0 {
+		condition = "attribute_not_exists(LastSeq) OR " + condition
+	}
+	txItems := []*dynamodb.TransactWriteItem{{
+		Update: &dynamodb.Update{
+			TableName:           aws.String(TableCursors),
+			Key:                 map[string]*dynamodb.AttributeValue{TableCursorsPkName: {S: aws.String(keyLogCursorName)}},
+			UpdateExpression:    aws.String("SET LastSeq = :c"),
+			ConditionExpression: aws.String(condition),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":a": {N: aws.String(strconv.FormatInt(after, 10))},
+				":c": {N: aws.String(strconv.FormatInt(cursor, 10))},
+			},
+		},
+	}}
+	for i, e := range entries {
+		dbEntry := keyLogEntryToDTODB(e)
+		dbEntry.LogIndex = size + int64(i)
+		entryAwsMap, err := dynamodbattribute.MarshalMap(dbEntry)
+		if err != nil {
+			return fmt.Errorf("failed to serialize key log entry for dynamodb : %v", err)
+		}
+		//a concurrent append of the same size fails the transaction
+		txItems = append(txItems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(TableKeyLog),
+				Item:                entryAwsMap,
+				ConditionExpression: aws.String("attribute_not_exists(" + TableKeyLogSkName + ")"),
+			},
+		})
+	}
+	_, err = a.homeDB().TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: txItems})
+	if isConditionFailed(err) {
+		return fmt.Errorf("failed to append key log entries : %w", ErrCursorMoved)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to append key log entries : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) ListKeyLogEntries(ctx context.Context, start int64, limit int) ([]*domain.KeyLogEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var entries []*domain.KeyLogEntry
+	var fnErr error
+	err := a.homeDB().QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TableKeyLog),
+		KeyConditionExpression: aws.String(TableKeyLogPkName + " = :l AND " + TableKeyLogSkName + " >= :s"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":l": {S: aws.String(keyLogID)},
+			":s": {N: aws.String(strconv.FormatInt(start, 10))},
+		},
+		Limit: aws.Int64(int64(limit)),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			dbEntry := &KeyLogEntryDTODB{}
+			if fnErr = dynamodbattribute.UnmarshalMap(item, dbEntry); fnErr != nil {
+				return false
+			}
+			entries = append(entries, dbEntry.toKeyLogEntry())
+			if len(entries) == limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = fnErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key log entries : %v", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,177 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+//DomainToOrganizationEntry maps an email domain to the organization owning it
+type DomainToOrganizationEntry struct {
+	EmailDomain    string
+	OrganizationID string
+}
+
+func (a AwsDynamoUserRepo) CreateOrganization(ctx context.Context, o *domain.Organization) (*domain.Organization, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	dbOrganization, err := organizationToDTODB(o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize organization for DB : %v", err)
+	}
+	organizationAwsMap, err := dynamodbattribute.MarshalMap(dbOrganization)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize organization for dynamodb : %v", err)
+	}
+	domainAwsMap, err := dynamodbattribute.MarshalMap(&DomainToOrganizationEntry{
+		EmailDomain:    o.EmailDomain,
+		OrganizationID: o.ID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize domain entry for dynamodb : %v", err)
+	}
+
+	_, err = a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Put: &dynamodb.Put{
+					Item:                organizationAwsMap,
+					TableName:           aws.String(TableOrganizations),
+					ConditionExpression: aws.String("attribute_not_exists(" + TableOrganizationsPkName + ")"),
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					Item:                domainAwsMap,
+					TableName:           aws.String(TableDomainToOrganization),
+					ConditionExpression: aws.String("attribute_not_exists(" + TableDomainToOrganizationPkName + ")"),
+				},
+			},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("failed to insert organization : %w", ErrAlreadyExists)
+		}
+		return nil, fmt.Errorf("failed to insert organization : %v", err)
+	}
+	return o, nil
+}
+
+func (a AwsDynamoUserRepo) GetOrganization(ctx context.Context, id string) (*domain.Organization, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableOrganizations),
+		Key: map[string]*dynamodb.AttributeValue{
+			TableOrganizationsPkName: {S: aws.String(id)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch organization : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch organization : %w", ErrNotFound)
+	}
+	dbOrganization := &OrganizationDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbOrganization); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to OrganizationDTODB : %v", err)
+	}
+	return dbOrganization.toOrganization()
+}
+
+func (a AwsDynamoUserRepo) GetOrganizationByDomain(ctx context.Context, emailDomain string) (*domain.Organization, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableDomainToOrganization),
+		Key: map[string]*dynamodb.AttributeValue{
+			TableDomainToOrganizationPkName: {S: aws.String(emailDomain)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch organization : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch organization : %w", ErrNotFound)
+	}
+	entry := &DomainToOrganizationEntry{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, entry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to DomainToOrganizationEntry : %v", err)
+	}
+	return a.GetOrganization(ctx, entry.OrganizationID)
+}
+
+func (a AwsDynamoUserRepo) PutEscrowWrapping(ctx context.Context, w *domain.EscrowWrapping) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	dbWrapping, err := escrowWrappingToDTODB(w)
+	if err != nil {
+		return fmt.Errorf("failed to serialize escrow wrapping for DB : %v", err)
+	}
+	wrappingAwsMap, err := dynamodbattribute.MarshalMap(dbWrapping)
+	if err != nil {
+		return fmt.Errorf("failed to serialize escrow wrapping for dynamodb : %v", err)
+	}
+	err = a.transactFenced(ctx, dbWrapping.OwnerEmail, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName: aws.String(TableEscrowWrappings),
+			Item:      wrappingAwsMap,
+		},
+	})
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return fmt.Errorf("failed to store escrow wrapping : %w", err)
+		}
+		return fmt.Errorf("failed to store escrow wrapping : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) GetEscrowWrapping(ctx context.Context, ownerEmail string) (*domain.EscrowWrapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableEscrowWrappings),
+		Key: map[string]*dynamodb.AttributeValue{
+			TableEscrowWrappingsPkName: {S: aws.String(ownerEmail)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch escrow wrapping : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch escrow wrapping : %w", ErrNotFound)
+	}
+	dbWrapping := &EscrowWrappingDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbWrapping); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to EscrowWrappingDTODB : %v", err)
+	}
+	return dbWrapping.toEscrowWrapping()
+}
+
+//purgeEscrowWrapping removes the escrow wrapping of ownerEmail if there is one
+func (a AwsDynamoUserRepo) purgeEscrowWrapping(ctx context.Context, ownerEmail string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	_, err := a.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(TableEscrowWrappings),
+		Key: map[string]*dynamodb.AttributeValue{
+			TableEscrowWrappingsPkName: {S: aws.String(ownerEmail)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to purge escrow wrapping : %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"sort"
+)
+
+func recoveryWrappingKey(ownerEmail, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		TableRecoveryWrappingsPkName: {S: aws.String(ownerEmail)},
+		TableRecoveryWrappingsSkName: {S: aws.String(id)},
+	}
+}
+
+func (a AwsDynamoUserRepo) AddRecoveryWrapping(ctx context.Context, w *domain.RecoveryWrapping) (*domain.RecoveryWrapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	dbWrapping, err := recoveryWrappingToDTODB(w)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize recovery wrapping for DB : %v", err)
+	}
+	wrappingAwsMap, err := dynamodbattribute.MarshalMap(dbWrapping)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize recovery wrapping for dynamodb : %v", err)
+	}
+	err = a.transactFenced(ctx, dbWrapping.OwnerEmail, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:           aws.String(TableRecoveryWrappings),
+			Item:                wrappingAwsMap,
+			ConditionExpression: aws.String("attribute_not_exists(" + TableRecoveryWrappingsSkName + ")"),
+		},
+	})
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return nil, fmt.Errorf("failed to insert recovery wrapping : %w", err)
+		}
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("failed to insert recovery wrapping : %w", ErrAlreadyExists)
+		}
+		return nil, fmt.Errorf("failed to insert recovery wrapping : %v", err)
+	}
+	return w, nil
+}
+
+func (a AwsDynamoUserRepo) ListRecoveryWrappings(ctx context.Context, ownerEmail string) ([]*domain.RecoveryWrapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var wrappings []*domain.RecoveryWrapping
+	err := a.queryByHashKey(ctx, TableRecoveryWrappings, TableRecoveryWrappingsPkName, ownerEmail, func(item map[string]*dynamodb.AttributeValue) error {
+		dbWrapping := &RecoveryWrappingDTODB{}
+		if err := dynamodbattribute.UnmarshalMap(item, dbWrapping); err != nil {
+			return err
+		}
+		wrapping, err := dbWrapping.toRecoveryWrapping()
+		if err != nil {
+			return err
+		}
+		wrappings = append(wrappings, wrapping)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recovery wrappings : %v", err)
+	}
+	sort.Slice(wrappings, func(i, j int) bool {
+		return wrappings[i].CreatedAt.Before(wrappings[j].CreatedAt)
+	})
+	return wrappings, nil
+}
+
+func (a AwsDynamoUserRepo) GetRecoveryWrapping(ctx context.Context, ownerEmail, id string) (*domain.RecoveryWrapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableRecoveryWrappings),
+		Key:       recoveryWrappingKey(ownerEmail, id),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recovery wrapping : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch recovery wrapping : %w", ErrNotFound)
+	}
+	dbWrapping := &RecoveryWrappingDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbWrapping); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dynamodb entry to RecoveryWrappingDTODB : %v", err)
+	}
+	return dbWrapping.toRecoveryWrapping()
+}
+
+func (a AwsDynamoUserRepo) DeleteRecoveryWrapping(ctx context.Context, ownerEmail, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	err := a.transactFenced(ctx, ownerEmail, &dynamodb.TransactWriteItem{
+		Delete: &dynamodb.Delete{
+			TableName:           aws.String(TableRecoveryWrappings),
+			Key:                 recoveryWrappingKey(ownerEmail, id),
+			ConditionExpression: aws.String("attribute_exists(" + TableRecoveryWrappingsSkName + ")"),
+		},
+	})
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return fmt.Errorf("failed to delete recovery wrapping : %w", err)
+		}
+		if isConditionFailed(err) {
+			return fmt.Errorf("failed to delete recovery wrapping : %w", ErrNotFound)
+		}
+		return fmt.Errorf("failed to delete recovery wrapping : %v", err)
+	}
+	return nil
+}
+
+//purgeRecoveryWrappings removes all recovery wrappings of ownerEmail, also if the user is fenced
+func (a AwsDynamoUserRepo) purgeRecoveryWrappings(ctx context.Context, ownerEmail string) error {
+	wrappings, err := a.ListRecoveryWrappings(ctx, ownerEmail)
+	if err != nil {
+		return err
+	}
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(wrappings))
+	for _, v := range wrappings {
+		keys = append(keys, recoveryWrappingKey(ownerEmail, v.ID))
+	}
+	return a.deleteKeys(ctx, TableRecoveryWrappings, keys)
+}
+
+func (a AwsDynamoUserRepo) AddRecoveryAudit(ctx context.Context, audit *domain.RecoveryAudit) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	auditAwsMap, err := dynamodbattribute.MarshalMap(recoveryAuditToDTODB(audit))
+	if err != nil {
+		return fmt.Errorf("failed to serialize recovery audit for dynamodb : %v", err)
+	}
+	err = a.transactFenced(ctx, audit.OwnerEmail, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName: aws.String(TableRecoveryAudits),
+			Item:      auditAwsMap,
+		},
+	})
+	if err != nil {
+		if errors.Is(err, ErrUserMoving) {
+			return fmt.Errorf("failed to insert recovery audit : %w", err)
+		}
+		return fmt.Errorf("failed to insert recovery audit : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) ListRecoveryAudits(ctx context.Context, ownerEmail string) ([]*domain.RecoveryAudit, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var audits []*domain.RecoveryAudit
+	err := a.queryByHashKey(ctx, TableRecoveryAudits, TableRecoveryAuditsPkName, ownerEmail, func(item map[string]*dynamodb.AttributeValue) error {
+		dbAudit := &RecoveryAuditDTODB{}
+		if err := dynamodbattribute.UnmarshalMap(item, dbAudit); err != nil {
+			return err
+		}
+		audits = append(audits, dbAudit.toRecoveryAudit())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recovery audits : %v", err)
+	}
+	sort.Slice(audits, func(i, j int) bool {
+		return audits[i].RecoveredAt.Before(audits[j].RecoveredAt)
+	})
+	return audits, nil
+}
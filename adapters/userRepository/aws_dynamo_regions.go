@@ -0,0 +1,673 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Attributes stamped on the items of the replicated user tables by RegionalDynamo
+const (
+	//AttributeWriteVersion is the time of the last write in unix nanoseconds
+	AttributeWriteVersion = "WriteVersion"
+	//AttributeWriteRegion is the region of the last write, it breaks ties between equal versions
+	AttributeWriteRegion = "WriteRegion"
+)
+
+//regionalTables maps the tables holding the user directory, whose items are stamped and reconciled, to
+//their hash key
+var regionalTables = map[string]string{
+	TableUser:             TableUserPkName,
+	TableEmailToPublicKey: TableEmailToPublicKeyPkName,
+}
+
+//DefaultTombstoneRetention is the time the tombstones of deleted items are kept
+const DefaultTombstoneRetention = 30 * 24 * time.Hour
+
+//lwwCondition lets a write replace an item only if the item has an older version, or the same version
+//from a lower region
+const lwwCondition = "(attribute_not_exists(#lwwVersion) OR #lwwVersion < :lwwVersion OR (#lwwVersion = :lwwVersion AND #lwwRegion < :lwwRegion))"
+
+//RegionalDynamo is a DynamoClient for one region of dynamodb global tables. It stamps the writes to
+//the user tables with AttributeWriteVersion and AttributeWriteRegion and makes them conditional, so that
+//the last writer wins: a write never replaces an item written later, e.g. one replicated from a region
+//with a faster clock. A write losing this way fails like any other failed condition. Deletes are
+//conditional the same way and leave a stamped tombstone in TableRegionTombstones, so that a delete and a
+//write of another region are ordered by time as well. Global tables resolve concurrent writes by their own
+//replication time, ReconcileRegions finds and repairs the items whose regions disagree.
+//
+//Only the user tables are stamped. Tables written by counters or appends, like the outbox and the key log,
+//fork when written in several regions, see NewAwsRegionalDynamoUserRepo
+type RegionalDynamo struct {
+	//Region is the name of the region the writes go to
+	Region string
+	Client DynamoClient
+	//ReadClient pins reads to another region, e.g. the home region of the users. Nil reads from Client.
+	//Consistent reads always go to Client, they read what the next conditional write is checked against
+	ReadClient DynamoClient
+	//Now returns the write time, nil selects time.Now
+	Now func() time.Time
+	//TombstoneRetention is the time the tombstones of deletes are kept, zero selects
+	//DefaultTombstoneRetention. ReconcileRegions can not tell older deletes from items missing in a region
+	TombstoneRetention time.Duration
+
+	mu sync.Mutex
+	//lastVersion keeps the versions of this process increasing if the clock goes backwards
+	lastVersion int64
+}
+
+func (r *RegionalDynamo) reader(consistent *bool) DynamoClient {
+	if r.ReadClient != nil && !aws.BoolValue(consistent) {
+		return r.ReadClient
+	}
+	return r.Client
+}
+
+//nextVersion returns the version of a write
+func (r *RegionalDynamo) nextVersion() int64 {
+	now := time.Now
+	if r.Now != nil {
+		now = r.Now
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	version := now().UnixNano()
+	if version <= r.lastVersion {
+		version = r.lastVersion + 1
+	}
+	r.lastVersion = version
+	return version
+}
+
+//stamp holds the expression parts of a conditional write
+type stamp struct {
+	version, region *dynamodb.AttributeValue
+	//expiresAtUnix is the TTL of the tombstones of the write
+	expiresAtUnix int64
+}
+
+func (r *RegionalDynamo) newStamp() stamp {
+	version := r.nextVersion()
+	retention := r.TombstoneRetention
+	if retention == 0 {
+		retention = DefaultTombstoneRetention
+	}
+	return stamp{
+		version:       &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version, 10))},
+		region:        &dynamodb.AttributeValue{S: aws.String(r.Region)},
+		expiresAtUnix: time.Unix(0, version).Add(retention).Unix(),
+	}
+}
+
+//condition joins condition with the lww condition and adds the placeholders to names and values
+func (s stamp) condition(condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	withNames := map[string]*string{
+		"#lwwVersion": aws.String(AttributeWriteVersion),
+		"#lwwRegion":  aws.String(AttributeWriteRegion),
+	}
+	for k, v := range names {
+		withNames[k] = v
+	}
+	withValues := map[string]*dynamodb.AttributeValue{
+		":lwwVersion": s.version,
+		":lwwRegion":  s.region,
+	}
+	for k, v := range values {
+		withValues[k] = v
+	}
+	if condition == nil {
+		return aws.String(lwwCondition), withNames, withValues
+	}
+	return aws.String("(" + *condition + ") AND " + lwwCondition), withNames, withValues
+}
+
+//item returns a copy of item with the stamp attributes
+func (s stamp) item(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	stamped := make(map[string]*dynamodb.AttributeValue, len(item)+2)
+	for k, v := range item {
+		stamped[k] = v
+	}
+	stamped[AttributeWriteVersion] = s.version
+	stamped[AttributeWriteRegion] = s.region
+	return stamped
+}
+
+//update returns the update expression also setting the stamp attributes
+func (s stamp) update(expression *string) *string {
+	set := "#lwwVersion = :lwwVersion, #lwwRegion = :lwwRegion"
+	current := aws.StringValue(expression)
+	if i := strings.Index(current, "SET "); i >= 0 {
+		return aws.String(current[:i] + "SET " + set + ", " + current[i+len("SET "):])
+	}
+	return aws.String(strings.TrimSpace("SET " + set + " " + current))
+}
+
+func (s stamp) put(in *dynamodb.Put) *dynamodb.Put {
+	stamped := *in
+	stamped.Item = s.item(in.Item)
+	stamped.ConditionExpression, stamped.ExpressionAttributeNames, stamped.ExpressionAttributeValues = s.condition(in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	return &stamped
+}
+
+func (s stamp) updateItem(in *dynamodb.Update) *dynamodb.Update {
+	stamped := *in
+	stamped.UpdateExpression = s.update(in.UpdateExpression)
+	stamped.ConditionExpression, stamped.ExpressionAttributeNames, stamped.ExpressionAttributeValues = s.condition(in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	return &stamped
+}
+
+func (s stamp) deleteItem(in *dynamodb.Delete) *dynamodb.Delete {
+	stamped := *in
+	stamped.ConditionExpression, stamped.ExpressionAttributeNames, stamped.ExpressionAttributeValues = s.condition(in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	return &stamped
+}
+
+//tombstoneKey returns the key of the tombstone of the item of table with the hash key value v
+func tombstoneKey(table string, v *dynamodb.AttributeValue) string {
+	return table + "/" + base64.StdEncoding.EncodeToString([]byte(encodeAttribute(v)))
+}
+
+//tombstone returns the put of the tombstone of the delete of the item of table with key
+func (s stamp) tombstone(table string, key map[string]*dynamodb.AttributeValue) *dynamodb.Put {
+	hashKey := key[regionalTables[table]]
+	put := &dynamodb.Put{
+		TableName: aws.String(TableRegionTombstones),
+		Item: s.item(map[string]*dynamodb.AttributeValue{
+			TableRegionTombstonesPkName: {S: aws.String(tombstoneKey(table, hashKey))},
+			"DeletedTable":              {S: aws.String(table)},
+			"DeletedKey":                hashKey,
+			"ExpiresAtUnix":             {N: aws.String(strconv.FormatInt(s.expiresAtUnix, 10))},
+		}),
+	}
+	put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues = s.condition(nil, nil, nil)
+	return put
+}
+
+func (r *RegionalDynamo) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return r.reader(in.ConsistentRead).GetItemWithContext(ctx, in, opts...)
+}
+
+func (r *RegionalDynamo) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return r.reader(in.ConsistentRead).QueryWithContext(ctx, in, opts...)
+}
+
+func (r *RegionalDynamo) QueryPagesWithContext(ctx aws.Context, in *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return r.reader(in.ConsistentRead).QueryPagesWithContext(ctx, in, fn, opts...)
+}
+
+func (r *RegionalDynamo) ScanPagesWithContext(ctx aws.Context, in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	return r.reader(in.ConsistentRead).ScanPagesWithContext(ctx, in, fn, opts...)
+}
+
+func (r *RegionalDynamo) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if regionalTables[aws.StringValue(in.TableName)] != "" {
+		s := r.newStamp()
+		stamped := *in
+		stamped.Item = s.item(in.Item)
+		stamped.ConditionExpression, stamped.ExpressionAttributeNames, stamped.ExpressionAttributeValues = s.condition(in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+		in = &stamped
+	}
+	return r.Client.PutItemWithContext(ctx, in, opts...)
+}
+
+func (r *RegionalDynamo) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if regionalTables[aws.StringValue(in.TableName)] != "" {
+		s := r.newStamp()
+		stamped := *in
+		stamped.UpdateExpression = s.update(in.UpdateExpression)
+		stamped.ConditionExpression, stamped.ExpressionAttributeNames, stamped.ExpressionAttributeValues = s.condition(in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+		in = &stamped
+	}
+	return r.Client.UpdateItemWithContext(ctx, in, opts...)
+}
+
+//DeleteItemWithContext writes deletes from the user tables together with their tombstone in a transaction,
+//so they can not return the old item
+func (r *RegionalDynamo) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	table := aws.StringValue(in.TableName)
+	if regionalTables[table] == "" {
+		return r.Client.DeleteItemWithContext(ctx, in, opts...)
+	}
+	if v := aws.StringValue(in.ReturnValues); v != "" && v != dynamodb.ReturnValueNone {
+		return nil, fmt.Errorf("failed to delete from %v : return values are not supported", table)
+	}
+	s := r.newStamp()
+	_, err := r.Client.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Delete: s.deleteItem(&dynamodb.Delete{
+				TableName:                 in.TableName,
+				Key:                       in.Key,
+				ConditionExpression:       in.ConditionExpression,
+				ExpressionAttributeNames:  in.ExpressionAttributeNames,
+				ExpressionAttributeValues: in.ExpressionAttributeValues,
+			})},
+			{Put: s.tombstone(table, in.Key)},
+		},
+	}, opts...)
+	if isConditionFailed(err) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+//TransactWriteItemsWithContext stamps all items of the transaction with the same version. The tombstones
+//of deletes are appended to the items, so the cancellation reasons of the items keep their index
+func (r *RegionalDynamo) TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	s := r.newStamp()
+	stamped := *in
+	stamped.TransactItems = make([]*dynamodb.TransactWriteItem, len(in.TransactItems), len(in.TransactItems)+1)
+	for i, v := range in.TransactItems {
+		item := *v
+		switch {
+		case v.Put != nil && regionalTables[aws.StringValue(v.Put.TableName)] != "":
+			item.Put = s.put(v.Put)
+		case v.Update != nil && regionalTables[aws.StringValue(v.Update.TableName)] != "":
+			item.Update = s.updateItem(v.Update)
+		case v.Delete != nil && regionalTables[aws.StringValue(v.Delete.TableName)] != "":
+			item.Delete = s.deleteItem(v.Delete)
+			stamped.TransactItems = append(stamped.TransactItems, &dynamodb.TransactWriteItem{
+				Put: s.tombstone(aws.StringValue(v.Delete.TableName), v.Delete.Key),
+			})
+		}
+		stamped.TransactItems[i] = &item
+	}
+	return r.Client.TransactWriteItemsWithContext(ctx, &stamped, opts...)
+}
+
+//NewAwsRegionalDynamoUserRepo creates a repo writing to the global tables in region. A non empty
+//readRegion pins the reads to that region. The key log, the cursors and the webhooks are read and written
+//in homeRegion only, see NewAwsRegionalDynamoUserRepoWithClient
+func NewAwsRegionalDynamoUserRepo(sess *session.Session, region, readRegion, homeRegion string) (*AwsDynamoUserRepo, error) {
+	if homeRegion == "" {
+		return nil, fmt.Errorf("failed to setup region %v : missing home region", region)
+	}
+	db := dynamodb.New(sess, aws.NewConfig().WithRegion(region).WithMaxRetries(0))
+	if err := setupTables(db); err != nil {
+		return nil, err
+	}
+	regional := &RegionalDynamo{Region: region, Client: db}
+	if readRegion != "" && readRegion != region {
+		regional.ReadClient = dynamodb.New(sess, aws.NewConfig().WithRegion(readRegion).WithMaxRetries(0))
+	}
+	home := dynamodb.New(sess, aws.NewConfig().WithRegion(homeRegion).WithMaxRetries(0))
+	return NewAwsRegionalDynamoUserRepoWithClient(regional, home, nil), nil
+}
+
+//NewAwsRegionalDynamoUserRepoWithClient creates a repo writing the users through regional and the tables
+//needing a single writer through home, the client of the same home region in all regions. The events of
+//the writes can not share a transaction with home, they go to a stream of the region in the outbox and
+//have to be relayed to the outbox of home, see UserEventSources. A nil resilience selects the defaults
+func NewAwsRegionalDynamoUserRepoWithClient(regional *RegionalDynamo, home DynamoClient, resilience *DynamoResilience) *AwsDynamoUserRepo {
+	repo := NewAwsDynamoUserRepoWithClient(regional, resilience)
+	repo.home = &resilientDynamoClient{client: home, resilience: repo.resilience}
+	repo.eventStream = userEventStream + "@" + regional.Region
+	return repo
+}
+
+//RegionDriftKind tells how the regions disagree about an item
+type RegionDriftKind string
+
+const (
+	//RegionDriftMissing items exist in other regions but not in Region
+	RegionDriftMissing RegionDriftKind = "missing"
+	//RegionDriftDiverged items in Region differ from the last written one in Winner
+	RegionDriftDiverged RegionDriftKind = "diverged"
+	//RegionDriftDeleted items in Region have been deleted in Winner after they were written
+	RegionDriftDeleted RegionDriftKind = "deleted"
+	//RegionDriftDangling email entries in Region point to a key without a user of that email
+	RegionDriftDangling RegionDriftKind = "dangling"
+	//RegionDriftOrphan users in Region are not deleted, but their email entry points to another key.
+	//Concurrent creates of the same email in different regions leave orphans behind
+	RegionDriftOrphan RegionDriftKind = "orphan"
+)
+
+//RegionDrift is an item the regions disagree about
+type RegionDrift struct {
+	Kind   RegionDriftKind
+	Table  string
+	Email  string
+	Region string
+	//Winner is the region holding the last write for missing, diverged and deleted items
+	Winner string
+	//KeyFingerprint identifies the users of orphans and the user items of the other kinds
+	KeyFingerprint string
+}
+
+//RegionReport is the result of ReconcileRegions
+type RegionReport struct {
+	//Compared is the number of compared items
+	Compared int
+	Drift    []RegionDrift
+	//Repaired is the number of items written to regions
+	Repaired int
+}
+
+//InSync returns true if no drift was found
+func (r *RegionReport) InSync() bool {
+	return len(r.Drift) == 0
+}
+
+//RegionReconcileOptions configures ReconcileRegions
+type RegionReconcileOptions struct {
+	//Repair writes the last written item to the regions with diverged items and removes the deleted items
+	Repair bool
+	//CopyMissing copies items to the regions missing them, unless a tombstone records a later delete.
+	//Items deleted before their tombstones expired are resurrected, so only use it for regions that lost
+	//writes
+	CopyMissing bool
+}
+
+//regionItems are the items of a table in each region keyed by the encoded hash key
+type regionItems map[string]map[string]map[string]*dynamodb.AttributeValue
+
+func scanRegionTable(ctx context.Context, client DynamoClient, table string) (map[string]map[string]*dynamodb.AttributeValue, error) {
+	hashKey := regionalTables[table]
+	items := make(map[string]map[string]*dynamodb.AttributeValue)
+	err := client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:      aws.String(table),
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			items[encodeAttribute(item[hashKey])] = item
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %v : %v", table, err)
+	}
+	return items, nil
+}
+
+//scanTombstones returns the tombstones of a region by the table of the deleted items
+func scanTombstones(ctx context.Context, client DynamoClient) (map[string]map[string]map[string]*dynamodb.AttributeValue, error) {
+	tombstones := make(map[string]map[string]map[string]*dynamodb.AttributeValue)
+	err := client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:      aws.String(TableRegionTombstones),
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			table := aws.StringValue(item["DeletedTable"].S)
+			if tombstones[table] == nil {
+				tombstones[table] = make(map[string]map[string]*dynamodb.AttributeValue)
+			}
+			tombstones[table][encodeAttribute(item["DeletedKey"])] = item
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %v : %v", TableRegionTombstones, err)
+	}
+	return tombstones, nil
+}
+
+//writeVersion returns the version an item was stamped with, 0 for items without stamp
+func writeVersion(item map[string]*dynamodb.AttributeValue) int64 {
+	version := int64(0)
+	if v := item[AttributeWriteVersion]; v != nil && v.N != nil {
+		version, _ = strconv.ParseInt(*v.N, 10, 64)
+	}
+	return version
+}
+
+//writtenAfter returns true if item a was written after item b. Items without stamp are the oldest
+func writtenAfter(a, b map[string]*dynamodb.AttributeValue) bool {
+	versionA, versionB := writeVersion(a), writeVersion(b)
+	if versionA != versionB {
+		return versionA > versionB
+	}
+	return writeRegion(a) > writeRegion(b)
+}
+
+//writeRegion returns the region an item was stamped with, empty for items without stamp
+func writeRegion(item map[string]*dynamodb.AttributeValue) string {
+	if v := item[AttributeWriteRegion]; v != nil {
+		return aws.StringValue(v.S)
+	}
+	return ""
+}
+
+//unchangedCondition returns the condition that the item of table is still the compared item, so that
+//concurrent writes win over repairs. Items without stamp are matched by the absence of the stamp
+func unchangedCondition(table string, item map[string]*dynamodb.AttributeValue) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	names := map[string]*string{
+		"#k": aws.String(regionalTables[table]),
+		"#v": aws.String(AttributeWriteVersion),
+		"#r": aws.String(AttributeWriteRegion),
+	}
+	if item == nil {
+		return aws.String("attribute_not_exists(#k)"), map[string]*string{"#k": names["#k"]}, nil
+	}
+	if item[AttributeWriteVersion] == nil || item[AttributeWriteRegion] == nil {
+		return aws.String("attribute_exists(#k) AND attribute_not_exists(#v)"), map[string]*string{"#k": names["#k"], "#v": names["#v"]}, nil
+	}
+	return aws.String("#v = :v AND #r = :r"), map[string]*string{"#v": names["#v"], "#r": names["#r"]}, map[string]*dynamodb.AttributeValue{
+		":v": item[AttributeWriteVersion],
+		":r": item[AttributeWriteRegion],
+	}
+}
+
+//describeItem returns the email and key fingerprint of an item of the user tables
+func describeItem(table string, item map[string]*dynamodb.AttributeValue) (email, fingerprint string) {
+	if table == TableEmailToPublicKey {
+		entry := &EmailToPkEntry{}
+		if err := dynamodbattribute.UnmarshalMap(item, entry); err == nil {
+			return entry.Email, domain.KeyFingerprint(entry.PrimaryKey)
+		}
+		return "", ""
+	}
+	dbUser := &UserDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(item, dbUser); err == nil {
+		return dbUser.NormalizedEmail, domain.KeyFingerprint(dbUser.PublicKeyPKIX)
+	}
+	return "", ""
+}
+
+//reconcileTable compares the items of table across regions and repairs them as configured. An item is
+//deleted if a tombstone of any region was written after all of its copies
+func reconcileTable(ctx context.Context, regions map[string]DynamoClient, names []string, table string, items, tombstones regionItems, opts RegionReconcileOptions, report *RegionReport) error {
+	keys := make(map[string]bool)
+	for _, region := range names {
+		for k := range items[region] {
+			keys[k] = true
+		}
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+	for _, k := range sortedKeys {
+		report.Compared++
+		winner, deletedIn := "", ""
+		for _, region := range names {
+			if item, ok := items[region][k]; ok && (winner == "" || writtenAfter(item, items[winner][k])) {
+				winner = region
+			}
+			if tombstone, ok := tombstones[region][k]; ok && (deletedIn == "" || writtenAfter(tombstone, tombstones[deletedIn][k])) {
+				deletedIn = region
+			}
+		}
+		winning := items[winner][k]
+		email, fingerprint := describeItem(table, winning)
+		if deletedIn != "" && writtenAfter(tombstones[deletedIn][k], winning) {
+			for _, region := range names {
+				item, ok := items[region][k]
+				if !ok {
+					continue
+				}
+				drift := RegionDrift{
+					Kind:           RegionDriftDeleted,
+					Table:          table,
+					Email:          email,
+					Region:         region,
+					Winner:         deletedIn,
+					KeyFingerprint: fingerprint,
+				}
+				if !opts.Repair {
+					report.Drift = append(report.Drift, drift)
+					continue
+				}
+				del := &dynamodb.DeleteItemInput{
+					TableName: aws.String(table),
+					Key:       map[string]*dynamodb.AttributeValue{regionalTables[table]: item[regionalTables[table]]},
+				}
+				del.ConditionExpression, del.ExpressionAttributeNames, del.ExpressionAttributeValues = unchangedCondition(table, item)
+				if _, err := regions[region].DeleteItemWithContext(ctx, del); err != nil {
+					report.Drift = append(report.Drift, drift)
+					if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+						continue
+					}
+					return fmt.Errorf("failed to repair %v in %v : %v", table, region, err)
+				}
+				delete(items[region], k)
+				report.Repaired++
+			}
+			continue
+		}
+		for _, region := range names {
+			item, ok := items[region][k]
+			if ok && reflect.DeepEqual(item, winning) {
+				continue
+			}
+			drift := RegionDrift{
+				Kind:           RegionDriftDiverged,
+				Table:          table,
+				Email:          email,
+				Region:         region,
+				Winner:         winner,
+				KeyFingerprint: fingerprint,
+			}
+			if !ok {
+				drift.Kind = RegionDriftMissing
+				if !opts.CopyMissing {
+					report.Drift = append(report.Drift, drift)
+					continue
+				}
+			} else if !opts.Repair || writeVersion(winning) == 0 {
+				//without stamps there is no telling which item was written last
+				report.Drift = append(report.Drift, drift)
+				continue
+			}
+			put := &dynamodb.PutItemInput{TableName: aws.String(table), Item: winning}
+			put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues = unchangedCondition(table, item)
+			if _, err := regions[region].PutItemWithContext(ctx, put); err != nil {
+				report.Drift = append(report.Drift, drift)
+				if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+					continue
+				}
+				return fmt.Errorf("failed to repair %v in %v : %v", table, region, err)
+			}
+			items[region][k] = winning
+			report.Repaired++
+		}
+	}
+	return nil
+}
+
+//checkPairs reports the email entries and users of a region that do not point to each other
+func checkPairs(region string, users, emails map[string]map[string]*dynamodb.AttributeValue, report *RegionReport) {
+	var drift []RegionDrift
+	for _, item := range emails {
+		entry := &EmailToPkEntry{}
+		if err := dynamodbattribute.UnmarshalMap(item, entry); err != nil {
+			continue
+		}
+		dbUser := &UserDTODB{}
+		userItem, ok := users[encodeAttribute(&dynamodb.AttributeValue{B: entry.PrimaryKey})]
+		if !ok || dynamodbattribute.UnmarshalMap(userItem, dbUser) != nil || dbUser.NormalizedEmail != entry.Email {
+			drift = append(drift, RegionDrift{
+				Kind:           RegionDriftDangling,
+				Table:          TableEmailToPublicKey,
+				Email:          entry.Email,
+				Region:         region,
+				KeyFingerprint: domain.KeyFingerprint(entry.PrimaryKey),
+			})
+		}
+	}
+	for _, item := range users {
+		dbUser := &UserDTODB{}
+		if err := dynamodbattribute.UnmarshalMap(item, dbUser); err != nil || dbUser.DeletedAt != nil {
+			continue
+		}
+		entry := &EmailToPkEntry{}
+		emailItem, ok := emails[encodeAttribute(&dynamodb.AttributeValue{S: aws.String(dbUser.NormalizedEmail)})]
+		if !ok || dynamodbattribute.UnmarshalMap(emailItem, entry) != nil || string(entry.PrimaryKey) != string(dbUser.PublicKeyPKIX) {
+			drift = append(drift, RegionDrift{
+				Kind:           RegionDriftOrphan,
+				Table:          TableUser,
+				Email:          dbUser.NormalizedEmail,
+				Region:         region,
+				KeyFingerprint: domain.KeyFingerprint(dbUser.PublicKeyPKIX),
+			})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].Email != drift[j].Email {
+			return drift[i].Email < drift[j].Email
+		}
+		return drift[i].KeyFingerprint < drift[j].KeyFingerprint
+	})
+	report.Drift = append(report.Drift, drift...)
+}
+
+//ReconcileRegions compares the user tables of the regions of global tables. Items are compared by
+//their content, the last write wins, see RegionalDynamo. Deletes are compared by the stamps of their
+//tombstones, items without stamp are older than all stamped writes and deletes. Afterwards the email
+//entries and users of each region are checked to point to each other. Only repairs of diverged, deleted
+//and missing items are made, dangling entries and orphans are left to an admin. The clients must not be
+//RegionalDynamo, repairs keep the stamps of the winning items
+func ReconcileRegions(ctx context.Context, regions map[string]DynamoClient, opts RegionReconcileOptions) (*RegionReport, error) {
+	names := make([]string, 0, len(regions))
+	for region := range regions {
+		names = append(names, region)
+	}
+	sort.Strings(names)
+	report := &RegionReport{}
+	tombstones := make(map[string]regionItems)
+	for _, region := range names {
+		regionTombstones, err := scanTombstones(ctx, regions[region])
+		if err != nil {
+			return report, fmt.Errorf("failed to read %v : %v", region, err)
+		}
+		for table, items := range regionTombstones {
+			if tombstones[table] == nil {
+				tombstones[table] = make(regionItems)
+			}
+			tombstones[table][region] = items
+		}
+	}
+	scanned := make(map[string]regionItems)
+	for _, table := range []string{TableUser, TableEmailToPublicKey} {
+		scanned[table] = make(regionItems)
+		for _, region := range names {
+			items, err := scanRegionTable(ctx, regions[region], table)
+			if err != nil {
+				return report, fmt.Errorf("failed to read %v : %v", region, err)
+			}
+			scanned[table][region] = items
+		}
+		if err := reconcileTable(ctx, regions, names, table, scanned[table], tombstones[table], opts, report); err != nil {
+			return report, err
+		}
+	}
+	for _, region := range names {
+		checkPairs(region, scanned[TableUser][region], scanned[TableEmailToPublicKey][region], report)
+	}
+	return report, nil
+}
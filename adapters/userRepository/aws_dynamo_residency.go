@@ -0,0 +1,111 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"time"
+)
+
+func residencyKey(email string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{TableUserResidenciesPkName: {S: aws.String(email)}}
+}
+
+func (a AwsDynamoUserRepo) GetResidency(ctx context.Context, email string) (*domain.UserResidency, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(TableUserResidencies),
+		Key:            residencyKey(email),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch residency : %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("failed to fetch residency : %w", ErrNotFound)
+	}
+	dbResidency := &UserResidencyDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, dbResidency); err != nil {
+		return nil, fmt.Errorf("failed to deserialize residency : %v", err)
+	}
+	return dbResidency.toResidency(), nil
+}
+
+func (a AwsDynamoUserRepo) CreateResidency(ctx context.Context, r *domain.UserResidency) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	r.UpdatedAt = time.Now()
+	residencyAwsMap, err := dynamodbattribute.MarshalMap(residencyToDTODB(r))
+	if err != nil {
+		return fmt.Errorf("failed to serialize residency for dynamodb : %v", err)
+	}
+	_, err = a.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(TableUserResidencies),
+		Item:                residencyAwsMap,
+		ConditionExpression: aws.String("attribute_not_exists(" + TableUserResidenciesPkName + ")"),
+	})
+	if err != nil {
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return fmt.Errorf("failed to insert residency : %w", ErrAlreadyExists)
+		}
+		return fmt.Errorf("failed to insert residency : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) SwapResidency(ctx context.Context, expected, r *domain.UserResidency) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	r.UpdatedAt = time.Now()
+	residencyAwsMap, err := dynamodbattribute.MarshalMap(residencyToDTODB(r))
+	if err != nil {
+		return fmt.Errorf("failed to serialize residency for dynamodb : %v", err)
+	}
+	//MovingTo is omitted while empty, region is a reserved word
+	condition := "#region = :region AND attribute_not_exists(#movingTo)"
+	names := map[string]*string{"#region": aws.String("Region"), "#movingTo": aws.String("MovingTo")}
+	values := map[string]*dynamodb.AttributeValue{":region": {S: aws.String(expected.Region)}}
+	if expected.IsMoving() {
+		condition = "#region = :region AND #movingTo = :movingTo"
+		values[":movingTo"] = &dynamodb.AttributeValue{S: aws.String(expected.MovingTo)}
+	}
+	_, err = a.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(TableUserResidencies),
+		Item:                      residencyAwsMap,
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return fmt.Errorf("failed to update residency : %w", ErrResidencyChanged)
+		}
+		return fmt.Errorf("failed to update residency : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) DeleteResidency(ctx context.Context, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	_, err := a.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(TableUserResidencies),
+		Key:                 residencyKey(email),
+		ConditionExpression: aws.String("attribute_exists(" + TableUserResidenciesPkName + ")"),
+	})
+	if err != nil {
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return fmt.Errorf("failed to delete residency : %w", ErrNotFound)
+		}
+		return fmt.Errorf("failed to delete residency : %v", err)
+	}
+	return nil
+}
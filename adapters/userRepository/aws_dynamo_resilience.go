@@ -0,0 +1,341 @@
+package userRepository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	mathrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//ErrUnavailable is returned without calling the backend while its circuit breaker is open
+var ErrUnavailable = errors.New("backend unavailable")
+
+const (
+	DefaultDynamoMaxAttempts = 5
+	//DefaultDynamoMinBackoff is the maximal delay before the first retry, it doubles with each further
+	//attempt. The actual delay is picked at random up to this bound
+	DefaultDynamoMinBackoff = 25 * time.Millisecond
+	DefaultDynamoMaxBackoff = time.Second
+	//DefaultDynamoBreakerThreshold is the number of consecutive failed calls opening the circuit breaker
+	DefaultDynamoBreakerThreshold = 5
+	//DefaultDynamoBreakerCooldown is the time the circuit breaker stays open before letting a probe through
+	DefaultDynamoBreakerCooldown = 10 * time.Second
+)
+
+//DynamoClient are the calls of AwsDynamoUserRepo to dynamodb. It is implemented by *dynamodb.DynamoDB
+//and by FakeDynamo
+type DynamoClient interface {
+	GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error)
+	PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+	UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error)
+	DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error)
+	QueryPagesWithContext(ctx aws.Context, in *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error
+	ScanPagesWithContext(ctx aws.Context, in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error
+	TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+//DynamoFailure classifies the errors of dynamodb calls
+type DynamoFailure int
+
+const (
+	//DynamoPermanent failures are not retried, e.g. failed conditions or invalid requests
+	DynamoPermanent DynamoFailure = iota
+	//DynamoRejected failures were rejected before applying the request, e.g. throttling. They are retried
+	DynamoRejected
+	//DynamoTransient failures may or may not have applied the request, e.g. 5xx responses. Only
+	//idempotent calls are retried
+	DynamoTransient
+)
+
+//throttlingCodes are the error codes and cancellation reasons of requests rejected by dynamodb
+var throttlingCodes = map[string]bool{
+	dynamodb.ErrCodeProvisionedThroughputExceededException: true,
+	dynamodb.ErrCodeRequestLimitExceeded:                   true,
+	dynamodb.ErrCodeTransactionConflictException:           true,
+	dynamodb.ErrCodeTransactionInProgressException:         true,
+	"ThrottlingException":                                  true,
+	//cancellation reasons of transactions
+	"TransactionConflict":           true,
+	"ThrottlingError":               true,
+	"ProvisionedThroughputExceeded": true,
+}
+
+//ClassifyDynamoError returns how a call failing with err may be retried
+func ClassifyDynamoError(err error) DynamoFailure {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return DynamoPermanent
+	}
+	if canceled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		//the transaction was not applied, retrying helps if no condition failed
+		retryable := len(canceled.CancellationReasons) > 0
+		for _, v := range canceled.CancellationReasons {
+			code := aws.StringValue(v.Code)
+			if code != "None" && !throttlingCodes[code] {
+				retryable = false
+			}
+		}
+		if retryable {
+			return DynamoRejected
+		}
+		return DynamoPermanent
+	}
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return DynamoPermanent
+	}
+	switch {
+	case throttlingCodes[awsErr.Code()]:
+		return DynamoRejected
+	case awsErr.Code() == request.CanceledErrorCode:
+		return DynamoPermanent
+	case awsErr.Code() == dynamodb.ErrCodeInternalServerError, awsErr.Code() == request.ErrCodeRequestError,
+		awsErr.Code() == request.ErrCodeResponseTimeout, awsErr.Code() == "RequestTimeout":
+		return DynamoTransient
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= http.StatusInternalServerError {
+		return DynamoTransient
+	}
+	return DynamoPermanent
+}
+
+//DynamoResilience retries failed dynamodb calls within the deadline of the caller and fails fast
+//with ErrUnavailable after BreakerThreshold consecutive calls failed, until BreakerCooldown passed.
+//Afterwards a single probe call decides whether the breaker closes again. Zero fields select the defaults
+type DynamoResilience struct {
+	MaxAttempts      int
+	MinBackoff       time.Duration
+	MaxBackoff       time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	//Sleep waits between attempts, tests may replace it
+	Sleep func(ctx context.Context, d time.Duration) error
+
+	mu sync.Mutex
+	//failures is the number of consecutive failed calls
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+//backoff returns the random delay after the given number of failed attempts
+func (r *DynamoResilience) backoff(attempts int) time.Duration {
+	minBackoff, maxBackoff := r.MinBackoff, r.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultDynamoMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultDynamoMaxBackoff
+	}
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return time.Duration(mathrand.Int63n(int64(delay)) + 1)
+}
+
+//Healthy returns ErrUnavailable while the circuit breaker is open or waits for its probe
+func (r *DynamoResilience) Healthy() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Now().Before(r.openUntil) || r.probing {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+//allow returns whether a call may be made and whether it is the probe of a half open breaker
+func (r *DynamoResilience) allow() (allowed bool, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.openUntil.IsZero() {
+		return true, false
+	}
+	if time.Now().Before(r.openUntil) || r.probing {
+		return false, false
+	}
+	r.probing = true
+	return true, true
+}
+
+//record updates the breaker with the outcome of a call
+func (r *DynamoResilience) record(failed bool, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if probe {
+		r.probing = false
+	}
+	if !failed {
+		r.failures = 0
+		r.openUntil = time.Time{}
+		return
+	}
+	r.failures++
+	threshold, cooldown := r.BreakerThreshold, r.BreakerCooldown
+	if threshold <= 0 {
+		threshold = DefaultDynamoBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultDynamoBreakerCooldown
+	}
+	if probe || r.failures >= threshold {
+		r.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+//Do calls fn until it succeeds, fails permanently, the attempts are used up or ctx is done. Transient
+//failures are only retried if idempotent returns true after the failed attempt
+func (r *DynamoResilience) Do(ctx context.Context, idempotent func() bool, fn func(ctx context.Context) error) error {
+	allowed, probe := r.allow()
+	if !allowed {
+		return fmt.Errorf("circuit breaker open : %w", ErrUnavailable)
+	}
+	maxAttempts := r.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultDynamoMaxAttempts
+	}
+	sleep := r.Sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+	var err error
+	var failure DynamoFailure
+	for attempt := 1; ; attempt++ {
+		err = fn(ctx)
+		failure = ClassifyDynamoError(err)
+		retry := failure == DynamoRejected || (failure == DynamoTransient && idempotent())
+		if err == nil || !retry || attempt >= maxAttempts {
+			break
+		}
+		if sleepErr := sleep(ctx, r.backoff(attempt)); sleepErr != nil {
+			break
+		}
+	}
+	//a backend not answering within the deadline counts as failure as well
+	r.record(err != nil && (failure != DynamoPermanent || ctx.Err() == context.DeadlineExceeded), probe)
+	return err
+}
+
+//resilientDynamoClient runs the calls of a DynamoClient with a DynamoResilience
+type resilientDynamoClient struct {
+	client     DynamoClient
+	resilience *DynamoResilience
+}
+
+func always() bool {
+	return true
+}
+
+func never() bool {
+	return false
+}
+
+func (c *resilientDynamoClient) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	var out *dynamodb.GetItemOutput
+	err := c.resilience.Do(ctx, always, func(ctx context.Context) (err error) {
+		out, err = c.client.GetItemWithContext(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+//The conditional writes are not idempotent, a retry may fail the condition because of the first attempt
+
+func (c *resilientDynamoClient) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	var out *dynamodb.PutItemOutput
+	err := c.resilience.Do(ctx, never, func(ctx context.Context) (err error) {
+		out, err = c.client.PutItemWithContext(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *resilientDynamoClient) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	var out *dynamodb.UpdateItemOutput
+	err := c.resilience.Do(ctx, never, func(ctx context.Context) (err error) {
+		out, err = c.client.UpdateItemWithContext(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *resilientDynamoClient) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	var out *dynamodb.DeleteItemOutput
+	err := c.resilience.Do(ctx, never, func(ctx context.Context) (err error) {
+		out, err = c.client.DeleteItemWithContext(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *resilientDynamoClient) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	var out *dynamodb.QueryOutput
+	err := c.resilience.Do(ctx, always, func(ctx context.Context) (err error) {
+		out, err = c.client.QueryWithContext(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+//The paginated calls resume after the last page handed to fn when they are retried, so that fn sees no
+//page twice
+
+func (c *resilientDynamoClient) QueryPagesWithContext(ctx aws.Context, in *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	next := *in
+	return c.resilience.Do(ctx, always, func(ctx context.Context) error {
+		return c.client.QueryPagesWithContext(ctx, &next, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			next.ExclusiveStartKey = page.LastEvaluatedKey
+			return fn(page, lastPage)
+		}, opts...)
+	})
+}
+
+func (c *resilientDynamoClient) ScanPagesWithContext(ctx aws.Context, in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	next := *in
+	return c.resilience.Do(ctx, always, func(ctx context.Context) error {
+		return c.client.ScanPagesWithContext(ctx, &next, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			next.ExclusiveStartKey = page.LastEvaluatedKey
+			return fn(page, lastPage)
+		}, opts...)
+	})
+}
+
+//TransactWriteItemsWithContext sets a client request token, which makes retries idempotent
+func (c *resilientDynamoClient) TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if in.ClientRequestToken == nil {
+		token, err := newRandomID()
+		if err != nil {
+			return nil, err
+		}
+		withToken := *in
+		withToken.ClientRequestToken = aws.String(token)
+		in = &withToken
+	}
+	var out *dynamodb.TransactWriteItemsOutput
+	err := c.resilience.Do(ctx, always, func(ctx context.Context) (err error) {
+		out, err = c.client.TransactWriteItemsWithContext(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
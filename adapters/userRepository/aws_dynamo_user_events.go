@@ -0,0 +1,240 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"strconv"
+	"time"
+)
+
+//userEventStream is the hash key of all user events. Like the key log a single partition suffices
+const userEventStream = "users"
+
+//userEventAppendAttempts bounds the retries of writes racing for the same event sequences
+const userEventAppendAttempts = 5
+
+//userEventCounterKey is the key of the item holding the last assigned sequence of stream
+func userEventCounterKey(stream string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		TableUserEventsPkName: {S: aws.String(stream)},
+		TableUserEventsSkName: {N: aws.String("0")},
+	}
+}
+
+//stream returns the hash key the events of the writes of the repo go to
+func (a AwsDynamoUserRepo) stream() string {
+	if a.eventStream != "" {
+		return a.eventStream
+	}
+	return userEventStream
+}
+
+//lastUserEventSeq returns the last assigned sequence of stream, 0 if no event has been written yet
+func lastUserEventSeq(ctx context.Context, db DynamoClient, stream string) (int64, error) {
+	result, err := db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(TableUserEvents),
+		Key:            userEventCounterKey(stream),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+	last, ok := result.Item["LastEventSeq"]
+	if !ok || last.N == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(*last.N, 10, 64)
+}
+
+//isUserEventConflict returns true if err cancelled a transaction of transactWithEvents because another
+//write claimed the same sequences
+func isUserEventConflict(err error) bool {
+	canceled, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok || len(canceled.CancellationReasons) == 0 {
+		return false
+	}
+	return aws.StringValue(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed"
+}
+
+//transactWithEvents writes items together with events in a single transaction, so that an event is
+//written if and only if the change is. Errors of the items are returned unwrapped for awsErrorIs
+func (a AwsDynamoUserRepo) transactWithEvents(ctx context.Context, items []*dynamodb.TransactWriteItem, events ...*domain.UserEvent) error {
+	return a.appendUserEvents(ctx, a.db, a.stream(), items, events...)
+}
+
+//appendUserEvents writes events to stream of db together with items in a single transaction
+func (a AwsDynamoUserRepo) appendUserEvents(ctx context.Context, db DynamoClient, stream string, items []*dynamodb.TransactWriteItem, events ...*domain.UserEvent) error {
+	for i := 0; i < userEventAppendAttempts; i++ {
+		last, err := lastUserEventSeq(ctx, db, stream)
+		if err != nil {
+			return fmt.Errorf("failed to fetch last event sequence : %v", err)
+		}
+		next := last + int64(len(events))
+		//the counter is the first item, so that its cancellation reason can be told apart
+		counter := &dynamodb.Update{
+			TableName:        aws.String(TableUserEvents),
+			Key:              userEventCounterKey(stream),
+			UpdateExpression: aws.String("SET LastEventSeq = :n"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":n": {N: aws.String(strconv.FormatInt(next, 10))},
+			},
+		}
+		if last == 0 {
+			counter.ConditionExpression = aws.String("attribute_not_exists(LastEventSeq)")
+		} else {
+			counter.ConditionExpression = aws.String("LastEventSeq = :o")
+			counter.ExpressionAttributeValues[":o"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(last, 10))}
+		}
+		txItems := []*dynamodb.TransactWriteItem{{Update: counter}}
+		for j, e := range events {
+			e.Sequence = last + int64(j) + 1
+			dbEvent := userEventToDTODB(e)
+			dbEvent.StreamName = stream
+			dbEvent.ExpiresAtUnix = e.CreatedAt.Add(a.EventRetention).Unix()
+			eventAwsMap, err := dynamodbattribute.MarshalMap(dbEvent)
+			if err != nil {
+				return fmt.Errorf("failed to serialize user event for dynamodb : %v", err)
+			}
+			txItems = append(txItems, &dynamodb.TransactWriteItem{
+				Put: &dynamodb.Put{
+					Item:      eventAwsMap,
+					TableName: aws.String(TableUserEvents),
+				},
+			})
+		}
+		txItems = append(txItems, items...)
+
+		_, err = db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: txItems})
+		if !isUserEventConflict(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("failed to append user events : too many concurrent writes")
+}
+
+//ListUserEvents returns the events of the outbox of the home region, see UserEventSources
+func (a AwsDynamoUserRepo) ListUserEvents(ctx context.Context, after int64, limit int) ([]*domain.UserEvent, error) {
+	return listUserEvents(ctx, a.homeDB(), userEventStream, after, limit)
+}
+
+func listUserEvents(ctx context.Context, db DynamoClient, stream string, after int64, limit int) ([]*domain.UserEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var events []*domain.UserEvent
+	var fnErr error
+	err := db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TableUserEvents),
+		KeyConditionExpression: aws.String(TableUserEventsPkName + " = :s AND " + TableUserEventsSkName + " > :a"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {S: aws.String(stream)},
+			":a": {N: aws.String(strconv.FormatInt(after, 10))},
+		},
+		ConsistentRead: aws.Bool(true),
+		Limit:          aws.Int64(int64(limit)),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			dbEvent := &UserEventDTODB{}
+			if fnErr = dynamodbattribute.UnmarshalMap(item, dbEvent); fnErr != nil {
+				return false
+			}
+			events = append(events, dbEvent.toUserEvent())
+			if len(events) == limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = fnErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user events : %v", err)
+	}
+	return events, nil
+}
+
+//PurgeUserEvents is a no-op, expired events are removed by dynamodb TTL. The counter item never expires,
+//so sequences are not reused
+func (a AwsDynamoUserRepo) PurgeUserEvents(ctx context.Context, createdBefore time.Time) (int, error) {
+	return 0, nil
+}
+
+//UserEventSources returns the stream of the region of a regional repo, see NewAwsRegionalDynamoUserRepo
+func (a *AwsDynamoUserRepo) UserEventSources() map[string]UserEventRepo {
+	if a.eventStream == "" {
+		return nil
+	}
+	return map[string]UserEventRepo{a.eventStream: dynamoEventStream{db: a.db, stream: a.eventStream}}
+}
+
+//dynamoEventStream reads the events of one stream of the outbox
+type dynamoEventStream struct {
+	db     DynamoClient
+	stream string
+}
+
+func (s dynamoEventStream) ListUserEvents(ctx context.Context, after int64, limit int) ([]*domain.UserEvent, error) {
+	return listUserEvents(ctx, s.db, s.stream, after, limit)
+}
+
+//PurgeUserEvents is a no-op, expired events are removed by dynamodb TTL
+func (s dynamoEventStream) PurgeUserEvents(ctx context.Context, createdBefore time.Time) (int, error) {
+	return 0, nil
+}
+
+func (a AwsDynamoUserRepo) GetRelayCursor(ctx context.Context, source string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.homeDB().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(TableCursors),
+		Key:            map[string]*dynamodb.AttributeValue{TableCursorsPkName: {S: aws.String(relayCursorName(source))}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch relay cursor : %v", err)
+	}
+	if result.Item == nil {
+		return 0, nil
+	}
+	cursor := &CursorDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, cursor); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal dynamodb entry to CursorDTODB : %v", err)
+	}
+	return cursor.LastSeq, nil
+}
+
+//RelayUserEvents writes the events and the cursor in one transaction, so events has to be shorter than the
+//100 items of a transaction
+func (a AwsDynamoUserRepo) RelayUserEvents(ctx context.Context, source string, after, cursor int64, events []*domain.UserEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	condition := "LastSeq = :a"
+	if after == 0 {
+		condition = "attribute_not_exists(LastSeq) OR " + condition
+	}
+	update := &dynamodb.Update{
+		TableName:           aws.String(TableCursors),
+		Key:                 map[string]*dynamodb.AttributeValue{TableCursorsPkName: {S: aws.String(relayCursorName(source))}},
+		UpdateExpression:    aws.String("SET LastSeq = :c"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":a": {N: aws.String(strconv.FormatInt(after, 10))},
+			":c": {N: aws.String(strconv.FormatInt(cursor, 10))},
+		},
+	}
+	err := a.appendUserEvents(ctx, a.homeDB(), userEventStream, []*dynamodb.TransactWriteItem{{Update: update}}, events...)
+	if isConditionFailed(err) {
+		return fmt.Errorf("failed to relay user events : %w", ErrCursorMoved)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to relay user events : %v", err)
+	}
+	return nil
+}
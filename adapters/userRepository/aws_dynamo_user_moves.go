@@ -0,0 +1,260 @@
+package userRepository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"time"
+)
+
+func userFenceKey(email string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		TableUserFencesPkName: {S: aws.String(email)},
+	}
+}
+
+//fenceCheck is the transaction item failing while the writes to the user with the normalized email are
+//fenced. Writes to a user include it, so that they conflict with a concurrent FenceUser
+func fenceCheck(email string) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		ConditionCheck: &dynamodb.ConditionCheck{
+			TableName:           aws.String(TableUserFences),
+			Key:                 userFenceKey(email),
+			ConditionExpression: aws.String("attribute_not_exists(" + TableUserFencesPkName + ")"),
+		},
+	}
+}
+
+//fencedError returns ErrUserMoving if err cancelled a transaction because one of the users with the
+//normalized emails is fenced, otherwise err
+func (a AwsDynamoUserRepo) fencedError(ctx context.Context, err error, emails ...string) error {
+	if !isConditionFailed(err) {
+		return err
+	}
+	for _, email := range emails {
+		result, getErr := a.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(TableUserFences),
+			Key:            userFenceKey(email),
+			ConsistentRead: aws.Bool(true),
+		})
+		if getErr != nil {
+			return fmt.Errorf("failed to check fence : %v", getErr)
+		}
+		if result.Item != nil {
+			return fmt.Errorf("user is fenced : %w", ErrUserMoving)
+		}
+	}
+	return err
+}
+
+//transactFenced writes items in a transaction, unless the user with the normalized email is fenced
+func (a AwsDynamoUserRepo) transactFenced(ctx context.Context, email string, items ...*dynamodb.TransactWriteItem) error {
+	_, err := a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: append([]*dynamodb.TransactWriteItem{fenceCheck(email)}, items...),
+	})
+	return a.fencedError(ctx, err, email)
+}
+
+func (a AwsDynamoUserRepo) FenceUser(ctx context.Context, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	fenceAwsMap, err := dynamodbattribute.MarshalMap(&UserFenceDTODB{Email: email, CreatedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to serialize fence for dynamodb : %v", err)
+	}
+	_, err = a.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(TableUserFences),
+		Item:      fenceAwsMap,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fence user : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) UnfenceUser(ctx context.Context, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	_, err := a.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(TableUserFences),
+		Key:       userFenceKey(email),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unfence user : %v", err)
+	}
+	return nil
+}
+
+//ImportUserData puts the items one by one, as the data of a user may exceed a transaction. Importing the
+//same data again is harmless
+func (a AwsDynamoUserRepo) ImportUserData(ctx context.Context, data *UserData) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	type tableItem struct {
+		table string
+		item  interface{}
+	}
+	var items []tableItem
+	for _, v := range data.Devices {
+		dbDevice, err := deviceToDTODB(v)
+		if err != nil {
+			return fmt.Errorf("failed to serialize device for DB : %v", err)
+		}
+		items = append(items, tableItem{TableDevices, dbDevice}, tableItem{TableDevicePkToDevice, &DevicePkToDeviceEntry{
+			PublicKeyPKIX: dbDevice.PublicKeyPKIX,
+			OwnerEmail:    dbDevice.OwnerEmail,
+			ID:            dbDevice.ID,
+		}})
+	}
+	for _, v := range data.Enrollments {
+		dbEnrollment, err := enrollmentToDTODB(v)
+		if err != nil {
+			return fmt.Errorf("failed to serialize enrollment for DB : %v", err)
+		}
+		items = append(items, tableItem{TableEnrollments, dbEnrollment})
+	}
+	for _, v := range data.RecoveryWrappings {
+		dbWrapping, err := recoveryWrappingToDTODB(v)
+		if err != nil {
+			return fmt.Errorf("failed to serialize recovery wrapping for DB : %v", err)
+		}
+		items = append(items, tableItem{TableRecoveryWrappings, dbWrapping})
+	}
+	for _, v := range data.RecoveryAudits {
+		items = append(items, tableItem{TableRecoveryAudits, recoveryAuditToDTODB(v)})
+	}
+	if data.EscrowWrapping != nil {
+		dbWrapping, err := escrowWrappingToDTODB(data.EscrowWrapping)
+		if err != nil {
+			return fmt.Errorf("failed to serialize escrow wrapping for DB : %v", err)
+		}
+		items = append(items, tableItem{TableEscrowWrappings, dbWrapping})
+	}
+	for _, v := range data.GroupKeyWrappings {
+		items = append(items, tableItem{TableGroupKeys, groupKeyWrappingToDTODB(v)})
+	}
+	for _, v := range items {
+		itemAwsMap, err := dynamodbattribute.MarshalMap(v.item)
+		if err != nil {
+			return fmt.Errorf("failed to serialize %v item for dynamodb : %v", v.table, err)
+		}
+		_, err = a.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(v.table),
+			Item:      itemAwsMap,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to import %v item : %v", v.table, err)
+		}
+	}
+	return nil
+}
+
+//DropMovedUser scans the group keys for the ones wrapped for the user, as the groups are stored elsewhere.
+//Moves are rare enough to afford it
+func (a AwsDynamoUserRepo) DropMovedUser(ctx context.Context, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, 4*dynamoTimeout)
+	defer cancel()
+
+	if err := a.purgeDevices(ctx, email); err != nil {
+		return fmt.Errorf("failed to drop moved user : %v", err)
+	}
+	if err := a.purgeRecoveryWrappings(ctx, email); err != nil {
+		return fmt.Errorf("failed to drop moved user : %v", err)
+	}
+	if err := a.purgeEscrowWrapping(ctx, email); err != nil {
+		return fmt.Errorf("failed to drop moved user : %v", err)
+	}
+	for _, v := range []struct{ table, pkName, skName string }{
+		{TableEnrollments, TableEnrollmentsPkName, TableEnrollmentsSkName},
+		{TableRecoveryAudits, TableRecoveryAuditsPkName, TableRecoveryAuditsSkName},
+	} {
+		var keys []map[string]*dynamodb.AttributeValue
+		err := a.queryByHashKey(ctx, v.table, v.pkName, email, func(item map[string]*dynamodb.AttributeValue) error {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{v.pkName: item[v.pkName], v.skName: item[v.skName]})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to query %v : %v", v.table, err)
+		}
+		if err := a.deleteKeys(ctx, v.table, keys); err != nil {
+			return err
+		}
+	}
+	var groupKeys []map[string]*dynamodb.AttributeValue
+	err := a.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:                 aws.String(TableGroupKeys),
+		FilterExpression:          aws.String(TableGroupKeysSkName + " = :e"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":e": {S: aws.String(email)}},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			groupKeys = append(groupKeys, map[string]*dynamodb.AttributeValue{
+				TableGroupKeysPkName: item[TableGroupKeysPkName],
+				TableGroupKeysSkName: item[TableGroupKeysSkName],
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan %v : %v", TableGroupKeys, err)
+	}
+	if err := a.deleteKeys(ctx, TableGroupKeys, groupKeys); err != nil {
+		return err
+	}
+
+	emailToPk, err := a.getEmailEntry(ctx, email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to drop moved user : %v", err)
+	}
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(TableUserFences),
+				Key:       userFenceKey(email),
+			},
+		},
+	}
+	if emailToPk != nil {
+		items = append(items,
+			&dynamodb.TransactWriteItem{
+				Delete: &dynamodb.Delete{
+					TableName: aws.String(TableEmailToPublicKey),
+					Key: map[string]*dynamodb.AttributeValue{
+						TableEmailToPublicKeyPkName: {S: aws.String(email)},
+					},
+				},
+			},
+			&dynamodb.TransactWriteItem{
+				Delete: &dynamodb.Delete{
+					TableName: aws.String(TableUser),
+					Key: map[string]*dynamodb.AttributeValue{
+						TableUserPkName: {B: emailToPk.PrimaryKey},
+					},
+				},
+			},
+		)
+	}
+	if _, err := a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+		return fmt.Errorf("failed to drop moved user : %v", err)
+	}
+	return nil
+}
+
+//deleteKeys removes the items with keys from table
+func (a AwsDynamoUserRepo) deleteKeys(ctx context.Context, table string, keys []map[string]*dynamodb.AttributeValue) error {
+	for _, key := range keys {
+		_, err := a.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(table),
+			Key:       key,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete %v item : %v", table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func webhookDeliveryKey(webhookID string, eventSequence int64) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		TableWebhookDeliveriesPkName: {S: aws.String(webhookID)},
+		TableWebhookDeliveriesSkName: {N: aws.String(strconv.FormatInt(eventSequence, 10))},
+	}
+}
+
+func (a AwsDynamoUserRepo) CreateWebhook(ctx context.Context, w *domain.Webhook) (*domain.Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	w.CreatedAt = time.Now()
+	webhookAwsMap, err := dynamodbattribute.MarshalMap(webhookToDTODB(w))
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize webhook for dynamodb : %v", err)
+	}
+	_, err = a.homeDB().PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(TableWebhooks),
+		Item:                webhookAwsMap,
+		ConditionExpression: aws.String("attribute_not_exists(" + TableWebhooksPkName + ")"),
+	})
+	if err != nil {
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return nil, fmt.Errorf("failed to insert webhook : %w", ErrAlreadyExists)
+		}
+		return nil, fmt.Errorf("failed to insert webhook : %v", err)
+	}
+	return w, nil
+}
+
+func (a AwsDynamoUserRepo) ListWebhooks(ctx context.Context) ([]*domain.Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	var webhooks []*domain.Webhook
+	err := a.homeDB().ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String(TableWebhooks)},
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				dbWebhook := &WebhookDTODB{}
+				if err := dynamodbattribute.UnmarshalMap(item, dbWebhook); err != nil {
+					log.Printf("skipping malformed webhook entry : %v", err)
+					continue
+				}
+				webhooks = append(webhooks, dbWebhook.toWebhook())
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %v : %v", TableWebhooks, err)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+	return webhooks, nil
+}
+
+func (a AwsDynamoUserRepo) DeleteWebhook(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	_, err := a.homeDB().DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(TableWebhooks),
+		Key:                 map[string]*dynamodb.AttributeValue{TableWebhooksPkName: {S: aws.String(id)}},
+		ConditionExpression: aws.String("attribute_exists(" + TableWebhooksPkName + ")"),
+	})
+	if err != nil {
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return fmt.Errorf("failed to delete webhook : %w", ErrNotFound)
+		}
+		return fmt.Errorf("failed to delete webhook : %v", err)
+	}
+	//deliveries enqueued concurrently may survive, they are dropped as their webhook is gone
+	return a.queryByHashKey(ctx, TableWebhookDeliveries, TableWebhookDeliveriesPkName, id, func(item map[string]*dynamodb.AttributeValue) error {
+		_, err := a.homeDB().DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(TableWebhookDeliveries),
+			Key: map[string]*dynamodb.AttributeValue{
+				TableWebhookDeliveriesPkName: item[TableWebhookDeliveriesPkName],
+				TableWebhookDeliveriesSkName: item[TableWebhookDeliveriesSkName],
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete webhook delivery : %v", err)
+		}
+		return nil
+	})
+}
+
+func (a AwsDynamoUserRepo) GetWebhookCursor(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	result, err := a.homeDB().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(TableCursors),
+		Key:            map[string]*dynamodb.AttributeValue{TableCursorsPkName: {S: aws.String(webhookCursorName)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch webhook cursor : %v", err)
+	}
+	if result.Item == nil {
+		return 0, nil
+	}
+	cursor := &CursorDTODB{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, cursor); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal dynamodb entry to CursorDTODB : %v", err)
+	}
+	return cursor.LastSeq, nil
+}
+
+//EnqueueWebhookDeliveries is not atomic, but idempotent. Deliveries are written before the cursor
+//advances, so no event is skipped if it fails midway
+func (a AwsDynamoUserRepo) EnqueueWebhookDeliveries(ctx context.Context, cursor int64, deliveries []*domain.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	for _, v := range deliveries {
+		deliveryAwsMap, err := dynamodbattribute.MarshalMap(webhookDeliveryToDTODB(v))
+		if err != nil {
+			return fmt.Errorf("failed to serialize webhook delivery for dynamodb : %v", err)
+		}
+		_, err = a.homeDB().PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(TableWebhookDeliveries),
+			Item:                deliveryAwsMap,
+			ConditionExpression: aws.String("attribute_not_exists(" + TableWebhookDeliveriesSkName + ")"),
+		})
+		if err != nil && !awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return fmt.Errorf("failed to insert webhook delivery : %v", err)
+		}
+	}
+	_, err := a.homeDB().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(TableCursors),
+		Key:                 map[string]*dynamodb.AttributeValue{TableCursorsPkName: {S: aws.String(webhookCursorName)}},
+		UpdateExpression:    aws.String("SET LastSeq = :c"),
+		ConditionExpression: aws.String("attribute_not_exists(LastSeq) OR LastSeq < :c"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":c": {N: aws.String(strconv.FormatInt(cursor, 10))},
+		},
+	})
+	if err != nil && !awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return fmt.Errorf("failed to update webhook cursor : %v", err)
+	}
+	return nil
+}
+
+//queryWebhookDeliveries returns up to limit deliveries of webhookID in state matching the optional
+//filter expression
+func (a AwsDynamoUserRepo) queryWebhookDeliveries(ctx context.Context, webhookID string, state domain.WebhookDeliveryState, filter string, values map[string]*dynamodb.AttributeValue, limit int) ([]*domain.WebhookDelivery, error) {
+	expression := "#s = :s"
+	if filter != "" {
+		expression += " AND " + filter
+	}
+	attributeValues := map[string]*dynamodb.AttributeValue{
+		":w": {S: aws.String(webhookID)},
+		":s": {S: aws.String(string(state))},
+	}
+	for k, v := range values {
+		attributeValues[k] = v
+	}
+	var deliveries []*domain.WebhookDelivery
+	var fnErr error
+	err := a.homeDB().QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TableWebhookDeliveries),
+		KeyConditionExpression: aws.String(TableWebhookDeliveriesPkName + " = :w"),
+		FilterExpression:       aws.String(expression),
+		//State is a reserved word
+		ExpressionAttributeNames:  map[string]*string{"#s": aws.String("State")},
+		ExpressionAttributeValues: attributeValues,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			dbDelivery := &WebhookDeliveryDTODB{}
+			if fnErr = dynamodbattribute.UnmarshalMap(item, dbDelivery); fnErr != nil {
+				return false
+			}
+			deliveries = append(deliveries, dbDelivery.toWebhookDelivery())
+			if len(deliveries) == limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = fnErr
+	}
+	return deliveries, err
+}
+
+//collectWebhookDeliveries queries the deliveries of the given webhooks until limit are found
+func (a AwsDynamoUserRepo) collectWebhookDeliveries(webhookIDs []string, limit int, query func(webhookID string, limit int) ([]*domain.WebhookDelivery, error)) ([]*domain.WebhookDelivery, error) {
+	var deliveries []*domain.WebhookDelivery
+	for _, id := range webhookIDs {
+		found, err := query(id, limit-len(deliveries))
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, found...)
+		if len(deliveries) >= limit {
+			break
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].EventSequence < deliveries[j].EventSequence
+	})
+	return deliveries, nil
+}
+
+//webhookIDs returns the ids of all webhooks
+func (a AwsDynamoUserRepo) webhookIDs(ctx context.Context) ([]string, error) {
+	webhooks, err := a.ListWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(webhooks))
+	for _, v := range webhooks {
+		ids = append(ids, v.ID)
+	}
+	return ids, nil
+}
+
+func (a AwsDynamoUserRepo) ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*domain.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	ids, err := a.webhookIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch due webhook deliveries : %v", err)
+	}
+	deliveries, err := a.collectWebhookDeliveries(ids, limit, func(webhookID string, limit int) ([]*domain.WebhookDelivery, error) {
+		return a.queryWebhookDeliveries(ctx, webhookID, domain.WebhookDeliveryPending, "NextAttemptAtUnix <= :n",
+			map[string]*dynamodb.AttributeValue{":n": {N: aws.String(strconv.FormatInt(now.Unix(), 10))}}, limit)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch due webhook deliveries : %v", err)
+	}
+	return deliveries, nil
+}
+
+func (a AwsDynamoUserRepo) ClaimWebhookDelivery(ctx context.Context, d *domain.WebhookDelivery, leaseUntil time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	_, err := a.homeDB().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(TableWebhookDeliveries),
+		Key:                      webhookDeliveryKey(d.WebhookID, d.EventSequence),
+		UpdateExpression:         aws.String("SET NextAttemptAtUnix = :l"),
+		ConditionExpression:      aws.String("#s = :p AND NextAttemptAtUnix = :n"),
+		ExpressionAttributeNames: map[string]*string{"#s": aws.String("State")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":l": {N: aws.String(strconv.FormatInt(leaseUntil.Unix(), 10))},
+			":p": {S: aws.String(string(domain.WebhookDeliveryPending))},
+			":n": {N: aws.String(strconv.FormatInt(d.NextAttemptAt.Unix(), 10))},
+		},
+	})
+	if err != nil {
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return fmt.Errorf("failed to claim webhook delivery : %w", ErrNotFound)
+		}
+		return fmt.Errorf("failed to claim webhook delivery : %v", err)
+	}
+	d.NextAttemptAt = time.Unix(leaseUntil.Unix(), 0)
+	return nil
+}
+
+func (a AwsDynamoUserRepo) UpdateWebhookDelivery(ctx context.Context, d *domain.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	dbDelivery := webhookDeliveryToDTODB(d)
+	_, err := a.homeDB().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(TableWebhookDeliveries),
+		Key:                      webhookDeliveryKey(dbDelivery.WebhookID, dbDelivery.EventSequence),
+		UpdateExpression:         aws.String("SET #s = :s, Attempts = :a, NextAttemptAtUnix = :n, LastError = :e"),
+		ConditionExpression:      aws.String("attribute_exists(" + TableWebhookDeliveriesSkName + ")"),
+		ExpressionAttributeNames: map[string]*string{"#s": aws.String("State")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {S: aws.String(dbDelivery.State)},
+			":a": {N: aws.String(strconv.Itoa(dbDelivery.Attempts))},
+			":n": {N: aws.String(strconv.FormatInt(dbDelivery.NextAttemptAtUnix, 10))},
+			":e": {S: aws.String(dbDelivery.LastError)},
+		},
+	})
+	if err != nil {
+		if awsErrorIs(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			return fmt.Errorf("failed to update webhook delivery : %w", ErrNotFound)
+		}
+		return fmt.Errorf("failed to update webhook delivery : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) CompleteWebhookDelivery(ctx context.Context, webhookID string, eventSequence int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	_, err := a.homeDB().DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(TableWebhookDeliveries),
+		Key:       webhookDeliveryKey(webhookID, eventSequence),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook delivery : %v", err)
+	}
+	return nil
+}
+
+func (a AwsDynamoUserRepo) ListDeadWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]*domain.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*dynamoTimeout)
+	defer cancel()
+
+	ids := []string{webhookID}
+	if webhookID == "" {
+		var err error
+		if ids, err = a.webhookIDs(ctx); err != nil {
+			return nil, fmt.Errorf("failed to fetch dead webhook deliveries : %v", err)
+		}
+	}
+	deliveries, err := a.collectWebhookDeliveries(ids, limit, func(webhookID string, limit int) ([]*domain.WebhookDelivery, error) {
+		return a.queryWebhookDeliveries(ctx, webhookID, domain.WebhookDeliveryDead, "", nil, limit)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dead webhook deliveries : %v", err)
+	}
+	return deliveries, nil
+}
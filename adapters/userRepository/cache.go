@@ -0,0 +1,382 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"container/list"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//UserCacheConfig configures a CachedUserRepo
+type UserCacheConfig struct {
+	//Size is the maximum number of cached lookups, the least recently used lookup is evicted first
+	Size int
+	//TTL is the time a found user is cached
+	TTL time.Duration
+	//NegativeTTL is the time a lookup that found no user is cached, zero disables negative caching
+	NegativeTTL time.Duration
+	//Singleflight collapses concurrent lookups of the same key into one backend call. The collapsed
+	//lookups share the result of the first one, including errors caused by its context
+	Singleflight bool
+}
+
+//UserCacheStats counts the lookups of a CachedUserRepo since its creation
+type UserCacheStats struct {
+	Hits int64
+	//NegativeHits are hits of cached misses
+	NegativeHits int64
+	Misses       int64
+	//Collapsed are misses that waited for a concurrent lookup of the same key instead of calling the backend
+	Collapsed int64
+	Evictions int64
+	//Size is the current number of cached lookups
+	Size int
+}
+
+//cacheEntry is a cached lookup. user is nil for cached misses
+type cacheEntry struct {
+	key     string
+	email   string
+	user    *domain.User
+	expires time.Time
+}
+
+//cacheFlight is a backend lookup that concurrent lookups of the same key wait for
+type cacheFlight struct {
+	wg   sync.WaitGroup
+	user *domain.User
+	err  error
+}
+
+//CachedUserRepo is a read through cache for the lookups of users by email and by public key. Writes
+//through the cache invalidate the affected lookups. Writes by other instances are only seen once the
+//cached lookups expire, unless the instances share an InvalidationBus
+type CachedUserRepo struct {
+	repo UserDirectoryRepo
+	cfg  UserCacheConfig
+	//bus receives the invalidations of writes through the cache, if set
+	bus    InvalidationBus
+	origin string
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	//byEmail maps normalized emails to the keys of their cached lookups
+	byEmail map[string]map[string]bool
+	flights map[string]*cacheFlight
+	//generation is increased by each invalidation, lookups started before are not cached
+	generation uint64
+	stats      UserCacheStats
+}
+
+//NewCachedUserRepo wraps repo with a cache configured by cfg
+func NewCachedUserRepo(repo UserDirectoryRepo, cfg UserCacheConfig) *CachedUserRepo {
+	return &CachedUserRepo{
+		repo:    repo,
+		cfg:     cfg,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		byEmail: make(map[string]map[string]bool),
+		flights: make(map[string]*cacheFlight),
+	}
+}
+
+//Stats returns a snapshot of the cache counters
+func (c *CachedUserRepo) Stats() UserCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
+
+func emailCacheKey(normalizedEmail string) string {
+	return "email:" + normalizedEmail
+}
+
+func pkCacheKey(PKIXPublicKey []byte) string {
+	return "pk:" + string(PKIXPublicKey)
+}
+
+//cachedUserCopy returns a copy of u, so that callers can not modify cached users
+func cachedUserCopy(u *domain.User) *domain.User {
+	if u == nil {
+		return nil
+	}
+	cp := *u
+	return &cp
+}
+
+//removeElement drops a cached lookup. The caller has to hold mu
+func (c *CachedUserRepo) removeElement(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	if keys := c.byEmail[e.email]; keys != nil {
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(c.byEmail, e.email)
+		}
+	}
+}
+
+//store caches the result of a lookup. The caller has to hold mu
+func (c *CachedUserRepo) store(key, email string, u *domain.User, err error) {
+	e := &cacheEntry{key: key, email: email}
+	switch {
+	case err == nil:
+		normalized, normErr := domain.NormalizeEmail(u.Email)
+		if normErr != nil {
+			return
+		}
+		e.email = normalized
+		e.user = cachedUserCopy(u)
+		e.expires = time.Now().Add(c.cfg.TTL)
+	case errors.Is(err, ErrNotFound) && c.cfg.NegativeTTL > 0:
+		e.expires = time.Now().Add(c.cfg.NegativeTTL)
+	default:
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	if e.email != "" {
+		if c.byEmail[e.email] == nil {
+			c.byEmail[e.email] = make(map[string]bool)
+		}
+		c.byEmail[e.email][key] = true
+	}
+	for c.cfg.Size > 0 && c.lru.Len() > c.cfg.Size {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+//lookup serves key from the cache or calls fetch. email is the normalized email for lookups by email
+func (c *CachedUserRepo) lookup(key, email string, fetch func() (*domain.User, error)) (*domain.User, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			if e.user == nil {
+				c.stats.NegativeHits++
+				c.mu.Unlock()
+				return nil, fmt.Errorf("failed to fetch user : %w", ErrNotFound)
+			}
+			c.stats.Hits++
+			u := cachedUserCopy(e.user)
+			c.mu.Unlock()
+			return u, nil
+		}
+		c.removeElement(el)
+	}
+	c.stats.Misses++
+	var flight *cacheFlight
+	if c.cfg.Singleflight {
+		if f, ok := c.flights[key]; ok {
+			c.stats.Collapsed++
+			c.mu.Unlock()
+			f.wg.Wait()
+			return cachedUserCopy(f.user), f.err
+		}
+		flight = &cacheFlight{}
+		flight.wg.Add(1)
+		c.flights[key] = flight
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	u, err := fetch()
+
+	c.mu.Lock()
+	if generation == c.generation {
+		c.store(key, email, u, err)
+	}
+	if flight != nil {
+		if c.flights[key] == flight {
+			delete(c.flights, key)
+		}
+		flight.user, flight.err = cachedUserCopy(u), err
+		flight.wg.Done()
+	}
+	c.mu.Unlock()
+	return u, err
+}
+
+//UseInvalidationBus publishes the invalidations of writes through the cache on bus and applies the
+//invalidations published by other caches, until the returned func is called
+func (c *CachedUserRepo) UseInvalidationBus(bus InvalidationBus) (func(), error) {
+	origin, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.bus, c.origin = bus, origin
+	c.mu.Unlock()
+	unsubscribe := bus.Subscribe(func(inv CacheInvalidation) {
+		if inv.Origin != origin {
+			c.apply(inv)
+		}
+	})
+	return func() {
+		unsubscribe()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.origin == origin {
+			c.bus, c.origin = nil, ""
+		}
+	}, nil
+}
+
+//apply drops the cached lookups named by inv
+func (c *CachedUserRepo) apply(inv CacheInvalidation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	//lookups in flight may return the state before the write, so later lookups do not join them
+	c.flights = make(map[string]*cacheFlight)
+	if inv.Flush {
+		c.lru.Init()
+		c.entries = make(map[string]*list.Element)
+		c.byEmail = make(map[string]map[string]bool)
+		return
+	}
+	keys := []string{}
+	if normalized, err := domain.NormalizeEmail(inv.Email); err == nil {
+		keys = append(keys, emailCacheKey(normalized))
+		for key := range c.byEmail[normalized] {
+			keys = append(keys, key)
+		}
+	}
+	for _, pk := range inv.PublicKeys {
+		keys = append(keys, pkCacheKey(pk))
+	}
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.removeElement(el)
+		}
+	}
+}
+
+//publish applies inv and hands it to the invalidation bus, if any
+func (c *CachedUserRepo) publish(inv CacheInvalidation) {
+	c.apply(inv)
+	c.mu.Lock()
+	bus := c.bus
+	inv.Origin = c.origin
+	c.mu.Unlock()
+	if bus == nil {
+		return
+	}
+	if err := bus.Publish(context.Background(), inv); err != nil {
+		log.Printf("failed to publish cache invalidation of %q : %v", inv.Email, err)
+	}
+}
+
+//invalidate drops all cached lookups of the user with email and of the keys in pks
+func (c *CachedUserRepo) invalidate(email string, pks ...[]byte) {
+	c.publish(CacheInvalidation{Email: email, PublicKeys: pks})
+}
+
+//invalidateUser drops all cached lookups of u and of its public key
+func (c *CachedUserRepo) invalidateUser(u *domain.User) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
+	if err != nil {
+		c.invalidate(u.Email)
+		return
+	}
+	c.invalidate(u.Email, pkPKIX)
+}
+
+//Invalidate drops the cached lookups of u in all caches sharing the invalidation bus, for writes that
+//bypass the cache like moving users between regions
+func (c *CachedUserRepo) Invalidate(u *domain.User) {
+	c.invalidateUser(u)
+}
+
+//Flush drops all cached lookups of this cache only
+func (c *CachedUserRepo) Flush() {
+	c.apply(CacheInvalidation{Flush: true})
+}
+
+func (c *CachedUserRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error) {
+	return c.lookup(pkCacheKey(PKIXPublicKey), "", func() (*domain.User, error) {
+		return c.repo.GetByPk(ctx, PKIXPublicKey)
+	})
+}
+
+func (c *CachedUserRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return c.repo.GetByEmail(ctx, email)
+	}
+	return c.lookup(emailCacheKey(normalized), normalized, func() (*domain.User, error) {
+		return c.repo.GetByEmail(ctx, email)
+	})
+}
+
+//ListUsers is not cached, it is only used by the admin tooling
+func (c *CachedUserRepo) ListUsers(ctx context.Context, filter domain.UserFilter) ([]*domain.User, error) {
+	return c.repo.ListUsers(ctx, filter)
+}
+
+func (c *CachedUserRepo) ScanUsers(ctx context.Context, fn func(u *domain.User) error) error {
+	return c.repo.ScanUsers(ctx, fn)
+}
+
+func (c *CachedUserRepo) FindByEmail(ctx context.Context, email string) (*domain.User, error) {
+	return c.repo.FindByEmail(ctx, email)
+}
+
+//The writes invalidate even if they fail, as the backend may have applied them anyway
+
+func (c *CachedUserRepo) Create(ctx context.Context, u *domain.User) (*domain.User, error) {
+	defer c.invalidateUser(u)
+	return c.repo.Create(ctx, u)
+}
+
+func (c *CachedUserRepo) Update(ctx context.Context, u *domain.User) (*domain.User, error) {
+	defer c.invalidate(u.Email)
+	return c.repo.Update(ctx, u)
+}
+
+func (c *CachedUserRepo) DeleteByEmail(ctx context.Context, email string) error {
+	defer c.invalidate(email)
+	return c.repo.DeleteByEmail(ctx, email)
+}
+
+func (c *CachedUserRepo) Restore(ctx context.Context, email string, deletedAfter time.Time) (*domain.User, error) {
+	defer c.invalidate(email)
+	return c.repo.Restore(ctx, email, deletedAfter)
+}
+
+func (c *CachedUserRepo) PurgeByEmail(ctx context.Context, email string) error {
+	defer c.invalidate(email)
+	return c.repo.PurgeByEmail(ctx, email)
+}
+
+//PurgeDeleted flushes the whole cache if users may have been purged, as the purged users are not known
+func (c *CachedUserRepo) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	n, err := c.repo.PurgeDeleted(ctx, deletedBefore)
+	if n > 0 || err != nil {
+		c.publish(CacheInvalidation{Flush: true})
+	}
+	return n, err
+}
+
+func (c *CachedUserRepo) RotateUserKey(ctx context.Context, u *domain.User) (*domain.User, error) {
+	defer c.invalidateUser(u)
+	return c.repo.RotateUserKey(ctx, u)
+}
+
+func (c *CachedUserRepo) ImportUser(ctx context.Context, u *domain.User, overwrite bool) (bool, error) {
+	defer c.invalidateUser(u)
+	return c.repo.ImportUser(ctx, u, overwrite)
+}
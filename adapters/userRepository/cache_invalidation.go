@@ -0,0 +1,77 @@
+package userRepository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+//CacheInvalidation names the cached lookups dropped after a write
+type CacheInvalidation struct {
+	//Origin identifies the cache that published the invalidation, it ignores its own invalidations
+	Origin string
+	//Email of the written user, may be empty if only PublicKeys are known
+	Email string
+	//PublicKeys are the PKIX encoded public keys of the written user
+	PublicKeys [][]byte
+	//Flush drops all cached lookups, e.g. after purging users that are not known individually
+	Flush bool
+}
+
+//InvalidationBus distributes cache invalidations between the caches of several replicas
+type InvalidationBus interface {
+	//Publish delivers inv to all subscribers. Implementations spanning several processes may deliver
+	//to remote subscribers asynchronously
+	Publish(ctx context.Context, inv CacheInvalidation) error
+	//Subscribe calls fn for each published invalidation until the returned func is called. fn must
+	//not block
+	Subscribe(fn func(inv CacheInvalidation)) (unsubscribe func())
+}
+
+//LocalInvalidationBus is an InvalidationBus delivering synchronously to the subscribers of this process
+type LocalInvalidationBus struct {
+	mu   sync.Mutex
+	next int
+	subs map[int]func(inv CacheInvalidation)
+}
+
+func NewLocalInvalidationBus() *LocalInvalidationBus {
+	return &LocalInvalidationBus{subs: make(map[int]func(inv CacheInvalidation))}
+}
+
+func (b *LocalInvalidationBus) Publish(_ context.Context, inv CacheInvalidation) error {
+	b.mu.Lock()
+	subs := make([]func(inv CacheInvalidation), 0, len(b.subs))
+	for _, fn := range b.subs {
+		subs = append(subs, fn)
+	}
+	b.mu.Unlock()
+	for _, fn := range subs {
+		fn(inv)
+	}
+	return nil
+}
+
+func (b *LocalInvalidationBus) Subscribe(fn func(inv CacheInvalidation)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+//newRandomID returns a random hex encoded identifier
+func newRandomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to read randomness : %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -4,6 +4,7 @@ import (
 	"UserService/domain"
 	"crypto/x509"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -12,11 +13,18 @@ func userToDTODB(u *domain.User) (*UserDTODB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert .PublicKey field : %v", err)
 	}
+	normalizedEmail, err := domain.NormalizeEmail(u.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize .Email field : %v", err)
+	}
 	return &UserDTODB{
 		CreatedAt:         u.CreatedAt,
 		UpdatedAt:         u.UpdatedAt,
+		NormalizedEmail:   normalizedEmail,
 		Email:             u.Email,
 		Name:              u.Name,
+		State:             string(u.State),
+		DeletedAt:         u.DeletedAt,
 		PublicKeyPKIX:     pkPKIX,
 		WrappedPrivateKey: u.WrappedPrivateKey,
 		WrappedMasterKey:  u.WrappedMasterKey,
@@ -26,11 +34,17 @@ func userToDTODB(u *domain.User) (*UserDTODB, error) {
 type UserDTODB struct {
 	CreatedAt         time.Time
 	UpdatedAt         time.Time
-	Email             string `gorm:"primaryKey"`
+	NormalizedEmail   string `gorm:"primaryKey"` //lookup key, see domain.NormalizeEmail
+	Email             string `gorm:"not null"`   //display form as entered by the user
 	Name              string `gorm:"not null"`
-	PublicKeyPKIX     []byte `gorm:"not null"`
+	State             string `gorm:"not null;default:active"` //users created before verification existed are active
+	PublicKeyPKIX     []byte `gorm:"not null;uniqueIndex"`
 	WrappedPrivateKey []byte `gorm:"not null"`
 	WrappedMasterKey  []byte `gorm:"not null"`
+	//DeletedAt is set for soft deleted users
+	DeletedAt *time.Time `gorm:"index" dynamodbav:",omitempty"`
+	//PurgeAtUnix is used as dynamo TTL attribute for deleted users
+	PurgeAtUnix int64 `gorm:"-" dynamodbav:",omitempty"`
 }
 
 func (u *UserDTODB) toUser() (*domain.User, error) {
@@ -38,14 +52,645 @@ func (u *UserDTODB) toUser() (*domain.User, error) {
 	if err != nil {
 		return nil, fmt.Errorf(".PublicKey is no valid x509.PKIX pubkey")
 	}
+	state := domain.UserState(u.State)
+	if state == "" {
+		//dynamo entries created before verification existed do not have the attribute
+		state = domain.UserStateActive
+	}
 	return &domain.User{
 		Email:             u.Email,
 		CreatedAt:         u.CreatedAt,
 		UpdatedAt:         u.UpdatedAt,
 		Name:              u.Name,
+		State:             state,
+		DeletedAt:         u.DeletedAt,
 		PublicKey:         genericPubKey,
 		WrappedPrivateKey: u.WrappedPrivateKey,
 		WrappedMasterKey:  u.WrappedMasterKey,
 	}, err
 
 }
+
+type VerificationTokenDTODB struct {
+	TokenHash []byte `gorm:"primaryKey"`
+	Email     string `gorm:"not null;index"`
+	Purpose   string `gorm:"not null"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null;index"`
+	//ExpiresAtUnix is used as dynamo TTL attribute
+	ExpiresAtUnix int64 `gorm:"-"`
+}
+
+func tokenToDTODB(t *domain.VerificationToken) *VerificationTokenDTODB {
+	return &VerificationTokenDTODB{
+		TokenHash:     t.TokenHash,
+		Email:         t.Email,
+		Purpose:       string(t.Purpose),
+		CreatedAt:     t.CreatedAt,
+		ExpiresAt:     t.ExpiresAt,
+		ExpiresAtUnix: t.ExpiresAt.Unix(),
+	}
+}
+
+func (t *VerificationTokenDTODB) toToken() *domain.VerificationToken {
+	return &domain.VerificationToken{
+		TokenHash: t.TokenHash,
+		Email:     t.Email,
+		Purpose:   domain.VerificationPurpose(t.Purpose),
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+	}
+}
+
+type DeviceDTODB struct {
+	ID               string `gorm:"primaryKey"`
+	OwnerEmail       string `gorm:"not null;index"`
+	Name             string `gorm:"not null"`
+	PublicKeyPKIX    []byte `gorm:"not null;uniqueIndex"`
+	WrappedMasterKey []byte
+	CreatedAt        time.Time
+	LastSeenAt       time.Time
+	RevokedAt        *time.Time `dynamodbav:",omitempty"`
+}
+
+func deviceToDTODB(d *domain.Device) (*DeviceDTODB, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(d.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .PublicKey field : %v", err)
+	}
+	return &DeviceDTODB{
+		ID:               d.ID,
+		OwnerEmail:       d.OwnerEmail,
+		Name:             d.Name,
+		PublicKeyPKIX:    pkPKIX,
+		WrappedMasterKey: d.WrappedMasterKey,
+		CreatedAt:        d.CreatedAt,
+		LastSeenAt:       d.LastSeenAt,
+		RevokedAt:        d.RevokedAt,
+	}, nil
+}
+
+func (d *DeviceDTODB) toDevice() (*domain.Device, error) {
+	genericPubKey, err := x509.ParsePKIXPublicKey(d.PublicKeyPKIX)
+	if err != nil {
+		return nil, fmt.Errorf(".PublicKey is no valid x509.PKIX pubkey")
+	}
+	return &domain.Device{
+		ID:               d.ID,
+		OwnerEmail:       d.OwnerEmail,
+		Name:             d.Name,
+		PublicKey:        genericPubKey,
+		WrappedMasterKey: d.WrappedMasterKey,
+		CreatedAt:        d.CreatedAt,
+		LastSeenAt:       d.LastSeenAt,
+		RevokedAt:        d.RevokedAt,
+	}, nil
+}
+
+type EnrollmentDTODB struct {
+	ID            string `gorm:"primaryKey"`
+	OwnerEmail    string `gorm:"not null;index"`
+	DeviceName    string `gorm:"not null"`
+	PublicKeyPKIX []byte `gorm:"not null"`
+	State         string `gorm:"not null"`
+	DeviceID      string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time `gorm:"not null;index"`
+	//ExpiresAtUnix is used as dynamo TTL attribute
+	ExpiresAtUnix int64 `gorm:"-"`
+}
+
+func enrollmentToDTODB(e *domain.Enrollment) (*EnrollmentDTODB, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(e.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .PublicKey field : %v", err)
+	}
+	return &EnrollmentDTODB{
+		ID:            e.ID,
+		OwnerEmail:    e.OwnerEmail,
+		DeviceName:    e.DeviceName,
+		PublicKeyPKIX: pkPKIX,
+		State:         string(e.State),
+		DeviceID:      e.DeviceID,
+		CreatedAt:     e.CreatedAt,
+		ExpiresAt:     e.ExpiresAt,
+		ExpiresAtUnix: e.ExpiresAt.Unix(),
+	}, nil
+}
+
+func (e *EnrollmentDTODB) toEnrollment() (*domain.Enrollment, error) {
+	genericPubKey, err := x509.ParsePKIXPublicKey(e.PublicKeyPKIX)
+	if err != nil {
+		return nil, fmt.Errorf(".PublicKey is no valid x509.PKIX pubkey")
+	}
+	return &domain.Enrollment{
+		ID:         e.ID,
+		OwnerEmail: e.OwnerEmail,
+		DeviceName: e.DeviceName,
+		PublicKey:  genericPubKey,
+		State:      domain.EnrollmentState(e.State),
+		DeviceID:   e.DeviceID,
+		CreatedAt:  e.CreatedAt,
+		ExpiresAt:  e.ExpiresAt,
+	}, nil
+}
+
+type RecoveryWrappingDTODB struct {
+	ID                  string `gorm:"primaryKey"`
+	OwnerEmail          string `gorm:"not null;index"`
+	Kind                string `gorm:"not null"`
+	Label               string
+	EscrowPublicKeyPKIX []byte `dynamodbav:",omitempty"`
+	WrappedMasterKey    []byte `gorm:"not null"`
+	CreatedAt           time.Time
+}
+
+func recoveryWrappingToDTODB(w *domain.RecoveryWrapping) (*RecoveryWrappingDTODB, error) {
+	dbWrapping := &RecoveryWrappingDTODB{
+		ID:               w.ID,
+		OwnerEmail:       w.OwnerEmail,
+		Kind:             string(w.Kind),
+		Label:            w.Label,
+		WrappedMasterKey: w.WrappedMasterKey,
+		CreatedAt:        w.CreatedAt,
+	}
+	if w.EscrowPublicKey != nil {
+		pkPKIX, err := x509.MarshalPKIXPublicKey(w.EscrowPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert .EscrowPublicKey field : %v", err)
+		}
+		dbWrapping.EscrowPublicKeyPKIX = pkPKIX
+	}
+	return dbWrapping, nil
+}
+
+func (w *RecoveryWrappingDTODB) toRecoveryWrapping() (*domain.RecoveryWrapping, error) {
+	wrapping := &domain.RecoveryWrapping{
+		ID:               w.ID,
+		OwnerEmail:       w.OwnerEmail,
+		Kind:             domain.RecoveryKind(w.Kind),
+		Label:            w.Label,
+		WrappedMasterKey: w.WrappedMasterKey,
+		CreatedAt:        w.CreatedAt,
+	}
+	if len(w.EscrowPublicKeyPKIX) > 0 {
+		genericPubKey, err := x509.ParsePKIXPublicKey(w.EscrowPublicKeyPKIX)
+		if err != nil {
+			return nil, fmt.Errorf(".EscrowPublicKey is no valid x509.PKIX pubkey")
+		}
+		wrapping.EscrowPublicKey = genericPubKey
+	}
+	return wrapping, nil
+}
+
+type RecoveryAuditDTODB struct {
+	ID          string `gorm:"primaryKey"`
+	OwnerEmail  string `gorm:"not null;index"`
+	WrappingID  string `gorm:"not null"`
+	Kind        string `gorm:"not null"`
+	RecoveredAt time.Time
+}
+
+func recoveryAuditToDTODB(a *domain.RecoveryAudit) *RecoveryAuditDTODB {
+	return &RecoveryAuditDTODB{
+		ID:          a.ID,
+		OwnerEmail:  a.OwnerEmail,
+		WrappingID:  a.WrappingID,
+		Kind:        string(a.Kind),
+		RecoveredAt: a.RecoveredAt,
+	}
+}
+
+func (a *RecoveryAuditDTODB) toRecoveryAudit() *domain.RecoveryAudit {
+	return &domain.RecoveryAudit{
+		ID:          a.ID,
+		OwnerEmail:  a.OwnerEmail,
+		WrappingID:  a.WrappingID,
+		Kind:        domain.RecoveryKind(a.Kind),
+		RecoveredAt: a.RecoveredAt,
+	}
+}
+
+type OrganizationDTODB struct {
+	ID                  string `gorm:"primaryKey"`
+	Name                string `gorm:"not null"`
+	EmailDomain         string `gorm:"not null;uniqueIndex"`
+	EscrowPublicKeyPKIX []byte `gorm:"not null"`
+	CreatedAt           time.Time
+}
+
+func organizationToDTODB(o *domain.Organization) (*OrganizationDTODB, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(o.EscrowPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .EscrowPublicKey field : %v", err)
+	}
+	return &OrganizationDTODB{
+		ID:                  o.ID,
+		Name:                o.Name,
+		EmailDomain:         o.EmailDomain,
+		EscrowPublicKeyPKIX: pkPKIX,
+		CreatedAt:           o.CreatedAt,
+	}, nil
+}
+
+func (o *OrganizationDTODB) toOrganization() (*domain.Organization, error) {
+	genericPubKey, err := x509.ParsePKIXPublicKey(o.EscrowPublicKeyPKIX)
+	if err != nil {
+		return nil, fmt.Errorf(".EscrowPublicKey is no valid x509.PKIX pubkey")
+	}
+	return &domain.Organization{
+		ID:              o.ID,
+		Name:            o.Name,
+		EmailDomain:     o.EmailDomain,
+		EscrowPublicKey: genericPubKey,
+		CreatedAt:       o.CreatedAt,
+	}, nil
+}
+
+type EscrowWrappingDTODB struct {
+	OwnerEmail          string `gorm:"primaryKey"`
+	OrganizationID      string `gorm:"not null;index"`
+	EscrowPublicKeyPKIX []byte `gorm:"not null"`
+	WrappedMasterKey    []byte `gorm:"not null"`
+	UpdatedAt           time.Time
+}
+
+func escrowWrappingToDTODB(w *domain.EscrowWrapping) (*EscrowWrappingDTODB, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(w.EscrowPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .EscrowPublicKey field : %v", err)
+	}
+	return &EscrowWrappingDTODB{
+		OwnerEmail:          w.OwnerEmail,
+		OrganizationID:      w.OrganizationID,
+		EscrowPublicKeyPKIX: pkPKIX,
+		WrappedMasterKey:    w.WrappedMasterKey,
+		UpdatedAt:           w.UpdatedAt,
+	}, nil
+}
+
+func (w *EscrowWrappingDTODB) toEscrowWrapping() (*domain.EscrowWrapping, error) {
+	genericPubKey, err := x509.ParsePKIXPublicKey(w.EscrowPublicKeyPKIX)
+	if err != nil {
+		return nil, fmt.Errorf(".EscrowPublicKey is no valid x509.PKIX pubkey")
+	}
+	return &domain.EscrowWrapping{
+		OwnerEmail:       w.OwnerEmail,
+		OrganizationID:   w.OrganizationID,
+		EscrowPublicKey:  genericPubKey,
+		WrappedMasterKey: w.WrappedMasterKey,
+		UpdatedAt:        w.UpdatedAt,
+	}, nil
+}
+
+type GroupDTODB struct {
+	ID             string `gorm:"primaryKey"`
+	Name           string `gorm:"not null"`
+	OrganizationID string `gorm:"index"`
+	OwnerEmail     string `gorm:"not null"`
+	KeyEpoch       int64  `gorm:"not null;default:1"`
+	CreatedAt      time.Time
+}
+
+func groupToDTODB(g *domain.Group) *GroupDTODB {
+	return &GroupDTODB{
+		ID:             g.ID,
+		Name:           g.Name,
+		OrganizationID: g.OrganizationID,
+		OwnerEmail:     g.OwnerEmail,
+		KeyEpoch:       g.KeyEpoch,
+		CreatedAt:      g.CreatedAt,
+	}
+}
+
+func (g *GroupDTODB) toGroup() *domain.Group {
+	return &domain.Group{
+		ID:             g.ID,
+		Name:           g.Name,
+		OrganizationID: g.OrganizationID,
+		OwnerEmail:     g.OwnerEmail,
+		KeyEpoch:       g.KeyEpoch,
+		CreatedAt:      g.CreatedAt,
+	}
+}
+
+type GroupMemberDTODB struct {
+	GroupID     string `gorm:"primaryKey"`
+	MemberEmail string `gorm:"primaryKey;index"`
+	AddedAt     time.Time
+}
+
+func groupMemberToDTODB(m *domain.GroupMember) *GroupMemberDTODB {
+	return &GroupMemberDTODB{
+		GroupID:     m.GroupID,
+		MemberEmail: m.MemberEmail,
+		AddedAt:     m.AddedAt,
+	}
+}
+
+func (m *GroupMemberDTODB) toGroupMember() *domain.GroupMember {
+	return &domain.GroupMember{
+		GroupID:     m.GroupID,
+		MemberEmail: m.MemberEmail,
+		AddedAt:     m.AddedAt,
+	}
+}
+
+type GroupKeyWrappingDTODB struct {
+	GroupID              string `gorm:"primaryKey"`
+	Epoch                int64  `gorm:"primaryKey;autoIncrement:false"`
+	MemberEmail          string `gorm:"primaryKey;index"`
+	MemberKeyFingerprint string
+	WrappedGroupKey      []byte `gorm:"not null"`
+	UploaderEmail        string `gorm:"not null"`
+	UploadedAt           time.Time
+	//GroupEpoch is the dynamo hash key combining GroupID and Epoch
+	GroupEpoch string `gorm:"-"`
+}
+
+func groupEpochKey(groupID string, epoch int64) string {
+	return fmt.Sprintf("%v#%v", groupID, epoch)
+}
+
+func groupKeyWrappingToDTODB(w *domain.GroupKeyWrapping) *GroupKeyWrappingDTODB {
+	return &GroupKeyWrappingDTODB{
+		GroupID:              w.GroupID,
+		Epoch:                w.Epoch,
+		MemberEmail:          w.MemberEmail,
+		MemberKeyFingerprint: w.MemberKeyFingerprint,
+		WrappedGroupKey:      w.WrappedGroupKey,
+		UploaderEmail:        w.UploaderEmail,
+		UploadedAt:           w.UploadedAt,
+		GroupEpoch:           groupEpochKey(w.GroupID, w.Epoch),
+	}
+}
+
+func (w *GroupKeyWrappingDTODB) toGroupKeyWrapping() *domain.GroupKeyWrapping {
+	return &domain.GroupKeyWrapping{
+		GroupID:              w.GroupID,
+		Epoch:                w.Epoch,
+		MemberEmail:          w.MemberEmail,
+		MemberKeyFingerprint: w.MemberKeyFingerprint,
+		WrappedGroupKey:      w.WrappedGroupKey,
+		UploaderEmail:        w.UploaderEmail,
+		UploadedAt:           w.UploadedAt,
+	}
+}
+
+type KeyLogEntryDTODB struct {
+	LogIndex      int64  `gorm:"primaryKey;autoIncrement:false"`
+	Kind          string `gorm:"not null"`
+	Email         string `gorm:"not null"`
+	PublicKeyPKIX []byte `gorm:"not null"`
+	CreatedAt     time.Time
+	//LogID is the dynamo hash key shared by all entries, see keyLogID
+	LogID string `gorm:"-"`
+}
+
+func keyLogEntryToDTODB(e *domain.KeyLogEntry) *KeyLogEntryDTODB {
+	return &KeyLogEntryDTODB{
+		LogIndex:      e.Index,
+		Kind:          string(e.Kind),
+		Email:         e.Email,
+		PublicKeyPKIX: e.PublicKeyPKIX,
+		CreatedAt:     e.CreatedAt,
+		LogID:         keyLogID,
+	}
+}
+
+func (e *KeyLogEntryDTODB) toKeyLogEntry() *domain.KeyLogEntry {
+	return &domain.KeyLogEntry{
+		Index:         e.LogIndex,
+		Kind:          domain.KeyLogKind(e.Kind),
+		Email:         e.Email,
+		PublicKeyPKIX: e.PublicKeyPKIX,
+		CreatedAt:     e.CreatedAt,
+	}
+}
+
+type AuditEntryDTODB struct {
+	ID          string    `gorm:"primaryKey"`
+	Time        time.Time `gorm:"not null;index"`
+	Operation   string    `gorm:"not null"`
+	ActorEmail  string    `gorm:"index"`
+	ActorKey    string
+	TargetEmail string `gorm:"index"`
+	PeerAddress string
+	KeyBefore   string
+	KeyAfter    string
+	Result      string `gorm:"not null"`
+	//Partition and EntryKey are the dynamo keys, see auditPartitions
+	Partition string `gorm:"-"`
+	EntryKey  string `gorm:"-"`
+}
+
+func auditEntryToDTODB(a *domain.AuditEntry) *AuditEntryDTODB {
+	return &AuditEntryDTODB{
+		ID:          a.ID,
+		Time:        a.Time,
+		Operation:   a.Operation,
+		ActorEmail:  a.ActorEmail,
+		ActorKey:    a.ActorKey,
+		TargetEmail: a.TargetEmail,
+		PeerAddress: a.PeerAddress,
+		KeyBefore:   a.KeyBefore,
+		KeyAfter:    a.KeyAfter,
+		Result:      a.Result,
+	}
+}
+
+func (a *AuditEntryDTODB) toAuditEntry() *domain.AuditEntry {
+	return &domain.AuditEntry{
+		ID:          a.ID,
+		Time:        a.Time,
+		Operation:   a.Operation,
+		ActorEmail:  a.ActorEmail,
+		ActorKey:    a.ActorKey,
+		TargetEmail: a.TargetEmail,
+		PeerAddress: a.PeerAddress,
+		KeyBefore:   a.KeyBefore,
+		KeyAfter:    a.KeyAfter,
+		Result:      a.Result,
+	}
+}
+
+type UserEventDTODB struct {
+	Sequence      int64  `gorm:"primaryKey;autoIncrement" dynamodbav:"EventSeq"`
+	Kind          string `gorm:"not null"`
+	Email         string `gorm:"not null"`
+	PublicKeyPKIX []byte
+	State         string
+	CreatedAt     time.Time `gorm:"index"`
+	//StreamName is the dynamo hash key shared by all events, see userEventStream
+	StreamName string `gorm:"-"`
+	//ExpiresAtUnix is used as dynamo TTL attribute
+	ExpiresAtUnix int64 `gorm:"-" dynamodbav:",omitempty"`
+}
+
+func userEventToDTODB(e *domain.UserEvent) *UserEventDTODB {
+	return &UserEventDTODB{
+		Sequence:      e.Sequence,
+		Kind:          string(e.Kind),
+		Email:         e.Email,
+		PublicKeyPKIX: e.PublicKeyPKIX,
+		State:         string(e.State),
+		CreatedAt:     e.CreatedAt,
+	}
+}
+
+func (e *UserEventDTODB) toUserEvent() *domain.UserEvent {
+	return &domain.UserEvent{
+		Sequence:      e.Sequence,
+		Kind:          domain.UserEventKind(e.Kind),
+		Email:         e.Email,
+		PublicKeyPKIX: e.PublicKeyPKIX,
+		State:         domain.UserState(e.State),
+		CreatedAt:     e.CreatedAt,
+	}
+}
+
+//userEventOf returns the event of kind for the stored user
+func userEventOf(kind domain.UserEventKind, u *UserDTODB) *domain.UserEvent {
+	return &domain.UserEvent{
+		Kind:          kind,
+		Email:         u.NormalizedEmail,
+		PublicKeyPKIX: u.PublicKeyPKIX,
+		State:         domain.UserState(u.State),
+		CreatedAt:     time.Now(),
+	}
+}
+
+//deviceEventOf returns the event of kind for the stored device
+func deviceEventOf(kind domain.UserEventKind, d *DeviceDTODB) *domain.UserEvent {
+	return &domain.UserEvent{
+		Kind:          kind,
+		Email:         d.OwnerEmail,
+		PublicKeyPKIX: d.PublicKeyPKIX,
+		CreatedAt:     time.Now(),
+	}
+}
+
+type WebhookDTODB struct {
+	ID     string `gorm:"primaryKey"`
+	URL    string `gorm:"not null"`
+	Secret []byte `gorm:"not null"`
+	//EventKinds is the comma separated list of subscribed kinds, empty for all kinds
+	EventKinds string
+	CreatedAt  time.Time
+}
+
+func webhookToDTODB(w *domain.Webhook) *WebhookDTODB {
+	kinds := make([]string, 0, len(w.EventKinds))
+	for _, v := range w.EventKinds {
+		kinds = append(kinds, string(v))
+	}
+	return &WebhookDTODB{
+		ID:         w.ID,
+		URL:        w.URL,
+		Secret:     w.Secret,
+		EventKinds: strings.Join(kinds, ","),
+		CreatedAt:  w.CreatedAt,
+	}
+}
+
+func (w *WebhookDTODB) toWebhook() *domain.Webhook {
+	webhook := &domain.Webhook{
+		ID:        w.ID,
+		URL:       w.URL,
+		Secret:    w.Secret,
+		CreatedAt: w.CreatedAt,
+	}
+	if w.EventKinds != "" {
+		for _, v := range strings.Split(w.EventKinds, ",") {
+			webhook.EventKinds = append(webhook.EventKinds, domain.UserEventKind(v))
+		}
+	}
+	return webhook
+}
+
+type WebhookDeliveryDTODB struct {
+	WebhookID     string `gorm:"primaryKey"`
+	EventSequence int64  `gorm:"primaryKey;autoIncrement:false" dynamodbav:"EventSeq"`
+	EventKind     string `gorm:"not null"`
+	Payload       []byte
+	State         string `gorm:"not null;index:idx_webhook_delivery_due"`
+	Attempts      int
+	//NextAttemptAtUnix is stored as number, so that dynamo filters can compare it
+	NextAttemptAtUnix int64 `gorm:"index:idx_webhook_delivery_due"`
+	LastError         string
+	CreatedAt         time.Time
+}
+
+func webhookDeliveryToDTODB(d *domain.WebhookDelivery) *WebhookDeliveryDTODB {
+	return &WebhookDeliveryDTODB{
+		WebhookID:         d.WebhookID,
+		EventSequence:     d.EventSequence,
+		EventKind:         string(d.EventKind),
+		Payload:           d.Payload,
+		State:             string(d.State),
+		Attempts:          d.Attempts,
+		NextAttemptAtUnix: d.NextAttemptAt.Unix(),
+		LastError:         d.LastError,
+		CreatedAt:         d.CreatedAt,
+	}
+}
+
+func (d *WebhookDeliveryDTODB) toWebhookDelivery() *domain.WebhookDelivery {
+	return &domain.WebhookDelivery{
+		WebhookID:     d.WebhookID,
+		EventSequence: d.EventSequence,
+		EventKind:     domain.UserEventKind(d.EventKind),
+		Payload:       d.Payload,
+		State:         domain.WebhookDeliveryState(d.State),
+		Attempts:      d.Attempts,
+		NextAttemptAt: time.Unix(d.NextAttemptAtUnix, 0),
+		LastError:     d.LastError,
+		CreatedAt:     d.CreatedAt,
+	}
+}
+
+//CursorDTODB holds the sequence of the last user event processed by a consumer of the outbox, like the
+//webhook deliveries or the key log
+type CursorDTODB struct {
+	CursorName string `gorm:"primaryKey"`
+	LastSeq    int64
+}
+
+//UserResidencyDTODB maps the normalized email of a user to the region storing it
+type UserResidencyDTODB struct {
+	Email     string `gorm:"primaryKey"`
+	Region    string `gorm:"not null"`
+	MovingTo  string `dynamodbav:",omitempty"`
+	UpdatedAt time.Time
+}
+
+func residencyToDTODB(r *domain.UserResidency) *UserResidencyDTODB {
+	return &UserResidencyDTODB{
+		Email:     r.Email,
+		Region:    r.Region,
+		MovingTo:  r.MovingTo,
+		UpdatedAt: r.UpdatedAt,
+	}
+}
+
+func (r *UserResidencyDTODB) toResidency() *domain.UserResidency {
+	return &domain.UserResidency{
+		Email:     r.Email,
+		Region:    r.Region,
+		MovingTo:  r.MovingTo,
+		UpdatedAt: r.UpdatedAt,
+	}
+}
+
+//UserFenceDTODB marks a user whose writes are fenced while it is moved to another backend, see
+//UserMoveRepo
+type UserFenceDTODB struct {
+	Email     string `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+//UserKeyDTODB maps the public key of a user to its normalized email, in the shard of the key
+type UserKeyDTODB struct {
+	PublicKeyPKIX []byte `gorm:"primaryKey"`
+	Email         string `gorm:"not null;index"`
+}
@@ -0,0 +1,304 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"sort"
+	"time"
+)
+
+//EmailCollision lists all stored emails that map to the same normalized email
+type EmailCollision struct {
+	NormalizedEmail string
+	Emails          []string
+}
+
+//EmailMigrationReport summarizes a run of MigrateEmailKeys
+type EmailMigrationReport struct {
+	Scanned int
+	//NeedsRewrite is the number of users whose key is not yet the normalized email
+	NeedsRewrite int
+	Rewritten    int
+	Collisions   []EmailCollision
+	//Invalid holds stored emails that cannot be normalized at all
+	Invalid []string
+}
+
+//EmailKeyMigrator is implemented by repositories that can rewrite legacy verbatim email keys to
+//normalized email keys
+type EmailKeyMigrator interface {
+	//MigrateEmailKeys scans all users and reports collisions. Keys are only rewritten if apply is set
+	//and no collisions or invalid emails have been found
+	MigrateEmailKeys(ctx context.Context, apply bool) (*EmailMigrationReport, error)
+}
+
+//emailGrouper collects the stored emails per normalized email
+type emailGrouper struct {
+	report *EmailMigrationReport
+	groups map[string][]string
+}
+
+func newEmailGrouper() *emailGrouper {
+	return &emailGrouper{
+		report: &EmailMigrationReport{},
+		groups: make(map[string][]string),
+	}
+}
+
+//add records email and returns its normalized form. ok is false if email can not be normalized
+func (g *emailGrouper) add(email string) (normalized string, ok bool) {
+	g.report.Scanned++
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		g.report.Invalid = append(g.report.Invalid, email)
+		return "", false
+	}
+	g.groups[normalized] = append(g.groups[normalized], email)
+	return normalized, true
+}
+
+//finish fills in the collisions and reports whether it is safe to rewrite keys
+func (g *emailGrouper) finish() bool {
+	for normalized, emails := range g.groups {
+		if len(emails) > 1 {
+			g.report.Collisions = append(g.report.Collisions, EmailCollision{
+				NormalizedEmail: normalized,
+				Emails:          emails,
+			})
+		}
+	}
+	sort.Slice(g.report.Collisions, func(i, j int) bool {
+		return g.report.Collisions[i].NormalizedEmail < g.report.Collisions[j].NormalizedEmail
+	})
+	return len(g.report.Collisions) == 0 && len(g.report.Invalid) == 0
+}
+
+//legacyUserDTODB can be read from both the legacy table layout with the verbatim email as primary key
+//and the current layout
+type legacyUserDTODB struct {
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	NormalizedEmail   string
+	Email             string
+	Name              string
+	State             string
+	PublicKeyPKIX     []byte
+	WrappedPrivateKey []byte
+	WrappedMasterKey  []byte
+	DeletedAt         *time.Time
+}
+
+func (d DefaultRepo) MigrateEmailKeys(ctx context.Context, apply bool) (*EmailMigrationReport, error) {
+	db := d.DB.WithContext(ctx)
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&UserDTODB{}); err != nil {
+		return nil, fmt.Errorf("failed to parse UserDTODB schema : %v", err)
+	}
+	table := stmt.Schema.Table
+
+	var rows []legacyUserDTODB
+	if err := db.Table(table).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read users : %v", err)
+	}
+
+	g := newEmailGrouper()
+	converted := make([]*UserDTODB, 0, len(rows))
+	for _, v := range rows {
+		normalized, ok := g.add(v.Email)
+		if !ok {
+			continue
+		}
+		if v.NormalizedEmail != normalized {
+			g.report.NeedsRewrite++
+		}
+		if v.State == "" {
+			v.State = string(domain.UserStateActive)
+		}
+		converted = append(converted, &UserDTODB{
+			CreatedAt:         v.CreatedAt,
+			UpdatedAt:         v.UpdatedAt,
+			NormalizedEmail:   normalized,
+			Email:             v.Email,
+			Name:              v.Name,
+			State:             v.State,
+			PublicKeyPKIX:     v.PublicKeyPKIX,
+			WrappedPrivateKey: v.WrappedPrivateKey,
+			WrappedMasterKey:  v.WrappedMasterKey,
+			DeletedAt:         v.DeletedAt,
+		})
+	}
+	if !g.finish() || !apply || g.report.NeedsRewrite == 0 {
+		return g.report, nil
+	}
+
+	//earlier runs keep their copies as well
+	legacyTable := table + "_legacy"
+	for i := 2; db.Migrator().HasTable(legacyTable); i++ {
+		legacyTable = fmt.Sprintf("%v_legacy_%v", table, i)
+	}
+	//the primary key changes, so the table is recreated. A copy of the old table is kept for manual
+	//inspection. It is copied instead of renamed, as the renamed table would keep the names of its
+	//indexes, which the new table needs
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("CREATE TABLE ? AS SELECT * FROM ?", clause.Table{Name: legacyTable}, clause.Table{Name: table}).Error; err != nil {
+			return fmt.Errorf("failed to copy %v to %v : %v", table, legacyTable, err)
+		}
+		if err := tx.Migrator().DropTable(table); err != nil {
+			return fmt.Errorf("failed to drop %v : %v", table, err)
+		}
+		if err := tx.AutoMigrate(&UserDTODB{}); err != nil {
+			return fmt.Errorf("failed to create %v : %v", table, err)
+		}
+		if len(converted) == 0 {
+			return nil
+		}
+		if err := tx.Create(converted).Error; err != nil {
+			return fmt.Errorf("failed to insert migrated users : %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return g.report, err
+	}
+	g.report.Rewritten = g.report.NeedsRewrite
+	return g.report, nil
+}
+
+func (a AwsDynamoUserRepo) MigrateEmailKeys(ctx context.Context, apply bool) (*EmailMigrationReport, error) {
+	var users []*UserDTODB
+	err := a.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String(TableUser)},
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				dbUser := &UserDTODB{}
+				if err := dynamodbattribute.UnmarshalMap(item, dbUser); err != nil {
+					log.Printf("skipping malformed user entry : %v", err)
+					continue
+				}
+				users = append(users, dbUser)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %v : %v", TableUser, err)
+	}
+
+	var emailEntries []*EmailToPkEntry
+	err = a.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String(TableEmailToPublicKey)},
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				entry := &EmailToPkEntry{}
+				if err := dynamodbattribute.UnmarshalMap(item, entry); err != nil {
+					log.Printf("skipping malformed email entry : %v", err)
+					continue
+				}
+				emailEntries = append(emailEntries, entry)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %v : %v", TableEmailToPublicKey, err)
+	}
+
+	type rewrite struct {
+		user       *UserDTODB
+		normalized string
+		//staleKeys are email table keys pointing to this user that are not normalized
+		staleKeys []string
+	}
+	g := newEmailGrouper()
+	var rewrites []rewrite
+	for _, u := range users {
+		normalized, ok := g.add(u.Email)
+		if !ok {
+			continue
+		}
+		r := rewrite{user: u, normalized: normalized}
+		hasNormalizedKey := false
+		for _, e := range emailEntries {
+			if !bytes.Equal(e.PrimaryKey, u.PublicKeyPKIX) {
+				continue
+			}
+			if e.Email == normalized {
+				hasNormalizedKey = true
+			} else {
+				r.staleKeys = append(r.staleKeys, e.Email)
+			}
+		}
+		if u.NormalizedEmail != normalized || !hasNormalizedKey || len(r.staleKeys) > 0 {
+			rewrites = append(rewrites, r)
+		}
+	}
+	g.report.NeedsRewrite = len(rewrites)
+	if !g.finish() || !apply {
+		return g.report, nil
+	}
+
+	for _, r := range rewrites {
+		if err := a.rewriteEmailKey(ctx, r.user, r.normalized, r.staleKeys); err != nil {
+			return g.report, fmt.Errorf("failed to rewrite key for %v : %v", r.user.Email, err)
+		}
+		g.report.Rewritten++
+	}
+	return g.report, nil
+}
+
+//rewriteEmailKey atomically stores the normalized email for u and replaces the stale email table entries
+func (a AwsDynamoUserRepo) rewriteEmailKey(ctx context.Context, u *UserDTODB, normalized string, staleKeys []string) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoTimeout)
+	defer cancel()
+
+	emailToPkAwsMap, err := dynamodbattribute.MarshalMap(&EmailToPkEntry{
+		Email:      normalized,
+		PrimaryKey: u.PublicKeyPKIX,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to serialize email to pk entry for dynamodb : %v", err)
+	}
+
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Update: &dynamodb.Update{
+				TableName: aws.String(TableUser),
+				Key: map[string]*dynamodb.AttributeValue{
+					TableUserPkName: {B: u.PublicKeyPKIX},
+				},
+				UpdateExpression: aws.String("SET NormalizedEmail = :n"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":n": {S: aws.String(normalized)},
+				},
+			},
+		},
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TableEmailToPublicKey),
+				Item:      emailToPkAwsMap,
+				//never steal the normalized key from another user
+				ConditionExpression: aws.String("attribute_not_exists(" + TableEmailToPublicKeyPkName + ") OR PrimaryKey = :pk"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":pk": {B: u.PublicKeyPKIX},
+				},
+			},
+		},
+	}
+	for _, v := range staleKeys {
+		items = append(items, &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(TableEmailToPublicKey),
+				Key: map[string]*dynamodb.AttributeValue{
+					TableEmailToPublicKeyPkName: {S: aws.String(v)},
+				},
+			},
+		})
+	}
+
+	_, err = a.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return err
+}
@@ -0,0 +1,1030 @@
+package userRepository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+//FakeDynamoFault decides the error injected into a call of a FakeDynamo. It is called before each call
+//with applied set to false, a non nil error rejects the call. It is called again after a successful
+//call with applied set to true, a non nil error is returned although the call was applied, like a
+//response lost to a timeout. input is the input of the call, operation its name like "GetItem"
+type FakeDynamoFault func(operation string, input interface{}, applied bool) error
+
+//FakeDynamo is an in memory DynamoClient holding the tables of AwsDynamoUserRepo, for tests without
+//DynamoDB Local. It supports the expressions used by the repo on top level attributes, i.e. comparisons,
+//BETWEEN, attribute_exists, attribute_not_exists, begins_with, AND, OR, NOT and updates with SET,
+//including additions and subtractions, and REMOVE. Results are only paginated after SetPageSize
+type FakeDynamo struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+	fault  FakeDynamoFault
+	//maxBatchGetKeys bounds the keys served by one BatchGetItem call
+	maxBatchGetKeys int
+	//pageSize bounds the items of one Query or Scan page
+	pageSize int
+	//requestTokens are the client request tokens of applied transactions
+	requestTokens map[string]bool
+}
+
+type fakeTable struct {
+	hashKey  string
+	rangeKey string
+	items    map[string]map[string]*dynamodb.AttributeValue
+}
+
+//NewFakeDynamo creates a FakeDynamo with the empty tables of AwsDynamoUserRepo
+func NewFakeDynamo() *FakeDynamo {
+	f := &FakeDynamo{
+		tables:        make(map[string]*fakeTable),
+		requestTokens: make(map[string]bool),
+	}
+	for _, v := range createRequests {
+		table := &fakeTable{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+		for _, key := range v.KeySchema {
+			if aws.StringValue(key.KeyType) == dynamodb.KeyTypeHash {
+				table.hashKey = aws.StringValue(key.AttributeName)
+			} else {
+				table.rangeKey = aws.StringValue(key.AttributeName)
+			}
+		}
+		f.tables[aws.StringValue(v.TableName)] = table
+	}
+	return f
+}
+
+//SetFault injects the errors decided by fault into all further calls, nil disables fault injection
+func (f *FakeDynamo) SetFault(fault FakeDynamoFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fault = fault
+}
+
+//SetMaxBatchGetKeys bounds the keys served by one BatchGetItem call, the remaining keys are returned as
+//UnprocessedKeys. Zero serves all keys
+func (f *FakeDynamo) SetMaxBatchGetKeys(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxBatchGetKeys = n
+}
+
+//SetPageSize bounds the items of one Query or Scan page. Further items are returned by the next page,
+//requested with the LastEvaluatedKey of the previous one as ExclusiveStartKey. Zero returns all items in
+//one page
+func (f *FakeDynamo) SetPageSize(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pageSize = n
+}
+
+//paginate returns the items following the item with the key start and, if the page size cuts them off,
+//the key of the last returned item. after reports whether an item is ordered after start
+func (f *FakeDynamo) paginate(table *fakeTable, items []map[string]*dynamodb.AttributeValue, start map[string]*dynamodb.AttributeValue, after func(item map[string]*dynamodb.AttributeValue) bool) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue) {
+	if start != nil {
+		i := 0
+		for i < len(items) && !after(items[i]) {
+			i++
+		}
+		items = items[i:]
+	}
+	if f.pageSize <= 0 || len(items) <= f.pageSize {
+		return items, nil
+	}
+	items = items[:f.pageSize]
+	return items, table.keyOf(items[len(items)-1])
+}
+
+//call runs apply under the lock of f, after checking ctx and the injected faults
+func (f *FakeDynamo) call(ctx context.Context, operation string, input interface{}, apply func() error) error {
+	if err := ctx.Err(); err != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fault != nil {
+		if err := f.fault(operation, input, false); err != nil {
+			return err
+		}
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	if f.fault != nil {
+		return f.fault(operation, input, true)
+	}
+	return nil
+}
+
+func fakeValidationError(format string, a ...interface{}) error {
+	return awserr.New("ValidationException", fmt.Sprintf(format, a...), nil)
+}
+
+func (f *FakeDynamo) table(name *string) (*fakeTable, error) {
+	table, ok := f.tables[aws.StringValue(name)]
+	if !ok {
+		return nil, &dynamodb.ResourceNotFoundException{Message_: aws.String("table not found : " + aws.StringValue(name))}
+	}
+	return table, nil
+}
+
+//encodeAttribute returns a string uniquely identifying a key attribute value
+func encodeAttribute(v *dynamodb.AttributeValue) string {
+	switch {
+	case v == nil:
+		return ""
+	case v.S != nil:
+		return "S" + *v.S
+	case v.N != nil:
+		if r, ok := new(big.Rat).SetString(*v.N); ok {
+			return "N" + r.String()
+		}
+		return "N" + *v.N
+	case v.B != nil:
+		return "B" + string(v.B)
+	}
+	return ""
+}
+
+//itemKey returns the identifier of the item with the key attributes in key
+func (t *fakeTable) itemKey(key map[string]*dynamodb.AttributeValue) (string, error) {
+	hash := encodeAttribute(key[t.hashKey])
+	if hash == "" {
+		return "", fakeValidationError("missing hash key %v", t.hashKey)
+	}
+	if t.rangeKey == "" {
+		return hash, nil
+	}
+	rangeValue := encodeAttribute(key[t.rangeKey])
+	if rangeValue == "" {
+		return "", fakeValidationError("missing range key %v", t.rangeKey)
+	}
+	return hash + "\x00" + rangeValue, nil
+}
+
+func (t *fakeTable) keyOf(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := map[string]*dynamodb.AttributeValue{t.hashKey: item[t.hashKey]}
+	if t.rangeKey != "" {
+		key[t.rangeKey] = item[t.rangeKey]
+	}
+	return key
+}
+
+//sortedItems returns the items of t ordered by their key
+func (t *fakeTable) sortedItems() []map[string]*dynamodb.AttributeValue {
+	keys := make([]string, 0, len(t.items))
+	for k := range t.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, t.items[k])
+	}
+	return items
+}
+
+func copyAttribute(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+	cp := &dynamodb.AttributeValue{
+		S:    v.S,
+		N:    v.N,
+		BOOL: v.BOOL,
+		NULL: v.NULL,
+		SS:   v.SS,
+		NS:   v.NS,
+	}
+	if v.B != nil {
+		cp.B = append([]byte{}, v.B...)
+	}
+	for _, b := range v.BS {
+		cp.BS = append(cp.BS, append([]byte{}, b...))
+	}
+	if v.L != nil {
+		cp.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i := range v.L {
+			cp.L[i] = copyAttribute(v.L[i])
+		}
+	}
+	if v.M != nil {
+		cp.M = copyItem(v.M)
+	}
+	return cp
+}
+
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	cp := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		cp[k] = copyAttribute(v)
+	}
+	return cp
+}
+
+//compareAttributes orders scalar values of the same type. ok is false if they are not comparable
+func compareAttributes(a, b *dynamodb.AttributeValue) (cmp int, ok bool) {
+	switch {
+	case a == nil || b == nil:
+		return 0, false
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), true
+	case a.N != nil && b.N != nil:
+		x, okX := new(big.Rat).SetString(*a.N)
+		y, okY := new(big.Rat).SetString(*b.N)
+		if !okX || !okY {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case a.B != nil && b.B != nil:
+		return bytes.Compare(a.B, b.B), true
+	}
+	return 0, false
+}
+
+func equalAttributes(a, b *dynamodb.AttributeValue) bool {
+	if cmp, ok := compareAttributes(a, b); ok {
+		return cmp == 0
+	}
+	return a != nil && b != nil && reflect.DeepEqual(a, b)
+}
+
+//fakeExpression evaluates a dynamodb expression against an item
+type fakeExpression struct {
+	tokens []string
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+//tokenizeExpression splits an expression into names, placeholders, keywords and operators
+func tokenizeExpression(expression string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("(),+-=", r):
+			tokens = append(tokens, string(r))
+			i++
+		case r == '<' || r == '>':
+			if i+1 < len(runes) && (runes[i+1] == '=' || (r == '<' && runes[i+1] == '>')) {
+				tokens = append(tokens, string(runes[i:i+2]))
+				i += 2
+			} else {
+				tokens = append(tokens, string(r))
+				i++
+			}
+		case r == '#' || r == ':' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			start := i
+			i++
+			for i < len(runes) && (runes[i] == '_' || runes[i] == '.' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			return nil, fakeValidationError("unexpected %q in expression %q", r, expression)
+		}
+	}
+	return tokens, nil
+}
+
+func newFakeExpression(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*fakeExpression, error) {
+	tokens, err := tokenizeExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeExpression{tokens: tokens, names: names, values: values}, nil
+}
+
+func (e *fakeExpression) peek() string {
+	if e.pos < len(e.tokens) {
+		return e.tokens[e.pos]
+	}
+	return ""
+}
+
+func (e *fakeExpression) next() string {
+	t := e.peek()
+	e.pos++
+	return t
+}
+
+//keyword consumes the next token if it is the keyword kw, ignoring case
+func (e *fakeExpression) keyword(kw string) bool {
+	if strings.EqualFold(e.peek(), kw) {
+		e.pos++
+		return true
+	}
+	return false
+}
+
+func (e *fakeExpression) expect(token string) error {
+	if t := e.next(); t != token {
+		return fakeValidationError("want %q got %q in expression %v", token, t, strings.Join(e.tokens, " "))
+	}
+	return nil
+}
+
+//path resolves the next token to an attribute name
+func (e *fakeExpression) path() (string, error) {
+	t := e.next()
+	switch {
+	case t == "" || strings.HasPrefix(t, ":") || strings.ContainsAny(t, "(),+-=<>"):
+		return "", fakeValidationError("want attribute name got %q", t)
+	case strings.HasPrefix(t, "#"):
+		name, ok := e.names[t]
+		if !ok {
+			return "", fakeValidationError("undefined attribute name %v", t)
+		}
+		return aws.StringValue(name), nil
+	}
+	return t, nil
+}
+
+//operand resolves the next token to a placeholder value or to an attribute of item
+func (e *fakeExpression) operand(item map[string]*dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	if strings.HasPrefix(e.peek(), ":") {
+		t := e.next()
+		v, ok := e.values[t]
+		if !ok {
+			return nil, fakeValidationError("undefined attribute value %v", t)
+		}
+		return v, nil
+	}
+	name, err := e.path()
+	if err != nil {
+		return nil, err
+	}
+	return item[name], nil
+}
+
+//condition evaluates a complete condition expression
+func (e *fakeExpression) condition(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	ok, err := e.or(item)
+	if err != nil {
+		return false, err
+	}
+	if e.pos != len(e.tokens) {
+		return false, fakeValidationError("unexpected %q in condition", e.peek())
+	}
+	return ok, nil
+}
+
+func (e *fakeExpression) or(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	result, err := e.and(item)
+	if err != nil {
+		return false, err
+	}
+	for e.keyword("OR") {
+		ok, err := e.and(item)
+		if err != nil {
+			return false, err
+		}
+		result = result || ok
+	}
+	return result, nil
+}
+
+func (e *fakeExpression) and(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	result, err := e.not(item)
+	if err != nil {
+		return false, err
+	}
+	for e.keyword("AND") {
+		ok, err := e.not(item)
+		if err != nil {
+			return false, err
+		}
+		result = result && ok
+	}
+	return result, nil
+}
+
+func (e *fakeExpression) not(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if e.keyword("NOT") {
+		ok, err := e.not(item)
+		return !ok, err
+	}
+	return e.primary(item)
+}
+
+func (e *fakeExpression) primary(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if e.peek() == "(" {
+		e.next()
+		ok, err := e.or(item)
+		if err != nil {
+			return false, err
+		}
+		return ok, e.expect(")")
+	}
+	switch fn := strings.ToLower(e.peek()); fn {
+	case "attribute_exists", "attribute_not_exists", "begins_with":
+		e.next()
+		if err := e.expect("("); err != nil {
+			return false, err
+		}
+		name, err := e.path()
+		if err != nil {
+			return false, err
+		}
+		result := item[name] != nil
+		if fn == "attribute_not_exists" {
+			result = !result
+		}
+		if fn == "begins_with" {
+			if err := e.expect(","); err != nil {
+				return false, err
+			}
+			prefix, err := e.operand(item)
+			if err != nil {
+				return false, err
+			}
+			v := item[name]
+			switch {
+			case v != nil && v.S != nil && prefix.S != nil:
+				result = strings.HasPrefix(*v.S, *prefix.S)
+			case v != nil && v.B != nil && prefix.B != nil:
+				result = bytes.HasPrefix(v.B, prefix.B)
+			default:
+				result = false
+			}
+		}
+		return result, e.expect(")")
+	}
+	left, err := e.operand(item)
+	if err != nil {
+		return false, err
+	}
+	if e.keyword("BETWEEN") {
+		low, err := e.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if !e.keyword("AND") {
+			return false, fakeValidationError("want AND in BETWEEN")
+		}
+		high, err := e.operand(item)
+		if err != nil {
+			return false, err
+		}
+		lowCmp, okLow := compareAttributes(left, low)
+		highCmp, okHigh := compareAttributes(left, high)
+		return okLow && okHigh && lowCmp >= 0 && highCmp <= 0, nil
+	}
+	comparator := e.next()
+	right, err := e.operand(item)
+	if err != nil {
+		return false, err
+	}
+	switch comparator {
+	case "=":
+		return equalAttributes(left, right), nil
+	case "<>":
+		return !equalAttributes(left, right), nil
+	}
+	cmp, ok := compareAttributes(left, right)
+	if !ok {
+		return false, nil
+	}
+	switch comparator {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return false, fakeValidationError("unknown comparator %q", comparator)
+}
+
+//update applies a complete update expression to item
+func (e *fakeExpression) update(item map[string]*dynamodb.AttributeValue) error {
+	for e.pos < len(e.tokens) {
+		switch {
+		case e.keyword("SET"):
+			for {
+				name, err := e.path()
+				if err != nil {
+					return err
+				}
+				if err := e.expect("="); err != nil {
+					return err
+				}
+				v, err := e.operand(item)
+				if err != nil {
+					return err
+				}
+				if op := e.peek(); op == "+" || op == "-" {
+					e.next()
+					w, err := e.operand(item)
+					if err != nil {
+						return err
+					}
+					if v, err = addNumbers(v, w, op == "-"); err != nil {
+						return err
+					}
+				}
+				item[name] = copyAttribute(v)
+				if e.peek() != "," {
+					break
+				}
+				e.next()
+			}
+		case e.keyword("REMOVE"):
+			for {
+				name, err := e.path()
+				if err != nil {
+					return err
+				}
+				delete(item, name)
+				if e.peek() != "," {
+					break
+				}
+				e.next()
+			}
+		default:
+			return fakeValidationError("unsupported update clause %q", e.peek())
+		}
+	}
+	return nil
+}
+
+func addNumbers(a, b *dynamodb.AttributeValue, subtract bool) (*dynamodb.AttributeValue, error) {
+	if a == nil || b == nil || a.N == nil || b.N == nil {
+		return nil, fakeValidationError("operands of + and - must be numbers")
+	}
+	x, okX := new(big.Rat).SetString(*a.N)
+	y, okY := new(big.Rat).SetString(*b.N)
+	if !okX || !okY {
+		return nil, fakeValidationError("invalid numbers %v and %v", *a.N, *b.N)
+	}
+	if subtract {
+		y.Neg(y)
+	}
+	sum := new(big.Rat).Add(x, y)
+	if sum.IsInt() {
+		return &dynamodb.AttributeValue{N: aws.String(sum.Num().String())}, nil
+	}
+	return &dynamodb.AttributeValue{N: aws.String(sum.FloatString(20))}, nil
+}
+
+//checkCondition evaluates the optional condition against item, which is nil for missing items
+func checkCondition(condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if condition == nil {
+		return true, nil
+	}
+	e, err := newFakeExpression(*condition, names, values)
+	if err != nil {
+		return false, err
+	}
+	if item == nil {
+		item = map[string]*dynamodb.AttributeValue{}
+	}
+	return e.condition(item)
+}
+
+//filterItems returns the items matching the optional filter
+func filterItems(items []map[string]*dynamodb.AttributeValue, filter *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	var matches []map[string]*dynamodb.AttributeValue
+	for _, item := range items {
+		ok, err := checkCondition(filter, names, values, item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, copyItem(item))
+		}
+	}
+	return matches, nil
+}
+
+func conditionFailed() error {
+	return &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed")}
+}
+
+func (f *FakeDynamo) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	out := &dynamodb.GetItemOutput{}
+	err := f.call(ctx, "GetItem", in, func() error {
+		table, err := f.table(in.TableName)
+		if err != nil {
+			return err
+		}
+		key, err := table.itemKey(in.Key)
+		if err != nil {
+			return err
+		}
+		out.Item = copyItem(table.items[key])
+		return nil
+	})
+	return out, err
+}
+
+func (f *FakeDynamo) BatchGetItemWithContext(ctx aws.Context, in *dynamodb.BatchGetItemInput, _ ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       make(map[string][]map[string]*dynamodb.AttributeValue),
+		UnprocessedKeys: make(map[string]*dynamodb.KeysAndAttributes),
+	}
+	err := f.call(ctx, "BatchGetItem", in, func() error {
+		names := make([]string, 0, len(in.RequestItems))
+		for name := range in.RequestItems {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		served := 0
+		for _, name := range names {
+			table, err := f.table(aws.String(name))
+			if err != nil {
+				return err
+			}
+			for _, keyMap := range in.RequestItems[name].Keys {
+				if f.maxBatchGetKeys > 0 && served >= f.maxBatchGetKeys {
+					if out.UnprocessedKeys[name] == nil {
+						out.UnprocessedKeys[name] = &dynamodb.KeysAndAttributes{}
+					}
+					out.UnprocessedKeys[name].Keys = append(out.UnprocessedKeys[name].Keys, keyMap)
+					continue
+				}
+				served++
+				key, err := table.itemKey(keyMap)
+				if err != nil {
+					return err
+				}
+				if item, ok := table.items[key]; ok {
+					out.Responses[name] = append(out.Responses[name], copyItem(item))
+				}
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+//put stores item after checking the condition, it returns the replaced item
+func (f *FakeDynamo) put(tableName *string, item map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	table, err := f.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := table.itemKey(item)
+	if err != nil {
+		return nil, err
+	}
+	old := table.items[key]
+	ok, err := checkCondition(condition, names, values, old)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed()
+	}
+	table.items[key] = copyItem(item)
+	return old, nil
+}
+
+func (f *FakeDynamo) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	out := &dynamodb.PutItemOutput{}
+	err := f.call(ctx, "PutItem", in, func() error {
+		old, err := f.put(in.TableName, in.Item, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(in.ReturnValues) == dynamodb.ReturnValueAllOld {
+			out.Attributes = copyItem(old)
+		}
+		return nil
+	})
+	return out, err
+}
+
+//update applies the update expression to the item with keyMap after checking the condition. Missing
+//items are created. It returns the item before and after the update
+func (f *FakeDynamo) update(tableName *string, keyMap map[string]*dynamodb.AttributeValue, expression, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (old, updated map[string]*dynamodb.AttributeValue, err error) {
+	table, err := f.table(tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := table.itemKey(keyMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	old = table.items[key]
+	ok, err := checkCondition(condition, names, values, old)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, conditionFailed()
+	}
+	updated = copyItem(old)
+	if updated == nil {
+		updated = copyItem(table.keyOf(keyMap))
+	}
+	if expression != nil {
+		e, err := newFakeExpression(*expression, names, values)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := e.update(updated); err != nil {
+			return nil, nil, err
+		}
+	}
+	table.items[key] = updated
+	return old, updated, nil
+}
+
+func (f *FakeDynamo) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, _ ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	out := &dynamodb.UpdateItemOutput{}
+	err := f.call(ctx, "UpdateItem", in, func() error {
+		old, updated, err := f.update(in.TableName, in.Key, in.UpdateExpression, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+		if err != nil {
+			return err
+		}
+		switch aws.StringValue(in.ReturnValues) {
+		case dynamodb.ReturnValueAllOld:
+			out.Attributes = copyItem(old)
+		case dynamodb.ReturnValueAllNew:
+			out.Attributes = copyItem(updated)
+		}
+		return nil
+	})
+	return out, err
+}
+
+//remove deletes the item with keyMap after checking the condition, it returns the deleted item
+func (f *FakeDynamo) remove(tableName *string, keyMap map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	table, err := f.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := table.itemKey(keyMap)
+	if err != nil {
+		return nil, err
+	}
+	old := table.items[key]
+	ok, err := checkCondition(condition, names, values, old)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed()
+	}
+	delete(table.items, key)
+	return old, nil
+}
+
+func (f *FakeDynamo) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	out := &dynamodb.DeleteItemOutput{}
+	err := f.call(ctx, "DeleteItem", in, func() error {
+		old, err := f.remove(in.TableName, in.Key, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(in.ReturnValues) == dynamodb.ReturnValueAllOld {
+			out.Attributes = copyItem(old)
+		}
+		return nil
+	})
+	return out, err
+}
+
+//query returns the page of the items matching the key condition and the filter of in, ordered by the
+//range key, and the key of its last item if further items follow
+func (f *FakeDynamo) query(in *dynamodb.QueryInput) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+	table, err := f.table(in.TableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if in.KeyConditionExpression == nil {
+		return nil, nil, fakeValidationError("missing key condition")
+	}
+	items, err := filterItems(table.sortedItems(), in.KeyConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	if items, err = filterItems(items, in.FilterExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues); err != nil {
+		return nil, nil, err
+	}
+	forward := in.ScanIndexForward == nil || *in.ScanIndexForward
+	if table.rangeKey != "" {
+		sort.SliceStable(items, func(i, j int) bool {
+			cmp, _ := compareAttributes(items[i][table.rangeKey], items[j][table.rangeKey])
+			if !forward {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+	items, lastKey := f.paginate(table, items, in.ExclusiveStartKey, func(item map[string]*dynamodb.AttributeValue) bool {
+		if table.rangeKey == "" {
+			return false
+		}
+		cmp, _ := compareAttributes(item[table.rangeKey], in.ExclusiveStartKey[table.rangeKey])
+		if !forward {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+	if in.Limit != nil && int64(len(items)) > *in.Limit {
+		items = items[:*in.Limit]
+		if lastKey != nil && len(items) > 0 {
+			lastKey = table.keyOf(items[len(items)-1])
+		}
+	}
+	return items, lastKey, nil
+}
+
+func (f *FakeDynamo) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, _ ...request.Option) (*dynamodb.QueryOutput, error) {
+	out := &dynamodb.QueryOutput{}
+	err := f.call(ctx, "Query", in, func() error {
+		items, lastKey, err := f.query(in)
+		if err != nil {
+			return err
+		}
+		out.Items = items
+		out.Count = aws.Int64(int64(len(items)))
+		out.LastEvaluatedKey = lastKey
+		return nil
+	})
+	return out, err
+}
+
+//QueryPagesWithContext requests the pages one by one, each page is a call of its own for the faults
+func (f *FakeDynamo) QueryPagesWithContext(ctx aws.Context, in *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	next := *in
+	for {
+		out, err := f.QueryWithContext(ctx, &next, opts...)
+		if err != nil {
+			return err
+		}
+		lastPage := out.LastEvaluatedKey == nil
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		next.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+//ScanPagesWithContext requests the pages one by one, each page is a call of its own for the faults
+func (f *FakeDynamo) ScanPagesWithContext(ctx aws.Context, in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, _ ...request.Option) error {
+	next := *in
+	for {
+		out := &dynamodb.ScanOutput{}
+		err := f.call(ctx, "Scan", &next, func() error {
+			table, err := f.table(next.TableName)
+			if err != nil {
+				return err
+			}
+			items, err := filterItems(table.sortedItems(), next.FilterExpression, next.ExpressionAttributeNames, next.ExpressionAttributeValues)
+			if err != nil {
+				return err
+			}
+			var startKey string
+			if next.ExclusiveStartKey != nil {
+				if startKey, err = table.itemKey(next.ExclusiveStartKey); err != nil {
+					return err
+				}
+			}
+			out.Items, out.LastEvaluatedKey = f.paginate(table, items, next.ExclusiveStartKey, func(item map[string]*dynamodb.AttributeValue) bool {
+				key, _ := table.itemKey(item)
+				return key > startKey
+			})
+			out.Count = aws.Int64(int64(len(out.Items)))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		lastPage := out.LastEvaluatedKey == nil
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		next.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+//transactTarget returns the table, key and condition of a transaction item
+func (f *FakeDynamo) transactTarget(v *dynamodb.TransactWriteItem) (table *fakeTable, keyMap map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, err error) {
+	var tableName *string
+	switch {
+	case v.Put != nil:
+		tableName, keyMap, condition, names, values = v.Put.TableName, v.Put.Item, v.Put.ConditionExpression, v.Put.ExpressionAttributeNames, v.Put.ExpressionAttributeValues
+	case v.Update != nil:
+		tableName, keyMap, condition, names, values = v.Update.TableName, v.Update.Key, v.Update.ConditionExpression, v.Update.ExpressionAttributeNames, v.Update.ExpressionAttributeValues
+	case v.Delete != nil:
+		tableName, keyMap, condition, names, values = v.Delete.TableName, v.Delete.Key, v.Delete.ConditionExpression, v.Delete.ExpressionAttributeNames, v.Delete.ExpressionAttributeValues
+	case v.ConditionCheck != nil:
+		tableName, keyMap, condition, names, values = v.ConditionCheck.TableName, v.ConditionCheck.Key, v.ConditionCheck.ConditionExpression, v.ConditionCheck.ExpressionAttributeNames, v.ConditionCheck.ExpressionAttributeValues
+	default:
+		return nil, nil, nil, nil, nil, fakeValidationError("empty transaction item")
+	}
+	table, err = f.table(tableName)
+	return table, keyMap, condition, names, values, err
+}
+
+//TransactWriteItemsWithContext checks all conditions before applying any write. If a condition fails
+//the transaction is canceled with a reason per item. Transactions with a client request token that was
+//applied before succeed without being applied again
+func (f *FakeDynamo) TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, _ ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	err := f.call(ctx, "TransactWriteItems", in, func() error {
+		token := aws.StringValue(in.ClientRequestToken)
+		if token != "" && f.requestTokens[token] {
+			return nil
+		}
+		if len(in.TransactItems) == 0 || len(in.TransactItems) > 100 {
+			return fakeValidationError("transactions must have between 1 and 100 items")
+		}
+		reasons := make([]*dynamodb.CancellationReason, len(in.TransactItems))
+		canceled := false
+		touched := make(map[*fakeTable]map[string]bool)
+		for i, v := range in.TransactItems {
+			table, keyMap, condition, names, values, err := f.transactTarget(v)
+			if err != nil {
+				return err
+			}
+			key, err := table.itemKey(keyMap)
+			if err != nil {
+				return err
+			}
+			if touched[table][key] {
+				return fakeValidationError("transaction has multiple operations on one item")
+			}
+			if touched[table] == nil {
+				touched[table] = make(map[string]bool)
+			}
+			touched[table][key] = true
+			//detect invalid update expressions before writing anything
+			if v.Update != nil && v.Update.UpdateExpression != nil {
+				e, err := newFakeExpression(*v.Update.UpdateExpression, names, values)
+				if err != nil {
+					return err
+				}
+				item := copyItem(table.items[key])
+				if item == nil {
+					item = copyItem(table.keyOf(keyMap))
+				}
+				if err := e.update(item); err != nil {
+					return err
+				}
+			}
+			ok, err := checkCondition(condition, names, values, table.items[key])
+			if err != nil {
+				return err
+			}
+			reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+			if !ok {
+				reasons[i] = &dynamodb.CancellationReason{
+					Code:    aws.String("ConditionalCheckFailed"),
+					Message: aws.String("The conditional request failed"),
+				}
+				canceled = true
+			}
+		}
+		if canceled {
+			return &dynamodb.TransactionCanceledException{
+				Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons"),
+				CancellationReasons: reasons,
+			}
+		}
+		//all conditions hold and each item is written once, so the writes can not fail anymore
+		for _, v := range in.TransactItems {
+			var err error
+			switch {
+			case v.Put != nil:
+				_, err = f.put(v.Put.TableName, v.Put.Item, nil, nil, nil)
+			case v.Update != nil:
+				_, _, err = f.update(v.Update.TableName, v.Update.Key, v.Update.UpdateExpression, nil, v.Update.ExpressionAttributeNames, v.Update.ExpressionAttributeValues)
+			case v.Delete != nil:
+				_, err = f.remove(v.Delete.TableName, v.Delete.Key, nil, nil, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if token != "" {
+			f.requestTokens[token] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
@@ -2,9 +2,12 @@ package userRepository
 
 import (
 	"UserService/domain"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"gorm.io/gorm"
+	"time"
 )
 
 type DefaultRepo struct {
@@ -14,7 +17,10 @@ type DefaultRepo struct {
 func (d DefaultRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error) {
 	dbUser := &UserDTODB{}
 
-	if err := d.DB.WithContext(ctx).Where(" public_key = ?", PKIXPublicKey).First(dbUser).Error; err != nil {
+	if err := d.DB.WithContext(ctx).Where("public_key_pkix = ? AND deleted_at IS NULL", PKIXPublicKey).First(dbUser).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch user : %w", ErrNotFound)
+		}
 		return nil, err
 	}
 	user, err := dbUser.toUser()
@@ -25,8 +31,15 @@ func (d DefaultRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain
 }
 
 func (d DefaultRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
 	dbUser := &UserDTODB{}
-	if err := d.DB.WithContext(ctx).Where("email = ?", email).First(dbUser).Error; err != nil {
+	if err := d.DB.WithContext(ctx).Where("normalized_email = ? AND deleted_at IS NULL", normalizedEmail).First(dbUser).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch user : %w", ErrNotFound)
+		}
 		return nil, err
 	}
 	user, err := dbUser.toUser()
@@ -41,7 +54,13 @@ func (d DefaultRepo) Create(ctx context.Context, u *domain.User) (*domain.User,
 	if err != nil {
 		return nil, fmt.Errorf("failed to serialize user for DB : %v", err)
 	}
-	if err := d.DB.WithContext(ctx).Create(dbUser).Error; err != nil {
+	err = d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(dbUser).Error; err != nil {
+			return err
+		}
+		return appendUserEvents(tx, userEventOf(domain.UserEventCreated, dbUser))
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to insert user : %v", err)
 	}
 	user, err := dbUser.toUser()
@@ -51,9 +70,215 @@ func (d DefaultRepo) Create(ctx context.Context, u *domain.User) (*domain.User,
 	return user, nil
 }
 
+func (d DefaultRepo) Update(ctx context.Context, u *domain.User) (*domain.User, error) {
+	dbUser, err := userToDTODB(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user for DB : %v", err)
+	}
+	err = d.fencedWrite(ctx, dbUser.NormalizedEmail, func(tx *gorm.DB) error {
+		current := &UserDTODB{}
+		if err := tx.Where("normalized_email = ? AND deleted_at IS NULL", dbUser.NormalizedEmail).First(current).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("failed to fetch user : %w", ErrNotFound)
+			}
+			return err
+		}
+		if !bytes.Equal(current.PublicKeyPKIX, dbUser.PublicKeyPKIX) {
+			return fmt.Errorf("public key can not be changed by update")
+		}
+		dbUser.CreatedAt = current.CreatedAt
+		if err := tx.Select("*").Where("normalized_email = ?", dbUser.NormalizedEmail).Updates(dbUser).Error; err != nil {
+			return err
+		}
+		return appendUserEvents(tx, userEventOf(domain.UserEventUpdated, dbUser))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user : %w", err)
+	}
+	return dbUser.toUser()
+}
+
 func (d DefaultRepo) DeleteByEmail(ctx context.Context, email string) error {
-	if err := d.DB.WithContext(ctx).Where("email = ?", email).Delete(&UserDTODB{}).Error; err != nil {
-		return err
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return fmt.Errorf("failed to normalize email : %v", err)
+	}
+	return d.fencedWrite(ctx, normalizedEmail, func(tx *gorm.DB) error {
+		current := &UserDTODB{}
+		if err := tx.Where("normalized_email = ? AND deleted_at IS NULL", normalizedEmail).First(current).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("failed to delete user : %w", ErrNotFound)
+			}
+			return err
+		}
+		res := tx.Model(&UserDTODB{}).
+			Where("normalized_email = ? AND deleted_at IS NULL", normalizedEmail).
+			Update("deleted_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to delete user : %w", ErrNotFound)
+		}
+		return appendUserEvents(tx, userEventOf(domain.UserEventDeleted, current))
+	})
+}
+
+func (d DefaultRepo) Restore(ctx context.Context, email string, deletedAfter time.Time) (*domain.User, error) {
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	err = d.fencedWrite(ctx, normalizedEmail, func(tx *gorm.DB) error {
+		res := tx.Model(&UserDTODB{}).
+			Where("normalized_email = ? AND deleted_at > ?", normalizedEmail, deletedAfter).
+			Update("deleted_at", nil)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to restore user : %w", ErrNotFound)
+		}
+		restored := &UserDTODB{}
+		if err := tx.Where("normalized_email = ?", normalizedEmail).First(restored).Error; err != nil {
+			return err
+		}
+		return appendUserEvents(tx, userEventOf(domain.UserEventRestored, restored))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.GetByEmail(ctx, email)
+}
+
+func (d DefaultRepo) PurgeByEmail(ctx context.Context, email string) error {
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return fmt.Errorf("failed to normalize email : %v", err)
+	}
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var purged []*UserDTODB
+		if err := tx.Where("normalized_email = ?", normalizedEmail).Find(&purged).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_email = ?", normalizedEmail).Delete(&DeviceDTODB{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_email = ?", normalizedEmail).Delete(&RecoveryWrappingDTODB{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_email = ?", normalizedEmail).Delete(&EscrowWrappingDTODB{}).Error; err != nil {
+			return err
+		}
+		if err := purgeGroupMemberships(tx, []string{normalizedEmail}); err != nil {
+			return err
+		}
+		if err := tx.Where("normalized_email = ?", normalizedEmail).Delete(&UserDTODB{}).Error; err != nil {
+			return err
+		}
+		return appendPurgeEvents(tx, purged)
+	})
+}
+
+func (d DefaultRepo) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	count := 0
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var purged []*UserDTODB
+		if err := tx.Where("deleted_at < ?", deletedBefore).Find(&purged).Error; err != nil {
+			return err
+		}
+		expired := tx.Model(&UserDTODB{}).Select("normalized_email").Where("deleted_at < ?", deletedBefore)
+		if err := tx.Where("owner_email IN (?)", expired).Delete(&DeviceDTODB{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_email IN (?)", expired).Delete(&RecoveryWrappingDTODB{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_email IN (?)", expired).Delete(&EscrowWrappingDTODB{}).Error; err != nil {
+			return err
+		}
+		if err := purgeGroupMemberships(tx, expired); err != nil {
+			return err
+		}
+		if err := tx.Where("deleted_at < ?", deletedBefore).Delete(&UserDTODB{}).Error; err != nil {
+			return err
+		}
+		count = len(purged)
+		return appendPurgeEvents(tx, purged)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted users : %v", err)
+	}
+	return count, nil
+}
+
+//appendPurgeEvents announces the removal of the purged users
+func appendPurgeEvents(tx *gorm.DB, purged []*UserDTODB) error {
+	for _, v := range purged {
+		if err := appendUserEvents(tx, userEventOf(domain.UserEventPurged, v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d DefaultRepo) CreateToken(ctx context.Context, t *domain.VerificationToken) error {
+	if err := d.DB.WithContext(ctx).Create(tokenToDTODB(t)).Error; err != nil {
+		return fmt.Errorf("failed to insert token : %v", err)
 	}
 	return nil
 }
+
+func (d DefaultRepo) ConsumeToken(ctx context.Context, tokenHash []byte, email string, purpose domain.VerificationPurpose) (*domain.VerificationToken, error) {
+	dbToken := &VerificationTokenDTODB{}
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("token_hash = ? AND email = ? AND purpose = ?", tokenHash, email, string(purpose)).First(dbToken).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("failed to fetch token : %w", ErrNotFound)
+			}
+			return err
+		}
+		res := tx.Where("token_hash = ?", tokenHash).Delete(&VerificationTokenDTODB{})
+		if res.Error != nil {
+			return res.Error
+		}
+		//a concurrent consumer was faster
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to delete token : %w", ErrNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dbToken.toToken(), nil
+}
+
+func (d DefaultRepo) PurgeExpiredTokens(ctx context.Context, now time.Time) (int, error) {
+	res := d.DB.WithContext(ctx).Where("expires_at < ?", now).Delete(&VerificationTokenDTODB{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("failed to purge expired tokens : %v", res.Error)
+	}
+	return int(res.RowsAffected), nil
+}
+
+func (d DefaultRepo) ScanTokens(ctx context.Context, fn func(t *domain.VerificationToken) error) error {
+	after := []byte{}
+	for {
+		var dbTokens []*VerificationTokenDTODB
+		err := d.DB.WithContext(ctx).Where("token_hash > ?", after).Order("token_hash").Limit(scanPageSize).Find(&dbTokens).Error
+		if err != nil {
+			return fmt.Errorf("failed to fetch tokens : %v", err)
+		}
+		for _, v := range dbTokens {
+			if err := fn(v.toToken()); err != nil {
+				return err
+			}
+		}
+		if len(dbTokens) < scanPageSize {
+			return nil
+		}
+		after = dbTokens[len(dbTokens)-1].TokenHash
+	}
+}
@@ -0,0 +1,176 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+//likeEscaper escapes the wildcards of LIKE patterns, see ListUsers
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (d DefaultRepo) ListUsers(ctx context.Context, filter domain.UserFilter) ([]*domain.User, error) {
+	query := d.DB.WithContext(ctx).Order("normalized_email")
+	if !filter.IncludeDeleted {
+		query = query.Where("deleted_at IS NULL")
+	}
+	if filter.State != "" {
+		query = query.Where("state = ?", string(filter.State))
+	}
+	if filter.After != "" {
+		query = query.Where("normalized_email > ?", filter.After)
+	}
+	if filter.Query != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(filter.Query)) + "%"
+		query = query.Where(`(normalized_email LIKE ? ESCAPE '\' OR LOWER(name) LIKE ? ESCAPE '\')`, pattern, pattern)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	var dbUsers []*UserDTODB
+	if err := query.Find(&dbUsers).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch users : %v", err)
+	}
+	users := make([]*domain.User, 0, len(dbUsers))
+	for _, v := range dbUsers {
+		user, err := v.toUser()
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert to user :%v", err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+//scanPageSize is the number of users ScanUsers fetches at once
+const scanPageSize = 500
+
+//ScanUsers pages by the primary key instead of holding a cursor open, so fn may write to the database
+func (d DefaultRepo) ScanUsers(ctx context.Context, fn func(u *domain.User) error) error {
+	after := ""
+	for {
+		var dbUsers []*UserDTODB
+		err := d.DB.WithContext(ctx).Where("normalized_email > ?", after).Order("normalized_email").Limit(scanPageSize).Find(&dbUsers).Error
+		if err != nil {
+			return fmt.Errorf("failed to fetch users : %v", err)
+		}
+		for _, v := range dbUsers {
+			user, err := v.toUser()
+			if err != nil {
+				return fmt.Errorf("failed to convert to user :%v", err)
+			}
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(dbUsers) < scanPageSize {
+			return nil
+		}
+		after = dbUsers[len(dbUsers)-1].NormalizedEmail
+	}
+}
+
+func (d DefaultRepo) FindByEmail(ctx context.Context, email string) (*domain.User, error) {
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	dbUser := &UserDTODB{}
+	if err := d.DB.WithContext(ctx).Where("normalized_email = ?", normalizedEmail).First(dbUser).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch user : %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	user, err := dbUser.toUser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert to user :%v", err)
+	}
+	return user, nil
+}
+
+func (d DefaultRepo) RotateUserKey(ctx context.Context, u *domain.User) (*domain.User, error) {
+	dbUser, err := userToDTODB(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user for DB : %v", err)
+	}
+	err = d.fencedWrite(ctx, dbUser.NormalizedEmail, func(tx *gorm.DB) error {
+		current := &UserDTODB{}
+		if err := tx.Where("normalized_email = ? AND deleted_at IS NULL", dbUser.NormalizedEmail).First(current).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		//the key must not resolve to any other user or device
+		var users, devices int64
+		if err := tx.Model(&UserDTODB{}).Where("public_key_pkix = ?", dbUser.PublicKeyPKIX).Count(&users).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&DeviceDTODB{}).Where("public_key_pkix = ?", dbUser.PublicKeyPKIX).Count(&devices).Error; err != nil {
+			return err
+		}
+		if users > 0 || devices > 0 {
+			return ErrAlreadyExists
+		}
+		current.PublicKeyPKIX = dbUser.PublicKeyPKIX
+		current.WrappedPrivateKey = dbUser.WrappedPrivateKey
+		current.WrappedMasterKey = dbUser.WrappedMasterKey
+		current.UpdatedAt = time.Now()
+		if err := tx.Select("*").Where("normalized_email = ?", current.NormalizedEmail).Updates(current).Error; err != nil {
+			return err
+		}
+		dbUser = current
+		return appendUserEvents(tx, userEventOf(domain.UserEventKeyRotated, current))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate key : %w", err)
+	}
+	return dbUser.toUser()
+}
+
+func (d DefaultRepo) ImportUser(ctx context.Context, u *domain.User, overwrite bool) (bool, error) {
+	dbUser, err := userToDTODB(u)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize user for DB : %v", err)
+	}
+	replaced := false
+	err = d.fencedWrite(ctx, dbUser.NormalizedEmail, func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&UserDTODB{}).Where("normalized_email = ?", dbUser.NormalizedEmail).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 && !overwrite {
+			return ErrAlreadyExists
+		}
+		//the key must not resolve to any other user or device
+		var users, devices int64
+		if err := tx.Model(&UserDTODB{}).Where("public_key_pkix = ? AND normalized_email <> ?", dbUser.PublicKeyPKIX, dbUser.NormalizedEmail).Count(&users).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&DeviceDTODB{}).Where("public_key_pkix = ?", dbUser.PublicKeyPKIX).Count(&devices).Error; err != nil {
+			return err
+		}
+		if users > 0 || devices > 0 {
+			return ErrAlreadyExists
+		}
+		if existing > 0 {
+			//UpdateColumns keeps the imported timestamps
+			if err := tx.Model(&UserDTODB{}).Select("*").Where("normalized_email = ?", dbUser.NormalizedEmail).UpdateColumns(dbUser).Error; err != nil {
+				return err
+			}
+			replaced = true
+		} else if err := tx.Create(dbUser).Error; err != nil {
+			return err
+		}
+		return appendUserEvents(tx, userEventOf(domain.UserEventImported, dbUser))
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to import user : %w", err)
+	}
+	return replaced, nil
+}
@@ -0,0 +1,39 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"fmt"
+)
+
+func (d DefaultRepo) AppendAuditEntry(ctx context.Context, e *domain.AuditEntry) error {
+	if err := d.DB.WithContext(ctx).Create(auditEntryToDTODB(e)).Error; err != nil {
+		return fmt.Errorf("failed to insert audit entry : %v", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) QueryAuditEntries(ctx context.Context, filter domain.AuditFilter) ([]*domain.AuditEntry, error) {
+	query := d.DB.WithContext(ctx).Order("time").Order("id")
+	if filter.Email != "" {
+		query = query.Where("actor_email = ? OR target_email = ?", filter.Email, filter.Email)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("time >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("time < ?", filter.To)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	var dbEntries []*AuditEntryDTODB
+	if err := query.Find(&dbEntries).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch audit entries : %v", err)
+	}
+	entries := make([]*domain.AuditEntry, 0, len(dbEntries))
+	for _, v := range dbEntries {
+		entries = append(entries, v.toAuditEntry())
+	}
+	return entries, nil
+}
@@ -0,0 +1,83 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"time"
+)
+
+func (d DefaultRepo) AddDevice(ctx context.Context, device *domain.Device) (*domain.Device, error) {
+	dbDevice, err := deviceToDTODB(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize device for DB : %v", err)
+	}
+	err = d.fencedWrite(ctx, dbDevice.OwnerEmail, func(tx *gorm.DB) error {
+		if err := tx.Create(dbDevice).Error; err != nil {
+			return err
+		}
+		return appendUserEvents(tx, deviceEventOf(domain.UserEventDeviceAdded, dbDevice))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert device : %v", err)
+	}
+	return dbDevice.toDevice()
+}
+
+func (d DefaultRepo) ListDevices(ctx context.Context, ownerEmail string) ([]*domain.Device, error) {
+	var dbDevices []*DeviceDTODB
+	if err := d.DB.WithContext(ctx).Where("owner_email = ?", ownerEmail).Order("created_at").Find(&dbDevices).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch devices : %v", err)
+	}
+	devices := make([]*domain.Device, 0, len(dbDevices))
+	for _, v := range dbDevices {
+		device, err := v.toDevice()
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert to device :%v", err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+func (d DefaultRepo) GetDeviceByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.Device, error) {
+	dbDevice := &DeviceDTODB{}
+	if err := d.DB.WithContext(ctx).Where("public_key_pkix = ?", PKIXPublicKey).First(dbDevice).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch device : %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	return dbDevice.toDevice()
+}
+
+func (d DefaultRepo) RevokeDevice(ctx context.Context, ownerEmail, deviceID string) error {
+	return d.fencedWrite(ctx, ownerEmail, func(tx *gorm.DB) error {
+		res := tx.Model(&DeviceDTODB{}).
+			Where("id = ? AND owner_email = ? AND revoked_at IS NULL", deviceID, ownerEmail).
+			Updates(map[string]interface{}{"revoked_at": time.Now(), "wrapped_master_key": nil})
+		if res.Error != nil {
+			return fmt.Errorf("failed to revoke device : %v", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to revoke device : %w", ErrNotFound)
+		}
+		revoked := &DeviceDTODB{}
+		if err := tx.Where("id = ? AND owner_email = ?", deviceID, ownerEmail).First(revoked).Error; err != nil {
+			return fmt.Errorf("failed to revoke device : %v", err)
+		}
+		return appendUserEvents(tx, deviceEventOf(domain.UserEventDeviceRevoked, revoked))
+	})
+}
+
+func (d DefaultRepo) TouchDevice(ctx context.Context, ownerEmail, deviceID string, lastSeen time.Time) error {
+	err := d.DB.WithContext(ctx).Model(&DeviceDTODB{}).
+		Where("id = ? AND owner_email = ?", deviceID, ownerEmail).
+		Update("last_seen_at", lastSeen).Error
+	if err != nil {
+		return fmt.Errorf("failed to update device : %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"time"
+)
+
+func (d DefaultRepo) CreateEnrollment(ctx context.Context, e *domain.Enrollment) (*domain.Enrollment, error) {
+	dbEnrollment, err := enrollmentToDTODB(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize enrollment for DB : %v", err)
+	}
+	err = d.fencedWrite(ctx, dbEnrollment.OwnerEmail, func(tx *gorm.DB) error {
+		return tx.Create(dbEnrollment).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert enrollment : %w", err)
+	}
+	return dbEnrollment.toEnrollment()
+}
+
+func (d DefaultRepo) GetEnrollment(ctx context.Context, ownerEmail, id string) (*domain.Enrollment, error) {
+	dbEnrollment := &EnrollmentDTODB{}
+	if err := d.DB.WithContext(ctx).Where("id = ? AND owner_email = ?", id, ownerEmail).First(dbEnrollment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch enrollment : %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	return dbEnrollment.toEnrollment()
+}
+
+func (d DefaultRepo) ListEnrollments(ctx context.Context, ownerEmail string) ([]*domain.Enrollment, error) {
+	var dbEnrollments []*EnrollmentDTODB
+	if err := d.DB.WithContext(ctx).Where("owner_email = ?", ownerEmail).Order("created_at").Find(&dbEnrollments).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch enrollments : %v", err)
+	}
+	enrollments := make([]*domain.Enrollment, 0, len(dbEnrollments))
+	for _, v := range dbEnrollments {
+		enrollment, err := v.toEnrollment()
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert to enrollment :%v", err)
+		}
+		enrollments = append(enrollments, enrollment)
+	}
+	return enrollments, nil
+}
+
+func (d DefaultRepo) ApproveEnrollment(ctx context.Context, ownerEmail, id, deviceID string) error {
+	return d.fencedWrite(ctx, ownerEmail, func(tx *gorm.DB) error {
+		res := tx.Model(&EnrollmentDTODB{}).
+			Where("id = ? AND owner_email = ? AND state = ?", id, ownerEmail, string(domain.EnrollmentStatePending)).
+			Updates(map[string]interface{}{"state": string(domain.EnrollmentStateApproved), "device_id": deviceID})
+		if res.Error != nil {
+			return fmt.Errorf("failed to approve enrollment : %v", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to approve enrollment : %w", ErrNotFound)
+		}
+		return nil
+	})
+}
+
+func (d DefaultRepo) PurgeExpiredEnrollments(ctx context.Context, now time.Time) (int, error) {
+	res := d.DB.WithContext(ctx).Where("expires_at < ?", now).Delete(&EnrollmentDTODB{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("failed to purge expired enrollments : %v", res.Error)
+	}
+	return int(res.RowsAffected), nil
+}
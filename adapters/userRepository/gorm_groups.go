@@ -0,0 +1,196 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func (d DefaultRepo) CreateGroup(ctx context.Context, g *domain.Group) (*domain.Group, error) {
+	g.KeyEpoch = 1
+	dbGroup := groupToDTODB(g)
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(dbGroup).Error; err != nil {
+			return err
+		}
+		return tx.Create(&GroupMemberDTODB{
+			GroupID:     g.ID,
+			MemberEmail: g.OwnerEmail,
+			AddedAt:     g.CreatedAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert group : %v", err)
+	}
+	return dbGroup.toGroup(), nil
+}
+
+func (d DefaultRepo) GetGroup(ctx context.Context, id string) (*domain.Group, error) {
+	dbGroup := &GroupDTODB{}
+	if err := d.DB.WithContext(ctx).Where("id = ?", id).First(dbGroup).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch group : %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	return dbGroup.toGroup(), nil
+}
+
+func (d DefaultRepo) AddGroupMember(ctx context.Context, m *domain.GroupMember) error {
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&GroupMemberDTODB{}).Where("group_id = ? AND member_email = ?", m.GroupID, m.MemberEmail).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyExists
+		}
+		return tx.Create(groupMemberToDTODB(m)).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrAlreadyExists) {
+			return fmt.Errorf("failed to insert group member : %w", err)
+		}
+		return fmt.Errorf("failed to insert group member : %v", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) RemoveGroupMember(ctx context.Context, groupID, memberEmail string) error {
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("group_id = ? AND member_email = ?", groupID, memberEmail).Delete(&GroupMemberDTODB{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return tx.Model(&GroupDTODB{}).Where("id = ?", groupID).
+			Update("key_epoch", gorm.Expr("key_epoch + 1")).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to delete group member : %w", err)
+		}
+		return fmt.Errorf("failed to delete group member : %v", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) listGroupMembersWhere(ctx context.Context, query string, arg string) ([]*domain.GroupMember, error) {
+	var dbMembers []*GroupMemberDTODB
+	if err := d.DB.WithContext(ctx).Where(query, arg).Order("added_at").Find(&dbMembers).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch group members : %v", err)
+	}
+	members := make([]*domain.GroupMember, 0, len(dbMembers))
+	for _, v := range dbMembers {
+		members = append(members, v.toGroupMember())
+	}
+	return members, nil
+}
+
+func (d DefaultRepo) ListGroupMembers(ctx context.Context, groupID string) ([]*domain.GroupMember, error) {
+	return d.listGroupMembersWhere(ctx, "group_id = ?", groupID)
+}
+
+func (d DefaultRepo) ListGroupsOfMember(ctx context.Context, memberEmail string) ([]*domain.GroupMember, error) {
+	return d.listGroupMembersWhere(ctx, "member_email = ?", memberEmail)
+}
+
+func (d DefaultRepo) PutGroupKeyWrappings(ctx context.Context, groupID string, epoch int64, wrappings []*domain.GroupKeyWrapping) error {
+	dbWrappings := make([]*GroupKeyWrappingDTODB, 0, len(wrappings))
+	for _, v := range wrappings {
+		dbWrappings = append(dbWrappings, groupKeyWrappingToDTODB(v))
+	}
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		group := &GroupDTODB{}
+		if err := tx.Where("id = ?", groupID).First(group).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if group.KeyEpoch != epoch {
+			return ErrStaleEpoch
+		}
+		return storeGroupKeyWrappings(tx, dbWrappings)
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrStaleEpoch) || errors.Is(err, ErrUserMoving) {
+			return fmt.Errorf("failed to store group key wrappings : %w", err)
+		}
+		return fmt.Errorf("failed to store group key wrappings : %v", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) StoreGroupKeyWrappings(ctx context.Context, wrappings []*domain.GroupKeyWrapping) error {
+	dbWrappings := make([]*GroupKeyWrappingDTODB, 0, len(wrappings))
+	for _, v := range wrappings {
+		dbWrappings = append(dbWrappings, groupKeyWrappingToDTODB(v))
+	}
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return storeGroupKeyWrappings(tx, dbWrappings)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store group key wrappings : %w", err)
+	}
+	return nil
+}
+
+//storeGroupKeyWrappings creates or replaces the wrappings, unless one of their members is fenced
+func storeGroupKeyWrappings(tx *gorm.DB, dbWrappings []*GroupKeyWrappingDTODB) error {
+	if len(dbWrappings) == 0 {
+		return nil
+	}
+	for _, v := range dbWrappings {
+		if err := checkUnfenced(tx, v.MemberEmail); err != nil {
+			return err
+		}
+	}
+	return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(dbWrappings).Error
+}
+
+func (d DefaultRepo) GetGroupKeyWrapping(ctx context.Context, groupID string, epoch int64, memberEmail string) (*domain.GroupKeyWrapping, error) {
+	dbWrapping := &GroupKeyWrappingDTODB{}
+	err := d.DB.WithContext(ctx).Where("group_id = ? AND epoch = ? AND member_email = ?", groupID, epoch, memberEmail).
+		First(dbWrapping).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch group key wrapping : %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	return dbWrapping.toGroupKeyWrapping(), nil
+}
+
+func (d DefaultRepo) ListGroupKeyWrappings(ctx context.Context, groupID string, epoch int64) ([]*domain.GroupKeyWrapping, error) {
+	var dbWrappings []*GroupKeyWrappingDTODB
+	if err := d.DB.WithContext(ctx).Where("group_id = ? AND epoch = ?", groupID, epoch).Find(&dbWrappings).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch group key wrappings : %v", err)
+	}
+	wrappings := make([]*domain.GroupKeyWrapping, 0, len(dbWrappings))
+	for _, v := range dbWrappings {
+		wrappings = append(wrappings, v.toGroupKeyWrapping())
+	}
+	return wrappings, nil
+}
+
+//purgeGroupMemberships removes members from all groups, bumping the key epochs of these groups, and
+//drops the group keys wrapped for them. members is a list or subquery of normalized emails
+func purgeGroupMemberships(tx *gorm.DB, members interface{}) error {
+	groups := tx.Model(&GroupMemberDTODB{}).Select("group_id").Where("member_email IN (?)", members)
+	err := tx.Model(&GroupDTODB{}).Where("id IN (?)", groups).
+		Update("key_epoch", gorm.Expr("key_epoch + 1")).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("member_email IN (?)", members).Delete(&GroupKeyWrappingDTODB{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("member_email IN (?)", members).Delete(&GroupMemberDTODB{}).Error
+}
@@ -0,0 +1,69 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+//keyLogCursorName is the name of the cursor tracking the user events taken into the key log
+const keyLogCursorName = "key-log"
+
+func (d DefaultRepo) GetKeyLogCursor(ctx context.Context) (int64, error) {
+	cursor := &CursorDTODB{}
+	err := d.DB.WithContext(ctx).Where("cursor_name = ?", keyLogCursorName).First(cursor).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch key log cursor : %v", err)
+	}
+	return cursor.LastSeq, nil
+}
+
+func (d DefaultRepo) AppendKeyLogEntries(ctx context.Context, after, cursor int64, entries []*domain.KeyLogEntry) error {
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&CursorDTODB{CursorName: keyLogCursorName}).Error
+		if err != nil {
+			return fmt.Errorf("failed to insert key log cursor : %v", err)
+		}
+		//moving the cursor first locks it, so concurrent appends wait for each other
+		res := tx.Model(&CursorDTODB{}).
+			Where("cursor_name = ? AND last_seq = ?", keyLogCursorName, after).
+			Update("last_seq", cursor)
+		if res.Error != nil {
+			return fmt.Errorf("failed to update key log cursor : %v", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to update key log cursor : %w", ErrCursorMoved)
+		}
+		var size int64
+		if err := tx.Model(&KeyLogEntryDTODB{}).Count(&size).Error; err != nil {
+			return fmt.Errorf("failed to fetch key log size : %v", err)
+		}
+		for i, e := range entries {
+			dbEntry := keyLogEntryToDTODB(e)
+			dbEntry.LogIndex = size + int64(i)
+			if err := tx.Create(dbEntry).Error; err != nil {
+				return fmt.Errorf("failed to insert key log entry : %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (d DefaultRepo) ListKeyLogEntries(ctx context.Context, start int64, limit int) ([]*domain.KeyLogEntry, error) {
+	var dbEntries []*KeyLogEntryDTODB
+	err := d.DB.WithContext(ctx).Where("log_index >= ?", start).Order("log_index").Limit(limit).Find(&dbEntries).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key log entries : %v", err)
+	}
+	entries := make([]*domain.KeyLogEntry, 0, len(dbEntries))
+	for _, v := range dbEntries {
+		entries = append(entries, v.toKeyLogEntry())
+	}
+	return entries, nil
+}
@@ -0,0 +1,78 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func (d DefaultRepo) CreateOrganization(ctx context.Context, o *domain.Organization) (*domain.Organization, error) {
+	dbOrganization, err := organizationToDTODB(o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize organization for DB : %v", err)
+	}
+	err = d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&OrganizationDTODB{}).Where("email_domain = ?", o.EmailDomain).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyExists
+		}
+		return tx.Create(dbOrganization).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrAlreadyExists) {
+			return nil, fmt.Errorf("failed to insert organization : %w", err)
+		}
+		return nil, fmt.Errorf("failed to insert organization : %v", err)
+	}
+	return dbOrganization.toOrganization()
+}
+
+func (d DefaultRepo) getOrganizationWhere(ctx context.Context, query string, arg string) (*domain.Organization, error) {
+	dbOrganization := &OrganizationDTODB{}
+	if err := d.DB.WithContext(ctx).Where(query, arg).First(dbOrganization).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch organization : %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	return dbOrganization.toOrganization()
+}
+
+func (d DefaultRepo) GetOrganization(ctx context.Context, id string) (*domain.Organization, error) {
+	return d.getOrganizationWhere(ctx, "id = ?", id)
+}
+
+func (d DefaultRepo) GetOrganizationByDomain(ctx context.Context, emailDomain string) (*domain.Organization, error) {
+	return d.getOrganizationWhere(ctx, "email_domain = ?", emailDomain)
+}
+
+func (d DefaultRepo) PutEscrowWrapping(ctx context.Context, w *domain.EscrowWrapping) error {
+	dbWrapping, err := escrowWrappingToDTODB(w)
+	if err != nil {
+		return fmt.Errorf("failed to serialize escrow wrapping for DB : %v", err)
+	}
+	err = d.fencedWrite(ctx, dbWrapping.OwnerEmail, func(tx *gorm.DB) error {
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(dbWrapping).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store escrow wrapping : %w", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) GetEscrowWrapping(ctx context.Context, ownerEmail string) (*domain.EscrowWrapping, error) {
+	dbWrapping := &EscrowWrappingDTODB{}
+	if err := d.DB.WithContext(ctx).Where("owner_email = ?", ownerEmail).First(dbWrapping).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch escrow wrapping : %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	return dbWrapping.toEscrowWrapping()
+}
@@ -0,0 +1,85 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+)
+
+func (d DefaultRepo) AddRecoveryWrapping(ctx context.Context, w *domain.RecoveryWrapping) (*domain.RecoveryWrapping, error) {
+	dbWrapping, err := recoveryWrappingToDTODB(w)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize recovery wrapping for DB : %v", err)
+	}
+	err = d.fencedWrite(ctx, dbWrapping.OwnerEmail, func(tx *gorm.DB) error {
+		return tx.Create(dbWrapping).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert recovery wrapping : %w", err)
+	}
+	return dbWrapping.toRecoveryWrapping()
+}
+
+func (d DefaultRepo) ListRecoveryWrappings(ctx context.Context, ownerEmail string) ([]*domain.RecoveryWrapping, error) {
+	var dbWrappings []*RecoveryWrappingDTODB
+	if err := d.DB.WithContext(ctx).Where("owner_email = ?", ownerEmail).Order("created_at").Find(&dbWrappings).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch recovery wrappings : %v", err)
+	}
+	wrappings := make([]*domain.RecoveryWrapping, 0, len(dbWrappings))
+	for _, v := range dbWrappings {
+		wrapping, err := v.toRecoveryWrapping()
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert to recovery wrapping :%v", err)
+		}
+		wrappings = append(wrappings, wrapping)
+	}
+	return wrappings, nil
+}
+
+func (d DefaultRepo) GetRecoveryWrapping(ctx context.Context, ownerEmail, id string) (*domain.RecoveryWrapping, error) {
+	dbWrapping := &RecoveryWrappingDTODB{}
+	if err := d.DB.WithContext(ctx).Where("id = ? AND owner_email = ?", id, ownerEmail).First(dbWrapping).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch recovery wrapping : %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	return dbWrapping.toRecoveryWrapping()
+}
+
+func (d DefaultRepo) DeleteRecoveryWrapping(ctx context.Context, ownerEmail, id string) error {
+	return d.fencedWrite(ctx, ownerEmail, func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND owner_email = ?", id, ownerEmail).Delete(&RecoveryWrappingDTODB{})
+		if res.Error != nil {
+			return fmt.Errorf("failed to delete recovery wrapping : %v", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to delete recovery wrapping : %w", ErrNotFound)
+		}
+		return nil
+	})
+}
+
+func (d DefaultRepo) AddRecoveryAudit(ctx context.Context, a *domain.RecoveryAudit) error {
+	err := d.fencedWrite(ctx, a.OwnerEmail, func(tx *gorm.DB) error {
+		return tx.Create(recoveryAuditToDTODB(a)).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert recovery audit : %w", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) ListRecoveryAudits(ctx context.Context, ownerEmail string) ([]*domain.RecoveryAudit, error) {
+	var dbAudits []*RecoveryAuditDTODB
+	if err := d.DB.WithContext(ctx).Where("owner_email = ?", ownerEmail).Order("recovered_at").Find(&dbAudits).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch recovery audits : %v", err)
+	}
+	audits := make([]*domain.RecoveryAudit, 0, len(dbAudits))
+	for _, v := range dbAudits {
+		audits = append(audits, v.toRecoveryAudit())
+	}
+	return audits, nil
+}
@@ -0,0 +1,67 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"time"
+)
+
+func (d DefaultRepo) GetResidency(ctx context.Context, email string) (*domain.UserResidency, error) {
+	dbResidency := &UserResidencyDTODB{}
+	if err := d.DB.WithContext(ctx).Where("email = ?", email).First(dbResidency).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to fetch residency : %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch residency : %v", err)
+	}
+	return dbResidency.toResidency(), nil
+}
+
+func (d DefaultRepo) CreateResidency(ctx context.Context, r *domain.UserResidency) error {
+	r.UpdatedAt = time.Now()
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&UserResidencyDTODB{}).Where("email = ?", r.Email).Count(&existing).Error; err != nil {
+			return fmt.Errorf("failed to check residency : %v", err)
+		}
+		if existing > 0 {
+			return fmt.Errorf("failed to insert residency : %w", ErrAlreadyExists)
+		}
+		if err := tx.Create(residencyToDTODB(r)).Error; err != nil {
+			return fmt.Errorf("failed to insert residency : %v", err)
+		}
+		return nil
+	})
+}
+
+func (d DefaultRepo) SwapResidency(ctx context.Context, expected, r *domain.UserResidency) error {
+	r.UpdatedAt = time.Now()
+	res := d.DB.WithContext(ctx).Model(&UserResidencyDTODB{}).
+		Where("email = ? AND region = ? AND moving_to = ?", r.Email, expected.Region, expected.MovingTo).
+		Updates(map[string]interface{}{
+			"region":     r.Region,
+			"moving_to":  r.MovingTo,
+			"updated_at": r.UpdatedAt,
+		})
+	if res.Error != nil {
+		return fmt.Errorf("failed to update residency : %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed to update residency : %w", ErrResidencyChanged)
+	}
+	return nil
+}
+
+func (d DefaultRepo) DeleteResidency(ctx context.Context, email string) error {
+	res := d.DB.WithContext(ctx).Where("email = ?", email).Delete(&UserResidencyDTODB{})
+	if res.Error != nil {
+		return fmt.Errorf("failed to delete residency : %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed to delete residency : %w", ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+//appendUserEvents writes events to the outbox as part of tx. Sequences are assigned by the database
+func appendUserEvents(tx *gorm.DB, events ...*domain.UserEvent) error {
+	for _, v := range events {
+		dbEvent := userEventToDTODB(v)
+		dbEvent.Sequence = 0
+		if err := tx.Create(dbEvent).Error; err != nil {
+			return fmt.Errorf("failed to insert user event : %v", err)
+		}
+		v.Sequence = dbEvent.Sequence
+	}
+	return nil
+}
+
+func (d DefaultRepo) ListUserEvents(ctx context.Context, after int64, limit int) ([]*domain.UserEvent, error) {
+	var dbEvents []*UserEventDTODB
+	err := d.DB.WithContext(ctx).Where("sequence > ?", after).Order("sequence").Limit(limit).Find(&dbEvents).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user events : %v", err)
+	}
+	events := make([]*domain.UserEvent, 0, len(dbEvents))
+	for _, v := range dbEvents {
+		events = append(events, v.toUserEvent())
+	}
+	return events, nil
+}
+
+func (d DefaultRepo) PurgeUserEvents(ctx context.Context, createdBefore time.Time) (int, error) {
+	latest := d.DB.Model(&UserEventDTODB{}).Select("MAX(sequence)")
+	res := d.DB.WithContext(ctx).Where("created_at < ? AND sequence < (?)", createdBefore, latest).Delete(&UserEventDTODB{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("failed to purge user events : %v", res.Error)
+	}
+	return int(res.RowsAffected), nil
+}
+
+//relayCursorName is the name of the cursor tracking the events relayed from source
+func relayCursorName(source string) string {
+	return "relay:" + source
+}
+
+func (d DefaultRepo) GetRelayCursor(ctx context.Context, source string) (int64, error) {
+	cursor := &CursorDTODB{}
+	err := d.DB.WithContext(ctx).Where("cursor_name = ?", relayCursorName(source)).First(cursor).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch relay cursor : %v", err)
+	}
+	return cursor.LastSeq, nil
+}
+
+func (d DefaultRepo) RelayUserEvents(ctx context.Context, source string, after, cursor int64, events []*domain.UserEvent) error {
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&CursorDTODB{CursorName: relayCursorName(source)}).Error
+		if err != nil {
+			return fmt.Errorf("failed to insert relay cursor : %v", err)
+		}
+		res := tx.Model(&CursorDTODB{}).
+			Where("cursor_name = ? AND last_seq = ?", relayCursorName(source), after).
+			Update("last_seq", cursor)
+		if res.Error != nil {
+			return fmt.Errorf("failed to update relay cursor : %v", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to update relay cursor : %w", ErrCursorMoved)
+		}
+		return appendUserEvents(tx, events...)
+	})
+}
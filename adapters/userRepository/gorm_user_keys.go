@@ -0,0 +1,65 @@
+package userRepository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+)
+
+func (d DefaultRepo) GetKeyOwner(ctx context.Context, PKIXPublicKey []byte) (string, error) {
+	dbKey := &UserKeyDTODB{}
+	if err := d.DB.WithContext(ctx).Where("public_key_pkix = ?", PKIXPublicKey).First(dbKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", fmt.Errorf("failed to fetch key owner : %w", ErrNotFound)
+		}
+		return "", fmt.Errorf("failed to fetch key owner : %v", err)
+	}
+	return dbKey.Email, nil
+}
+
+func (d DefaultRepo) ClaimKey(ctx context.Context, PKIXPublicKey []byte, email string) error {
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing []*UserKeyDTODB
+		if err := tx.Where("public_key_pkix = ?", PKIXPublicKey).Limit(1).Find(&existing).Error; err != nil {
+			return fmt.Errorf("failed to fetch key owner : %v", err)
+		}
+		if len(existing) > 0 {
+			if existing[0].Email != email {
+				return fmt.Errorf("failed to claim key : %w", ErrAlreadyExists)
+			}
+			return nil
+		}
+		if err := tx.Create(&UserKeyDTODB{PublicKeyPKIX: PKIXPublicKey, Email: email}).Error; err != nil {
+			return fmt.Errorf("failed to claim key : %v", err)
+		}
+		return nil
+	})
+}
+
+func (d DefaultRepo) DeleteKeyOwner(ctx context.Context, PKIXPublicKey []byte, email string) error {
+	res := d.DB.WithContext(ctx).Where("public_key_pkix = ? AND email = ?", PKIXPublicKey, email).Delete(&UserKeyDTODB{})
+	if res.Error != nil {
+		return fmt.Errorf("failed to delete key owner : %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed to delete key owner : %w", ErrNotFound)
+	}
+	return nil
+}
+
+func (d DefaultRepo) ListKeyOwners(ctx context.Context, after []byte, limit int) ([]*KeyOwner, error) {
+	query := d.DB.WithContext(ctx).Order("public_key_pkix").Limit(limit)
+	if len(after) > 0 {
+		query = query.Where("public_key_pkix > ?", after)
+	}
+	var dbKeys []*UserKeyDTODB
+	if err := query.Find(&dbKeys).Error; err != nil {
+		return nil, fmt.Errorf("failed to list key owners : %v", err)
+	}
+	owners := make([]*KeyOwner, 0, len(dbKeys))
+	for _, v := range dbKeys {
+		owners = append(owners, &KeyOwner{PublicKeyPKIX: v.PublicKeyPKIX, Email: v.Email})
+	}
+	return owners, nil
+}
@@ -0,0 +1,125 @@
+package userRepository
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+//checkUnfenced fails with ErrUserMoving if the writes to the user with the normalized email are fenced.
+//It has to run in the transaction of the write, which then conflicts with a concurrent FenceUser
+func checkUnfenced(tx *gorm.DB, email string) error {
+	var fenced int64
+	if err := tx.Model(&UserFenceDTODB{}).Where("email = ?", email).Count(&fenced).Error; err != nil {
+		return fmt.Errorf("failed to check fence : %v", err)
+	}
+	if fenced > 0 {
+		return fmt.Errorf("user is fenced : %w", ErrUserMoving)
+	}
+	return nil
+}
+
+//fencedWrite runs write in a transaction, unless the writes to the user with the normalized email are
+//fenced
+func (d DefaultRepo) fencedWrite(ctx context.Context, email string, write func(tx *gorm.DB) error) error {
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkUnfenced(tx, email); err != nil {
+			return err
+		}
+		return write(tx)
+	})
+}
+
+func (d DefaultRepo) FenceUser(ctx context.Context, email string) error {
+	err := d.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&UserFenceDTODB{Email: email}).Error
+	if err != nil {
+		return fmt.Errorf("failed to fence user : %v", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) UnfenceUser(ctx context.Context, email string) error {
+	if err := d.DB.WithContext(ctx).Where("email = ?", email).Delete(&UserFenceDTODB{}).Error; err != nil {
+		return fmt.Errorf("failed to unfence user : %v", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) ImportUserData(ctx context.Context, data *UserData) error {
+	var rows []interface{}
+	for _, v := range data.Devices {
+		dbDevice, err := deviceToDTODB(v)
+		if err != nil {
+			return fmt.Errorf("failed to serialize device for DB : %v", err)
+		}
+		rows = append(rows, dbDevice)
+	}
+	for _, v := range data.Enrollments {
+		dbEnrollment, err := enrollmentToDTODB(v)
+		if err != nil {
+			return fmt.Errorf("failed to serialize enrollment for DB : %v", err)
+		}
+		rows = append(rows, dbEnrollment)
+	}
+	for _, v := range data.RecoveryWrappings {
+		dbWrapping, err := recoveryWrappingToDTODB(v)
+		if err != nil {
+			return fmt.Errorf("failed to serialize recovery wrapping for DB : %v", err)
+		}
+		rows = append(rows, dbWrapping)
+	}
+	for _, v := range data.RecoveryAudits {
+		rows = append(rows, recoveryAuditToDTODB(v))
+	}
+	if data.EscrowWrapping != nil {
+		dbWrapping, err := escrowWrappingToDTODB(data.EscrowWrapping)
+		if err != nil {
+			return fmt.Errorf("failed to serialize escrow wrapping for DB : %v", err)
+		}
+		rows = append(rows, dbWrapping)
+	}
+	for _, v := range data.GroupKeyWrappings {
+		rows = append(rows, groupKeyWrappingToDTODB(v))
+	}
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import user data : %v", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) DropMovedUser(ctx context.Context, email string) error {
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		owned := []interface{}{
+			&DeviceDTODB{},
+			&EnrollmentDTODB{},
+			&RecoveryWrappingDTODB{},
+			&RecoveryAuditDTODB{},
+			&EscrowWrappingDTODB{},
+		}
+		for _, v := range owned {
+			if err := tx.Where("owner_email = ?", email).Delete(v).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("member_email = ?", email).Delete(&GroupKeyWrappingDTODB{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("normalized_email = ?", email).Delete(&UserDTODB{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("email = ?", email).Delete(&UserFenceDTODB{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to drop moved user : %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+//webhookCursorName is the name of the cursor tracking the user events enqueued for webhooks
+const webhookCursorName = "webhooks"
+
+func (d DefaultRepo) CreateWebhook(ctx context.Context, w *domain.Webhook) (*domain.Webhook, error) {
+	w.CreatedAt = time.Now()
+	if err := d.DB.WithContext(ctx).Create(webhookToDTODB(w)).Error; err != nil {
+		return nil, fmt.Errorf("failed to insert webhook : %v", err)
+	}
+	return w, nil
+}
+
+func (d DefaultRepo) ListWebhooks(ctx context.Context) ([]*domain.Webhook, error) {
+	var dbWebhooks []*WebhookDTODB
+	if err := d.DB.WithContext(ctx).Order("created_at").Find(&dbWebhooks).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch webhooks : %v", err)
+	}
+	webhooks := make([]*domain.Webhook, 0, len(dbWebhooks))
+	for _, v := range dbWebhooks {
+		webhooks = append(webhooks, v.toWebhook())
+	}
+	return webhooks, nil
+}
+
+func (d DefaultRepo) DeleteWebhook(ctx context.Context, id string) error {
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ?", id).Delete(&WebhookDTODB{})
+		if res.Error != nil {
+			return fmt.Errorf("failed to delete webhook : %v", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("failed to delete webhook : %w", ErrNotFound)
+		}
+		if err := tx.Where("webhook_id = ?", id).Delete(&WebhookDeliveryDTODB{}).Error; err != nil {
+			return fmt.Errorf("failed to delete webhook deliveries : %v", err)
+		}
+		return nil
+	})
+}
+
+func (d DefaultRepo) GetWebhookCursor(ctx context.Context) (int64, error) {
+	cursor := &CursorDTODB{}
+	err := d.DB.WithContext(ctx).Where("cursor_name = ?", webhookCursorName).First(cursor).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch webhook cursor : %v", err)
+	}
+	return cursor.LastSeq, nil
+}
+
+func (d DefaultRepo) EnqueueWebhookDeliveries(ctx context.Context, cursor int64, deliveries []*domain.WebhookDelivery) error {
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, v := range deliveries {
+			err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(webhookDeliveryToDTODB(v)).Error
+			if err != nil {
+				return fmt.Errorf("failed to insert webhook delivery : %v", err)
+			}
+		}
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&CursorDTODB{CursorName: webhookCursorName}).Error
+		if err != nil {
+			return fmt.Errorf("failed to insert webhook cursor : %v", err)
+		}
+		err = tx.Model(&CursorDTODB{}).
+			Where("cursor_name = ? AND last_seq < ?", webhookCursorName, cursor).
+			Update("last_seq", cursor).Error
+		if err != nil {
+			return fmt.Errorf("failed to update webhook cursor : %v", err)
+		}
+		return nil
+	})
+}
+
+func (d DefaultRepo) ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*domain.WebhookDelivery, error) {
+	var dbDeliveries []*WebhookDeliveryDTODB
+	err := d.DB.WithContext(ctx).
+		Where("state = ? AND next_attempt_at_unix <= ?", string(domain.WebhookDeliveryPending), now.Unix()).
+		Order("event_sequence").Limit(limit).Find(&dbDeliveries).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch due webhook deliveries : %v", err)
+	}
+	return toWebhookDeliveries(dbDeliveries), nil
+}
+
+func (d DefaultRepo) ClaimWebhookDelivery(ctx context.Context, delivery *domain.WebhookDelivery, leaseUntil time.Time) error {
+	res := d.DB.WithContext(ctx).Model(&WebhookDeliveryDTODB{}).
+		Where("webhook_id = ? AND event_sequence = ? AND state = ? AND next_attempt_at_unix = ?",
+			delivery.WebhookID, delivery.EventSequence, string(domain.WebhookDeliveryPending), delivery.NextAttemptAt.Unix()).
+		Update("next_attempt_at_unix", leaseUntil.Unix())
+	if res.Error != nil {
+		return fmt.Errorf("failed to claim webhook delivery : %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed to claim webhook delivery : %w", ErrNotFound)
+	}
+	delivery.NextAttemptAt = time.Unix(leaseUntil.Unix(), 0)
+	return nil
+}
+
+func (d DefaultRepo) UpdateWebhookDelivery(ctx context.Context, delivery *domain.WebhookDelivery) error {
+	dbDelivery := webhookDeliveryToDTODB(delivery)
+	res := d.DB.WithContext(ctx).Model(&WebhookDeliveryDTODB{}).
+		Where("webhook_id = ? AND event_sequence = ?", dbDelivery.WebhookID, dbDelivery.EventSequence).
+		Updates(map[string]interface{}{
+			"state":                dbDelivery.State,
+			"attempts":             dbDelivery.Attempts,
+			"next_attempt_at_unix": dbDelivery.NextAttemptAtUnix,
+			"last_error":           dbDelivery.LastError,
+		})
+	if res.Error != nil {
+		return fmt.Errorf("failed to update webhook delivery : %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed to update webhook delivery : %w", ErrNotFound)
+	}
+	return nil
+}
+
+func (d DefaultRepo) CompleteWebhookDelivery(ctx context.Context, webhookID string, eventSequence int64) error {
+	err := d.DB.WithContext(ctx).
+		Where("webhook_id = ? AND event_sequence = ?", webhookID, eventSequence).
+		Delete(&WebhookDeliveryDTODB{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook delivery : %v", err)
+	}
+	return nil
+}
+
+func (d DefaultRepo) ListDeadWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]*domain.WebhookDelivery, error) {
+	query := d.DB.WithContext(ctx).Where("state = ?", string(domain.WebhookDeliveryDead))
+	if webhookID != "" {
+		query = query.Where("webhook_id = ?", webhookID)
+	}
+	var dbDeliveries []*WebhookDeliveryDTODB
+	if err := query.Order("event_sequence").Limit(limit).Find(&dbDeliveries).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch dead webhook deliveries : %v", err)
+	}
+	return toWebhookDeliveries(dbDeliveries), nil
+}
+
+func toWebhookDeliveries(dbDeliveries []*WebhookDeliveryDTODB) []*domain.WebhookDelivery {
+	deliveries := make([]*domain.WebhookDelivery, 0, len(dbDeliveries))
+	for _, v := range dbDeliveries {
+		deliveries = append(deliveries, v.toWebhookDelivery())
+	}
+	return deliveries
+}
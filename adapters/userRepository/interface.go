@@ -4,14 +4,298 @@ import (
 	"UserService/domain"
 	"context"
 	"errors"
+	"time"
 )
 
+//DefaultRetention is the time deleted users can be restored before they are purged
+const DefaultRetention = 30 * 24 * time.Hour
+
+//DefaultEventRetention is the time user events are kept for subscribers that reconnect
+const DefaultEventRetention = 7 * 24 * time.Hour
+
 var ErrNotFound = errors.New("entry not found")
 var ErrAlreadyExists = errors.New("entry already exists")
 
+//ErrStaleEpoch is returned for writes referring to an outdated group key epoch
+var ErrStaleEpoch = errors.New("stale group key epoch")
+
+//ErrResidencyChanged is returned by SwapResidency if the residency changed since it has been read
+var ErrResidencyChanged = errors.New("residency changed concurrently")
+
+//ErrCursorMoved is returned for writes conditioned on a cursor that has been advanced concurrently
+var ErrCursorMoved = errors.New("cursor moved concurrently")
+
 type UserRepo interface {
 	GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error)
 	GetByEmail(ctx context.Context, email string) (*domain.User, error)
 	Create(ctx context.Context, u *domain.User) (*domain.User, error)
+	//Update replaces the mutable fields of the user with the same email. The public key can not be changed
+	Update(ctx context.Context, u *domain.User) (*domain.User, error)
+	//DeleteByEmail marks the user as deleted. Deleted users are hidden from all lookups and keep their
+	//email reserved until they are restored or purged
 	DeleteByEmail(ctx context.Context, email string) error
+	//Restore undoes DeleteByEmail if the user has been deleted after deletedAfter
+	Restore(ctx context.Context, email string, deletedAfter time.Time) (*domain.User, error)
+	//PurgeByEmail irrevocably removes the user, no matter if deleted or not
+	PurgeByEmail(ctx context.Context, email string) error
+	//PurgeDeleted irrevocably removes all users deleted before deletedBefore and returns their number
+	PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error)
+}
+
+type VerificationTokenRepo interface {
+	CreateToken(ctx context.Context, t *domain.VerificationToken) error
+	//ConsumeToken removes the token with tokenHash and returns it, if it has been issued for the normalized
+	//email and purpose. Otherwise it fails with ErrNotFound and the token is kept. Expired tokens are
+	//returned as well, the caller has to check the expiry
+	ConsumeToken(ctx context.Context, tokenHash []byte, email string, purpose domain.VerificationPurpose) (*domain.VerificationToken, error)
+	//PurgeExpiredTokens removes all tokens that expired before now and returns their number
+	PurgeExpiredTokens(ctx context.Context, now time.Time) (int, error)
+	//ScanTokens calls fn with every token including expired ones in no particular order. It stops at the
+	//first error of fn and returns it
+	ScanTokens(ctx context.Context, fn func(t *domain.VerificationToken) error) error
+}
+
+type DeviceRepo interface {
+	AddDevice(ctx context.Context, d *domain.Device) (*domain.Device, error)
+	//ListDevices returns all devices of the user with the normalized ownerEmail, including revoked ones
+	ListDevices(ctx context.Context, ownerEmail string) ([]*domain.Device, error)
+	//GetDeviceByPk returns the device with PKIXPublicKey. Revoked devices are returned as well
+	GetDeviceByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.Device, error)
+	//RevokeDevice marks the device as revoked and drops its wrapped master key
+	RevokeDevice(ctx context.Context, ownerEmail, deviceID string) error
+	//TouchDevice updates the last seen time of the device
+	TouchDevice(ctx context.Context, ownerEmail, deviceID string, lastSeen time.Time) error
+}
+
+type EnrollmentRepo interface {
+	CreateEnrollment(ctx context.Context, e *domain.Enrollment) (*domain.Enrollment, error)
+	//GetEnrollment returns the enrollment with id of the user with the normalized ownerEmail
+	GetEnrollment(ctx context.Context, ownerEmail, id string) (*domain.Enrollment, error)
+	//ListEnrollments returns all enrollments of the user, including approved and expired ones
+	ListEnrollments(ctx context.Context, ownerEmail string) ([]*domain.Enrollment, error)
+	//ApproveEnrollment moves a pending enrollment to the approved state. It fails with ErrNotFound
+	//if the enrollment does not exist or is no longer pending
+	ApproveEnrollment(ctx context.Context, ownerEmail, id, deviceID string) error
+	//PurgeExpiredEnrollments removes all enrollments that expired before now and returns their number
+	PurgeExpiredEnrollments(ctx context.Context, now time.Time) (int, error)
+}
+
+type RecoveryRepo interface {
+	AddRecoveryWrapping(ctx context.Context, w *domain.RecoveryWrapping) (*domain.RecoveryWrapping, error)
+	//ListRecoveryWrappings returns all recovery wrappings of the user with the normalized ownerEmail
+	ListRecoveryWrappings(ctx context.Context, ownerEmail string) ([]*domain.RecoveryWrapping, error)
+	GetRecoveryWrapping(ctx context.Context, ownerEmail, id string) (*domain.RecoveryWrapping, error)
+	DeleteRecoveryWrapping(ctx context.Context, ownerEmail, id string) error
+	//AddRecoveryAudit records a recovery. Audit entries are kept when the user is purged
+	AddRecoveryAudit(ctx context.Context, a *domain.RecoveryAudit) error
+	ListRecoveryAudits(ctx context.Context, ownerEmail string) ([]*domain.RecoveryAudit, error)
+}
+
+type OrganizationRepo interface {
+	//CreateOrganization fails with ErrAlreadyExists if the email domain already belongs to an organization
+	CreateOrganization(ctx context.Context, o *domain.Organization) (*domain.Organization, error)
+	GetOrganization(ctx context.Context, id string) (*domain.Organization, error)
+	//GetOrganizationByDomain returns the organization owning the normalized emailDomain
+	GetOrganizationByDomain(ctx context.Context, emailDomain string) (*domain.Organization, error)
+	EscrowRepo
+}
+
+//EscrowRepo stores the master keys of the members of organizations wrapped for the escrow key
+type EscrowRepo interface {
+	//PutEscrowWrapping creates or replaces the escrow wrapping of the member
+	PutEscrowWrapping(ctx context.Context, w *domain.EscrowWrapping) error
+	GetEscrowWrapping(ctx context.Context, ownerEmail string) (*domain.EscrowWrapping, error)
+}
+
+type GroupRepo interface {
+	//CreateGroup stores the group with key epoch 1 and adds its owner as first member
+	CreateGroup(ctx context.Context, g *domain.Group) (*domain.Group, error)
+	GetGroup(ctx context.Context, id string) (*domain.Group, error)
+	//AddGroupMember fails with ErrAlreadyExists if the user already is a member
+	AddGroupMember(ctx context.Context, m *domain.GroupMember) error
+	//RemoveGroupMember removes the member and increments the key epoch of the group
+	RemoveGroupMember(ctx context.Context, groupID, memberEmail string) error
+	ListGroupMembers(ctx context.Context, groupID string) ([]*domain.GroupMember, error)
+	//ListGroupsOfMember returns the memberships of the user with the normalized memberEmail
+	ListGroupsOfMember(ctx context.Context, memberEmail string) ([]*domain.GroupMember, error)
+	//PutGroupKeyWrappings creates or replaces the wrappings of the group key in epoch. It fails with
+	//ErrStaleEpoch if epoch is not the current key epoch of the group
+	PutGroupKeyWrappings(ctx context.Context, groupID string, epoch int64, wrappings []*domain.GroupKeyWrapping) error
+	GetGroupKeyWrapping(ctx context.Context, groupID string, epoch int64, memberEmail string) (*domain.GroupKeyWrapping, error)
+	//ListGroupKeyWrappings returns all wrappings of the group key in epoch
+	ListGroupKeyWrappings(ctx context.Context, groupID string, epoch int64) ([]*domain.GroupKeyWrapping, error)
+}
+
+//GroupKeyRepo stores the group keys wrapped for the members apart from the groups, see ResidencyRepo
+type GroupKeyRepo interface {
+	//StoreGroupKeyWrappings creates or replaces the wrappings without checking the key epochs of their
+	//groups, the caller has to check them
+	StoreGroupKeyWrappings(ctx context.Context, wrappings []*domain.GroupKeyWrapping) error
+	GetGroupKeyWrapping(ctx context.Context, groupID string, epoch int64, memberEmail string) (*domain.GroupKeyWrapping, error)
+	ListGroupKeyWrappings(ctx context.Context, groupID string, epoch int64) ([]*domain.GroupKeyWrapping, error)
+}
+
+//KeyLogRepo stores the entries of the append only key transparency log. Entries are never removed, not
+//even when the user is purged. The log is built from the user events, a cursor tracks the last event
+//taken into it
+type KeyLogRepo interface {
+	//GetKeyLogCursor returns the sequence of the last user event taken into the log, 0 if none
+	GetKeyLogCursor(ctx context.Context) (int64, error)
+	//AppendKeyLogEntries stores entries at the end of the log and advances the cursor from after to cursor
+	//in the same transaction. It fails with ErrCursorMoved if the cursor is no longer at after
+	AppendKeyLogEntries(ctx context.Context, after, cursor int64, entries []*domain.KeyLogEntry) error
+	//ListKeyLogEntries returns up to limit entries starting at index start in log order
+	ListKeyLogEntries(ctx context.Context, start int64, limit int) ([]*domain.KeyLogEntry, error)
+}
+
+//AuditRepo is the append only store of the audit log. Entries are kept when users are purged
+type AuditRepo interface {
+	AppendAuditEntry(ctx context.Context, e *domain.AuditEntry) error
+	//QueryAuditEntries returns up to filter.Limit entries matching filter ordered by time. Without
+	//filter.Email, From and To have to be set
+	QueryAuditEntries(ctx context.Context, filter domain.AuditFilter) ([]*domain.AuditEntry, error)
+}
+
+//UserEventRepo reads the outbox of user events. Events are written by the mutating methods of UserRepo
+//and DeviceRepo in the same transaction as the change
+type UserEventRepo interface {
+	//ListUserEvents returns up to limit events with a sequence larger than after in order
+	ListUserEvents(ctx context.Context, after int64, limit int) ([]*domain.UserEvent, error)
+	//PurgeUserEvents removes events created before createdBefore and returns their number. The latest
+	//event is always kept, so that sequences are never reused
+	PurgeUserEvents(ctx context.Context, createdBefore time.Time) (int, error)
+}
+
+//UserEventRelayRepo takes the events of other outboxes into the outbox of the repo, for writes that can not
+//share a transaction with it. Relayed events get new sequences
+type UserEventRelayRepo interface {
+	//GetRelayCursor returns the sequence of the last event of source relayed, 0 if none
+	GetRelayCursor(ctx context.Context, source string) (int64, error)
+	//RelayUserEvents appends events to the outbox and advances the cursor of source from after to cursor in
+	//the same transaction. It fails with ErrCursorMoved if the cursor is no longer at after
+	RelayUserEvents(ctx context.Context, source string, after, cursor int64, events []*domain.UserEvent) error
+}
+
+//UserEventSourceRepo is implemented by repos writing events to outboxes besides the one they list. The
+//outboxes are keyed by unique names and have to be relayed, see UserService.UserEventRelay
+type UserEventSourceRepo interface {
+	UserEventSources() map[string]UserEventRepo
+}
+
+//WebhookRepo stores the registered webhooks and the state of their deliveries. Deliveries are at least once,
+//receivers have to deduplicate by the event sequence
+type WebhookRepo interface {
+	CreateWebhook(ctx context.Context, w *domain.Webhook) (*domain.Webhook, error)
+	ListWebhooks(ctx context.Context) ([]*domain.Webhook, error)
+	//DeleteWebhook removes the webhook together with all its deliveries
+	DeleteWebhook(ctx context.Context, id string) error
+	//GetWebhookCursor returns the sequence of the last user event enqueued for delivery, 0 if none
+	GetWebhookCursor(ctx context.Context) (int64, error)
+	//EnqueueWebhookDeliveries stores the pending deliveries and advances the cursor to cursor. Deliveries
+	//that have been enqueued before are skipped and the cursor never moves backwards, so enqueueing the
+	//same events again is harmless
+	EnqueueWebhookDeliveries(ctx context.Context, cursor int64, deliveries []*domain.WebhookDelivery) error
+	//ListDueWebhookDeliveries returns up to limit pending deliveries whose next attempt is not after now
+	ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*domain.WebhookDelivery, error)
+	//ClaimWebhookDelivery hides the due delivery d from other dispatchers until leaseUntil by moving its next
+	//attempt there. It fails with ErrNotFound if d is no longer pending with the next attempt it has been
+	//listed with, e.g. because another dispatcher claimed it or its webhook has been deleted
+	ClaimWebhookDelivery(ctx context.Context, d *domain.WebhookDelivery, leaseUntil time.Time) error
+	//UpdateWebhookDelivery stores the state, attempts, next attempt and last error of d
+	UpdateWebhookDelivery(ctx context.Context, d *domain.WebhookDelivery) error
+	//CompleteWebhookDelivery removes a successful delivery
+	CompleteWebhookDelivery(ctx context.Context, webhookID string, eventSequence int64) error
+	//ListDeadWebhookDeliveries returns up to limit dead deliveries of webhookID, or of all webhooks if
+	//webhookID is empty
+	ListDeadWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]*domain.WebhookDelivery, error)
+}
+
+//UserAdminRepo provides the operations of the admin tooling
+type UserAdminRepo interface {
+	//ListUsers returns up to filter.Limit users matching filter ordered by normalized email
+	ListUsers(ctx context.Context, filter domain.UserFilter) ([]*domain.User, error)
+	//ScanUsers calls fn with every user including deleted ones in no particular order, reading the users
+	//only once. It stops at the first error of fn and returns it
+	ScanUsers(ctx context.Context, fn func(u *domain.User) error) error
+	//FindByEmail returns the user with the normalized email, also if it has been deleted. It fails with
+	//ErrNotFound for unknown or purged users
+	FindByEmail(ctx context.Context, email string) (*domain.User, error)
+	//RotateUserKey replaces the public key and the wrapped keys of the user with the email of u. It fails
+	//with ErrNotFound for unknown or deleted users and with ErrAlreadyExists if the new key is in use
+	RotateUserKey(ctx context.Context, u *domain.User) (*domain.User, error)
+	//ImportUser stores u as is, including its state and timestamps. An existing user with the same email
+	//is only replaced if overwrite is set, otherwise ErrAlreadyExists is returned. It also fails with
+	//ErrAlreadyExists if the key of u belongs to another user or a device
+	ImportUser(ctx context.Context, u *domain.User, overwrite bool) (replaced bool, err error)
+}
+
+//UserDirectoryRepo holds all operations on users. It is implemented by the backends and by decorators
+//like MirrorRepo and CachedUserRepo, so these can be stacked
+type UserDirectoryRepo interface {
+	UserRepo
+	UserAdminRepo
+}
+
+//ResidencyIndex is the global index of the regions storing the users, see ResidencyRepo
+type ResidencyIndex interface {
+	//GetResidency returns the residency of the user with the normalized email. It fails with ErrNotFound
+	//for unknown users
+	GetResidency(ctx context.Context, email string) (*domain.UserResidency, error)
+	//CreateResidency stores r. It fails with ErrAlreadyExists if the email already has a residency
+	CreateResidency(ctx context.Context, r *domain.UserResidency) error
+	//SwapResidency replaces the residency of r.Email with r if its region and target still equal the ones
+	//of expected, otherwise it fails with ErrResidencyChanged
+	SwapResidency(ctx context.Context, expected, r *domain.UserResidency) error
+	//DeleteResidency removes the residency of the user with the normalized email. It fails with
+	//ErrNotFound for unknown users
+	DeleteResidency(ctx context.Context, email string) error
+}
+
+//UserData is the data stored along with a user, which moves with it to another backend
+type UserData struct {
+	Devices           []*domain.Device
+	Enrollments       []*domain.Enrollment
+	RecoveryWrappings []*domain.RecoveryWrapping
+	RecoveryAudits    []*domain.RecoveryAudit
+	//EscrowWrapping is nil for users outside of organizations
+	EscrowWrapping *domain.EscrowWrapping
+	//GroupKeyWrappings are the wrappings of the current key epochs of the groups of the user
+	GroupKeyWrappings []*domain.GroupKeyWrapping
+}
+
+//UserMoveRepo is implemented by the backends users are moved between, see ResidencyRepo.MoveUser
+type UserMoveRepo interface {
+	//FenceUser makes all writes to the user with the normalized email and to its UserData fail with
+	//ErrUserMoving until UnfenceUser is called. Writes that committed before are kept, so the user can be
+	//copied once FenceUser returned. PurgeByEmail and the last seen times of TouchDevice are not fenced
+	FenceUser(ctx context.Context, email string) error
+	UnfenceUser(ctx context.Context, email string) error
+	//ImportUserData stores data as is, replacing entries with the same keys. It does not announce
+	//user events, the data of the user did not change
+	ImportUserData(ctx context.Context, data *UserData) error
+	//DropMovedUser removes the user with the normalized email, its UserData and its fence without
+	//announcing user events, after the user has been moved to another backend or its copy is given up
+	DropMovedUser(ctx context.Context, email string) error
+}
+
+//KeyOwner maps a PKIX encoded public key to the normalized email of its user
+type KeyOwner struct {
+	PublicKeyPKIX []byte
+	Email         string
+}
+
+//UserKeyIndex maps the public keys of users to their emails, for backends that hold a part of the users
+//only, see ShardedRepo
+type UserKeyIndex interface {
+	//GetKeyOwner returns the normalized email of the user with the key. It fails with ErrNotFound for
+	//unknown keys
+	GetKeyOwner(ctx context.Context, PKIXPublicKey []byte) (string, error)
+	//ClaimKey maps the key to the normalized email. It fails with ErrAlreadyExists if the key maps to
+	//another email, claiming it again for the same email succeeds
+	ClaimKey(ctx context.Context, PKIXPublicKey []byte, email string) error
+	//DeleteKeyOwner removes the mapping of the key to email. It fails with ErrNotFound if the key does not
+	//map to email
+	DeleteKeyOwner(ctx context.Context, PKIXPublicKey []byte, email string) error
+	//ListKeyOwners returns up to limit mappings with a key greater than after, ordered by key
+	ListKeyOwners(ctx context.Context, after []byte, limit int) ([]*KeyOwner, error)
 }
@@ -0,0 +1,715 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+//mirrorPageSize is the number of users fetched at once when comparing backends
+const mirrorPageSize = 1000
+
+//MirrorBackend is implemented by the backends MirrorRepo mirrors between. Besides the users it holds their
+//UserData and verification tokens
+type MirrorBackend interface {
+	UserDirectoryRepo
+	VerificationTokenRepo
+	DeviceRepo
+	EnrollmentRepo
+	RecoveryRepo
+	EscrowRepo
+	UserMoveRepo
+}
+
+//MirrorRepo is a decorator for live migrations of the users between backends. All calls are served by
+//Primary. After each successful write the affected user is copied from Primary to Secondary together with
+//its UserData, except for the group keys. Verification tokens and the last seen times of devices are
+//written to both backends instead. Copies of concurrent writes to the same user may land out of order and
+//a failed copy is not retried, it does not fail the call but is reported to OnMirrorError. Secondary can
+//therefore drift, VerifyMirror finds the drift and BackfillMirror repairs it.
+//
+//Organizations, groups with their keys, the key log, the audit log, the outbox and the webhooks are shared
+//by all users and are not mirrored. They stay with Primary and have to be copied separately before the
+//server is switched to Secondary, see cmd/mirrorUsers
+type MirrorRepo struct {
+	Primary   MirrorBackend
+	Secondary MirrorBackend
+	//ReadFromSecondary serves reads from Secondary, to cut over reads once VerifyMirror reports no drift
+	ReadFromSecondary bool
+	//OnMirrorError is called with the normalized email of users whose writes could not be mirrored.
+	//Errors are logged if it is nil
+	OnMirrorError func(email string, err error)
+}
+
+func (m *MirrorRepo) reads() MirrorBackend {
+	if m.ReadFromSecondary {
+		return m.Secondary
+	}
+	return m.Primary
+}
+
+//mirror copies the user with email and its data from Primary to Secondary
+func (m *MirrorRepo) mirror(ctx context.Context, email string) {
+	normalized, err := domain.NormalizeEmail(email)
+	if err == nil {
+		err = copyUser(ctx, m.Primary, m.Secondary, normalized)
+	}
+	if err != nil {
+		m.mirrorFailed(normalized, err)
+	}
+}
+
+//mirrorFailed reports a write to the user with the normalized email that has not been mirrored
+func (m *MirrorRepo) mirrorFailed(email string, err error) {
+	if m.OnMirrorError != nil {
+		m.OnMirrorError(email, err)
+		return
+	}
+	log.Printf("failed to mirror user %v : %v", email, err)
+}
+
+func (m *MirrorRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error) {
+	return m.reads().GetByPk(ctx, PKIXPublicKey)
+}
+
+func (m *MirrorRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	return m.reads().GetByEmail(ctx, email)
+}
+
+func (m *MirrorRepo) ListUsers(ctx context.Context, filter domain.UserFilter) ([]*domain.User, error) {
+	return m.reads().ListUsers(ctx, filter)
+}
+
+func (m *MirrorRepo) ScanUsers(ctx context.Context, fn func(u *domain.User) error) error {
+	return m.reads().ScanUsers(ctx, fn)
+}
+
+func (m *MirrorRepo) FindByEmail(ctx context.Context, email string) (*domain.User, error) {
+	return m.reads().FindByEmail(ctx, email)
+}
+
+func (m *MirrorRepo) Create(ctx context.Context, u *domain.User) (*domain.User, error) {
+	created, err := m.Primary.Create(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	m.mirror(ctx, created.Email)
+	return created, nil
+}
+
+func (m *MirrorRepo) Update(ctx context.Context, u *domain.User) (*domain.User, error) {
+	updated, err := m.Primary.Update(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	m.mirror(ctx, updated.Email)
+	return updated, nil
+}
+
+func (m *MirrorRepo) DeleteByEmail(ctx context.Context, email string) error {
+	if err := m.Primary.DeleteByEmail(ctx, email); err != nil {
+		return err
+	}
+	m.mirror(ctx, email)
+	return nil
+}
+
+func (m *MirrorRepo) Restore(ctx context.Context, email string, deletedAfter time.Time) (*domain.User, error) {
+	restored, err := m.Primary.Restore(ctx, email, deletedAfter)
+	if err != nil {
+		return nil, err
+	}
+	m.mirror(ctx, email)
+	return restored, nil
+}
+
+func (m *MirrorRepo) PurgeByEmail(ctx context.Context, email string) error {
+	if err := m.Primary.PurgeByEmail(ctx, email); err != nil {
+		return err
+	}
+	m.mirror(ctx, email)
+	return nil
+}
+
+//PurgeDeleted purges both backends with the same cut off, so they stay in sync without copying users
+func (m *MirrorRepo) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	purged, err := m.Primary.PurgeDeleted(ctx, deletedBefore)
+	if err != nil {
+		return purged, err
+	}
+	if _, err := m.Secondary.PurgeDeleted(ctx, deletedBefore); err != nil {
+		log.Printf("failed to purge deleted users of mirror : %v", err)
+	}
+	return purged, nil
+}
+
+func (m *MirrorRepo) RotateUserKey(ctx context.Context, u *domain.User) (*domain.User, error) {
+	rotated, err := m.Primary.RotateUserKey(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	m.mirror(ctx, rotated.Email)
+	return rotated, nil
+}
+
+func (m *MirrorRepo) ImportUser(ctx context.Context, u *domain.User, overwrite bool) (bool, error) {
+	replaced, err := m.Primary.ImportUser(ctx, u, overwrite)
+	if err != nil {
+		return false, err
+	}
+	m.mirror(ctx, u.Email)
+	return replaced, nil
+}
+
+func (m *MirrorRepo) CreateToken(ctx context.Context, t *domain.VerificationToken) error {
+	if err := m.Primary.CreateToken(ctx, t); err != nil {
+		return err
+	}
+	if err := m.Secondary.CreateToken(ctx, t); err != nil {
+		m.mirrorFailed(t.Email, err)
+	}
+	return nil
+}
+
+//ConsumeToken consumes the token in Primary, which decides if it is valid, and then removes it from
+//Secondary
+func (m *MirrorRepo) ConsumeToken(ctx context.Context, tokenHash []byte, email string, purpose domain.VerificationPurpose) (*domain.VerificationToken, error) {
+	t, err := m.Primary.ConsumeToken(ctx, tokenHash, email, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.Secondary.ConsumeToken(ctx, tokenHash, email, purpose); err != nil && !errors.Is(err, ErrNotFound) {
+		m.mirrorFailed(email, err)
+	}
+	return t, nil
+}
+
+func (m *MirrorRepo) PurgeExpiredTokens(ctx context.Context, now time.Time) (int, error) {
+	purged, err := m.Primary.PurgeExpiredTokens(ctx, now)
+	if err != nil {
+		return purged, err
+	}
+	if _, err := m.Secondary.PurgeExpiredTokens(ctx, now); err != nil {
+		log.Printf("failed to purge expired tokens of mirror : %v", err)
+	}
+	return purged, nil
+}
+
+func (m *MirrorRepo) ScanTokens(ctx context.Context, fn func(t *domain.VerificationToken) error) error {
+	return m.reads().ScanTokens(ctx, fn)
+}
+
+func (m *MirrorRepo) AddDevice(ctx context.Context, d *domain.Device) (*domain.Device, error) {
+	added, err := m.Primary.AddDevice(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	m.mirror(ctx, added.OwnerEmail)
+	return added, nil
+}
+
+func (m *MirrorRepo) ListDevices(ctx context.Context, ownerEmail string) ([]*domain.Device, error) {
+	return m.reads().ListDevices(ctx, ownerEmail)
+}
+
+func (m *MirrorRepo) GetDeviceByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.Device, error) {
+	return m.reads().GetDeviceByPk(ctx, PKIXPublicKey)
+}
+
+func (m *MirrorRepo) RevokeDevice(ctx context.Context, ownerEmail, deviceID string) error {
+	if err := m.Primary.RevokeDevice(ctx, ownerEmail, deviceID); err != nil {
+		return err
+	}
+	m.mirror(ctx, ownerEmail)
+	return nil
+}
+
+//TouchDevice is written to both backends, copying the user on every request of a device would be too
+//expensive. Devices that have not been copied yet are skipped
+func (m *MirrorRepo) TouchDevice(ctx context.Context, ownerEmail, deviceID string, lastSeen time.Time) error {
+	if err := m.Primary.TouchDevice(ctx, ownerEmail, deviceID, lastSeen); err != nil {
+		return err
+	}
+	if err := m.Secondary.TouchDevice(ctx, ownerEmail, deviceID, lastSeen); err != nil && !errors.Is(err, ErrNotFound) {
+		m.mirrorFailed(ownerEmail, err)
+	}
+	return nil
+}
+
+func (m *MirrorRepo) CreateEnrollment(ctx context.Context, e *domain.Enrollment) (*domain.Enrollment, error) {
+	created, err := m.Primary.CreateEnrollment(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	m.mirror(ctx, created.OwnerEmail)
+	return created, nil
+}
+
+func (m *MirrorRepo) GetEnrollment(ctx context.Context, ownerEmail, id string) (*domain.Enrollment, error) {
+	return m.reads().GetEnrollment(ctx, ownerEmail, id)
+}
+
+func (m *MirrorRepo) ListEnrollments(ctx context.Context, ownerEmail string) ([]*domain.Enrollment, error) {
+	return m.reads().ListEnrollments(ctx, ownerEmail)
+}
+
+func (m *MirrorRepo) ApproveEnrollment(ctx context.Context, ownerEmail, id, deviceID string) error {
+	if err := m.Primary.ApproveEnrollment(ctx, ownerEmail, id, deviceID); err != nil {
+		return err
+	}
+	m.mirror(ctx, ownerEmail)
+	return nil
+}
+
+func (m *MirrorRepo) PurgeExpiredEnrollments(ctx context.Context, now time.Time) (int, error) {
+	purged, err := m.Primary.PurgeExpiredEnrollments(ctx, now)
+	if err != nil {
+		return purged, err
+	}
+	if _, err := m.Secondary.PurgeExpiredEnrollments(ctx, now); err != nil {
+		log.Printf("failed to purge expired enrollments of mirror : %v", err)
+	}
+	return purged, nil
+}
+
+func (m *MirrorRepo) AddRecoveryWrapping(ctx context.Context, w *domain.RecoveryWrapping) (*domain.RecoveryWrapping, error) {
+	added, err := m.Primary.AddRecoveryWrapping(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+	m.mirror(ctx, added.OwnerEmail)
+	return added, nil
+}
+
+func (m *MirrorRepo) ListRecoveryWrappings(ctx context.Context, ownerEmail string) ([]*domain.RecoveryWrapping, error) {
+	return m.reads().ListRecoveryWrappings(ctx, ownerEmail)
+}
+
+func (m *MirrorRepo) GetRecoveryWrapping(ctx context.Context, ownerEmail, id string) (*domain.RecoveryWrapping, error) {
+	return m.reads().GetRecoveryWrapping(ctx, ownerEmail, id)
+}
+
+func (m *MirrorRepo) DeleteRecoveryWrapping(ctx context.Context, ownerEmail, id string) error {
+	if err := m.Primary.DeleteRecoveryWrapping(ctx, ownerEmail, id); err != nil {
+		return err
+	}
+	m.mirror(ctx, ownerEmail)
+	return nil
+}
+
+func (m *MirrorRepo) AddRecoveryAudit(ctx context.Context, a *domain.RecoveryAudit) error {
+	if err := m.Primary.AddRecoveryAudit(ctx, a); err != nil {
+		return err
+	}
+	m.mirror(ctx, a.OwnerEmail)
+	return nil
+}
+
+func (m *MirrorRepo) ListRecoveryAudits(ctx context.Context, ownerEmail string) ([]*domain.RecoveryAudit, error) {
+	return m.reads().ListRecoveryAudits(ctx, ownerEmail)
+}
+
+func (m *MirrorRepo) PutEscrowWrapping(ctx context.Context, w *domain.EscrowWrapping) error {
+	if err := m.Primary.PutEscrowWrapping(ctx, w); err != nil {
+		return err
+	}
+	m.mirror(ctx, w.OwnerEmail)
+	return nil
+}
+
+func (m *MirrorRepo) GetEscrowWrapping(ctx context.Context, ownerEmail string) (*domain.EscrowWrapping, error) {
+	return m.reads().GetEscrowWrapping(ctx, ownerEmail)
+}
+
+//copyUser makes the user with the normalized email and its UserData in to equal the ones in from, removing
+//the user from to if it does not exist in from
+func copyUser(ctx context.Context, from MirrorBackend, to MirrorBackend, email string) error {
+	u, err := from.FindByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		if err := to.PurgeByEmail(ctx, email); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to remove user from mirror : %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := readUserData(ctx, from, email)
+	if err != nil {
+		return err
+	}
+	copied, err := readUserData(ctx, to, email)
+	if err != nil {
+		return fmt.Errorf("failed to read user data of mirror : %v", err)
+	}
+	if err := dropStaleData(ctx, to, email, copied, data); err != nil {
+		return fmt.Errorf("failed to remove stale user data from mirror : %v", err)
+	}
+	if _, err := to.ImportUser(ctx, u, true); err != nil {
+		return fmt.Errorf("failed to copy user to mirror : %w", err)
+	}
+	if err := to.ImportUserData(ctx, data); err != nil {
+		return fmt.Errorf("failed to copy user data to mirror : %v", err)
+	}
+	return nil
+}
+
+//dropStaleData removes the entries of copied that no longer exist in data from to. Deleted recovery
+//wrappings are removed one by one. Devices, enrollments, recovery audits and escrow wrappings are only
+//removed by purges, which are mirrored, so if one of them is stale the user is dropped and copied anew
+func dropStaleData(ctx context.Context, to MirrorBackend, email string, copied, data *UserData) error {
+	wrappings := make(map[string]bool, len(data.RecoveryWrappings))
+	for _, v := range data.RecoveryWrappings {
+		wrappings[v.ID] = true
+	}
+	for _, v := range copied.RecoveryWrappings {
+		if wrappings[v.ID] {
+			continue
+		}
+		if err := to.DeleteRecoveryWrapping(ctx, email, v.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	ids := make(map[string]bool)
+	for _, v := range data.Devices {
+		ids["device "+v.ID] = true
+	}
+	for _, v := range data.Enrollments {
+		ids["enrollment "+v.ID] = true
+	}
+	for _, v := range data.RecoveryAudits {
+		ids["audit "+v.ID] = true
+	}
+	stale := copied.EscrowWrapping != nil && data.EscrowWrapping == nil
+	for _, v := range copied.Devices {
+		stale = stale || !ids["device "+v.ID]
+	}
+	for _, v := range copied.Enrollments {
+		stale = stale || !ids["enrollment "+v.ID]
+	}
+	for _, v := range copied.RecoveryAudits {
+		stale = stale || !ids["audit "+v.ID]
+	}
+	if stale {
+		return to.DropMovedUser(ctx, email)
+	}
+	return nil
+}
+
+//UserDriftKind describes how a user differs between the primary and the secondary backend
+type UserDriftKind string
+
+const (
+	//UserDriftMissing users only exist in the primary backend
+	UserDriftMissing UserDriftKind = "missing"
+	//UserDriftExtra users only exist in the secondary backend
+	UserDriftExtra UserDriftKind = "extra"
+	//UserDriftChanged users exist in both backends but differ in Fields
+	UserDriftChanged UserDriftKind = "changed"
+)
+
+//UserDrift is a user that differs between the primary and the secondary backend
+type UserDrift struct {
+	Email  string //normalized email of the user
+	Kind   UserDriftKind
+	Fields []string
+}
+
+//TokenDrift is an unexpired verification token that only exists in one of the backends
+type TokenDrift struct {
+	Email   string
+	Purpose domain.VerificationPurpose
+	//Kind is UserDriftMissing or UserDriftExtra
+	Kind UserDriftKind
+}
+
+//MirrorReport is the result of VerifyMirror and BackfillMirror
+type MirrorReport struct {
+	Compared int
+	Drift    []UserDrift
+	//Repaired is the number of drifted users copied by BackfillMirror
+	Repaired       int
+	ComparedTokens int
+	TokenDrift     []TokenDrift
+	//RepairedTokens is the number of drifted tokens copied or removed by BackfillMirror
+	RepairedTokens int
+}
+
+//InSync returns true if no drift has been found or all drift has been repaired
+func (r MirrorReport) InSync() bool {
+	return len(r.Drift) == r.Repaired && len(r.TokenDrift) == r.RepairedTokens
+}
+
+//userPager pages through all users of a repo ordered by normalized email
+type userPager struct {
+	repo  UserAdminRepo
+	page  []*domain.User
+	after string
+	done  bool
+}
+
+//next returns the next user and its normalized email or nil at the end
+func (p *userPager) next(ctx context.Context) (*domain.User, string, error) {
+	if len(p.page) == 0 && !p.done {
+		users, err := p.repo.ListUsers(ctx, domain.UserFilter{IncludeDeleted: true, After: p.after, Limit: mirrorPageSize})
+		if err != nil {
+			return nil, "", err
+		}
+		p.page = users
+		p.done = len(users) < mirrorPageSize
+	}
+	if len(p.page) == 0 {
+		return nil, "", nil
+	}
+	u := p.page[0]
+	p.page = p.page[1:]
+	normalized, err := domain.NormalizeEmail(u.Email)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid email %v : %v", u.Email, err)
+	}
+	p.after = normalized
+	return u, normalized, nil
+}
+
+//diffUsers returns the names of the fields that differ. Timestamps are compared in milliseconds, as not
+//all backends store finer resolutions
+func diffUsers(a, b *domain.User) []string {
+	var fields []string
+	sameTime := func(x, y time.Time) bool {
+		return x.Truncate(time.Millisecond).Equal(y.Truncate(time.Millisecond))
+	}
+	if a.Email != b.Email {
+		fields = append(fields, "Email")
+	}
+	if a.Name != b.Name {
+		fields = append(fields, "Name")
+	}
+	if a.State != b.State {
+		fields = append(fields, "State")
+	}
+	pkA, errA := x509.MarshalPKIXPublicKey(a.PublicKey)
+	pkB, errB := x509.MarshalPKIXPublicKey(b.PublicKey)
+	if errA != nil || errB != nil || !bytes.Equal(pkA, pkB) {
+		fields = append(fields, "PublicKey")
+	}
+	if !bytes.Equal(a.WrappedPrivateKey, b.WrappedPrivateKey) {
+		fields = append(fields, "WrappedPrivateKey")
+	}
+	if !bytes.Equal(a.WrappedMasterKey, b.WrappedMasterKey) {
+		fields = append(fields, "WrappedMasterKey")
+	}
+	if !sameTime(a.CreatedAt, b.CreatedAt) {
+		fields = append(fields, "CreatedAt")
+	}
+	if !sameTime(a.UpdatedAt, b.UpdatedAt) {
+		fields = append(fields, "UpdatedAt")
+	}
+	if a.IsDeleted() != b.IsDeleted() || (a.IsDeleted() && !sameTime(*a.DeletedAt, *b.DeletedAt)) {
+		fields = append(fields, "DeletedAt")
+	}
+	return fields
+}
+
+//userDataEntries renders the entries of data by field for comparison. Timestamps are compared in
+//milliseconds like in diffUsers. The last seen times of devices are left out, they change with every
+//request of a device
+func userDataEntries(data *UserData) map[string][]string {
+	millis := func(t time.Time) string {
+		return t.UTC().Truncate(time.Millisecond).Format(time.RFC3339Nano)
+	}
+	key := func(pk crypto.PublicKey) string {
+		if pk == nil {
+			return ""
+		}
+		pkPKIX, err := x509.MarshalPKIXPublicKey(pk)
+		if err != nil {
+			return "invalid"
+		}
+		return hex.EncodeToString(pkPKIX)
+	}
+	entries := make(map[string][]string)
+	for _, v := range data.Devices {
+		revoked := ""
+		if v.RevokedAt != nil {
+			revoked = millis(*v.RevokedAt)
+		}
+		entries["Devices"] = append(entries["Devices"], fmt.Sprintf("%v %q %v %x %v %v",
+			v.ID, v.Name, key(v.PublicKey), v.WrappedMasterKey, millis(v.CreatedAt), revoked))
+	}
+	for _, v := range data.Enrollments {
+		entries["Enrollments"] = append(entries["Enrollments"], fmt.Sprintf("%v %q %v %v %v %v %v",
+			v.ID, v.DeviceName, key(v.PublicKey), v.State, v.DeviceID, millis(v.CreatedAt), millis(v.ExpiresAt)))
+	}
+	for _, v := range data.RecoveryWrappings {
+		entries["RecoveryWrappings"] = append(entries["RecoveryWrappings"], fmt.Sprintf("%v %v %q %v %x %v",
+			v.ID, v.Kind, v.Label, key(v.EscrowPublicKey), v.WrappedMasterKey, millis(v.CreatedAt)))
+	}
+	for _, v := range data.RecoveryAudits {
+		entries["RecoveryAudits"] = append(entries["RecoveryAudits"], fmt.Sprintf("%v %v %v %v",
+			v.ID, v.WrappingID, v.Kind, millis(v.RecoveredAt)))
+	}
+	if v := data.EscrowWrapping; v != nil {
+		entries["EscrowWrapping"] = []string{fmt.Sprintf("%v %v %x %v",
+			v.OrganizationID, key(v.EscrowPublicKey), v.WrappedMasterKey, millis(v.UpdatedAt))}
+	}
+	for _, v := range entries {
+		sort.Strings(v)
+	}
+	return entries
+}
+
+//diffUserData returns the names of the fields of the UserData of the user with the normalized email that
+//differ between the backends
+func diffUserData(ctx context.Context, primary, secondary MirrorBackend, email string) ([]string, error) {
+	a, err := readUserData(ctx, primary, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read primary user data : %v", err)
+	}
+	b, err := readUserData(ctx, secondary, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secondary user data : %v", err)
+	}
+	entriesA, entriesB := userDataEntries(a), userDataEntries(b)
+	var fields []string
+	for _, field := range []string{"Devices", "Enrollments", "RecoveryWrappings", "RecoveryAudits", "EscrowWrapping"} {
+		if strings.Join(entriesA[field], "\n") != strings.Join(entriesB[field], "\n") {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+//compareMirror walks the users of both backends in email order and then compares the unexpired tokens.
+//With repair set drifted users and tokens are copied from primary to secondary
+func compareMirror(ctx context.Context, primary, secondary MirrorBackend, repair bool) (*MirrorReport, error) {
+	report := &MirrorReport{}
+	left, right := &userPager{repo: primary}, &userPager{repo: secondary}
+	a, emailA, err := left.next(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list primary users : %v", err)
+	}
+	b, emailB, err := right.next(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secondary users : %v", err)
+	}
+	for a != nil || b != nil {
+		var drift *UserDrift
+		advanceLeft, advanceRight := false, false
+		switch {
+		case b == nil || (a != nil && emailA < emailB):
+			drift = &UserDrift{Email: emailA, Kind: UserDriftMissing}
+			advanceLeft = true
+		case a == nil || emailB < emailA:
+			drift = &UserDrift{Email: emailB, Kind: UserDriftExtra}
+			advanceRight = true
+		default:
+			fields := diffUsers(a, b)
+			dataFields, err := diffUserData(ctx, primary, secondary, emailA)
+			if err != nil {
+				return report, err
+			}
+			if fields = append(fields, dataFields...); len(fields) > 0 {
+				drift = &UserDrift{Email: emailA, Kind: UserDriftChanged, Fields: fields}
+			}
+			advanceLeft, advanceRight = true, true
+		}
+		report.Compared++
+		if drift != nil {
+			report.Drift = append(report.Drift, *drift)
+			if repair {
+				if err := copyUser(ctx, primary, secondary, drift.Email); err != nil {
+					return report, fmt.Errorf("failed to repair %v : %v", drift.Email, err)
+				}
+				report.Repaired++
+			}
+		}
+		if advanceLeft {
+			if a, emailA, err = left.next(ctx); err != nil {
+				return report, fmt.Errorf("failed to list primary users : %v", err)
+			}
+		}
+		if advanceRight {
+			if b, emailB, err = right.next(ctx); err != nil {
+				return report, fmt.Errorf("failed to list secondary users : %v", err)
+			}
+		}
+	}
+	if err := compareTokens(ctx, primary, secondary, repair, report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+//compareTokens adds the unexpired tokens that only exist in one of the backends to report. Tokens are
+//short lived and never change, so they are kept in memory and compared by their hashes
+func compareTokens(ctx context.Context, primary, secondary MirrorBackend, repair bool, report *MirrorReport) error {
+	now := time.Now()
+	scan := func(repo MirrorBackend) (map[string]*domain.VerificationToken, error) {
+		tokens := make(map[string]*domain.VerificationToken)
+		err := repo.ScanTokens(ctx, func(t *domain.VerificationToken) error {
+			if !t.Expired(now) {
+				tokens[string(t.TokenHash)] = t
+			}
+			return nil
+		})
+		return tokens, err
+	}
+	primaryTokens, err := scan(primary)
+	if err != nil {
+		return fmt.Errorf("failed to scan primary tokens : %v", err)
+	}
+	secondaryTokens, err := scan(secondary)
+	if err != nil {
+		return fmt.Errorf("failed to scan secondary tokens : %v", err)
+	}
+	for hash, t := range primaryTokens {
+		report.ComparedTokens++
+		if secondaryTokens[hash] != nil {
+			continue
+		}
+		report.TokenDrift = append(report.TokenDrift, TokenDrift{Email: t.Email, Purpose: t.Purpose, Kind: UserDriftMissing})
+		if repair {
+			if err := secondary.CreateToken(ctx, t); err != nil {
+				return fmt.Errorf("failed to copy token of %v : %v", t.Email, err)
+			}
+			report.RepairedTokens++
+		}
+	}
+	for hash, t := range secondaryTokens {
+		if primaryTokens[hash] != nil {
+			continue
+		}
+		report.ComparedTokens++
+		report.TokenDrift = append(report.TokenDrift, TokenDrift{Email: t.Email, Purpose: t.Purpose, Kind: UserDriftExtra})
+		if repair {
+			_, err := secondary.ConsumeToken(ctx, t.TokenHash, t.Email, t.Purpose)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("failed to remove token of %v : %v", t.Email, err)
+			}
+			report.RepairedTokens++
+		}
+	}
+	return nil
+}
+
+//VerifyMirror compares all users with their UserData and all tokens of both backends and reports the
+//drift without changing anything
+func VerifyMirror(ctx context.Context, primary, secondary MirrorBackend) (*MirrorReport, error) {
+	return compareMirror(ctx, primary, secondary, false)
+}
+
+//BackfillMirror copies all drifted users with their UserData and all drifted tokens from primary to
+//secondary and removes users and tokens that only exist in secondary. It is safe to run while a MirrorRepo
+//mirrors writes, as both copy the current primary state
+func BackfillMirror(ctx context.Context, primary, secondary MirrorBackend) (*MirrorReport, error) {
+	return compareMirror(ctx, primary, secondary, true)
+}
@@ -0,0 +1,654 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+)
+
+//ErrUnknownRegion is returned for regions without a configured backend
+var ErrUnknownRegion = errors.New("unknown region")
+
+//ErrUserMoving is returned for writes to users that are moved to another region
+var ErrUserMoving = errors.New("user is moved to another region")
+
+//RegionBackend is a backend storing the users of a region together with their UserData
+type RegionBackend interface {
+	UserDirectoryRepo
+	DeviceRepo
+	EnrollmentRepo
+	RecoveryRepo
+	EscrowRepo
+	GroupKeyRepo
+	UserEventRepo
+	UserMoveRepo
+}
+
+//ResidencyRepo routes each user to the backend of its region, so that the data of users stays in the
+//storage of their region. The region is picked by domain.User.Region at creation, users without one go
+//to the default region. The ResidencyIndex maps the emails to the regions, lookups by email are
+//forwarded to the backend of the indexed region, lookups by key ask the backends in turn.
+//
+//Along with the users the regions store their UserData, which holds the wrapped keys of the users, see
+//residency_user_data.go. The backend of the index keeps what is shared by the users of all regions: the
+//residencies, the organizations, the groups with their members and key epochs, the verification tokens,
+//the audit log and the webhooks. It also keeps the key log and the outbox, which the events of the
+//regions are relayed to, see UserEventSources. Both only hold emails and public keys, which the key log
+//publishes anyway
+type ResidencyRepo struct {
+	index         ResidencyIndex
+	groups        GroupRepo
+	regions       map[string]RegionBackend
+	regionNames   []string
+	defaultRegion string
+}
+
+//NewResidencyRepo routes the users to the backends in regions, keyed by the region names. groups holds
+//the groups, whose key epochs are checked before the wrapped group keys are stored in the regions
+func NewResidencyRepo(index ResidencyIndex, groups GroupRepo, regions map[string]RegionBackend, defaultRegion string) (*ResidencyRepo, error) {
+	if _, ok := regions[defaultRegion]; !ok {
+		return nil, fmt.Errorf("default region %q has no backend", defaultRegion)
+	}
+	r := &ResidencyRepo{
+		index:         index,
+		groups:        groups,
+		regions:       make(map[string]RegionBackend, len(regions)),
+		defaultRegion: defaultRegion,
+	}
+	for name, repo := range regions {
+		r.regions[name] = repo
+		r.regionNames = append(r.regionNames, name)
+	}
+	sort.Strings(r.regionNames)
+	return r, nil
+}
+
+//Regions returns the sorted names of the configured regions
+func (r *ResidencyRepo) Regions() []string {
+	return append([]string(nil), r.regionNames...)
+}
+
+//HasRegion returns true if region has a backend
+func (r *ResidencyRepo) HasRegion(region string) bool {
+	_, ok := r.regions[region]
+	return ok
+}
+
+//UserEventSources returns the outboxes of the regions besides the one of the index backend, keyed by
+//"region:<name>". Their events have to be relayed to the index backend
+func (r *ResidencyRepo) UserEventSources() map[string]UserEventRepo {
+	sources := make(map[string]UserEventRepo)
+	for _, name := range r.regionNames {
+		if backend := r.regions[name]; !sameBackend(backend, r.index) {
+			sources["region:"+name] = backend
+		}
+	}
+	return sources
+}
+
+//sameBackend returns true if a and b are the same repo
+func sameBackend(a, b interface{}) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	return ta == tb && ta.Comparable() && a == b
+}
+
+func (r *ResidencyRepo) backend(region string) (RegionBackend, error) {
+	repo, ok := r.regions[region]
+	if !ok {
+		return nil, fmt.Errorf("no backend for %q : %w", region, ErrUnknownRegion)
+	}
+	return repo, nil
+}
+
+//residencyOf returns the normalized email, the residency and the backend of the user with email
+func (r *ResidencyRepo) residencyOf(ctx context.Context, email string) (string, *domain.UserResidency, RegionBackend, error) {
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	residency, err := r.index.GetResidency(ctx, normalized)
+	if err != nil {
+		return normalized, nil, nil, err
+	}
+	repo, err := r.backend(residency.Region)
+	if err != nil {
+		return normalized, nil, nil, err
+	}
+	return normalized, residency, repo, nil
+}
+
+//writable returns the residency and the backend of the user with email, unless it is moved
+func (r *ResidencyRepo) writable(ctx context.Context, email string) (*domain.UserResidency, RegionBackend, error) {
+	_, residency, repo, err := r.residencyOf(ctx, email)
+	if err != nil {
+		return nil, nil, err
+	}
+	if residency.IsMoving() {
+		return nil, nil, fmt.Errorf("failed to write user moving to %v : %w", residency.MovingTo, ErrUserMoving)
+	}
+	return residency, repo, nil
+}
+
+//residesIn returns true if the user with email is indexed in region. Copies of moved users may exist
+//in other regions until they are removed
+func (r *ResidencyRepo) residesIn(ctx context.Context, email, region string) (bool, error) {
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return false, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	residency, err := r.index.GetResidency(ctx, normalized)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return residency.Region == region, nil
+}
+
+//removeGroupMemberships removes the user with the normalized email from all groups of groups, for
+//backends that store the groups apart from the users
+func removeGroupMemberships(ctx context.Context, groups GroupRepo, email string) error {
+	memberships, err := groups.ListGroupsOfMember(ctx, email)
+	if err != nil {
+		return fmt.Errorf("failed to fetch group memberships : %v", err)
+	}
+	for _, v := range memberships {
+		if err := groups.RemoveGroupMember(ctx, v.GroupID, v.MemberEmail); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to remove group membership : %v", err)
+		}
+	}
+	return nil
+}
+
+func withRegion(u *domain.User, region string) *domain.User {
+	u.Region = region
+	return u
+}
+
+//checkKeyUnused fails with ErrAlreadyExists if a user or a device of another email outside of region has
+//the key pkPKIX. The backends only check the keys of their own users and devices
+func (r *ResidencyRepo) checkKeyUnused(ctx context.Context, email string, pkPKIX []byte, region string) error {
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return fmt.Errorf("failed to normalize email : %v", err)
+	}
+	for _, name := range r.regionNames {
+		if name == region {
+			continue
+		}
+		var owner string
+		if other, err := r.regions[name].GetByPk(ctx, pkPKIX); err == nil {
+			owner = other.Email
+		} else if !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to check key in %v : %v", name, err)
+		} else if device, err := r.regions[name].GetDeviceByPk(ctx, pkPKIX); err == nil {
+			owner = device.OwnerEmail
+		} else if !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to check key in %v : %v", name, err)
+		} else {
+			continue
+		}
+		//copies of moved users may remain until they are removed
+		if ownerEmail, err := domain.NormalizeEmail(owner); err != nil || ownerEmail != normalized {
+			return fmt.Errorf("key is used in %v : %w", name, ErrAlreadyExists)
+		}
+	}
+	return nil
+}
+
+//checkUserKeyUnused is checkKeyUnused for the key of u
+func (r *ResidencyRepo) checkUserKeyUnused(ctx context.Context, u *domain.User, region string) error {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode public key : %v", err)
+	}
+	return r.checkKeyUnused(ctx, u.Email, pkPKIX, region)
+}
+
+//reserve indexes the normalized email in region. A residency left behind by a purge that failed half
+//way is taken over, a residency of an existing user fails with ErrAlreadyExists
+func (r *ResidencyRepo) reserve(ctx context.Context, email, region string) error {
+	err := r.index.CreateResidency(ctx, &domain.UserResidency{Email: email, Region: region})
+	if !errors.Is(err, ErrAlreadyExists) {
+		return err
+	}
+	existing, err := r.index.GetResidency(ctx, email)
+	if err != nil {
+		return err
+	}
+	if existing.IsMoving() {
+		return fmt.Errorf("user is moving to %v : %w", existing.MovingTo, ErrUserMoving)
+	}
+	repo, err := r.backend(existing.Region)
+	if err != nil {
+		return err
+	}
+	if _, err := repo.FindByEmail(ctx, email); !errors.Is(err, ErrNotFound) {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("user exists in %v : %w", existing.Region, ErrAlreadyExists)
+	}
+	return r.index.SwapResidency(ctx, existing, &domain.UserResidency{Email: email, Region: region})
+}
+
+//release removes the residency of the normalized email reserved for a write that failed, unless the
+//user exists anyway
+func (r *ResidencyRepo) release(ctx context.Context, repo RegionBackend, email string) {
+	if _, err := repo.FindByEmail(ctx, email); !errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err := r.index.DeleteResidency(ctx, email); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("failed to release residency of %v : %v", email, err)
+	}
+}
+
+func (r *ResidencyRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error) {
+	for _, region := range r.regionNames {
+		u, err := r.regions[region].GetByPk(ctx, PKIXPublicKey)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		resides, err := r.residesIn(ctx, u.Email, region)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch residency : %v", err)
+		}
+		if resides {
+			return withRegion(u, region), nil
+		}
+	}
+	return nil, fmt.Errorf("failed to fetch user : %w", ErrNotFound)
+}
+
+func (r *ResidencyRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	_, residency, repo, err := r.residencyOf(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user : %w", err)
+	}
+	u, err := repo.GetByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	return withRegion(u, residency.Region), nil
+}
+
+func (r *ResidencyRepo) FindByEmail(ctx context.Context, email string) (*domain.User, error) {
+	_, residency, repo, err := r.residencyOf(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user : %w", err)
+	}
+	u, err := repo.FindByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	return withRegion(u, residency.Region), nil
+}
+
+//ScanUsers scans the regions in turn. Users found in several regions, e.g. while they are moved, are
+//visited once, in their indexed region if it holds them and otherwise in the first region holding them
+func (r *ResidencyRepo) ScanUsers(ctx context.Context, fn func(u *domain.User) error) error {
+	for i, region := range r.regionNames {
+		err := r.regions[region].ScanUsers(ctx, func(u *domain.User) error {
+			normalized, err := domain.NormalizeEmail(u.Email)
+			if err != nil {
+				return fmt.Errorf("failed to normalize email : %v", err)
+			}
+			residency, err := r.index.GetResidency(ctx, normalized)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("failed to fetch residency : %v", err)
+			}
+			var holders []string
+			if residency != nil && residency.Region != region {
+				holders = []string{residency.Region}
+			} else if residency == nil {
+				holders = r.regionNames[:i]
+			}
+			for _, holder := range holders {
+				repo, err := r.backend(holder)
+				if err != nil {
+					return err
+				}
+				if _, err := repo.FindByEmail(ctx, normalized); err == nil {
+					return nil
+				} else if !errors.Is(err, ErrNotFound) {
+					return err
+				}
+			}
+			return fn(withRegion(u, region))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ListUsers merges the users of all regions. Users found in several regions, e.g. while they are moved,
+//are listed with their indexed region
+func (r *ResidencyRepo) ListUsers(ctx context.Context, filter domain.UserFilter) ([]*domain.User, error) {
+	var merged []*domain.User
+	var emails []string
+	seen := make(map[string]int)
+	for _, region := range r.regionNames {
+		users, err := r.regions[region].ListUsers(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list users of %v : %v", region, err)
+		}
+		for _, u := range users {
+			normalized, err := domain.NormalizeEmail(u.Email)
+			if err != nil {
+				return nil, fmt.Errorf("failed to normalize email : %v", err)
+			}
+			i, duplicate := seen[normalized]
+			if !duplicate {
+				seen[normalized] = len(merged)
+				merged = append(merged, withRegion(u, region))
+				emails = append(emails, normalized)
+				continue
+			}
+			resides, err := r.residesIn(ctx, normalized, region)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch residency : %v", err)
+			}
+			if resides {
+				merged[i] = withRegion(u, region)
+			}
+		}
+	}
+	order := make([]int, len(merged))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return emails[order[i]] < emails[order[j]]
+	})
+	users := make([]*domain.User, 0, len(merged))
+	for _, i := range order {
+		users = append(users, merged[i])
+	}
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+	}
+	return users, nil
+}
+
+//Create stores u in the backend of u.Region, or of the default region if it is empty
+func (r *ResidencyRepo) Create(ctx context.Context, u *domain.User) (*domain.User, error) {
+	region := u.Region
+	if region == "" {
+		region = r.defaultRegion
+	}
+	repo, err := r.backend(region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user : %w", err)
+	}
+	normalized, err := domain.NormalizeEmail(u.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	if err := r.checkUserKeyUnused(ctx, u, region); err != nil {
+		return nil, fmt.Errorf("failed to create user : %w", err)
+	}
+	if err := r.reserve(ctx, normalized, region); err != nil {
+		return nil, fmt.Errorf("failed to create user : %w", err)
+	}
+	created, err := repo.Create(ctx, u)
+	if err != nil {
+		r.release(ctx, repo, normalized)
+		return nil, err
+	}
+	return withRegion(created, region), nil
+}
+
+func (r *ResidencyRepo) Update(ctx context.Context, u *domain.User) (*domain.User, error) {
+	residency, repo, err := r.writable(ctx, u.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user : %w", err)
+	}
+	updated, err := repo.Update(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return withRegion(updated, residency.Region), nil
+}
+
+func (r *ResidencyRepo) DeleteByEmail(ctx context.Context, email string) error {
+	_, repo, err := r.writable(ctx, email)
+	if err != nil {
+		return fmt.Errorf("failed to delete user : %w", err)
+	}
+	return repo.DeleteByEmail(ctx, email)
+}
+
+func (r *ResidencyRepo) Restore(ctx context.Context, email string, deletedAfter time.Time) (*domain.User, error) {
+	residency, repo, err := r.writable(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore user : %w", err)
+	}
+	restored, err := repo.Restore(ctx, email, deletedAfter)
+	if err != nil {
+		return nil, err
+	}
+	return withRegion(restored, residency.Region), nil
+}
+
+//PurgeByEmail removes the user, its group memberships and its residency
+func (r *ResidencyRepo) PurgeByEmail(ctx context.Context, email string) error {
+	residency, repo, err := r.writable(ctx, email)
+	if err != nil {
+		return fmt.Errorf("failed to purge user : %w", err)
+	}
+	if err := repo.PurgeByEmail(ctx, email); err != nil {
+		return err
+	}
+	//the region only drops the group keys wrapped for the user, the groups are stored with the index
+	if err := removeGroupMemberships(ctx, r.groups, residency.Email); err != nil {
+		return err
+	}
+	//a residency left behind is taken over by the next Create
+	if err := r.index.DeleteResidency(ctx, residency.Email); err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to delete residency : %v", err)
+	}
+	return nil
+}
+
+//PurgeDeleted purges all regions and removes the group memberships of the purged users. The residencies
+//of the purged users are taken over by the next Create of their email
+func (r *ResidencyRepo) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	purged := 0
+	for _, region := range r.regionNames {
+		repo := r.regions[region]
+		var expired []string
+		err := repo.ScanUsers(ctx, func(u *domain.User) error {
+			if u.DeletedAt != nil && u.DeletedAt.Before(deletedBefore) {
+				expired = append(expired, u.Email)
+			}
+			return nil
+		})
+		if err != nil {
+			return purged, fmt.Errorf("failed to scan %v : %v", region, err)
+		}
+		n, err := repo.PurgeDeleted(ctx, deletedBefore)
+		purged += n
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge deleted users of %v : %v", region, err)
+		}
+		for _, email := range expired {
+			normalized, err := domain.NormalizeEmail(email)
+			if err != nil {
+				return purged, fmt.Errorf("failed to normalize email : %v", err)
+			}
+			//users restored before the purge or copies of moved users are kept
+			if _, err := r.FindByEmail(ctx, normalized); !errors.Is(err, ErrNotFound) {
+				if err != nil {
+					return purged, err
+				}
+				continue
+			}
+			if err := removeGroupMemberships(ctx, r.groups, normalized); err != nil {
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+func (r *ResidencyRepo) RotateUserKey(ctx context.Context, u *domain.User) (*domain.User, error) {
+	residency, repo, err := r.writable(ctx, u.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate user key : %w", err)
+	}
+	if err := r.checkUserKeyUnused(ctx, u, residency.Region); err != nil {
+		return nil, fmt.Errorf("failed to rotate user key : %w", err)
+	}
+	rotated, err := repo.RotateUserKey(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return withRegion(rotated, residency.Region), nil
+}
+
+//ImportUser stores u in the region of the existing user with its email. New users are stored like by
+//Create. Use MoveUser to change the region of an existing user
+func (r *ResidencyRepo) ImportUser(ctx context.Context, u *domain.User, overwrite bool) (bool, error) {
+	normalized, residency, repo, err := r.residencyOf(ctx, u.Email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, fmt.Errorf("failed to import user : %w", err)
+	}
+	if err == nil {
+		if residency.IsMoving() {
+			return false, fmt.Errorf("failed to import user moving to %v : %w", residency.MovingTo, ErrUserMoving)
+		}
+		if u.Region != "" && u.Region != residency.Region {
+			return false, fmt.Errorf("failed to import user : it is stored in %v, move it first", residency.Region)
+		}
+		if err := r.checkUserKeyUnused(ctx, u, residency.Region); err != nil {
+			return false, fmt.Errorf("failed to import user : %w", err)
+		}
+		return repo.ImportUser(ctx, u, overwrite)
+	}
+
+	region := u.Region
+	if region == "" {
+		region = r.defaultRegion
+	}
+	if repo, err = r.backend(region); err != nil {
+		return false, fmt.Errorf("failed to import user : %w", err)
+	}
+	if err := r.checkUserKeyUnused(ctx, u, region); err != nil {
+		return false, fmt.Errorf("failed to import user : %w", err)
+	}
+	if err := r.reserve(ctx, normalized, region); err != nil {
+		return false, fmt.Errorf("failed to import user : %w", err)
+	}
+	replaced, err := repo.ImportUser(ctx, u, overwrite)
+	if err != nil {
+		r.release(ctx, repo, normalized)
+		return false, err
+	}
+	return replaced, nil
+}
+
+//MoveUser moves the user with email and its UserData to the backend of region, including deleted users.
+//Writes to the user are rejected with ErrUserMoving while reads are served by the old region until the
+//cutover:
+//
+//1. the residency is marked as moving, which rejects further writes routed by the residency
+//2. the user is fenced in the old region, which rejects the writes routed before that did not commit yet
+//3. the user and its data are copied
+//4. the residency is switched to region, which cuts reads and writes over to the copy
+//5. the user is dropped from the old region
+//
+//If the copy fails the move is rolled back. If the cutover fails the user stays blocked, calling MoveUser
+//again resumes the move. The move announces the copy as UserEventImported in region, the removal from
+//the old region is not announced
+func (r *ResidencyRepo) MoveUser(ctx context.Context, email, region string) (*domain.User, error) {
+	normalized, residency, source, err := r.residencyOf(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move user : %w", err)
+	}
+	target, err := r.backend(region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move user : %w", err)
+	}
+	if residency.IsMoving() && residency.MovingTo != region {
+		return nil, fmt.Errorf("failed to move user moving to %v : %w", residency.MovingTo, ErrUserMoving)
+	}
+	if residency.Region == region {
+		u, err := source.FindByEmail(ctx, normalized)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move user : %w", err)
+		}
+		return withRegion(u, region), nil
+	}
+
+	moving := &domain.UserResidency{Email: normalized, Region: residency.Region, MovingTo: region}
+	if !residency.IsMoving() {
+		if err := r.index.SwapResidency(ctx, residency, moving); err != nil {
+			return nil, fmt.Errorf("failed to block writes : %w", err)
+		}
+	}
+	if err := source.FenceUser(ctx, normalized); err != nil {
+		r.abortMove(moving, source, target)
+		return nil, fmt.Errorf("failed to fence user in %v : %v", residency.Region, err)
+	}
+	u, err := r.copyUser(ctx, normalized, source, target)
+	if err != nil {
+		r.abortMove(moving, source, target)
+		return nil, fmt.Errorf("failed to copy user to %v : %w", region, err)
+	}
+	if err := r.index.SwapResidency(ctx, moving, &domain.UserResidency{Email: normalized, Region: region}); err != nil {
+		return nil, fmt.Errorf("failed to cut over to %v : %w", region, err)
+	}
+	if err := source.DropMovedUser(ctx, normalized); err != nil {
+		log.Printf("failed to remove moved user %v from %v : %v", normalized, residency.Region, err)
+	}
+	return withRegion(u, region), nil
+}
+
+//copyUser copies the fenced user with the normalized email and its UserData from source to target
+func (r *ResidencyRepo) copyUser(ctx context.Context, email string, source, target RegionBackend) (*domain.User, error) {
+	u, err := source.FindByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.exportUserData(ctx, email, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export user data : %v", err)
+	}
+	u.Region = ""
+	if _, err := target.ImportUser(ctx, u, true); err != nil {
+		return nil, err
+	}
+	if err := target.ImportUserData(ctx, data); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+//abortMove removes a partial copy of a user whose copy failed and unblocks the writes to it
+func (r *ResidencyRepo) abortMove(moving *domain.UserResidency, source, target RegionBackend) {
+	//the context of the move may be done already
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	if err := target.DropMovedUser(ctx, moving.Email); err != nil {
+		log.Printf("failed to remove partial copy of %v from %v : %v", moving.Email, moving.MovingTo, err)
+	}
+	if err := source.UnfenceUser(ctx, moving.Email); err != nil {
+		log.Printf("failed to unfence %v in %v : %v", moving.Email, moving.Region, err)
+		return
+	}
+	if err := r.index.SwapResidency(ctx, moving, &domain.UserResidency{Email: moving.Email, Region: moving.Region}); err != nil {
+		log.Printf("failed to unblock writes to %v : %v", moving.Email, err)
+	}
+}
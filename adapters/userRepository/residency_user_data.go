@@ -0,0 +1,309 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//The UserData of the users is routed like the users themselves: writes go to the backend of the indexed
+//region unless the user is moving, reads by email are served by it. Lookups that are not keyed by the
+//owner ask the regions in turn and skip the copies left behind by moves
+
+func (r *ResidencyRepo) AddDevice(ctx context.Context, d *domain.Device) (*domain.Device, error) {
+	residency, repo, err := r.writable(ctx, d.OwnerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add device : %w", err)
+	}
+	pkPKIX, err := x509.MarshalPKIXPublicKey(d.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key : %v", err)
+	}
+	if err := r.checkKeyUnused(ctx, d.OwnerEmail, pkPKIX, residency.Region); err != nil {
+		return nil, fmt.Errorf("failed to add device : %w", err)
+	}
+	return repo.AddDevice(ctx, d)
+}
+
+func (r *ResidencyRepo) ListDevices(ctx context.Context, ownerEmail string) ([]*domain.Device, error) {
+	_, _, repo, err := r.residencyOf(ctx, ownerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices : %w", err)
+	}
+	return repo.ListDevices(ctx, ownerEmail)
+}
+
+func (r *ResidencyRepo) GetDeviceByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.Device, error) {
+	for _, region := range r.regionNames {
+		d, err := r.regions[region].GetDeviceByPk(ctx, PKIXPublicKey)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		resides, err := r.residesIn(ctx, d.OwnerEmail, region)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch residency : %v", err)
+		}
+		if resides {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to fetch device : %w", ErrNotFound)
+}
+
+func (r *ResidencyRepo) RevokeDevice(ctx context.Context, ownerEmail, deviceID string) error {
+	_, repo, err := r.writable(ctx, ownerEmail)
+	if err != nil {
+		return fmt.Errorf("failed to revoke device : %w", err)
+	}
+	return repo.RevokeDevice(ctx, ownerEmail, deviceID)
+}
+
+//TouchDevice is not blocked by moves, the last seen time of a device is not worth failing requests for
+func (r *ResidencyRepo) TouchDevice(ctx context.Context, ownerEmail, deviceID string, lastSeen time.Time) error {
+	_, _, repo, err := r.residencyOf(ctx, ownerEmail)
+	if err != nil {
+		return fmt.Errorf("failed to touch device : %w", err)
+	}
+	return repo.TouchDevice(ctx, ownerEmail, deviceID, lastSeen)
+}
+
+func (r *ResidencyRepo) CreateEnrollment(ctx context.Context, e *domain.Enrollment) (*domain.Enrollment, error) {
+	_, repo, err := r.writable(ctx, e.OwnerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create enrollment : %w", err)
+	}
+	return repo.CreateEnrollment(ctx, e)
+}
+
+func (r *ResidencyRepo) GetEnrollment(ctx context.Context, ownerEmail, id string) (*domain.Enrollment, error) {
+	_, _, repo, err := r.residencyOf(ctx, ownerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch enrollment : %w", err)
+	}
+	return repo.GetEnrollment(ctx, ownerEmail, id)
+}
+
+func (r *ResidencyRepo) ListEnrollments(ctx context.Context, ownerEmail string) ([]*domain.Enrollment, error) {
+	_, _, repo, err := r.residencyOf(ctx, ownerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enrollments : %w", err)
+	}
+	return repo.ListEnrollments(ctx, ownerEmail)
+}
+
+func (r *ResidencyRepo) ApproveEnrollment(ctx context.Context, ownerEmail, id, deviceID string) error {
+	_, repo, err := r.writable(ctx, ownerEmail)
+	if err != nil {
+		return fmt.Errorf("failed to approve enrollment : %w", err)
+	}
+	return repo.ApproveEnrollment(ctx, ownerEmail, id, deviceID)
+}
+
+//PurgeExpiredEnrollments purges the expired enrollments of all regions
+func (r *ResidencyRepo) PurgeExpiredEnrollments(ctx context.Context, now time.Time) (int, error) {
+	purged := 0
+	for _, region := range r.regionNames {
+		n, err := r.regions[region].PurgeExpiredEnrollments(ctx, now)
+		purged += n
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge enrollments of %v : %v", region, err)
+		}
+	}
+	return purged, nil
+}
+
+func (r *ResidencyRepo) AddRecoveryWrapping(ctx context.Context, w *domain.RecoveryWrapping) (*domain.RecoveryWrapping, error) {
+	_, repo, err := r.writable(ctx, w.OwnerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add recovery wrapping : %w", err)
+	}
+	return repo.AddRecoveryWrapping(ctx, w)
+}
+
+func (r *ResidencyRepo) ListRecoveryWrappings(ctx context.Context, ownerEmail string) ([]*domain.RecoveryWrapping, error) {
+	_, _, repo, err := r.residencyOf(ctx, ownerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recovery wrappings : %w", err)
+	}
+	return repo.ListRecoveryWrappings(ctx, ownerEmail)
+}
+
+func (r *ResidencyRepo) GetRecoveryWrapping(ctx context.Context, ownerEmail, id string) (*domain.RecoveryWrapping, error) {
+	_, _, repo, err := r.residencyOf(ctx, ownerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recovery wrapping : %w", err)
+	}
+	return repo.GetRecoveryWrapping(ctx, ownerEmail, id)
+}
+
+func (r *ResidencyRepo) DeleteRecoveryWrapping(ctx context.Context, ownerEmail, id string) error {
+	_, repo, err := r.writable(ctx, ownerEmail)
+	if err != nil {
+		return fmt.Errorf("failed to delete recovery wrapping : %w", err)
+	}
+	return repo.DeleteRecoveryWrapping(ctx, ownerEmail, id)
+}
+
+func (r *ResidencyRepo) AddRecoveryAudit(ctx context.Context, a *domain.RecoveryAudit) error {
+	_, repo, err := r.writable(ctx, a.OwnerEmail)
+	if err != nil {
+		return fmt.Errorf("failed to add recovery audit : %w", err)
+	}
+	return repo.AddRecoveryAudit(ctx, a)
+}
+
+func (r *ResidencyRepo) ListRecoveryAudits(ctx context.Context, ownerEmail string) ([]*domain.RecoveryAudit, error) {
+	_, _, repo, err := r.residencyOf(ctx, ownerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recovery audits : %w", err)
+	}
+	return repo.ListRecoveryAudits(ctx, ownerEmail)
+}
+
+func (r *ResidencyRepo) PutEscrowWrapping(ctx context.Context, w *domain.EscrowWrapping) error {
+	_, repo, err := r.writable(ctx, w.OwnerEmail)
+	if err != nil {
+		return fmt.Errorf("failed to store escrow wrapping : %w", err)
+	}
+	return repo.PutEscrowWrapping(ctx, w)
+}
+
+func (r *ResidencyRepo) GetEscrowWrapping(ctx context.Context, ownerEmail string) (*domain.EscrowWrapping, error) {
+	_, _, repo, err := r.residencyOf(ctx, ownerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch escrow wrapping : %w", err)
+	}
+	return repo.GetEscrowWrapping(ctx, ownerEmail)
+}
+
+//PutGroupKeyWrappings checks epoch against the group stored with the index and stores the wrappings in
+//the regions of their members. The check is not atomic with the stores, wrappings of an epoch that went
+//stale meanwhile are never read, as the wrappings are looked up by the current epoch
+func (r *ResidencyRepo) PutGroupKeyWrappings(ctx context.Context, groupID string, epoch int64, wrappings []*domain.GroupKeyWrapping) error {
+	group, err := r.groups.GetGroup(ctx, groupID)
+	if err != nil {
+		return fmt.Errorf("failed to store group key wrappings : %w", err)
+	}
+	if group.KeyEpoch != epoch {
+		return fmt.Errorf("failed to store group key wrappings : %w", ErrStaleEpoch)
+	}
+	return r.StoreGroupKeyWrappings(ctx, wrappings)
+}
+
+//StoreGroupKeyWrappings stores the wrappings in the regions of their members, all members are checked
+//to be writable before any wrapping is stored
+func (r *ResidencyRepo) StoreGroupKeyWrappings(ctx context.Context, wrappings []*domain.GroupKeyWrapping) error {
+	byRegion := make(map[string][]*domain.GroupKeyWrapping)
+	for _, w := range wrappings {
+		residency, _, err := r.writable(ctx, w.MemberEmail)
+		if err != nil {
+			return fmt.Errorf("failed to store group key wrappings : %w", err)
+		}
+		byRegion[residency.Region] = append(byRegion[residency.Region], w)
+	}
+	for _, region := range r.regionNames {
+		if len(byRegion[region]) == 0 {
+			continue
+		}
+		if err := r.regions[region].StoreGroupKeyWrappings(ctx, byRegion[region]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ResidencyRepo) GetGroupKeyWrapping(ctx context.Context, groupID string, epoch int64, memberEmail string) (*domain.GroupKeyWrapping, error) {
+	_, _, repo, err := r.residencyOf(ctx, memberEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch group key wrapping : %w", err)
+	}
+	return repo.GetGroupKeyWrapping(ctx, groupID, epoch, memberEmail)
+}
+
+//ListGroupKeyWrappings merges the wrappings of all regions, skipping those left behind by moves
+func (r *ResidencyRepo) ListGroupKeyWrappings(ctx context.Context, groupID string, epoch int64) ([]*domain.GroupKeyWrapping, error) {
+	var merged []*domain.GroupKeyWrapping
+	for _, region := range r.regionNames {
+		wrappings, err := r.regions[region].ListGroupKeyWrappings(ctx, groupID, epoch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list group key wrappings of %v : %v", region, err)
+		}
+		for _, w := range wrappings {
+			resides, err := r.residesIn(ctx, w.MemberEmail, region)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch residency : %v", err)
+			}
+			if resides {
+				merged = append(merged, w)
+			}
+		}
+	}
+	return merged, nil
+}
+
+//userDataRepo holds the UserData of users besides their group keys, which belong to the groups
+type userDataRepo interface {
+	DeviceRepo
+	EnrollmentRepo
+	RecoveryRepo
+	EscrowRepo
+}
+
+//readUserData reads the UserData of the user with the normalized email from source, without the group keys
+func readUserData(ctx context.Context, source userDataRepo, email string) (*UserData, error) {
+	data := &UserData{}
+	var err error
+	if data.Devices, err = source.ListDevices(ctx, email); err != nil {
+		return nil, fmt.Errorf("failed to list devices : %v", err)
+	}
+	if data.Enrollments, err = source.ListEnrollments(ctx, email); err != nil {
+		return nil, fmt.Errorf("failed to list enrollments : %v", err)
+	}
+	if data.RecoveryWrappings, err = source.ListRecoveryWrappings(ctx, email); err != nil {
+		return nil, fmt.Errorf("failed to list recovery wrappings : %v", err)
+	}
+	if data.RecoveryAudits, err = source.ListRecoveryAudits(ctx, email); err != nil {
+		return nil, fmt.Errorf("failed to list recovery audits : %v", err)
+	}
+	if data.EscrowWrapping, err = source.GetEscrowWrapping(ctx, email); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to fetch escrow wrapping : %v", err)
+	}
+	return data, nil
+}
+
+//exportUserData reads the UserData of the user with the normalized email from source. Only the group
+//keys of the current epochs are exported, older epochs are never read
+func (r *ResidencyRepo) exportUserData(ctx context.Context, email string, source RegionBackend) (*UserData, error) {
+	data, err := readUserData(ctx, source, email)
+	if err != nil {
+		return nil, err
+	}
+	memberships, err := r.groups.ListGroupsOfMember(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch group memberships : %v", err)
+	}
+	for _, m := range memberships {
+		group, err := r.groups.GetGroup(ctx, m.GroupID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch group : %v", err)
+		}
+		w, err := source.GetGroupKeyWrapping(ctx, group.ID, group.KeyEpoch, email)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch group key wrapping : %v", err)
+		}
+		data.GroupKeyWrappings = append(data.GroupKeyWrappings, w)
+	}
+	return data, nil
+}
@@ -0,0 +1,699 @@
+package userRepository
+
+import (
+	"UserService/domain"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//DefaultShardReplicas is the number of points of each shard on the hash ring. More points spread the
+//users more evenly
+const DefaultShardReplicas = 128
+
+//HashRing assigns keys to shards by consistent hashing. Adding a shard only moves the keys it takes over
+//from the other shards, about 1/n of all keys for n shards
+type HashRing struct {
+	points []uint64
+	owners []string
+}
+
+func ringHash(key []byte) uint64 {
+	h := sha256.Sum256(key)
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+//NewHashRing places each of the shards on the ring replicas times. A replicas of 0 selects
+//DefaultShardReplicas
+func NewHashRing(shards []string, replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultShardReplicas
+	}
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(shards)*replicas)
+	for _, shard := range shards {
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{hash: ringHash([]byte(shard + "#" + strconv.Itoa(i))), owner: shard})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	r := &HashRing{
+		points: make([]uint64, len(points)),
+		owners: make([]string, len(points)),
+	}
+	for i, v := range points {
+		r.points[i], r.owners[i] = v.hash, v.owner
+	}
+	return r
+}
+
+//Owner returns the shard of key, the one of the first point at or after the hash of key
+func (r *HashRing) Owner(key []byte) string {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+//ShardBackend is a backend holding the users and the keys hashed to its shard, together with the outbox
+//of the changes to its users
+type ShardBackend interface {
+	UserDirectoryRepo
+	UserKeyIndex
+	UserEventRepo
+	UserMoveRepo
+}
+
+//ShardsCentral is the backend the UserData and the group memberships of the sharded users are kept in
+type ShardsCentral interface {
+	UserMoveRepo
+	GroupRepo
+}
+
+//ShardedRepo distributes the users across shards by consistent hashing of their normalized email. As
+//lookups by public key can not be hashed to the shard of the user, each shard also holds the
+//UserKeyIndex entries of the keys hashed to it.
+//
+//Shards can be added while serving. The repo is then created with the previous shards, users and keys
+//are looked up on their current shard first and on their previous shard second. Writes move the user
+//to its current shard first, Reshard moves all others. A user is copied before it is removed from the
+//previous shard, so reads find it throughout. All replicas have to know the previous shards before the
+//first user is moved, replicas with the old shards only miss the moved users.
+//
+//Sharding spreads the lookups of users, which every request makes. The devices, enrollments, recovery and
+//escrow wrappings, group keys and groups are looked up far less often and stay in the central backend,
+//the repo only removes the UserData and the memberships of purged users from it. Each shard writes the
+//events of its users to its own outbox, see UserEventSources
+type ShardedRepo struct {
+	shards   map[string]ShardBackend
+	names    []string
+	ring     *HashRing
+	previous *HashRing
+	central  ShardsCentral
+}
+
+//NewShardedRepo distributes the users across shards, keyed by their names. The names must stay the same
+//when shards are added, the DSNs may change. previous holds the names of the shards before shards were
+//added, it is empty once Reshard finished. central keeps the data of the users besides the users
+func NewShardedRepo(shards map[string]ShardBackend, previous []string, central ShardsCentral) (*ShardedRepo, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards configured")
+	}
+	s := &ShardedRepo{shards: make(map[string]ShardBackend, len(shards)), central: central}
+	for name, shard := range shards {
+		s.shards[name] = shard
+		s.names = append(s.names, name)
+	}
+	sort.Strings(s.names)
+	s.ring = NewHashRing(s.names, 0)
+	if len(previous) > 0 {
+		for _, name := range previous {
+			if _, ok := shards[name]; !ok {
+				return nil, fmt.Errorf("previous shard %q is not configured, shards can only be added", name)
+			}
+		}
+		s.previous = NewHashRing(previous, 0)
+	}
+	return s, nil
+}
+
+//Shards returns the sorted names of the shards
+func (s *ShardedRepo) Shards() []string {
+	return append([]string(nil), s.names...)
+}
+
+//UserEventSources returns the outboxes of the shards, keyed by "shard:<name>". Their events have to be
+//relayed to the central backend
+func (s *ShardedRepo) UserEventSources() map[string]UserEventRepo {
+	sources := make(map[string]UserEventRepo, len(s.names))
+	for _, name := range s.names {
+		sources["shard:"+name] = s.shards[name]
+	}
+	return sources
+}
+
+//Resharding returns true while previous shards are configured
+func (s *ShardedRepo) Resharding() bool {
+	return s.previous != nil
+}
+
+//ShardOf returns the name of the shard of the user with the normalized email
+func (s *ShardedRepo) ShardOf(email string) string {
+	return s.ring.Owner([]byte(email))
+}
+
+func (s *ShardedRepo) emailShard(email string) ShardBackend {
+	return s.shards[s.ring.Owner([]byte(email))]
+}
+
+func (s *ShardedRepo) keyShard(PKIXPublicKey []byte) ShardBackend {
+	return s.shards[s.ring.Owner(PKIXPublicKey)]
+}
+
+//previousShard returns the previous shard of key if it differs from the current one
+func (s *ShardedRepo) previousShard(key []byte) (ShardBackend, bool) {
+	if s.previous == nil {
+		return nil, false
+	}
+	previous := s.previous.Owner(key)
+	if previous == s.ring.Owner(key) {
+		return nil, false
+	}
+	return s.shards[previous], true
+}
+
+func publicKeyPKIX(u *domain.User) ([]byte, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key : %v", err)
+	}
+	return pkPKIX, nil
+}
+
+//lookup calls fetch with the current shard of key and, while resharding, with the previous one. The
+//current shard is asked again, as the user may have been moved between the first two calls
+func lookup(s *ShardedRepo, key []byte, fetch func(shard ShardBackend) error) error {
+	err := fetch(s.shards[s.ring.Owner(key)])
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	previous, ok := s.previousShard(key)
+	if !ok {
+		return err
+	}
+	if err := fetch(previous); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return fetch(s.shards[s.ring.Owner(key)])
+}
+
+//find returns the user with the normalized email, also if it has been deleted
+func (s *ShardedRepo) find(ctx context.Context, email string) (*domain.User, error) {
+	var u *domain.User
+	err := lookup(s, []byte(email), func(shard ShardBackend) error {
+		var err error
+		u, err = shard.FindByEmail(ctx, email)
+		return err
+	})
+	return u, err
+}
+
+//keyOwner returns the normalized email of the user with the key
+func (s *ShardedRepo) keyOwner(ctx context.Context, PKIXPublicKey []byte) (string, error) {
+	var email string
+	err := lookup(s, PKIXPublicKey, func(shard ShardBackend) error {
+		var err error
+		email, err = shard.GetKeyOwner(ctx, PKIXPublicKey)
+		return err
+	})
+	return email, err
+}
+
+//settleUser moves the user with the normalized email from its previous shard to its current one. It
+//returns true if the user has been moved. The copy is announced as UserEventImported by the current
+//shard, the removal from the previous shard is not announced
+func (s *ShardedRepo) settleUser(ctx context.Context, email string) (bool, error) {
+	from, ok := s.previousShard([]byte(email))
+	if !ok {
+		return false, nil
+	}
+	to := s.emailShard(email)
+	u, err := from.FindByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch user to move : %v", err)
+	}
+	//a copy in the current shard is newer, as all writes go there
+	if _, err := to.ImportUser(ctx, u, false); err != nil {
+		if _, findErr := to.FindByEmail(ctx, email); findErr != nil {
+			return false, fmt.Errorf("failed to copy user to its shard : %v", err)
+		}
+	}
+	if err := from.DropMovedUser(ctx, email); err != nil {
+		return false, fmt.Errorf("failed to remove moved user : %v", err)
+	}
+	return true, nil
+}
+
+//settleKey moves the index entry of the key from its previous shard to its current one. It returns true
+//if the entry has been moved
+func (s *ShardedRepo) settleKey(ctx context.Context, PKIXPublicKey []byte) (bool, error) {
+	from, ok := s.previousShard(PKIXPublicKey)
+	if !ok {
+		return false, nil
+	}
+	email, err := from.GetKeyOwner(ctx, PKIXPublicKey)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	//an entry in the current shard is newer, as all claims go there
+	if err := s.keyShard(PKIXPublicKey).ClaimKey(ctx, PKIXPublicKey, email); err != nil && !errors.Is(err, ErrAlreadyExists) {
+		return false, err
+	}
+	if err := from.DeleteKeyOwner(ctx, PKIXPublicKey, email); err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	return true, nil
+}
+
+//claimKey maps the key to the normalized email. Entries of users that have been purged are taken over
+func (s *ShardedRepo) claimKey(ctx context.Context, PKIXPublicKey []byte, email string) error {
+	if _, err := s.settleKey(ctx, PKIXPublicKey); err != nil {
+		return fmt.Errorf("failed to move key to its shard : %v", err)
+	}
+	shard := s.keyShard(PKIXPublicKey)
+	err := shard.ClaimKey(ctx, PKIXPublicKey, email)
+	if !errors.Is(err, ErrAlreadyExists) {
+		return err
+	}
+	owner, err := shard.GetKeyOwner(ctx, PKIXPublicKey)
+	if err != nil {
+		return err
+	}
+	u, err := s.find(ctx, owner)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err == nil {
+		if pkPKIX, err := publicKeyPKIX(u); err != nil || bytes.Equal(pkPKIX, PKIXPublicKey) {
+			return fmt.Errorf("key belongs to another user : %w", ErrAlreadyExists)
+		}
+	}
+	if err := shard.DeleteKeyOwner(ctx, PKIXPublicKey, owner); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return shard.ClaimKey(ctx, PKIXPublicKey, email)
+}
+
+//releaseKey removes the mapping of the key to the normalized email, unless the user has the key
+func (s *ShardedRepo) releaseKey(ctx context.Context, PKIXPublicKey []byte, email string) error {
+	if u, err := s.find(ctx, email); err == nil {
+		if pkPKIX, err := publicKeyPKIX(u); err == nil && bytes.Equal(pkPKIX, PKIXPublicKey) {
+			return nil
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := s.keyShard(PKIXPublicKey).DeleteKeyOwner(ctx, PKIXPublicKey, email); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+//writable normalizes email and moves the user to its current shard, which it returns
+func (s *ShardedRepo) writable(ctx context.Context, email string) (string, ShardBackend, error) {
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	if _, err := s.settleUser(ctx, normalized); err != nil {
+		return "", nil, err
+	}
+	return normalized, s.emailShard(normalized), nil
+}
+
+//GetByPk resolves the key to the email of its user with the key index. Stale entries of purged users
+//are not returned
+func (s *ShardedRepo) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error) {
+	email, err := s.keyOwner(ctx, PKIXPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user : %w", err)
+	}
+	u, err := s.GetByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if pkPKIX, err := publicKeyPKIX(u); err != nil || !bytes.Equal(pkPKIX, PKIXPublicKey) {
+		return nil, fmt.Errorf("failed to fetch user : %w", ErrNotFound)
+	}
+	return u, nil
+}
+
+func (s *ShardedRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	var u *domain.User
+	err = lookup(s, []byte(normalized), func(shard ShardBackend) error {
+		var err error
+		u, err = shard.GetByEmail(ctx, normalized)
+		return err
+	})
+	return u, err
+}
+
+func (s *ShardedRepo) FindByEmail(ctx context.Context, email string) (*domain.User, error) {
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email : %v", err)
+	}
+	var u *domain.User
+	err = lookup(s, []byte(normalized), func(shard ShardBackend) error {
+		var err error
+		u, err = shard.FindByEmail(ctx, normalized)
+		return err
+	})
+	return u, err
+}
+
+//ScanUsers scans the shards in turn. Users found in two shards while they are moved are visited once, on
+//their current shard
+func (s *ShardedRepo) ScanUsers(ctx context.Context, fn func(u *domain.User) error) error {
+	for _, name := range s.names {
+		err := s.shards[name].ScanUsers(ctx, func(u *domain.User) error {
+			normalized, err := domain.NormalizeEmail(u.Email)
+			if err != nil {
+				return fmt.Errorf("failed to normalize email : %v", err)
+			}
+			if owner := s.ShardOf(normalized); owner != name {
+				if _, err := s.shards[owner].FindByEmail(ctx, normalized); err == nil {
+					return nil
+				} else if !errors.Is(err, ErrNotFound) {
+					return err
+				}
+			}
+			return fn(u)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ListUsers merges the users of all shards. Users found in two shards while they are moved are listed
+//once
+func (s *ShardedRepo) ListUsers(ctx context.Context, filter domain.UserFilter) ([]*domain.User, error) {
+	merged := make(map[string]*domain.User)
+	for _, name := range s.names {
+		users, err := s.shards[name].ListUsers(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list users of shard %v : %v", name, err)
+		}
+		for _, u := range users {
+			normalized, err := domain.NormalizeEmail(u.Email)
+			if err != nil {
+				return nil, fmt.Errorf("failed to normalize email : %v", err)
+			}
+			if _, duplicate := merged[normalized]; !duplicate || s.ShardOf(normalized) == name {
+				merged[normalized] = u
+			}
+		}
+	}
+	emails := make([]string, 0, len(merged))
+	for email := range merged {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	if filter.Limit > 0 && len(emails) > filter.Limit {
+		emails = emails[:filter.Limit]
+	}
+	users := make([]*domain.User, 0, len(emails))
+	for _, email := range emails {
+		users = append(users, merged[email])
+	}
+	return users, nil
+}
+
+func (s *ShardedRepo) Create(ctx context.Context, u *domain.User) (*domain.User, error) {
+	normalized, shard, err := s.writable(ctx, u.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user : %v", err)
+	}
+	pkPKIX, err := publicKeyPKIX(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.claimKey(ctx, pkPKIX, normalized); err != nil {
+		return nil, fmt.Errorf("failed to create user : %w", err)
+	}
+	created, err := shard.Create(ctx, u)
+	if err != nil {
+		if releaseErr := s.releaseKey(ctx, pkPKIX, normalized); releaseErr != nil {
+			return nil, fmt.Errorf("%v, failed to release key : %v", err, releaseErr)
+		}
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *ShardedRepo) Update(ctx context.Context, u *domain.User) (*domain.User, error) {
+	_, shard, err := s.writable(ctx, u.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user : %v", err)
+	}
+	return shard.Update(ctx, u)
+}
+
+func (s *ShardedRepo) DeleteByEmail(ctx context.Context, email string) error {
+	_, shard, err := s.writable(ctx, email)
+	if err != nil {
+		return fmt.Errorf("failed to delete user : %v", err)
+	}
+	return shard.DeleteByEmail(ctx, email)
+}
+
+func (s *ShardedRepo) Restore(ctx context.Context, email string, deletedAfter time.Time) (*domain.User, error) {
+	_, shard, err := s.writable(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore user : %v", err)
+	}
+	return shard.Restore(ctx, email, deletedAfter)
+}
+
+func (s *ShardedRepo) PurgeByEmail(ctx context.Context, email string) error {
+	normalized, shard, err := s.writable(ctx, email)
+	if err != nil {
+		return fmt.Errorf("failed to purge user : %v", err)
+	}
+	u, err := shard.FindByEmail(ctx, normalized)
+	if err != nil {
+		return err
+	}
+	if err := shard.PurgeByEmail(ctx, normalized); err != nil {
+		return err
+	}
+	pkPKIX, err := publicKeyPKIX(u)
+	if err != nil {
+		return err
+	}
+	if err := s.releaseKey(ctx, pkPKIX, normalized); err != nil {
+		return fmt.Errorf("failed to release key : %v", err)
+	}
+	return s.dropUserData(ctx, normalized)
+}
+
+//dropUserData removes the UserData and the group memberships of the purged user with the normalized email
+//from the central backend
+func (s *ShardedRepo) dropUserData(ctx context.Context, email string) error {
+	if err := s.central.DropMovedUser(ctx, email); err != nil {
+		return fmt.Errorf("failed to remove user data : %v", err)
+	}
+	return removeGroupMemberships(ctx, s.central, email)
+}
+
+//PurgeDeleted purges all shards and the central data of the purged users. The key index entries of the
+//purged users are taken over by the next claim of their keys
+func (s *ShardedRepo) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	purged := 0
+	for _, name := range s.names {
+		shard := s.shards[name]
+		var expired []string
+		err := shard.ScanUsers(ctx, func(u *domain.User) error {
+			if u.DeletedAt != nil && u.DeletedAt.Before(deletedBefore) {
+				expired = append(expired, u.Email)
+			}
+			return nil
+		})
+		if err != nil {
+			return purged, fmt.Errorf("failed to scan shard %v : %v", name, err)
+		}
+		n, err := shard.PurgeDeleted(ctx, deletedBefore)
+		purged += n
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge deleted users of shard %v : %v", name, err)
+		}
+		for _, email := range expired {
+			normalized, err := domain.NormalizeEmail(email)
+			if err != nil {
+				return purged, fmt.Errorf("failed to normalize email : %v", err)
+			}
+			//users restored before the purge are kept
+			if _, err := s.find(ctx, normalized); !errors.Is(err, ErrNotFound) {
+				if err != nil {
+					return purged, err
+				}
+				continue
+			}
+			if err := s.dropUserData(ctx, normalized); err != nil {
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+func (s *ShardedRepo) RotateUserKey(ctx context.Context, u *domain.User) (*domain.User, error) {
+	normalized, shard, err := s.writable(ctx, u.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate user key : %v", err)
+	}
+	current, err := shard.GetByEmail(ctx, normalized)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate user key : %w", err)
+	}
+	oldPk, err := publicKeyPKIX(current)
+	if err != nil {
+		return nil, err
+	}
+	newPk, err := publicKeyPKIX(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.claimKey(ctx, newPk, normalized); err != nil {
+		return nil, fmt.Errorf("failed to rotate user key : %w", err)
+	}
+	rotated, err := shard.RotateUserKey(ctx, u)
+	if err != nil {
+		if releaseErr := s.releaseKey(ctx, newPk, normalized); releaseErr != nil {
+			return nil, fmt.Errorf("%v, failed to release key : %v", err, releaseErr)
+		}
+		return nil, err
+	}
+	if err := s.releaseKey(ctx, oldPk, normalized); err != nil {
+		return nil, fmt.Errorf("failed to release old key : %v", err)
+	}
+	return rotated, nil
+}
+
+func (s *ShardedRepo) ImportUser(ctx context.Context, u *domain.User, overwrite bool) (bool, error) {
+	normalized, shard, err := s.writable(ctx, u.Email)
+	if err != nil {
+		return false, fmt.Errorf("failed to import user : %v", err)
+	}
+	existing, err := shard.FindByEmail(ctx, normalized)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	pkPKIX, err := publicKeyPKIX(u)
+	if err != nil {
+		return false, err
+	}
+	if err := s.claimKey(ctx, pkPKIX, normalized); err != nil {
+		return false, fmt.Errorf("failed to import user : %w", err)
+	}
+	replaced, err := shard.ImportUser(ctx, u, overwrite)
+	if err != nil {
+		if releaseErr := s.releaseKey(ctx, pkPKIX, normalized); releaseErr != nil {
+			return false, fmt.Errorf("%v, failed to release key : %v", err, releaseErr)
+		}
+		return false, err
+	}
+	if existing != nil {
+		if oldPk, err := publicKeyPKIX(existing); err == nil && !bytes.Equal(oldPk, pkPKIX) {
+			if err := s.releaseKey(ctx, oldPk, normalized); err != nil {
+				return replaced, fmt.Errorf("failed to release old key : %v", err)
+			}
+		}
+	}
+	return replaced, nil
+}
+
+//ReshardReport is the result of Reshard
+type ReshardReport struct {
+	//Scanned is the number of users and key index entries read
+	Scanned    int
+	MovedUsers int
+	MovedKeys  int
+}
+
+//isPrevious returns true if name is the previous shard of key
+func (s *ShardedRepo) isPrevious(key []byte, name string) bool {
+	return s.previous != nil && s.previous.Owner(key) == name
+}
+
+//Reshard moves all users and key index entries from their previous shards to their current ones and
+//indexes the keys of users missing from the key index, e.g. after moving from a single database to
+//shards. The repo keeps serving meanwhile, it can be run again after a failure
+func (s *ShardedRepo) Reshard(ctx context.Context) (*ReshardReport, error) {
+	report := &ReshardReport{}
+	for _, name := range s.names {
+		shard := s.shards[name]
+		//ScanUsers pages by email, so the moved users can be removed while scanning
+		err := shard.ScanUsers(ctx, func(u *domain.User) error {
+			normalized, err := domain.NormalizeEmail(u.Email)
+			if err != nil {
+				return fmt.Errorf("failed to normalize email : %v", err)
+			}
+			report.Scanned++
+			if s.isPrevious([]byte(normalized), name) {
+				moved, err := s.settleUser(ctx, normalized)
+				if err != nil {
+					return fmt.Errorf("failed to move %v : %v", normalized, err)
+				}
+				if moved {
+					report.MovedUsers++
+				}
+			}
+			pkPKIX, err := publicKeyPKIX(u)
+			if err != nil {
+				return err
+			}
+			if err := s.claimKey(ctx, pkPKIX, normalized); err != nil {
+				return fmt.Errorf("failed to index key of %v : %v", normalized, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to scan shard %v : %v", name, err)
+		}
+		var afterKey []byte
+		for {
+			owners, err := shard.ListKeyOwners(ctx, afterKey, mirrorPageSize)
+			if err != nil {
+				return report, fmt.Errorf("failed to list keys of shard %v : %v", name, err)
+			}
+			for _, v := range owners {
+				afterKey = v.PublicKeyPKIX
+				report.Scanned++
+				if !s.isPrevious(v.PublicKeyPKIX, name) {
+					continue
+				}
+				moved, err := s.settleKey(ctx, v.PublicKeyPKIX)
+				if err != nil {
+					return report, fmt.Errorf("failed to move key of %v : %v", v.Email, err)
+				}
+				if moved {
+					report.MovedKeys++
+				}
+			}
+			if len(owners) < mirrorPageSize {
+				break
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,88 @@
+//createOrganization registers an organization and its escrow key for an email domain.
+//It uses the same DSN envvar as the server. The escrow key is read from a PEM encoded PKIX public key file.
+package main
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/services/UserService"
+	"context"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+const (
+	//EnvDSN connection string for database
+	EnvDSN string = "DSN"
+)
+
+type backend interface {
+	userRepository.UserRepo
+	userRepository.OrganizationRepo
+}
+
+func setupBackend(dsn string) (backend, error) {
+	switch dsn {
+	case "dynamo":
+		return userRepository.NewAwsDynamoUserRepo(session.Must(session.NewSession()))
+	case "dynamo-local":
+		return userRepository.NewAwsLocalDynamoUserRepo(session.Must(session.NewSession()))
+	default:
+		db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+		if err := db.AutoMigrate(&userRepository.OrganizationDTODB{}, &userRepository.EscrowWrappingDTODB{}); err != nil {
+			return nil, fmt.Errorf("failed to auto migrate organizations : %v", err)
+		}
+		return &userRepository.DefaultRepo{DB: db}, nil
+	}
+}
+
+func readPublicKeyPEM(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%v contains no PEM encoded PUBLIC KEY", path)
+	}
+	return block.Bytes, nil
+}
+
+func main() {
+	name := flag.String("name", "", "display name of the organization")
+	emailDomain := flag.String("domain", "", "email domain of the members")
+	escrowKey := flag.String("escrow-key", "", "path of the PEM encoded escrow public key")
+	flag.Parse()
+
+	dsn := os.Getenv(EnvDSN)
+	if dsn == "" {
+		log.Fatalf("Specify %v envvar!", EnvDSN)
+	}
+	if *escrowKey == "" {
+		log.Fatalf("Specify -escrow-key")
+	}
+	pkPKIX, err := readPublicKeyPEM(*escrowKey)
+	if err != nil {
+		log.Fatalf("Failed to read escrow key : %v", err)
+	}
+	repo, err := setupBackend(dsn)
+	if err != nil {
+		log.Fatalf("Failed to setup db : %v", err)
+	}
+
+	userService := UserService.NewUserService(repo, UserService.WithOrganizations(repo))
+	org, err := userService.CreateOrganization(context.Background(), *name, *emailDomain, pkPKIX)
+	if err != nil {
+		log.Fatalf("Failed to create organization : %v", err)
+	}
+	log.Printf("Created %v", org)
+}
@@ -0,0 +1,362 @@
+//Package backendSetup builds the repositories configured by the environment. The server and the admin
+//tools share it, so a tool working on the databases directly sees the users where the server stores them.
+package backendSetup
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//EnvDSN connection string for database
+	EnvDSN string = "DSN"
+	//EnvMirrorDSN connection string of a second database the users and their data are copied to on each
+	//write, to move them to another backend. See cmd/mirrorUsers for the backfill and the verification
+	EnvMirrorDSN string = "MIRROR_DSN"
+	//EnvMirrorReads set to true serves the reads of the mirrored data from the mirror database, once it is
+	//in sync
+	EnvMirrorReads string = "MIRROR_READS"
+	//EnvDynamoRegion region of the dynamodb global tables this replica writes to. Setting it enables
+	//last-writer-wins writes for active-active regions, see cmd/reconcileRegions
+	EnvDynamoRegion string = "DYNAMO_REGION"
+	//EnvDynamoReadRegion region reads are pinned to, defaults to DYNAMO_REGION
+	EnvDynamoReadRegion string = "DYNAMO_READ_REGION"
+	//EnvDynamoHomeRegion region holding the key log, the webhooks and the merged outbox of all regions,
+	//required with DYNAMO_REGION. It has to be the same in all regions
+	EnvDynamoHomeRegion string = "DYNAMO_HOME_REGION"
+	//EnvResidencyRegions comma separated region=dsn pairs of the backends storing the users of each
+	//region, e.g. "eu=eu.db,us=dynamo:us-east-1". The index of the regions is kept in DSN
+	EnvResidencyRegions string = "RESIDENCY_REGIONS"
+	//EnvResidencyDefaultRegion region of users created without one, defaults to the first region
+	EnvResidencyDefaultRegion string = "RESIDENCY_DEFAULT_REGION"
+	//EnvUserShards comma separated name=dsn pairs of the sqlite databases the users are distributed
+	//across, e.g. "s1=users1.db,s2=users2.db". Names must be kept when adding shards, see cmd/reshardUsers.
+	//The devices, groups and other data of the users stay in DSN
+	EnvUserShards string = "USER_SHARDS"
+	//EnvUserShardsPrevious comma separated names of the shards before shards were added, while resharding
+	EnvUserShardsPrevious string = "USER_SHARDS_PREVIOUS"
+)
+
+//Backend is implemented by all supported repositories
+type Backend interface {
+	userRepository.UserRepo
+	userRepository.VerificationTokenRepo
+	userRepository.DeviceRepo
+	userRepository.EnrollmentRepo
+	userRepository.RecoveryRepo
+	userRepository.OrganizationRepo
+	userRepository.GroupRepo
+	userRepository.GroupKeyRepo
+	userRepository.KeyLogRepo
+	userRepository.AuditRepo
+	userRepository.UserEventRepo
+	userRepository.UserEventRelayRepo
+	userRepository.WebhookRepo
+	userRepository.UserAdminRepo
+	userRepository.ResidencyIndex
+	userRepository.UserMoveRepo
+}
+
+func SetupGormDB(dsn string) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect database: %v", err)
+	}
+
+	err = db.AutoMigrate(
+		&userRepository.UserDTODB{},
+		&userRepository.VerificationTokenDTODB{},
+		&userRepository.DeviceDTODB{},
+		&userRepository.EnrollmentDTODB{},
+		&userRepository.RecoveryWrappingDTODB{},
+		&userRepository.RecoveryAuditDTODB{},
+		&userRepository.OrganizationDTODB{},
+		&userRepository.EscrowWrappingDTODB{},
+		&userRepository.GroupDTODB{},
+		&userRepository.GroupMemberDTODB{},
+		&userRepository.GroupKeyWrappingDTODB{},
+		&userRepository.KeyLogEntryDTODB{},
+		&userRepository.AuditEntryDTODB{},
+		&userRepository.UserEventDTODB{},
+		&userRepository.WebhookDTODB{},
+		&userRepository.WebhookDeliveryDTODB{},
+		&userRepository.CursorDTODB{},
+		&userRepository.UserResidencyDTODB{},
+		&userRepository.UserFenceDTODB{},
+		&userRepository.UserKeyDTODB{},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to auto migrate domain : %v", err)
+	}
+	return db, nil
+}
+
+func isDynamoDSN(dsn string) bool {
+	return dsn == "dynamo" || dsn == "dynamo-local" || strings.HasPrefix(dsn, "dynamo:")
+}
+
+//SetupBackend creates the repository for dsn, which is either "dynamo", "dynamo:<aws region>",
+//"dynamo-local" or a sqlite dsn
+func SetupBackend(dsn string, retention, eventRetention time.Duration) (Backend, error) {
+	if isDynamoDSN(dsn) {
+		sess := session.Must(session.NewSession())
+		var dynamoRepo *userRepository.AwsDynamoUserRepo
+		var err error
+		if strings.HasPrefix(dsn, "dynamo:") {
+			dynamoRepo, err = userRepository.NewAwsDynamoUserRepoInRegion(sess, strings.TrimPrefix(dsn, "dynamo:"))
+		} else if region := os.Getenv(EnvDynamoRegion); dsn == "dynamo" && region != "" {
+			homeRegion := os.Getenv(EnvDynamoHomeRegion)
+			if homeRegion == "" {
+				return nil, fmt.Errorf("%v is required with %v", EnvDynamoHomeRegion, EnvDynamoRegion)
+			}
+			dynamoRepo, err = userRepository.NewAwsRegionalDynamoUserRepo(sess, region, os.Getenv(EnvDynamoReadRegion), homeRegion)
+		} else if dsn == "dynamo" {
+			dynamoRepo, err = userRepository.NewAwsDynamoUserRepo(sess)
+		} else {
+			log.Printf("Setting up dynamo-local db")
+			dynamoRepo, err = userRepository.NewAwsLocalDynamoUserRepo(sess)
+		}
+		if err != nil {
+			return nil, err
+		}
+		dynamoRepo.Retention = retention
+		dynamoRepo.EventRetention = eventRetention
+		return dynamoRepo, nil
+	}
+	db, err := SetupGormDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &userRepository.DefaultRepo{DB: db}, nil
+}
+
+//SetupResidency creates the repo routing the users and their data to the backends of the regions
+//configured by the environment, with the index of the regions and the groups in index. It returns nil if
+//data residency is disabled
+func SetupResidency(index Backend, retention, eventRetention time.Duration) (*userRepository.ResidencyRepo, error) {
+	v := os.Getenv(EnvResidencyRegions)
+	if v == "" {
+		return nil, nil
+	}
+	regions := make(map[string]userRepository.RegionBackend)
+	defaultRegion := os.Getenv(EnvResidencyDefaultRegion)
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %v entry %q, want region=dsn", EnvResidencyRegions, pair)
+		}
+		if _, ok := regions[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate region %v in %v", parts[0], EnvResidencyRegions)
+		}
+		backend, err := SetupBackend(parts[1], retention, eventRetention)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup backend of region %v : %v", parts[0], err)
+		}
+		regions[parts[0]] = backend
+		if defaultRegion == "" {
+			defaultRegion = parts[0]
+		}
+	}
+	residency, err := userRepository.NewResidencyRepo(index, index, regions, defaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	return residency, nil
+}
+
+//SetupShards creates the repo distributing the users across the shards configured by the environment,
+//with the data of the users besides the users in central. It returns nil if sharding is disabled
+func SetupShards(central Backend) (*userRepository.ShardedRepo, error) {
+	v := os.Getenv(EnvUserShards)
+	if v == "" {
+		return nil, nil
+	}
+	shards := make(map[string]userRepository.ShardBackend)
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %v entry %q, want name=dsn", EnvUserShards, pair)
+		}
+		if _, ok := shards[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate shard %v in %v", parts[0], EnvUserShards)
+		}
+		db, err := SetupGormDB(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup shard %v : %v", parts[0], err)
+		}
+		shards[parts[0]] = &userRepository.DefaultRepo{DB: db}
+	}
+	var previous []string
+	for _, name := range strings.Split(os.Getenv(EnvUserShardsPrevious), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			previous = append(previous, name)
+		}
+	}
+	return userRepository.NewShardedRepo(shards, previous, central)
+}
+
+//Directory is the user directory configured by the environment on top of the backend of DSN
+type Directory struct {
+	//Users serves the users, through residency, shards or the mirror if one of them is configured
+	Users userRepository.UserDirectoryRepo
+	//Residency routes the users to the backends of their regions, if configured
+	Residency *userRepository.ResidencyRepo
+	//Sharded distributes the users across shards, if configured
+	Sharded *userRepository.ShardedRepo
+	//Mirror copies the users and their data to the backend of MIRROR_DSN, if configured
+	Mirror *userRepository.MirrorRepo
+	//EventSources are the outboxes the users are written with besides the one of the backend. Their
+	//events have to be relayed to the backend, see UserService.UserEventRelay
+	EventSources map[string]userRepository.UserEventRepo
+}
+
+//SetupDirectory decorates the users of backend with the residency, the shards or the mirror configured
+//by the environment. They can not be combined
+func SetupDirectory(backend Backend, retention, eventRetention time.Duration) (*Directory, error) {
+	dir := &Directory{Users: backend}
+	if sources, ok := backend.(userRepository.UserEventSourceRepo); ok {
+		dir.EventSources = sources.UserEventSources()
+	}
+	residency, err := SetupResidency(backend, retention, eventRetention)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup data residency : %v", err)
+	}
+	if residency != nil {
+		dir.Residency = residency
+		dir.Users = residency
+		dir.EventSources = mergeEventSources(dir.EventSources, residency.UserEventSources())
+	}
+	sharded, err := SetupShards(backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup user shards : %v", err)
+	}
+	if sharded != nil {
+		if residency != nil {
+			return nil, fmt.Errorf("%v can not be combined with %v", EnvUserShards, EnvResidencyRegions)
+		}
+		dir.Sharded = sharded
+		dir.Users = sharded
+		dir.EventSources = mergeEventSources(dir.EventSources, sharded.UserEventSources())
+	}
+	if mirrorDSN := os.Getenv(EnvMirrorDSN); mirrorDSN != "" {
+		if residency != nil || sharded != nil {
+			return nil, fmt.Errorf("%v can not be combined with %v or %v", EnvMirrorDSN, EnvResidencyRegions, EnvUserShards)
+		}
+		secondary, err := SetupBackend(mirrorDSN, retention, eventRetention)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup mirror db : %v", err)
+		}
+		readFromSecondary := false
+		if v := os.Getenv(EnvMirrorReads); v != "" {
+			if readFromSecondary, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("invalid %v : %v", EnvMirrorReads, err)
+			}
+		}
+		dir.Mirror = &userRepository.MirrorRepo{
+			Primary:           backend,
+			Secondary:         secondary,
+			ReadFromSecondary: readFromSecondary,
+		}
+		dir.Users = dir.Mirror
+	}
+	return dir, nil
+}
+
+func mergeEventSources(sources, more map[string]userRepository.UserEventRepo) map[string]userRepository.UserEventRepo {
+	if len(more) == 0 {
+		return sources
+	}
+	merged := make(map[string]userRepository.UserEventRepo, len(sources)+len(more))
+	for name, source := range sources {
+		merged[name] = source
+	}
+	for name, source := range more {
+		merged[name] = source
+	}
+	return merged
+}
+
+//WithUsers returns backend serving the users from users, unless users is backend itself
+func WithUsers(backend Backend, users userRepository.UserDirectoryRepo) Backend {
+	if users == userRepository.UserDirectoryRepo(backend) {
+		return backend
+	}
+	return &UserDirectoryBackend{Backend: backend, Users: users}
+}
+
+//UserDirectoryBackend serves the users from a decorated UserDirectoryRepo and everything else from the
+//underlying Backend
+type UserDirectoryBackend struct {
+	Backend
+	Users userRepository.UserDirectoryRepo
+}
+
+func (b *UserDirectoryBackend) GetByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.User, error) {
+	return b.Users.GetByPk(ctx, PKIXPublicKey)
+}
+
+func (b *UserDirectoryBackend) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	return b.Users.GetByEmail(ctx, email)
+}
+
+func (b *UserDirectoryBackend) Create(ctx context.Context, u *domain.User) (*domain.User, error) {
+	return b.Users.Create(ctx, u)
+}
+
+func (b *UserDirectoryBackend) Update(ctx context.Context, u *domain.User) (*domain.User, error) {
+	return b.Users.Update(ctx, u)
+}
+
+func (b *UserDirectoryBackend) DeleteByEmail(ctx context.Context, email string) error {
+	return b.Users.DeleteByEmail(ctx, email)
+}
+
+func (b *UserDirectoryBackend) Restore(ctx context.Context, email string, deletedAfter time.Time) (*domain.User, error) {
+	return b.Users.Restore(ctx, email, deletedAfter)
+}
+
+func (b *UserDirectoryBackend) PurgeByEmail(ctx context.Context, email string) error {
+	return b.Users.PurgeByEmail(ctx, email)
+}
+
+func (b *UserDirectoryBackend) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	return b.Users.PurgeDeleted(ctx, deletedBefore)
+}
+
+func (b *UserDirectoryBackend) ListUsers(ctx context.Context, filter domain.UserFilter) ([]*domain.User, error) {
+	return b.Users.ListUsers(ctx, filter)
+}
+
+func (b *UserDirectoryBackend) ScanUsers(ctx context.Context, fn func(u *domain.User) error) error {
+	return b.Users.ScanUsers(ctx, fn)
+}
+
+func (b *UserDirectoryBackend) FindByEmail(ctx context.Context, email string) (*domain.User, error) {
+	return b.Users.FindByEmail(ctx, email)
+}
+
+func (b *UserDirectoryBackend) RotateUserKey(ctx context.Context, u *domain.User) (*domain.User, error) {
+	return b.Users.RotateUserKey(ctx, u)
+}
+
+func (b *UserDirectoryBackend) ImportUser(ctx context.Context, u *domain.User, overwrite bool) (bool, error) {
+	return b.Users.ImportUser(ctx, u, overwrite)
+}
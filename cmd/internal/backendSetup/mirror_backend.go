@@ -0,0 +1,112 @@
+package backendSetup
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"context"
+	"time"
+)
+
+//MirroredBackend serves the users, their UserData and the verification tokens through the mirror and
+//everything else from the underlying Backend, which is the primary of the mirror
+type MirroredBackend struct {
+	UserDirectoryBackend
+	Mirror *userRepository.MirrorRepo
+}
+
+//WithMirror returns backend serving the users, their UserData and the verification tokens from mirror,
+//unless mirror is nil. Decorators of the users, e.g. caches, are applied on top with WithUsers
+func WithMirror(backend Backend, mirror *userRepository.MirrorRepo) Backend {
+	if mirror == nil {
+		return backend
+	}
+	return &MirroredBackend{UserDirectoryBackend: UserDirectoryBackend{Backend: backend, Users: mirror}, Mirror: mirror}
+}
+
+func (b *MirroredBackend) CreateToken(ctx context.Context, t *domain.VerificationToken) error {
+	return b.Mirror.CreateToken(ctx, t)
+}
+
+func (b *MirroredBackend) ConsumeToken(ctx context.Context, tokenHash []byte, email string, purpose domain.VerificationPurpose) (*domain.VerificationToken, error) {
+	return b.Mirror.ConsumeToken(ctx, tokenHash, email, purpose)
+}
+
+func (b *MirroredBackend) PurgeExpiredTokens(ctx context.Context, now time.Time) (int, error) {
+	return b.Mirror.PurgeExpiredTokens(ctx, now)
+}
+
+func (b *MirroredBackend) ScanTokens(ctx context.Context, fn func(t *domain.VerificationToken) error) error {
+	return b.Mirror.ScanTokens(ctx, fn)
+}
+
+func (b *MirroredBackend) AddDevice(ctx context.Context, d *domain.Device) (*domain.Device, error) {
+	return b.Mirror.AddDevice(ctx, d)
+}
+
+func (b *MirroredBackend) ListDevices(ctx context.Context, ownerEmail string) ([]*domain.Device, error) {
+	return b.Mirror.ListDevices(ctx, ownerEmail)
+}
+
+func (b *MirroredBackend) GetDeviceByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.Device, error) {
+	return b.Mirror.GetDeviceByPk(ctx, PKIXPublicKey)
+}
+
+func (b *MirroredBackend) RevokeDevice(ctx context.Context, ownerEmail, deviceID string) error {
+	return b.Mirror.RevokeDevice(ctx, ownerEmail, deviceID)
+}
+
+func (b *MirroredBackend) TouchDevice(ctx context.Context, ownerEmail, deviceID string, lastSeen time.Time) error {
+	return b.Mirror.TouchDevice(ctx, ownerEmail, deviceID, lastSeen)
+}
+
+func (b *MirroredBackend) CreateEnrollment(ctx context.Context, e *domain.Enrollment) (*domain.Enrollment, error) {
+	return b.Mirror.CreateEnrollment(ctx, e)
+}
+
+func (b *MirroredBackend) GetEnrollment(ctx context.Context, ownerEmail, id string) (*domain.Enrollment, error) {
+	return b.Mirror.GetEnrollment(ctx, ownerEmail, id)
+}
+
+func (b *MirroredBackend) ListEnrollments(ctx context.Context, ownerEmail string) ([]*domain.Enrollment, error) {
+	return b.Mirror.ListEnrollments(ctx, ownerEmail)
+}
+
+func (b *MirroredBackend) ApproveEnrollment(ctx context.Context, ownerEmail, id, deviceID string) error {
+	return b.Mirror.ApproveEnrollment(ctx, ownerEmail, id, deviceID)
+}
+
+func (b *MirroredBackend) PurgeExpiredEnrollments(ctx context.Context, now time.Time) (int, error) {
+	return b.Mirror.PurgeExpiredEnrollments(ctx, now)
+}
+
+func (b *MirroredBackend) AddRecoveryWrapping(ctx context.Context, w *domain.RecoveryWrapping) (*domain.RecoveryWrapping, error) {
+	return b.Mirror.AddRecoveryWrapping(ctx, w)
+}
+
+func (b *MirroredBackend) ListRecoveryWrappings(ctx context.Context, ownerEmail string) ([]*domain.RecoveryWrapping, error) {
+	return b.Mirror.ListRecoveryWrappings(ctx, ownerEmail)
+}
+
+func (b *MirroredBackend) GetRecoveryWrapping(ctx context.Context, ownerEmail, id string) (*domain.RecoveryWrapping, error) {
+	return b.Mirror.GetRecoveryWrapping(ctx, ownerEmail, id)
+}
+
+func (b *MirroredBackend) DeleteRecoveryWrapping(ctx context.Context, ownerEmail, id string) error {
+	return b.Mirror.DeleteRecoveryWrapping(ctx, ownerEmail, id)
+}
+
+func (b *MirroredBackend) AddRecoveryAudit(ctx context.Context, a *domain.RecoveryAudit) error {
+	return b.Mirror.AddRecoveryAudit(ctx, a)
+}
+
+func (b *MirroredBackend) ListRecoveryAudits(ctx context.Context, ownerEmail string) ([]*domain.RecoveryAudit, error) {
+	return b.Mirror.ListRecoveryAudits(ctx, ownerEmail)
+}
+
+func (b *MirroredBackend) PutEscrowWrapping(ctx context.Context, w *domain.EscrowWrapping) error {
+	return b.Mirror.PutEscrowWrapping(ctx, w)
+}
+
+func (b *MirroredBackend) GetEscrowWrapping(ctx context.Context, ownerEmail string) (*domain.EscrowWrapping, error) {
+	return b.Mirror.GetEscrowWrapping(ctx, ownerEmail)
+}
@@ -0,0 +1,112 @@
+package backendSetup
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"context"
+	"time"
+)
+
+//ResidencyBackend serves the users and their UserData from the backends of their regions and everything
+//else from the underlying Backend, which holds the index of the regions
+type ResidencyBackend struct {
+	UserDirectoryBackend
+	Residency *userRepository.ResidencyRepo
+}
+
+//WithResidency returns backend serving the users and their UserData from residency, unless residency is
+//nil. Decorators of the users, e.g. caches, are applied on top with WithUsers
+func WithResidency(backend Backend, residency *userRepository.ResidencyRepo) Backend {
+	if residency == nil {
+		return backend
+	}
+	return &ResidencyBackend{UserDirectoryBackend: UserDirectoryBackend{Backend: backend, Users: residency}, Residency: residency}
+}
+
+func (b *ResidencyBackend) AddDevice(ctx context.Context, d *domain.Device) (*domain.Device, error) {
+	return b.Residency.AddDevice(ctx, d)
+}
+
+func (b *ResidencyBackend) ListDevices(ctx context.Context, ownerEmail string) ([]*domain.Device, error) {
+	return b.Residency.ListDevices(ctx, ownerEmail)
+}
+
+func (b *ResidencyBackend) GetDeviceByPk(ctx context.Context, PKIXPublicKey []byte) (*domain.Device, error) {
+	return b.Residency.GetDeviceByPk(ctx, PKIXPublicKey)
+}
+
+func (b *ResidencyBackend) RevokeDevice(ctx context.Context, ownerEmail, deviceID string) error {
+	return b.Residency.RevokeDevice(ctx, ownerEmail, deviceID)
+}
+
+func (b *ResidencyBackend) TouchDevice(ctx context.Context, ownerEmail, deviceID string, lastSeen time.Time) error {
+	return b.Residency.TouchDevice(ctx, ownerEmail, deviceID, lastSeen)
+}
+
+func (b *ResidencyBackend) CreateEnrollment(ctx context.Context, e *domain.Enrollment) (*domain.Enrollment, error) {
+	return b.Residency.CreateEnrollment(ctx, e)
+}
+
+func (b *ResidencyBackend) GetEnrollment(ctx context.Context, ownerEmail, id string) (*domain.Enrollment, error) {
+	return b.Residency.GetEnrollment(ctx, ownerEmail, id)
+}
+
+func (b *ResidencyBackend) ListEnrollments(ctx context.Context, ownerEmail string) ([]*domain.Enrollment, error) {
+	return b.Residency.ListEnrollments(ctx, ownerEmail)
+}
+
+func (b *ResidencyBackend) ApproveEnrollment(ctx context.Context, ownerEmail, id, deviceID string) error {
+	return b.Residency.ApproveEnrollment(ctx, ownerEmail, id, deviceID)
+}
+
+func (b *ResidencyBackend) PurgeExpiredEnrollments(ctx context.Context, now time.Time) (int, error) {
+	return b.Residency.PurgeExpiredEnrollments(ctx, now)
+}
+
+func (b *ResidencyBackend) AddRecoveryWrapping(ctx context.Context, w *domain.RecoveryWrapping) (*domain.RecoveryWrapping, error) {
+	return b.Residency.AddRecoveryWrapping(ctx, w)
+}
+
+func (b *ResidencyBackend) ListRecoveryWrappings(ctx context.Context, ownerEmail string) ([]*domain.RecoveryWrapping, error) {
+	return b.Residency.ListRecoveryWrappings(ctx, ownerEmail)
+}
+
+func (b *ResidencyBackend) GetRecoveryWrapping(ctx context.Context, ownerEmail, id string) (*domain.RecoveryWrapping, error) {
+	return b.Residency.GetRecoveryWrapping(ctx, ownerEmail, id)
+}
+
+func (b *ResidencyBackend) DeleteRecoveryWrapping(ctx context.Context, ownerEmail, id string) error {
+	return b.Residency.DeleteRecoveryWrapping(ctx, ownerEmail, id)
+}
+
+func (b *ResidencyBackend) AddRecoveryAudit(ctx context.Context, a *domain.RecoveryAudit) error {
+	return b.Residency.AddRecoveryAudit(ctx, a)
+}
+
+func (b *ResidencyBackend) ListRecoveryAudits(ctx context.Context, ownerEmail string) ([]*domain.RecoveryAudit, error) {
+	return b.Residency.ListRecoveryAudits(ctx, ownerEmail)
+}
+
+func (b *ResidencyBackend) PutEscrowWrapping(ctx context.Context, w *domain.EscrowWrapping) error {
+	return b.Residency.PutEscrowWrapping(ctx, w)
+}
+
+func (b *ResidencyBackend) GetEscrowWrapping(ctx context.Context, ownerEmail string) (*domain.EscrowWrapping, error) {
+	return b.Residency.GetEscrowWrapping(ctx, ownerEmail)
+}
+
+func (b *ResidencyBackend) PutGroupKeyWrappings(ctx context.Context, groupID string, epoch int64, wrappings []*domain.GroupKeyWrapping) error {
+	return b.Residency.PutGroupKeyWrappings(ctx, groupID, epoch, wrappings)
+}
+
+func (b *ResidencyBackend) StoreGroupKeyWrappings(ctx context.Context, wrappings []*domain.GroupKeyWrapping) error {
+	return b.Residency.StoreGroupKeyWrappings(ctx, wrappings)
+}
+
+func (b *ResidencyBackend) GetGroupKeyWrapping(ctx context.Context, groupID string, epoch int64, memberEmail string) (*domain.GroupKeyWrapping, error) {
+	return b.Residency.GetGroupKeyWrapping(ctx, groupID, epoch, memberEmail)
+}
+
+func (b *ResidencyBackend) ListGroupKeyWrappings(ctx context.Context, groupID string, epoch int64) ([]*domain.GroupKeyWrapping, error) {
+	return b.Residency.ListGroupKeyWrappings(ctx, groupID, epoch)
+}
@@ -0,0 +1,69 @@
+//migrateEmails rewrites the email keys of existing users to their normalized form.
+//It uses the same DSN envvar as the server. Without -apply it only reports collisions.
+package main
+
+import (
+	"UserService/adapters/userRepository"
+	"context"
+	"flag"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"log"
+	"os"
+)
+
+const (
+	//EnvDSN connection string for database
+	EnvDSN string = "DSN"
+)
+
+func setupMigrator(dsn string) (userRepository.EmailKeyMigrator, error) {
+	switch dsn {
+	case "dynamo":
+		return userRepository.NewAwsDynamoUserRepo(session.Must(session.NewSession()))
+	case "dynamo-local":
+		return userRepository.NewAwsLocalDynamoUserRepo(session.Must(session.NewSession()))
+	default:
+		//no auto migration here, the legacy table layout is migrated by MigrateEmailKeys
+		db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+		return &userRepository.DefaultRepo{DB: db}, nil
+	}
+}
+
+func main() {
+	apply := flag.Bool("apply", false, "rewrite keys if no collisions are found")
+	flag.Parse()
+
+	dsn := os.Getenv(EnvDSN)
+	if dsn == "" {
+		log.Fatalf("Specify %v envvar!", EnvDSN)
+	}
+	migrator, err := setupMigrator(dsn)
+	if err != nil {
+		log.Fatalf("Failed to setup db : %v", err)
+	}
+
+	report, err := migrator.MigrateEmailKeys(context.Background(), *apply)
+	if report != nil {
+		log.Printf("Scanned %v users, %v need a rewrite, %v rewritten", report.Scanned, report.NeedsRewrite, report.Rewritten)
+		for _, v := range report.Invalid {
+			log.Printf("Invalid email %q", v)
+		}
+		for _, v := range report.Collisions {
+			log.Printf("Collision on %q : %q", v.NormalizedEmail, v.Emails)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Migration failed : %v", err)
+	}
+	if len(report.Collisions) > 0 || len(report.Invalid) > 0 {
+		log.Fatalf("Resolve the reported emails manually before running with -apply")
+	}
+	if !*apply && report.NeedsRewrite > 0 {
+		log.Printf("Run with -apply to rewrite the keys")
+	}
+}
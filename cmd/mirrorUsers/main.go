@@ -0,0 +1,66 @@
+//mirrorUsers compares the users of the DSN database with the MIRROR_DSN database and reports drift. Along
+//with the users it compares their devices, enrollments, recovery and escrow wrappings and the unexpired
+//verification tokens. With -backfill drifted users and tokens are copied from DSN to MIRROR_DSN. The server
+//copies the users it writes while MIRROR_DSN is set, this tool repairs the copies it missed. Once no drift
+//is reported, reads can be cut over with MIRROR_READS and the server can be switched to the mirror.
+//Organizations, groups, the key log, the audit log, the outbox and the webhooks are not mirrored, they
+//have to be copied before the switch while the server is stopped.
+package main
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/cmd/internal/backendSetup"
+	"context"
+	"flag"
+	"log"
+	"os"
+)
+
+const (
+	//EnvDSN connection string for the primary database
+	EnvDSN string = backendSetup.EnvDSN
+	//EnvMirrorDSN connection string for the secondary database
+	EnvMirrorDSN string = backendSetup.EnvMirrorDSN
+)
+
+func main() {
+	backfill := flag.Bool("backfill", false, "copy drifted users to the mirror")
+	flag.Parse()
+
+	dsn := os.Getenv(EnvDSN)
+	mirrorDSN := os.Getenv(EnvMirrorDSN)
+	if dsn == "" || mirrorDSN == "" {
+		log.Fatalf("Specify %v and %v envvars!", EnvDSN, EnvMirrorDSN)
+	}
+	primary, err := backendSetup.SetupBackend(dsn, userRepository.DefaultRetention, userRepository.DefaultEventRetention)
+	if err != nil {
+		log.Fatalf("Failed to setup db : %v", err)
+	}
+	secondary, err := backendSetup.SetupBackend(mirrorDSN, userRepository.DefaultRetention, userRepository.DefaultEventRetention)
+	if err != nil {
+		log.Fatalf("Failed to setup mirror db : %v", err)
+	}
+
+	var report *userRepository.MirrorReport
+	if *backfill {
+		report, err = userRepository.BackfillMirror(context.Background(), primary, secondary)
+	} else {
+		report, err = userRepository.VerifyMirror(context.Background(), primary, secondary)
+	}
+	if report != nil {
+		for _, v := range report.Drift {
+			log.Printf("Drift %v %v %v", v.Kind, v.Email, v.Fields)
+		}
+		for _, v := range report.TokenDrift {
+			log.Printf("Token drift %v %v %v", v.Kind, v.Email, v.Purpose)
+		}
+		log.Printf("Compared %v users, %v drifted, %v repaired", report.Compared, len(report.Drift), report.Repaired)
+		log.Printf("Compared %v tokens, %v drifted, %v repaired", report.ComparedTokens, len(report.TokenDrift), report.RepairedTokens)
+	}
+	if err != nil {
+		log.Fatalf("Comparison failed : %v", err)
+	}
+	if !report.InSync() {
+		log.Fatalf("Mirror is not in sync, run with -backfill")
+	}
+}
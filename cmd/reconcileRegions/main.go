@@ -0,0 +1,63 @@
+//reconcileRegions compares the user tables of the DYNAMO_REGIONS regions of the dynamodb global tables
+//and reports the items they disagree about. With -repair diverged items are overwritten with the last
+//written one and items deleted later in another region are removed, with -copy-missing items missing in a
+//region are copied there unless a tombstone records a later delete. Dangling email entries and orphaned
+//users are only reported, they need a decision by an admin
+package main
+
+import (
+	"UserService/adapters/userRepository"
+	"context"
+	"flag"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	//EnvDynamoRegions comma separated regions of the global tables, e.g. "eu-central-1,us-east-1"
+	EnvDynamoRegions string = "DYNAMO_REGIONS"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "overwrite diverged items with the last written one and remove deleted items")
+	copyMissing := flag.Bool("copy-missing", false, "copy items to the regions missing them")
+	flag.Parse()
+
+	v := os.Getenv(EnvDynamoRegions)
+	if v == "" {
+		log.Fatalf("Specify %v envvar!", EnvDynamoRegions)
+	}
+	sess := session.Must(session.NewSession())
+	regions := make(map[string]userRepository.DynamoClient)
+	for _, region := range strings.Split(v, ",") {
+		region = strings.TrimSpace(region)
+		if region == "" {
+			continue
+		}
+		regions[region] = dynamodb.New(sess, aws.NewConfig().WithRegion(region))
+	}
+	if len(regions) < 2 {
+		log.Fatalf("%v needs at least two regions", EnvDynamoRegions)
+	}
+
+	report, err := userRepository.ReconcileRegions(context.Background(), regions, userRepository.RegionReconcileOptions{
+		Repair:      *repair,
+		CopyMissing: *copyMissing,
+	})
+	if report != nil {
+		for _, d := range report.Drift {
+			log.Printf("Drift %v %v %q %v in %v, winner %v", d.Kind, d.Table, d.Email, d.KeyFingerprint, d.Region, d.Winner)
+		}
+		log.Printf("Compared %v items, %v drifted, %v repaired", report.Compared, len(report.Drift), report.Repaired)
+	}
+	if err != nil {
+		log.Fatalf("Reconciliation failed : %v", err)
+	}
+	if !report.InSync() {
+		log.Fatalf("Regions are not in sync")
+	}
+}
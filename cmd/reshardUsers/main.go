@@ -0,0 +1,42 @@
+//reshardUsers moves the users of the USER_SHARDS databases to the shards they are hashed to. To add
+//shards, first restart all servers with the new shards in USER_SHARDS and the names of the old ones in
+//USER_SHARDS_PREVIOUS, which also sets up the new databases. The servers look up users on their previous
+//shard until they are moved, so reads keep working while this tool runs. Once it finished, the servers can
+//be restarted without USER_SHARDS_PREVIOUS. Run without USER_SHARDS_PREVIOUS it indexes the keys of all
+//users, e.g. after moving from DSN to shards. DSN has to be set like for the servers, it keeps the data of
+//the users besides the users.
+package main
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/cmd/internal/backendSetup"
+	"context"
+	"log"
+	"os"
+)
+
+func main() {
+	dsn := os.Getenv(backendSetup.EnvDSN)
+	if dsn == "" {
+		log.Fatalf("Specify %v envvar!", backendSetup.EnvDSN)
+	}
+	central, err := backendSetup.SetupBackend(dsn, userRepository.DefaultRetention, userRepository.DefaultEventRetention)
+	if err != nil {
+		log.Fatalf("Failed to setup db : %v", err)
+	}
+	sharded, err := backendSetup.SetupShards(central)
+	if err != nil {
+		log.Fatalf("Failed to setup shards : %v", err)
+	}
+	if sharded == nil {
+		log.Fatalf("Specify %v envvar!", backendSetup.EnvUserShards)
+	}
+
+	report, err := sharded.Reshard(context.Background())
+	if report != nil {
+		log.Printf("Scanned %v entries, moved %v users and %v keys", report.Scanned, report.MovedUsers, report.MovedKeys)
+	}
+	if err != nil {
+		log.Fatalf("Resharding failed : %v", err)
+	}
+}
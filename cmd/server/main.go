@@ -1,72 +1,400 @@
 package main
 
 import (
+	"UserService/adapters/mailer"
 	"UserService/adapters/userRepository"
+	"UserService/cmd/internal/backendSetup"
+	"UserService/domain"
 	"UserService/protobufs/UserServiceSchema"
 	"UserService/services/UserService"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"google.golang.org/grpc"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/smtp"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	//EnvDSN connection string for database
-	EnvDSN        string = "DSN"
+	EnvDSN        string = backendSetup.EnvDSN
 	EnvListenAddr string = "LISTEN"
+	//EnvMailDir stores outgoing mails as files in this dir instead of sending them
+	EnvMailDir string = "MAIL_DIR"
+	//EnvSMTPAddr host:port of the SMTP relay used for outgoing mails
+	EnvSMTPAddr     string = "SMTP_ADDR"
+	EnvSMTPFrom     string = "SMTP_FROM"
+	EnvSMTPUser     string = "SMTP_USER"
+	EnvSMTPPassword string = "SMTP_PASSWORD"
+	//EnvRetention duration in which deleted users can be restored, e.g. "720h"
+	EnvRetention string = "DELETE_RETENTION"
+	//EnvPurgeInterval duration between purges of deleted users and expired data
+	EnvPurgeInterval string = "PURGE_INTERVAL"
+	//EnvKeyLogSigningKey path of the PEM encoded PKCS8 private key signing the tree heads of the key log
+	EnvKeyLogSigningKey string = "KEY_LOG_SIGNING_KEY"
+	//EnvSigningKeys comma separated version=path pairs of PEM encoded PKCS8 private keys attesting
+	//email to public key bindings, e.g. "1=old.pem,2=new.pem". The highest version signs
+	EnvSigningKeys string = "SERVICE_SIGNING_KEYS"
+	//EnvAdminToken bearer token required for admin RPCs like QueryAuditLog. Admin RPCs are disabled if unset
+	EnvAdminToken string = "ADMIN_TOKEN"
+	//EnvEventRetention duration user events are kept for subscribers of WatchUserEvents, e.g. "168h"
+	EnvEventRetention string = "EVENT_RETENTION"
+	//EnvWebhookInterval duration between polls for new user events and due webhook deliveries
+	EnvWebhookInterval string = "WEBHOOK_INTERVAL"
+	//EnvUserCacheSize maximum number of cached user lookups, the cache is disabled if unset or 0
+	EnvUserCacheSize string = "USER_CACHE_SIZE"
+	//EnvUserCacheTTL duration found users are cached, e.g. "1m"
+	EnvUserCacheTTL string = "USER_CACHE_TTL"
+	//EnvUserCacheNegativeTTL duration lookups of unknown users are cached, "0s" disables negative caching
+	EnvUserCacheNegativeTTL string = "USER_CACHE_NEGATIVE_TTL"
+	//EnvUserCacheSingleflight set to true collapses concurrent lookups of the same user
+	EnvUserCacheSingleflight string = "USER_CACHE_SINGLEFLIGHT"
+	//EnvUserCachePeers comma separated host:port addresses of the other replicas, writes through the user
+	//cache invalidate their caches. Requires ADMIN_TOKEN, shared by all replicas
+	EnvUserCachePeers string = "USER_CACHE_PEERS"
+	//EnvUserCacheInvalidationTimeout duration the delivery of an invalidation to a peer is retried, e.g. "5s"
+	EnvUserCacheInvalidationTimeout string = "USER_CACHE_INVALIDATION_TIMEOUT"
+	//the envvars of the user directory, like RESIDENCY_REGIONS or USER_SHARDS, are documented in
+	//cmd/internal/backendSetup
 )
 
+const defaultPurgeInterval = time.Hour
+
+const (
+	defaultUserCacheTTL         = time.Minute
+	defaultUserCacheNegativeTTL = 5 * time.Second
+)
+
+//ServerConfig holds the settings of the grpc service that do not depend on the backend
+type ServerConfig struct {
+	Sender       mailer.Sender
+	Retention    time.Duration
+	KeyLogSigner crypto.Signer
+	SigningKeys  []domain.ServiceSigningKey
+	AdminToken   string
+	//VerificationTTL is the validity of verification tokens, zero selects the default
+	VerificationTTL time.Duration
+	//EventPollInterval is the time between outbox polls of WatchUserEvents, zero selects the default
+	EventPollInterval time.Duration
+	//UserCache is the cache in front of the backend, if any. Its counters are served to admins
+	UserCache *userRepository.CachedUserRepo
+	//CacheBus receives the cache invalidations of the peers, if any
+	CacheBus *UserService.PeerInvalidationBus
+	//BackendHealth reports whether the backend is reachable, calls fail fast while it returns an error
+	BackendHealth func() error
+	//Residency routes the users to the backends of their regions, if configured
+	Residency *userRepository.ResidencyRepo
+}
+
+//Backend is implemented by all supported repositories
+type Backend = backendSetup.Backend
+
+//SetupGormDB opens and migrates the sqlite database dsn
 func SetupGormDB(dsn string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	return backendSetup.SetupGormDB(dsn)
+}
+
+//SetupMailSender picks the mail sender based on the environment, falling back to logging mails
+func SetupMailSender() (mailer.Sender, error) {
+	if dir := os.Getenv(EnvMailDir); dir != "" {
+		return mailer.NewFileSender(dir)
+	}
+	if addr := os.Getenv(EnvSMTPAddr); addr != "" {
+		from := os.Getenv(EnvSMTPFrom)
+		if from == "" {
+			return nil, fmt.Errorf("specify %v envvar", EnvSMTPFrom)
+		}
+		sender := &mailer.SMTPSender{Addr: addr, From: from}
+		if user := os.Getenv(EnvSMTPUser); user != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %v : %v", EnvSMTPAddr, err)
+			}
+			sender.Auth = smtp.PlainAuth("", user, os.Getenv(EnvSMTPPassword), host)
+		}
+		return sender, nil
+	}
+	log.Printf("Neither %v nor %v set, mails will only be logged", EnvMailDir, EnvSMTPAddr)
+	return mailer.LogSender{}, nil
+}
+
+//loadSigner reads a PEM encoded PKCS8 private key from path
+func loadSigner(path string) (crypto.Signer, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v : %v", path, err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%v contains no PEM block", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v : %v", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T in %v", key, path)
+	}
+	return signer, nil
+}
+
+//SetupKeyLogSigner loads the signing key of the key log. Without a configured key an ephemeral key is
+//generated, whose tree heads can not be verified after a restart
+func SetupKeyLogSigner() (crypto.Signer, error) {
+	path := os.Getenv(EnvKeyLogSigningKey)
+	if path == "" {
+		log.Printf("%v not set, signing key log tree heads with an ephemeral key", EnvKeyLogSigningKey)
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	signer, err := loadSigner(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect database: %v", err)
+		return nil, fmt.Errorf("invalid %v : %v", EnvKeyLogSigningKey, err)
 	}
+	return signer, nil
+}
+
+//SetupSigningKeys loads the attestation signing keys configured as comma separated version=path
+//pairs. Keys are rotated by adding a key with a higher version, old keys should be kept as long as
+//clients may present attestations signed by them
+func SetupSigningKeys() ([]domain.ServiceSigningKey, error) {
+	v := os.Getenv(EnvSigningKeys)
+	if v == "" {
+		log.Printf("%v not set, bindings will not be attested", EnvSigningKeys)
+		return nil, nil
+	}
+	var keys []domain.ServiceSigningKey
+	seen := make(map[int64]bool)
+	for _, entry := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid %v entry %q, want version=path", EnvSigningKeys, entry)
+		}
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid %v version %q, want a positive number", EnvSigningKeys, parts[0])
+		}
+		if seen[version] {
+			return nil, fmt.Errorf("duplicate %v version %v", EnvSigningKeys, version)
+		}
+		seen[version] = true
+		signer, err := loadSigner(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v : %v", EnvSigningKeys, err)
+		}
+		keys = append(keys, domain.ServiceSigningKey{Version: version, Signer: signer})
+	}
+	return keys, nil
+}
+
+//durationFromEnv parses the envvar key as duration, returning def if it is not set
+func durationFromEnv(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v : %v", key, err)
+	}
+	return d, nil
+}
+
+//SetupUserCache creates the cache in front of users configured by the environment. It returns nil if
+//caching is disabled
+func SetupUserCache(users userRepository.UserDirectoryRepo) (*userRepository.CachedUserRepo, error) {
+	v := os.Getenv(EnvUserCacheSize)
+	if v == "" {
+		return nil, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid %v %q, want a number", EnvUserCacheSize, v)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	cfg := userRepository.UserCacheConfig{Size: size}
+	if cfg.TTL, err = durationFromEnv(EnvUserCacheTTL, defaultUserCacheTTL); err != nil {
+		return nil, err
+	}
+	if cfg.NegativeTTL, err = durationFromEnv(EnvUserCacheNegativeTTL, defaultUserCacheNegativeTTL); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv(EnvUserCacheSingleflight); v != "" {
+		if cfg.Singleflight, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid %v : %v", EnvUserCacheSingleflight, err)
+		}
+	}
+	return userRepository.NewCachedUserRepo(users, cfg), nil
+}
 
-	if err := db.AutoMigrate(&userRepository.UserDTODB{}); err != nil {
-		return nil, fmt.Errorf("failed to auto migrate domain : %v", err)
+//SetupCacheInvalidation connects cache to the peers configured by the environment. It returns nil if
+//no peers are configured
+func SetupCacheInvalidation(cache *userRepository.CachedUserRepo, adminToken string) (*UserService.PeerInvalidationBus, error) {
+	v := os.Getenv(EnvUserCachePeers)
+	if v == "" {
+		return nil, nil
 	}
-	return db, nil
+	if adminToken == "" {
+		return nil, fmt.Errorf("%v requires %v", EnvUserCachePeers, EnvAdminToken)
+	}
+	timeout, err := durationFromEnv(EnvUserCacheInvalidationTimeout, UserService.DefaultPeerInvalidationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	bus := UserService.NewPeerInvalidationBus(adminToken, timeout)
+	for _, addr := range strings.Split(v, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial peer %v : %v", addr, err)
+		}
+		bus.AddPeer(addr, UserServiceSchema.NewUserServiceClient(conn))
+	}
+	if _, err := cache.UseInvalidationBus(bus); err != nil {
+		return nil, err
+	}
+	return bus, nil
 }
 
-func SetupGRPCServer(userRepo userRepository.UserRepo) *grpc.Server {
-	grpcServer := grpc.NewServer()
-	UserServiceSchema.RegisterUserServiceServer(grpcServer, UserService.NewUserService(userRepo))
+func SetupGRPCServer(backend Backend, cfg ServerConfig) *grpc.Server {
+	verificationTTL := cfg.VerificationTTL
+	if verificationTTL == 0 {
+		verificationTTL = UserService.DefaultVerificationTTL
+	}
+	userService := UserService.NewUserService(backend,
+		UserService.WithVerification(backend, cfg.Sender, verificationTTL),
+		UserService.WithRetention(cfg.Retention),
+		UserService.WithDevices(backend),
+		UserService.WithEnrollments(backend, UserService.DefaultEnrollmentTTL),
+		UserService.WithRecovery(backend),
+		UserService.WithOrganizations(backend),
+		UserService.WithGroups(backend),
+		UserService.WithKeyLog(backend, backend, cfg.KeyLogSigner),
+		UserService.WithAttestations(cfg.SigningKeys),
+		UserService.WithAuditLog(backend, cfg.AdminToken),
+		UserService.WithUserEvents(backend, cfg.EventPollInterval),
+		UserService.WithWebhooks(backend),
+		UserService.WithUserAdmin(backend),
+		UserService.WithUserCache(cfg.UserCache),
+		UserService.WithCacheInvalidation(cfg.CacheBus),
+		UserService.WithBackendHealth(cfg.BackendHealth),
+		UserService.WithResidency(cfg.Residency),
+	)
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(userService.AvailabilityInterceptor, userService.AuditInterceptor))
+	UserServiceSchema.RegisterUserServiceServer(grpcServer, userService)
 	return grpcServer
 }
 
 func main() {
+	retention, err := durationFromEnv(EnvRetention, userRepository.DefaultRetention)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	purgeInterval, err := durationFromEnv(EnvPurgeInterval, defaultPurgeInterval)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	eventRetention, err := durationFromEnv(EnvEventRetention, userRepository.DefaultEventRetention)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	webhookInterval, err := durationFromEnv(EnvWebhookInterval, UserService.DefaultWebhookInterval)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	//setup database
 	dsn := os.Getenv(EnvDSN)
 	if dsn == "" {
 		log.Fatalf("Specify %v envvar!", EnvDSN)
 	}
-	var userRepo userRepository.UserRepo
-	if dsn == "dynamo" {
-		sess := session.Must(session.NewSession())
-		var err error
-		userRepo, err = userRepository.NewAwsDynamoUserRepo(sess)
-		if err != nil {
-			log.Fatalf("Failed to setup db : %v", err)
-		}
-	} else if dsn == "dynamo-local" {
-		log.Printf("Setting up dynamo-local db")
-		sess := session.Must(session.NewSession())
-		var err error
-		userRepo, err = userRepository.NewAwsLocalDynamoUserRepo(sess)
-		if err != nil {
-			log.Fatalf("Failed to setup db : %v", err)
+	userRepo, err := backendSetup.SetupBackend(dsn, retention, eventRetention)
+	if err != nil {
+		log.Fatalf("Failed to setup db : %v", err)
+	}
+	var backendHealth func() error
+	if dynamoRepo, ok := userRepo.(*userRepository.AwsDynamoUserRepo); ok {
+		backendHealth = dynamoRepo.Healthy
+	}
+	directory, err := backendSetup.SetupDirectory(userRepo, retention, eventRetention)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if directory.Residency != nil {
+		log.Printf("Routing users to regions %v", directory.Residency.Regions())
+	}
+	if directory.Sharded != nil {
+		log.Printf("Distributing users across shards %v", directory.Sharded.Shards())
+	}
+	if mirrorDSN := os.Getenv(backendSetup.EnvMirrorDSN); mirrorDSN != "" {
+		log.Printf("Mirroring users and their data to %v", mirrorDSN)
+	}
+	users := directory.Users
+	userCache, err := SetupUserCache(users)
+	if err != nil {
+		log.Fatalf("failed to setup user cache : %v", err)
+	}
+	var cacheBus *UserService.PeerInvalidationBus
+	if userCache != nil {
+		users = userCache
+		if cacheBus, err = SetupCacheInvalidation(userCache, os.Getenv(EnvAdminToken)); err != nil {
+			log.Fatalf("failed to setup cache invalidation : %v", err)
 		}
-	} else {
-		db, err := SetupGormDB(dsn)
-		if err != nil {
-			log.Fatalf("failed to setup db : %v", err)
+	} else if os.Getenv(EnvUserCachePeers) != "" {
+		log.Printf("%v set without %v, ignoring it", EnvUserCachePeers, EnvUserCacheSize)
+	}
+	//serve the users through the decorators, if any
+	userRepo = backendSetup.WithUsers(backendSetup.WithMirror(backendSetup.WithResidency(userRepo, directory.Residency), directory.Mirror), users)
+	//the purger also runs for dynamodb, its TTL expires deleted users without their devices and wrappings
+	purger := &UserService.Purger{
+		UserRepo:       userRepo,
+		TokenRepo:      userRepo,
+		EventRepo:      userRepo,
+		Retention:      retention,
+		EventRetention: eventRetention,
+		Interval:       purgeInterval,
+	}
+	go purger.Run(context.Background())
+
+	dispatcher := &UserService.WebhookDispatcher{
+		EventRepo:   userRepo,
+		WebhookRepo: userRepo,
+		Interval:    webhookInterval,
+	}
+	go dispatcher.Run(context.Background())
+
+	if len(directory.EventSources) > 0 {
+		relay := &UserService.UserEventRelay{
+			Sources:  directory.EventSources,
+			Target:   userRepo,
+			Interval: UserService.DefaultUserEventRelayInterval,
 		}
-		userRepo = &userRepository.DefaultRepo{DB: db}
+		go relay.Run(context.Background())
+	}
+
+	reconciler := &UserService.KeyLogReconciler{
+		KeyLogRepo: userRepo,
+		EventRepo:  userRepo,
+		Interval:   UserService.DefaultKeyLogInterval,
 	}
+	go reconciler.Run(context.Background())
 
 	//start grpc server
 	lis, err := net.Listen("tcp", os.Getenv(EnvListenAddr))
@@ -74,7 +402,32 @@ func main() {
 		log.Fatalf("failed to listen on %v : %v", os.Getenv(EnvListenAddr), err)
 	}
 
-	grpcServer := SetupGRPCServer(userRepo)
+	sender, err := SetupMailSender()
+	if err != nil {
+		log.Fatalf("failed to setup mail sender : %v", err)
+	}
+
+	keyLogSigner, err := SetupKeyLogSigner()
+	if err != nil {
+		log.Fatalf("failed to setup key log signer : %v", err)
+	}
+
+	signingKeys, err := SetupSigningKeys()
+	if err != nil {
+		log.Fatalf("failed to setup signing keys : %v", err)
+	}
+
+	grpcServer := SetupGRPCServer(userRepo, ServerConfig{
+		Sender:        sender,
+		Retention:     retention,
+		KeyLogSigner:  keyLogSigner,
+		SigningKeys:   signingKeys,
+		AdminToken:    os.Getenv(EnvAdminToken),
+		UserCache:     userCache,
+		CacheBus:      cacheBus,
+		BackendHealth: backendHealth,
+		Residency:     directory.Residency,
+	})
 	log.Printf("Starting GRPC server")
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("grpcServer termianted with :%v", err)
@@ -1,25 +1,50 @@
 package main
 
 import (
+	"UserService/adapters/mailer"
 	"UserService/adapters/userRepository"
+	"UserService/cmd/internal/backendSetup"
 	"UserService/domain"
 	"UserService/protobufs/UserServiceSchema"
+	"UserService/services/UserService"
+	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
-	"log"
+	"gorm.io/gorm"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type dbImpl string
@@ -31,9 +56,25 @@ func (d dbImpl) String() string {
 const gormDbImpl = dbImpl("gorm")
 const dynamoDbImpl = dbImpl("dynamo")
 
-//setupTestENV creates a client connected to an in memory service using an inmemory db
-func setupTestENV(ctx context.Context, backend dbImpl) (UserServiceSchema.UserServiceClient, error) {
-	var userRepo userRepository.UserRepo
+const testAdminToken = "test-admin-token"
+
+//testKeyLogSigner signs the key log tree heads of all test servers
+var testKeyLogSigner, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+//testSigningKeys attest bindings on all test servers, the key with version 2 is the current one
+var testSigningKeys = func() []domain.ServiceSigningKey {
+	old, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	current, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return []domain.ServiceSigningKey{{Version: 2, Signer: current}, {Version: 1, Signer: old}}
+}()
+
+//testDynamo holds the tables of the dynamo backend. Like the in memory db of the gorm backend it is shared
+//by all backends of the tests
+var testDynamo = userRepository.NewFakeDynamo()
+
+//setupTestBackend creates the repository for backend. The gorm backend uses an in memory db, the dynamo
+//backend testDynamo
+func setupTestBackend(backend dbImpl) (Backend, error) {
 	switch backend {
 	case gormDbImpl:
 		//this will create an in memory sqlite db
@@ -42,27 +83,33 @@ func setupTestENV(ctx context.Context, backend dbImpl) (UserServiceSchema.UserSe
 		if err != nil {
 			return nil, fmt.Errorf("failed to create %v backend : %v", backend, err)
 		}
-		userRepo = &userRepository.DefaultRepo{DB: db}
+		return &userRepository.DefaultRepo{DB: db}, nil
 	case dynamoDbImpl:
-		log.Printf("Testing dynamo db backend, make sure docker container is running!")
-		sess := session.Must(session.NewSession(&aws.Config{
-			Credentials: credentials.NewStaticCredentials("test-id", "test-secret", "test-token"),
-			Region:      aws.String("us-west-2"),
-		}))
-		var err error
-		userRepo, err = userRepository.NewAwsLocalDynamoUserRepo(sess)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create %v backend : %v", backend, err)
-		}
+		return userRepository.NewAwsDynamoUserRepoWithClient(testDynamo, nil), nil
 	default:
 		return nil, fmt.Errorf("unknown db implementation %v", backend)
-
 	}
+}
 
+//setupTestServer creates a client connected to an in memory service using userRepo. Mails are stored in mailDir.
+//configure may adjust the default test config
+func setupTestServer(ctx context.Context, userRepo Backend, mailDir string, configure ...func(cfg *ServerConfig)) UserServiceSchema.UserServiceClient {
 	//create server
 	bufferSize := 1024 * 1024
 	lis := bufconn.Listen(bufferSize)
-	server := SetupGRPCServer(userRepo)
+	cfg := ServerConfig{
+		Sender:       mailer.FileSender{Dir: mailDir},
+		Retention:    userRepository.DefaultRetention,
+		KeyLogSigner: testKeyLogSigner,
+		SigningKeys:  testSigningKeys,
+		AdminToken:   testAdminToken,
+		//keep the live part of the event tests fast
+		EventPollInterval: 10 * time.Millisecond,
+	}
+	for _, v := range configure {
+		v(&cfg)
+	}
+	server := SetupGRPCServer(userRepo, cfg)
 	go func() {
 		if err := server.Serve(lis); err != nil {
 			panic(err)
@@ -80,8 +127,39 @@ func setupTestENV(ctx context.Context, backend dbImpl) (UserServiceSchema.UserSe
 		},
 	), grpc.WithInsecure())
 
-	client := UserServiceSchema.NewUserServiceClient(conn)
-	return client, nil
+	return UserServiceSchema.NewUserServiceClient(conn)
+}
+
+//setupTestENV creates a client connected to an in memory service using an inmemory db. Mails are stored in mailDir
+func setupTestENV(ctx context.Context, backend dbImpl, mailDir string) (UserServiceSchema.UserServiceClient, error) {
+	userRepo, err := setupTestBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+	return setupTestServer(ctx, userRepo, mailDir), nil
+}
+
+//lastMailedToken returns the token of the last mail sent to email
+func lastMailedToken(mailDir, email string) (string, error) {
+	messages, err := mailer.FileSender{Dir: mailDir}.Messages(email)
+	if err != nil {
+		return "", fmt.Errorf("failed to read mails : %v", err)
+	}
+	if len(messages) == 0 {
+		return "", fmt.Errorf("no mail has been sent to %v", email)
+	}
+	//the token is the last word of the mail
+	words := strings.Fields(messages[len(messages)-1].Body)
+	return words[len(words)-1], nil
+}
+
+//confirmEmail confirms email with the last token that has been mailed to it
+func confirmEmail(ctx context.Context, client UserServiceSchema.UserServiceClient, mailDir, email string) (*UserServiceSchema.User, error) {
+	token, err := lastMailedToken(mailDir, email)
+	if err != nil {
+		return nil, err
+	}
+	return client.ConfirmEmail(ctx, &UserServiceSchema.UserRequestConfirmEmail{Email: email, Token: token})
 }
 
 func checkUserNoID(want *domain.User, got *UserServiceSchema.User) error {
@@ -105,7 +183,7 @@ func checkUserNoID(want *domain.User, got *UserServiceSchema.User) error {
 	return nil
 }
 
-func testUserCreationWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient) {
+func testUserCreationWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
 	//setup data for test wantUserNoID
 	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -153,6 +231,26 @@ func testUserCreationWithBackend(ctx context.Context, t *testing.T, client UserS
 		t.Fatalf("unexpected created user content :%v", err)
 	}
 
+	//pending users are not visible until the email has been confirmed
+	if _, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: wantEmail}); status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v for pending user got %v", codes.NotFound, err)
+	}
+	if _, err := client.ConfirmEmail(ctx, &UserServiceSchema.UserRequestConfirmEmail{Email: wantEmail, Token: "invalid"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for invalid token got %v", codes.PermissionDenied, err)
+	}
+	//a token presented for another email is rejected without being consumed
+	token, err := lastMailedToken(mailDir, wantEmail)
+	if err != nil {
+		t.Fatalf("failed to read token : %v", err)
+	}
+	if _, err := client.ConfirmEmail(ctx, &UserServiceSchema.UserRequestConfirmEmail{Email: "jane.doe@email.com", Token: token}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for token of another email got %v", codes.PermissionDenied, err)
+	}
+	gotGRPCUser, err = confirmEmail(ctx, client, mailDir, wantEmail)
+	if err != nil {
+		t.Fatalf("failed to confirm email : %v", err)
+	}
+
 	//check if the getters return the created user
 	gotGRPCUserByEmail, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: wantEmail})
 	if err != nil {
@@ -172,6 +270,28 @@ func testUserCreationWithBackend(ctx context.Context, t *testing.T, client UserS
 	if err == nil {
 		t.Fatalf("expected error getting deleted user, got none")
 	}
+	//the email stays reserved while the user can be restored
+	if _, err := client.CreateUser(ctx, createReq); err == nil {
+		t.Fatalf("expected error creating user with email of deleted user, got none")
+	}
+
+	//check that restoring brings back the user with its keys
+	restoredUser, err := client.RestoreUser(ctx, &UserServiceSchema.UserRequestEmail{Email: wantEmail})
+	if err != nil {
+		t.Fatalf("failed to restore user : %v", err)
+	}
+	if err := checkUserNoID(wantUserNoID, restoredUser); err != nil {
+		t.Fatalf("unexpected restored user content :%v", err)
+	}
+	if _, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: wantEmail}); err != nil {
+		t.Fatalf("unexpected error fetching restored user : %v", err)
+	}
+	if _, err := client.RestoreUser(ctx, &UserServiceSchema.UserRequestEmail{Email: wantEmail}); status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v restoring active user got %v", codes.NotFound, err)
+	}
+	if _, err = client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: wantEmail}); err != nil {
+		t.Fatalf("failed to delete user by id :%v ", err)
+	}
 }
 
 func TestUserCreation(t *testing.T) {
@@ -180,14 +300,4179 @@ func TestUserCreation(t *testing.T) {
 		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			client, err := setupTestENV(ctx, v)
+			mailDir := t.TempDir()
+			client, err := setupTestENV(ctx, v, mailDir)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testUserCreationWithBackend(ctx, t, client, mailDir)
+
+		})
+	}
+
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//validation happens before the repository is accessed, so one backend is enough
+	mailDir := t.TempDir()
+	client, err := setupTestENV(ctx, gormDbImpl, mailDir)
+	if err != nil {
+		t.Fatalf("failed to setup env : %v", err)
+	}
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key")
+	}
+	pkPKIXBytes, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+	weakSk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to setup test rsa key")
+	}
+	weakPkPKIXBytes, err := x509.MarshalPKIXPublicKey(weakSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test rsa pubkey encoding")
+	}
+
+	valid := func() *UserServiceSchema.UserRequestCreate {
+		return &UserServiceSchema.UserRequestCreate{
+			Email:             "jane.doe@email.com",
+			PublicKey:         pkPKIXBytes,
+			WrappedPrivateKey: []byte{1, 2, 3},
+			WrappedMasterKey:  []byte{4, 5, 6},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		modify    func(r *UserServiceSchema.UserRequestCreate)
+		wantField string
+	}{
+		{"empty email", func(r *UserServiceSchema.UserRequestCreate) { r.Email = "" }, "email"},
+		{"malformed email", func(r *UserServiceSchema.UserRequestCreate) { r.Email = "jane.doe" }, "email"},
+		{"weak rsa key", func(r *UserServiceSchema.UserRequestCreate) { r.PublicKey = weakPkPKIXBytes }, "public_key"},
+		{"empty wrapped master key", func(r *UserServiceSchema.UserRequestCreate) { r.WrappedMasterKey = nil }, "wrapped_master_key"},
+		{"huge wrapped private key", func(r *UserServiceSchema.UserRequestCreate) {
+			r.WrappedPrivateKey = make([]byte, 1024*1024)
+		}, "wrapped_private_key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid()
+			tt.modify(req)
+			_, err := client.CreateUser(ctx, req)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("want code %v got %v", codes.InvalidArgument, err)
+			}
+			var gotFields []string
+			for _, d := range status.Convert(err).Details() {
+				if br, ok := d.(*errdetails.BadRequest); ok {
+					for _, v := range br.FieldViolations {
+						gotFields = append(gotFields, v.Field)
+					}
+				}
+			}
+			if len(gotFields) != 1 || gotFields[0] != tt.wantField {
+				t.Fatalf("want violation for field %v got %v", tt.wantField, gotFields)
+			}
+		})
+	}
+
+	//mixed case and IDN emails keep their display form but are looked up by their normalized form
+	req := valid()
+	req.Email = "Jane.Doe@Bücher.Example"
+	gotUser, err := client.CreateUser(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateUser has unexpected error : %v", err)
+	}
+	if gotUser.Email != req.Email {
+		t.Fatalf("want display email %v got %v", req.Email, gotUser.Email)
+	}
+	if _, err := confirmEmail(ctx, client, mailDir, req.Email); err != nil {
+		t.Fatalf("failed to confirm email : %v", err)
+	}
+	for _, v := range []string{"jane.doe@bücher.example", "JANE.DOE@xn--bcher-kva.example"} {
+		gotByEmail, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: v})
+		if err != nil {
+			t.Fatalf("failed to get user by %v : %v", v, err)
+		}
+		if gotByEmail.Email != req.Email {
+			t.Fatalf("want display email %v got %v", req.Email, gotByEmail.Email)
+		}
+	}
+	req.Email = "jane.doe@xn--bcher-kva.example"
+	if _, err := client.CreateUser(ctx, req); err == nil {
+		t.Fatalf("expected error creating user with colliding email, got none")
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: "JANE.DOE@BÜCHER.EXAMPLE"}); err != nil {
+		t.Fatalf("failed to delete user by email : %v", err)
+	}
+}
+
+//failingUserRepo fails the lookups by email with err
+type failingUserRepo struct {
+	userRepository.UserDirectoryRepo
+	err error
+}
+
+func (f *failingUserRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	return nil, f.err
+}
+
+func testPendingUsersWithBackend(ctx context.Context, t *testing.T, backend Backend, mailDir string) {
+	ttl := 400 * time.Millisecond
+	client := setupTestServer(ctx, backend, mailDir, func(cfg *ServerConfig) {
+		cfg.VerificationTTL = ttl
+	})
+	email := fmt.Sprintf("pending%v@test.com", time.Now().UnixNano())
+	request := func() *UserServiceSchema.UserRequestCreate {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key : %v", err)
+		}
+		pkPKIX, err := x509.MarshalPKIXPublicKey(sk.Public())
+		if err != nil {
+			t.Fatalf("failed to encode key : %v", err)
+		}
+		return &UserServiceSchema.UserRequestCreate{
+			Email:             email,
+			PublicKey:         pkPKIX,
+			WrappedPrivateKey: []byte{1},
+			WrappedMasterKey:  []byte{2},
+		}
+	}
+
+	//repeating the request renews the verification, so the pending user is not stale until the new
+	//token expired
+	first := request()
+	if _, err := client.CreateUser(ctx, first); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	time.Sleep(ttl * 5 / 8)
+	if _, err := client.CreateUser(ctx, first); err != nil {
+		t.Fatalf("failed to repeat request : %v", err)
+	}
+	time.Sleep(ttl * 5 / 8)
+	if _, err := client.CreateUser(ctx, request()); err == nil {
+		t.Fatalf("want pending user with renewed verification kept")
+	}
+	time.Sleep(ttl / 2)
+	second := request()
+	if _, err := client.CreateUser(ctx, second); err != nil {
+		t.Fatalf("want stale pending user replaced got %v", err)
+	}
+	got, err := confirmEmail(ctx, client, mailDir, email)
+	if err != nil {
+		t.Fatalf("failed to confirm email : %v", err)
+	}
+	if !bytes.Equal(got.PublicKey, second.PublicKey) {
+		t.Fatalf("want key of the replacing user")
+	}
+
+	//a failing lookup must not be mistaken for an unknown email
+	outage := errors.New("backend unavailable")
+	failing := setupTestServer(ctx, &backendSetup.UserDirectoryBackend{
+		Backend: backend,
+		Users:   &failingUserRepo{UserDirectoryRepo: backend, err: outage},
+	}, mailDir)
+	duplicate := request()
+	duplicate.Email = fmt.Sprintf("pending%v@test.com", time.Now().UnixNano())
+	if _, err := failing.CreateUser(ctx, duplicate); err == nil {
+		t.Fatalf("want error while the backend fails")
+	}
+	if _, err := backend.GetByPk(ctx, duplicate.PublicKey); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want no user created while the backend fails got %v", err)
+	}
+}
+
+func TestPendingUsers(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			backend, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+			testPendingUsersWithBackend(ctx, t, backend, t.TempDir())
+		})
+	}
+}
+
+func testCreateUserKeyReuseWithBackend(ctx context.Context, t *testing.T, backend Backend, client UserServiceSchema.UserServiceClient, mailDir string) {
+	tag := fmt.Sprintf("keyreuse%v", time.Now().UnixNano())
+	victimEmail := tag + "-victim@test.com"
+	victimSk, err := createActiveUser(ctx, client, mailDir, victimEmail)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	victimPk, err := x509.MarshalPKIXPublicKey(victimSk.Public())
+	if err != nil {
+		t.Fatalf("failed to encode public key : %v", err)
+	}
+
+	//the published key of a user can not be registered for another email
+	_, err = client.CreateUser(ctx, &UserServiceSchema.UserRequestCreate{
+		Email:             tag + "-attacker@test.com",
+		PublicKey:         victimPk,
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("want code %v for reused key got %v", codes.AlreadyExists, err)
+	}
+	if got, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: victimEmail}); err != nil || !bytes.Equal(got.PublicKey, victimPk) {
+		t.Fatalf("want victim kept got %v : %v", got, err)
+	}
+	if got, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: victimPk}); err != nil || got.Email != victimEmail {
+		t.Fatalf("want victim by key got %v : %v", got, err)
+	}
+
+	//the backends reject reused keys as well, e.g. the key of a deleted user that can still be restored
+	if err := backend.DeleteByEmail(ctx, victimEmail); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	_, err = backend.Create(ctx, &domain.User{
+		Email:             tag + "-copy@test.com",
+		State:             domain.UserStateActive,
+		PublicKey:         victimSk.Public(),
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	})
+	if err == nil {
+		t.Fatalf("want error for key of deleted user")
+	}
+	if _, err := backend.GetByEmail(ctx, tag+"-copy@test.com"); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want no user created got %v", err)
+	}
+	if _, err := backend.Restore(ctx, victimEmail, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("failed to restore victim : %v", err)
+	}
+	if got, err := backend.GetByPk(ctx, victimPk); err != nil || got.Email != victimEmail {
+		t.Fatalf("want restored victim by key got %v : %v", got, err)
+	}
+}
+
+func TestCreateUserKeyReuse(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			backend, err := setupTestBackend(v)
 			if err != nil {
 				t.Fatalf("failed to setup env : %v", err)
 			}
+			client := setupTestServer(ctx, backend, mailDir)
+			testCreateUserKeyReuseWithBackend(ctx, t, backend, client, mailDir)
+		})
+	}
+}
+
+//createActiveUser creates and confirms a user with a fresh ecdsa key
+func createActiveUser(ctx context.Context, client UserServiceSchema.UserServiceClient, mailDir, email string) (*ecdsa.PrivateKey, error) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup test ecdsa key : %v", err)
+	}
+	pkPKIXBytes, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup test ecdsa pubkey encoding : %v", err)
+	}
+	_, err = client.CreateUser(ctx, &UserServiceSchema.UserRequestCreate{
+		Email:             email,
+		PublicKey:         pkPKIXBytes,
+		WrappedPrivateKey: []byte{1, 2, 3},
+		WrappedMasterKey:  []byte{4, 5, 6},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CreateUser has unexpected error : %v", err)
+	}
+	if _, err := confirmEmail(ctx, client, mailDir, email); err != nil {
+		return nil, fmt.Errorf("failed to confirm email : %v", err)
+	}
+	return sk, nil
+}
+
+//addDeviceRequest returns a request to add a device with devicePk signed by signer
+func addDeviceRequest(t *testing.T, signer *ecdsa.PrivateKey, email, name string, devicePk, wrappedMasterKey []byte) *UserServiceSchema.UserRequestAddDevice {
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		t.Fatalf("failed to normalize email : %v", err)
+	}
+	return &UserServiceSchema.UserRequestAddDevice{
+		Email:            email,
+		Name:             name,
+		PublicKey:        devicePk,
+		WrappedMasterKey: wrappedMasterKey,
+		Signature:        signRequest(t, signer, domain.ActionAddDevice, normalizedEmail, name, string(devicePk), string(wrappedMasterKey)),
+	}
+}
+
+func testDevicesWithBackend(ctx context.Context, t *testing.T, backend Backend, client UserServiceSchema.UserServiceClient, mailDir string) {
+	email := "device.owner@email.com"
+	ownerSk, err := createActiveUser(ctx, client, mailDir, email)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	strangerEmail := fmt.Sprintf("device.stranger%v@email.com", time.Now().UnixNano())
+	strangerSk, err := createActiveUser(ctx, client, mailDir, strangerEmail)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+
+	deviceSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key")
+	}
+	devicePk, err := x509.MarshalPKIXPublicKey(deviceSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+
+	//devices can only be added with a key of the user
+	unsigned := addDeviceRequest(t, ownerSk, email, "laptop", devicePk, []byte{7, 8, 9})
+	unsigned.Signature = nil
+	if _, err := client.AddDevice(ctx, unsigned); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("want code %v for unsigned request got %v", codes.Unauthenticated, err)
+	}
+	if _, err := client.AddDevice(ctx, addDeviceRequest(t, strangerSk, email, "laptop", devicePk, []byte{7, 8, 9})); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for request signed by another user got %v", codes.PermissionDenied, err)
+	}
+	if _, err := client.AddDevice(ctx, addDeviceRequest(t, deviceSk, email, "laptop", devicePk, []byte{7, 8, 9})); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for request signed by the new device got %v", codes.PermissionDenied, err)
+	}
+	addReq := addDeviceRequest(t, ownerSk, email, "laptop", devicePk, []byte{7, 8, 9})
+	device, err := client.AddDevice(ctx, addReq)
+	if err != nil {
+		t.Fatalf("failed to add device : %v", err)
+	}
+	if _, err := client.AddDevice(ctx, addReq); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("want code %v adding a key twice got %v", codes.AlreadyExists, err)
+	}
+
+	list, err := client.ListDevices(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to list devices : %v", err)
+	}
+	if len(list.Devices) != 1 || list.Devices[0].Id != device.Id || !reflect.DeepEqual(list.Devices[0].WrappedMasterKey, addReq.WrappedMasterKey) {
+		t.Fatalf("unexpected device list %v", list.Devices)
+	}
+
+	//device keys resolve to their owner
+	owner, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: devicePk})
+	if err != nil {
+		t.Fatalf("failed to get user by device key : %v", err)
+	}
+	if owner.Email != email {
+		t.Fatalf("want owner %v got %v", email, owner.Email)
+	}
+
+	//devices can only be revoked with a key of the user
+	revokeReq := &UserServiceSchema.UserRequestRevokeDevice{Email: email, DeviceId: device.Id}
+	if _, err := client.RevokeDevice(ctx, revokeReq); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("want code %v for unsigned request got %v", codes.Unauthenticated, err)
+	}
+	revokeReq.Signature = signRequest(t, strangerSk, domain.ActionRevokeDevice, email, device.Id)
+	if _, err := client.RevokeDevice(ctx, revokeReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for request signed by another user got %v", codes.PermissionDenied, err)
+	}
+
+	//revoked devices no longer resolve and lose their wrapped key
+	revokeReq.Signature = signRequest(t, deviceSk, domain.ActionRevokeDevice, email, device.Id)
+	if _, err = client.RevokeDevice(ctx, revokeReq); err != nil {
+		t.Fatalf("failed to revoke device : %v", err)
+	}
+	if _, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: devicePk}); status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v for revoked device got %v", codes.NotFound, err)
+	}
+	list, err = client.ListDevices(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to list devices : %v", err)
+	}
+	if len(list.Devices) != 1 || list.Devices[0].RevokedAtUnix == 0 || len(list.Devices[0].WrappedMasterKey) != 0 {
+		t.Fatalf("unexpected device list after revocation %v", list.Devices)
+	}
+
+	//purging deleted users removes their devices
+	reusedEmail := fmt.Sprintf("device.reused%v@email.com", time.Now().UnixNano())
+	reusedSk, err := createActiveUser(ctx, client, mailDir, reusedEmail)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if _, err := client.AddDevice(ctx, addDeviceRequest(t, reusedSk, reusedEmail, "phone", newDevicePk(t), []byte{1})); err != nil {
+		t.Fatalf("failed to add device : %v", err)
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: reusedEmail}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	if _, err := backend.PurgeDeleted(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("failed to purge deleted users : %v", err)
+	}
+	if devices, err := backend.ListDevices(ctx, reusedEmail); err != nil || len(devices) != 0 {
+		t.Fatalf("want devices of purged user removed got %v : %v", devices, err)
+	}
+
+	//a device left over from a previous user with the same email does not belong to a new user
+	staleSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key")
+	}
+	staleDeviceID := fmt.Sprintf("stale%v", time.Now().UnixNano())
+	if _, err := backend.AddDevice(ctx, &domain.Device{
+		ID:               staleDeviceID,
+		OwnerEmail:       reusedEmail,
+		Name:             "stale",
+		PublicKey:        staleSk.Public(),
+		WrappedMasterKey: []byte{1},
+	}); err != nil {
+		t.Fatalf("failed to add stale device : %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := createActiveUser(ctx, client, mailDir, reusedEmail); err != nil {
+		t.Fatalf("failed to create user with reused email : %v", err)
+	}
+	stalePk, err := x509.MarshalPKIXPublicKey(staleSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+	if _, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: stalePk}); status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v for device of previous user got %v", codes.NotFound, err)
+	}
+	if _, err := client.AddDevice(ctx, addDeviceRequest(t, staleSk, reusedEmail, "laptop", newDevicePk(t), []byte{1})); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for request signed by device of previous user got %v", codes.PermissionDenied, err)
+	}
+}
+
+//newDevicePk returns the PKIX encoding of a fresh device key
+func newDevicePk(t *testing.T) []byte {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key")
+	}
+	pk, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+	return pk
+}
 
-			testUserCreationWithBackend(ctx, t, client)
+func TestDevices(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			backend, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+			client := setupTestServer(ctx, backend, mailDir)
 
+			testDevicesWithBackend(ctx, t, backend, client, mailDir)
 		})
 	}
+}
+
+func testDeviceEnrollmentWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	email := "enrollment.owner@email.com"
+	ownerSk, err := createActiveUser(ctx, client, mailDir, email)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	ownerPk, err := x509.MarshalPKIXPublicKey(ownerSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+
+	deviceSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key")
+	}
+	devicePk, err := x509.MarshalPKIXPublicKey(deviceSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+	enrollment, err := client.RequestEnrollment(ctx, &UserServiceSchema.UserRequestEnrollment{
+		Email:      email,
+		DeviceName: "phone",
+		PublicKey:  devicePk,
+	})
+	if err != nil {
+		t.Fatalf("failed to request enrollment : %v", err)
+	}
+	if enrollment.State != string(domain.EnrollmentStatePending) {
+		t.Fatalf("want state %v got %v", domain.EnrollmentStatePending, enrollment.State)
+	}
 
+	pending, err := client.ListPendingEnrollments(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to list pending enrollments : %v", err)
+	}
+	if len(pending.Enrollments) != 1 || pending.Enrollments[0].Id != enrollment.Id {
+		t.Fatalf("unexpected pending enrollments %v", pending.Enrollments)
+	}
+
+	wrappedMasterKey := []byte{10, 11, 12}
+	sign := func(sk *ecdsa.PrivateKey, wrapped []byte) []byte {
+		digest := domain.EnrollmentApprovalDigest(enrollment.Id, devicePk, wrapped)
+		sig, err := ecdsa.SignASN1(rand.Reader, sk, digest)
+		if err != nil {
+			t.Fatalf("failed to sign approval : %v", err)
+		}
+		return sig
+	}
+	approveReq := &UserServiceSchema.UserRequestApproveEnrollment{
+		Email:             email,
+		EnrollmentId:      enrollment.Id,
+		ApproverPublicKey: ownerPk,
+		WrappedMasterKey:  wrappedMasterKey,
+		//signature over a different wrapped key
+		Signature: sign(ownerSk, []byte{1}),
+	}
+	if _, err := client.ApproveEnrollment(ctx, approveReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for invalid signature got %v", codes.PermissionDenied, err)
+	}
+	//only keys of the user may approve
+	approveReq.ApproverPublicKey = devicePk
+	approveReq.Signature = sign(deviceSk, wrappedMasterKey)
+	if _, err := client.ApproveEnrollment(ctx, approveReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for foreign approver got %v", codes.PermissionDenied, err)
+	}
+
+	approveReq.ApproverPublicKey = ownerPk
+	approveReq.Signature = sign(ownerSk, wrappedMasterKey)
+	device, err := client.ApproveEnrollment(ctx, approveReq)
+	if err != nil {
+		t.Fatalf("failed to approve enrollment : %v", err)
+	}
+	if !reflect.DeepEqual(device.WrappedMasterKey, wrappedMasterKey) || device.Name != "phone" {
+		t.Fatalf("unexpected device %v", device)
+	}
+	if _, err := client.ApproveEnrollment(ctx, approveReq); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("want code %v approving twice got %v", codes.FailedPrecondition, err)
+	}
+
+	//the new device learns about the approval by polling
+	got, err := client.GetEnrollment(ctx, &UserServiceSchema.UserRequestEnrollmentStatus{Email: email, EnrollmentId: enrollment.Id})
+	if err != nil {
+		t.Fatalf("failed to get enrollment : %v", err)
+	}
+	if got.State != string(domain.EnrollmentStateApproved) || got.DeviceId != device.Id {
+		t.Fatalf("unexpected enrollment after approval %v", got)
+	}
+	pending, err = client.ListPendingEnrollments(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to list pending enrollments : %v", err)
+	}
+	if len(pending.Enrollments) != 0 {
+		t.Fatalf("want no pending enrollments got %v", pending.Enrollments)
+	}
+	owner, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: devicePk})
+	if err != nil {
+		t.Fatalf("failed to get user by enrolled device key : %v", err)
+	}
+	if owner.Email != email {
+		t.Fatalf("want owner %v got %v", email, owner.Email)
+	}
+}
+
+func TestDeviceEnrollment(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			client, err := setupTestENV(ctx, v, mailDir)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testDeviceEnrollmentWithBackend(ctx, t, client, mailDir)
+		})
+	}
+}
+
+func testAccountRecoveryWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	email := "recovering.user@email.com"
+	sk, err := createActiveUser(ctx, client, mailDir, email)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	attackerEmail := fmt.Sprintf("recovery.attacker%v@email.com", time.Now().UnixNano())
+	attackerSk, err := createActiveUser(ctx, client, mailDir, attackerEmail)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	//addReq returns a request to add a wrapping of kind signed by signer
+	addReq := func(signer *ecdsa.PrivateKey, kind domain.RecoveryKind, label string, wrapped []byte) *UserServiceSchema.UserRequestAddRecoveryWrapping {
+		return &UserServiceSchema.UserRequestAddRecoveryWrapping{
+			Email:            email,
+			Kind:             string(kind),
+			Label:            label,
+			WrappedMasterKey: wrapped,
+			Signature:        signRequest(t, signer, domain.ActionAddRecoveryWrapping, email, string(kind), label, "", string(wrapped)),
+		}
+	}
+
+	//escrow wrappings require a key, recovery codes must not have one
+	_, err = client.AddRecoveryWrapping(ctx, addReq(sk, domain.RecoveryKindEscrow, "", []byte{1}))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for escrow wrapping without key got %v", codes.InvalidArgument, err)
+	}
+	//wrappings can only be added with a key of the user
+	wrappedMasterKey := []byte{13, 14, 15}
+	unsigned := addReq(sk, domain.RecoveryKindCode, "printed code", wrappedMasterKey)
+	unsigned.Signature = nil
+	if _, err := client.AddRecoveryWrapping(ctx, unsigned); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("want code %v for unsigned request got %v", codes.Unauthenticated, err)
+	}
+	if _, err := client.AddRecoveryWrapping(ctx, addReq(attackerSk, domain.RecoveryKindCode, "attacker code", []byte{1})); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for request signed by another user got %v", codes.PermissionDenied, err)
+	}
+	wrapping, err := client.AddRecoveryWrapping(ctx, addReq(sk, domain.RecoveryKindCode, "printed code", wrappedMasterKey))
+	if err != nil {
+		t.Fatalf("failed to add recovery wrapping : %v", err)
+	}
+	//wrappings can only be deleted with a key of the user
+	deleteReq := &UserServiceSchema.UserRequestRecoveryWrapping{Email: email, WrappingId: wrapping.Id}
+	if _, err := client.DeleteRecoveryWrapping(ctx, deleteReq); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("want code %v for unsigned request got %v", codes.Unauthenticated, err)
+	}
+	deleteReq.Signature = signRequest(t, attackerSk, domain.ActionDeleteRecoveryWrapping, email, wrapping.Id)
+	if _, err := client.DeleteRecoveryWrapping(ctx, deleteReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for request signed by another user got %v", codes.PermissionDenied, err)
+	}
+
+	//the wrapped master key is only handed out by RecoverAccount
+	list, err := client.ListRecoveryWrappings(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to list recovery wrappings : %v", err)
+	}
+	if len(list.Wrappings) != 1 || list.Wrappings[0].Id != wrapping.Id || len(list.Wrappings[0].WrappedMasterKey) != 0 {
+		t.Fatalf("unexpected recovery wrappings %v", list.Wrappings)
+	}
+
+	recoverReq := &UserServiceSchema.UserRequestRecoverAccount{Email: email, Token: "invalid", WrappingId: wrapping.Id}
+	if _, err := client.RecoverAccount(ctx, recoverReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for invalid token got %v", codes.PermissionDenied, err)
+	}
+	if _, err := client.StartRecovery(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+		t.Fatalf("failed to start recovery : %v", err)
+	}
+	recoverReq.Token, err = lastMailedToken(mailDir, email)
+	if err != nil {
+		t.Fatalf("failed to read recovery token : %v", err)
+	}
+	recovered, err := client.RecoverAccount(ctx, recoverReq)
+	if err != nil {
+		t.Fatalf("failed to recover account : %v", err)
+	}
+	if !reflect.DeepEqual(recovered.WrappedMasterKey, wrappedMasterKey) {
+		t.Fatalf("want wrapped master key %v got %v", wrappedMasterKey, recovered.WrappedMasterKey)
+	}
+	//tokens are single use
+	if _, err := client.RecoverAccount(ctx, recoverReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v reusing a token got %v", codes.PermissionDenied, err)
+	}
+
+	audits, err := client.ListRecoveryAudits(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to list recovery audits : %v", err)
+	}
+	if len(audits.Audits) != 1 || audits.Audits[0].WrappingId != wrapping.Id {
+		t.Fatalf("unexpected recovery audits %v", audits.Audits)
+	}
+
+	deleteReq.Signature = signRequest(t, sk, domain.ActionDeleteRecoveryWrapping, email, wrapping.Id)
+	if _, err := client.DeleteRecoveryWrapping(ctx, deleteReq); err != nil {
+		t.Fatalf("failed to delete recovery wrapping : %v", err)
+	}
+	if list, err := client.ListRecoveryWrappings(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil || len(list.Wrappings) != 0 {
+		t.Fatalf("want no recovery wrappings after deletion got %v : %v", list, err)
+	}
+}
+
+func TestAccountRecovery(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			client, err := setupTestENV(ctx, v, mailDir)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testAccountRecoveryWithBackend(ctx, t, client, mailDir)
+		})
+	}
+}
+
+func testOrganizationEscrowWithBackend(ctx context.Context, t *testing.T, backend Backend, client UserServiceSchema.UserServiceClient, mailDir string) {
+	escrowSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key")
+	}
+	escrowPk, err := x509.MarshalPKIXPublicKey(escrowSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+	//organizations are created by operators, not via grpc
+	userService := UserService.NewUserService(backend, UserService.WithOrganizations(backend))
+	if _, err := userService.CreateOrganization(ctx, "Acme", "Acme.Example", escrowPk); err != nil {
+		t.Fatalf("failed to create organization : %v", err)
+	}
+	if _, err := userService.CreateOrganization(ctx, "Acme2", "acme.example", escrowPk); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("want code %v for taken domain got %v", codes.AlreadyExists, err)
+	}
+
+	email := "employee@acme.example"
+	org, err := client.GetOrganizationByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to get organization : %v", err)
+	}
+	if !reflect.DeepEqual(org.EscrowPublicKey, escrowPk) {
+		t.Fatalf("unexpected organization %v", org)
+	}
+
+	userSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key")
+	}
+	userPk, err := x509.MarshalPKIXPublicKey(userSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+	createReq := &UserServiceSchema.UserRequestCreate{
+		Email:             email,
+		PublicKey:         userPk,
+		WrappedPrivateKey: []byte{1, 2, 3},
+		WrappedMasterKey:  []byte{4, 5, 6},
+	}
+	if _, err := client.CreateUser(ctx, createReq); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v without escrow wrapping got %v", codes.InvalidArgument, err)
+	}
+	createReq.EscrowWrappedMasterKey = []byte{7, 8, 9}
+	if _, err := client.CreateUser(ctx, createReq); err != nil {
+		t.Fatalf("failed to create member : %v", err)
+	}
+	user, err := confirmEmail(ctx, client, mailDir, email)
+	if err != nil {
+		t.Fatalf("failed to confirm email : %v", err)
+	}
+
+	updateReq := &UserServiceSchema.UserRequestUpdate{
+		Email:             email,
+		WrappedPrivateKey: []byte{11},
+		WrappedMasterKey:  []byte{12},
+		SignerPublicKey:   userPk,
+	}
+	sign := func(sk *ecdsa.PrivateKey, digest []byte) []byte {
+		sig, err := ecdsa.SignASN1(rand.Reader, sk, digest)
+		if err != nil {
+			t.Fatalf("failed to sign : %v", err)
+		}
+		return sig
+	}
+	updateReq.Signature = sign(userSk, domain.UserUpdateDigest(email, user.UpdatedAtUnix, updateReq.WrappedPrivateKey, updateReq.WrappedMasterKey, nil))
+	if _, err := client.UpdateUser(ctx, updateReq); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for update without escrow wrapping got %v", codes.InvalidArgument, err)
+	}
+	updateReq.EscrowWrappedMasterKey = []byte{13}
+	if _, err := client.UpdateUser(ctx, updateReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for signature over other fields got %v", codes.PermissionDenied, err)
+	}
+	updateReq.Signature = sign(userSk, domain.UserUpdateDigest(email, user.UpdatedAtUnix, updateReq.WrappedPrivateKey, updateReq.WrappedMasterKey, updateReq.EscrowWrappedMasterKey))
+	updated, err := client.UpdateUser(ctx, updateReq)
+	if err != nil {
+		t.Fatalf("failed to update user : %v", err)
+	}
+	if !reflect.DeepEqual(updated.WrappedMasterKey, updateReq.WrappedMasterKey) {
+		t.Fatalf("want wrapped master key %v got %v", updateReq.WrappedMasterKey, updated.WrappedMasterKey)
+	}
+
+	//only the escrow key may fetch the escrow wrapping
+	accessReq := &UserServiceSchema.UserRequestEscrowAccess{Email: email, TimestampUnix: time.Now().Unix()}
+	accessReq.Signature = sign(userSk, domain.EscrowAccessDigest(org.Id, email, accessReq.TimestampUnix))
+	if _, err := client.GetEscrowWrapping(ctx, accessReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for access with user key got %v", codes.PermissionDenied, err)
+	}
+	accessReq.Signature = sign(escrowSk, domain.EscrowAccessDigest(org.Id, email, accessReq.TimestampUnix))
+	escrow, err := client.GetEscrowWrapping(ctx, accessReq)
+	if err != nil {
+		t.Fatalf("failed to get escrow wrapping : %v", err)
+	}
+	if !reflect.DeepEqual(escrow.WrappedMasterKey, updateReq.EscrowWrappedMasterKey) {
+		t.Fatalf("want escrow wrapping %v got %v", updateReq.EscrowWrappedMasterKey, escrow.WrappedMasterKey)
+	}
+	audits, err := client.ListRecoveryAudits(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to list recovery audits : %v", err)
+	}
+	if len(audits.Audits) != 1 || audits.Audits[0].Kind != string(domain.RecoveryKindEscrow) {
+		t.Fatalf("unexpected recovery audits %v", audits.Audits)
+	}
+
+	//users outside of organizations must not send escrow wrappings
+	createReq.Email = "freelancer@email.com"
+	if _, err := client.CreateUser(ctx, createReq); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for escrow wrapping without organization got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestOrganizationEscrow(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			backend, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+			client := setupTestServer(ctx, backend, mailDir)
+
+			testOrganizationEscrowWithBackend(ctx, t, backend, client, mailDir)
+		})
+	}
+}
+
+//signRequest signs action and fields with sk for the current time
+func signRequest(t *testing.T, sk *ecdsa.PrivateKey, action string, fields ...string) *UserServiceSchema.RequestSignature {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatalf("failed to encode signer key : %v", err)
+	}
+	now := time.Now().Unix()
+	sig, err := ecdsa.SignASN1(rand.Reader, sk, domain.SignedRequestDigest(action, now, fields...))
+	if err != nil {
+		t.Fatalf("failed to sign request : %v", err)
+	}
+	return &UserServiceSchema.RequestSignature{SignerPublicKey: pkPKIX, TimestampUnix: now, Signature: sig}
+}
+
+func testGroupsWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	ownerEmail := "team.lead@email.com"
+	memberEmail := "team.member@email.com"
+	ownerSk, err := createActiveUser(ctx, client, mailDir, ownerEmail)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	memberSk, err := createActiveUser(ctx, client, mailDir, memberEmail)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+
+	createReq := &UserServiceSchema.GroupRequestCreate{OwnerEmail: ownerEmail, Name: "Team X"}
+	createReq.Signature = signRequest(t, memberSk, domain.ActionCreateGroup, ownerEmail, "Team X")
+	if _, err := client.CreateGroup(ctx, createReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v creating a group for someone else got %v", codes.PermissionDenied, err)
+	}
+	createReq.Signature = signRequest(t, ownerSk, domain.ActionCreateGroup, ownerEmail, "Team X")
+	group, err := client.CreateGroup(ctx, createReq)
+	if err != nil {
+		t.Fatalf("failed to create group : %v", err)
+	}
+
+	//only the owner may add members
+	addReq := &UserServiceSchema.GroupRequestMember{GroupId: group.Id, Email: memberEmail, ActorEmail: memberEmail}
+	addReq.Signature = signRequest(t, memberSk, domain.ActionAddGroupMember, group.Id, memberEmail)
+	if _, err := client.AddGroupMember(ctx, addReq); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v for member adding itself got %v", codes.PermissionDenied, err)
+	}
+	addReq.ActorEmail = ownerEmail
+	addReq.Signature = signRequest(t, ownerSk, domain.ActionAddGroupMember, group.Id, memberEmail)
+	if _, err := client.AddGroupMember(ctx, addReq); err != nil {
+		t.Fatalf("failed to add group member : %v", err)
+	}
+	if _, err := client.AddGroupMember(ctx, addReq); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("want code %v adding a member twice got %v", codes.AlreadyExists, err)
+	}
+
+	members, err := client.ListGroupMembers(ctx, &UserServiceSchema.GroupRequestId{GroupId: group.Id})
+	if err != nil {
+		t.Fatalf("failed to list group members : %v", err)
+	}
+	memberPk, err := x509.MarshalPKIXPublicKey(memberSk.Public())
+	if err != nil {
+		t.Fatalf("failed to encode member key : %v", err)
+	}
+	if len(members.Members) != 2 || members.Members[1].Email != memberEmail || !reflect.DeepEqual(members.Members[1].PublicKey, memberPk) {
+		t.Fatalf("unexpected group members %v", members.Members)
+	}
+	groups, err := client.ListGroupsOfUser(ctx, &UserServiceSchema.UserRequestEmail{Email: memberEmail})
+	if err != nil {
+		t.Fatalf("failed to list groups : %v", err)
+	}
+	if len(groups.Groups) != 1 || groups.Groups[0].Id != group.Id {
+		t.Fatalf("unexpected groups %v", groups.Groups)
+	}
+
+	//group keys are wrapped per member for the current epoch
+	uploadReq := &UserServiceSchema.GroupRequestUploadKeys{
+		GroupId:    group.Id,
+		Epoch:      group.KeyEpoch,
+		ActorEmail: memberEmail,
+		Wrappings: []*UserServiceSchema.GroupKeyUpload{
+			{Email: ownerEmail, WrappedGroupKey: []byte{1}},
+			{Email: memberEmail, WrappedGroupKey: []byte{2}},
+		},
+	}
+	signUpload := func(sk *ecdsa.PrivateKey) *UserServiceSchema.RequestSignature {
+		fields := []string{uploadReq.GroupId, strconv.FormatInt(uploadReq.Epoch, 10)}
+		for _, w := range uploadReq.Wrappings {
+			fields = append(fields, w.Email, string(w.WrappedGroupKey))
+		}
+		return signRequest(t, sk, domain.ActionUploadGroupKeys, fields...)
+	}
+	uploadReq.Signature = signUpload(memberSk)
+	if _, err := client.UploadGroupKeys(ctx, uploadReq); err != nil {
+		t.Fatalf("failed to upload group keys : %v", err)
+	}
+	members, err = client.ListGroupMembers(ctx, &UserServiceSchema.GroupRequestId{GroupId: group.Id})
+	if err != nil {
+		t.Fatalf("failed to list group members : %v", err)
+	}
+	for _, m := range members.Members {
+		if !m.HasCurrentKey {
+			t.Fatalf("want current key for %v", m.Email)
+		}
+	}
+
+	//members may leave
+	removeReq := &UserServiceSchema.GroupRequestMember{GroupId: group.Id, Email: memberEmail, ActorEmail: memberEmail}
+	removeReq.Signature = signRequest(t, memberSk, domain.ActionRemoveGroupMember, group.Id, memberEmail)
+	if _, err := client.RemoveGroupMember(ctx, removeReq); err != nil {
+		t.Fatalf("failed to leave group : %v", err)
+	}
+	members, err = client.ListGroupMembers(ctx, &UserServiceSchema.GroupRequestId{GroupId: group.Id})
+	if err != nil {
+		t.Fatalf("failed to list group members : %v", err)
+	}
+	if len(members.Members) != 1 || members.Members[0].Email != ownerEmail {
+		t.Fatalf("unexpected group members after leaving %v", members.Members)
+	}
+
+	//removing a member starts a new epoch, uploads for the old one are refused
+	if members.Group.KeyEpoch != group.KeyEpoch+1 || members.Members[0].HasCurrentKey {
+		t.Fatalf("want new epoch without keys after leaving got %v %v", members.Group, members.Members)
+	}
+	uploadReq.ActorEmail = ownerEmail
+	uploadReq.Wrappings = uploadReq.Wrappings[:1]
+	uploadReq.Signature = signUpload(ownerSk)
+	if _, err := client.UploadGroupKeys(ctx, uploadReq); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("want code %v for stale epoch got %v", codes.FailedPrecondition, err)
+	}
+	uploadReq.Epoch = members.Group.KeyEpoch
+	uploadReq.Wrappings[0].WrappedGroupKey = []byte{3}
+	uploadReq.Signature = signUpload(ownerSk)
+	if _, err := client.UploadGroupKeys(ctx, uploadReq); err != nil {
+		t.Fatalf("failed to upload group keys for new epoch : %v", err)
+	}
+	current, err := client.GetGroupKey(ctx, &UserServiceSchema.GroupRequestKey{GroupId: group.Id, Email: ownerEmail})
+	if err != nil {
+		t.Fatalf("failed to get group key : %v", err)
+	}
+	old, err := client.GetGroupKey(ctx, &UserServiceSchema.GroupRequestKey{GroupId: group.Id, Email: ownerEmail, Epoch: group.KeyEpoch})
+	if err != nil {
+		t.Fatalf("failed to get group key of old epoch : %v", err)
+	}
+	if !reflect.DeepEqual(current.WrappedGroupKey, []byte{3}) || !reflect.DeepEqual(old.WrappedGroupKey, []byte{1}) {
+		t.Fatalf("unexpected group keys %v %v", current, old)
+	}
+
+	//keys wrapped before the member rotated its key can no longer be unwrapped and have to be uploaded again
+	rotatedSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	rotatedPk, err := x509.MarshalPKIXPublicKey(rotatedSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding : %v", err)
+	}
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	rotate := &UserServiceSchema.UserRequestRotateKey{
+		Email:             ownerEmail,
+		PublicKey:         rotatedPk,
+		WrappedPrivateKey: []byte{7, 8, 9},
+		WrappedMasterKey:  []byte{10, 11, 12},
+	}
+	if _, err := client.RotateUserKey(adminCtx, rotate); err != nil {
+		t.Fatalf("failed to rotate key : %v", err)
+	}
+	if _, err := client.GetGroupKey(ctx, &UserServiceSchema.GroupRequestKey{GroupId: group.Id, Email: ownerEmail}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("want code %v for a key wrapped for the old key got %v", codes.FailedPrecondition, err)
+	}
+	if _, err := client.GetGroupKey(ctx, &UserServiceSchema.GroupRequestKey{GroupId: group.Id, Email: ownerEmail, Epoch: group.KeyEpoch}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("want code %v for a key of an old epoch wrapped for the old key got %v", codes.FailedPrecondition, err)
+	}
+	members, err = client.ListGroupMembers(ctx, &UserServiceSchema.GroupRequestId{GroupId: group.Id})
+	if err != nil {
+		t.Fatalf("failed to list group members : %v", err)
+	}
+	if len(members.Members) != 1 || members.Members[0].HasCurrentKey {
+		t.Fatalf("want no current key after the key rotation got %v", members.Members)
+	}
+	uploadReq.Wrappings[0].WrappedGroupKey = []byte{4}
+	uploadReq.Signature = signUpload(rotatedSk)
+	if _, err := client.UploadGroupKeys(ctx, uploadReq); err != nil {
+		t.Fatalf("failed to upload group keys for the rotated key : %v", err)
+	}
+	current, err = client.GetGroupKey(ctx, &UserServiceSchema.GroupRequestKey{GroupId: group.Id, Email: ownerEmail})
+	if err != nil || !reflect.DeepEqual(current.WrappedGroupKey, []byte{4}) {
+		t.Fatalf("want group key wrapped for the rotated key got %v, %v", current, err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			client, err := setupTestENV(ctx, v, mailDir)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testGroupsWithBackend(ctx, t, client, mailDir)
+		})
+	}
+}
+
+//verifyTreeHead checks the signature of head by testKeyLogSigner
+func verifyTreeHead(head *UserServiceSchema.SignedTreeHead) error {
+	digest := domain.TreeHeadDigest(head.Size, head.RootHash, head.TimestampUnix)
+	return domain.VerifySignature(testKeyLogSigner.Public(), digest, head.Signature)
+}
+
+func testKeyLogWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	aliceEmail := "alice-keylog@test.com"
+	bobEmail := "bob-keylog@test.com"
+	if _, err := createActiveUser(ctx, client, mailDir, aliceEmail); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+
+	//the key handed out for alice has been published in the log
+	proof, err := client.GetUserPkWithProof(ctx, &UserServiceSchema.UserRequestEmail{Email: aliceEmail})
+	if err != nil {
+		t.Fatalf("failed to get user pk with proof : %v", err)
+	}
+	if err := verifyTreeHead(proof.TreeHead); err != nil {
+		t.Fatalf("invalid tree head signature : %v", err)
+	}
+	if proof.Entry.Email != aliceEmail || proof.Entry.Kind != string(domain.KeyLogCreateUser) ||
+		!reflect.DeepEqual(proof.Entry.PublicKey, proof.UserPk.PublicKey) {
+		t.Fatalf("log entry %v does not match user pk %v", proof.Entry, proof.UserPk)
+	}
+	entry := &domain.KeyLogEntry{
+		Kind:          domain.KeyLogKind(proof.Entry.Kind),
+		Email:         proof.Entry.Email,
+		PublicKeyPKIX: proof.Entry.PublicKey,
+		CreatedAt:     time.Unix(proof.Entry.CreatedAtUnix, 0),
+	}
+	err = domain.VerifyMerkleInclusion(proof.Entry.Index, proof.TreeHead.Size, entry.LeafHash(), proof.InclusionProof, proof.TreeHead.RootHash)
+	if err != nil {
+		t.Fatalf("invalid inclusion proof : %v", err)
+	}
+
+	//later tree heads extend the earlier ones
+	if _, err := createActiveUser(ctx, client, mailDir, bobEmail); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: bobEmail}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	head, err := client.GetKeyLogTreeHead(ctx, &UserServiceSchema.Empty{})
+	if err != nil {
+		t.Fatalf("failed to get tree head : %v", err)
+	}
+	if err := verifyTreeHead(head); err != nil {
+		t.Fatalf("invalid tree head signature : %v", err)
+	}
+	if head.Size < proof.TreeHead.Size+2 {
+		t.Fatalf("want at least %v entries got %v", proof.TreeHead.Size+2, head.Size)
+	}
+	consistency, err := client.GetKeyLogConsistencyProof(ctx, &UserServiceSchema.KeyLogRequestConsistency{
+		FirstSize:  proof.TreeHead.Size,
+		SecondSize: head.Size,
+	})
+	if err != nil {
+		t.Fatalf("failed to get consistency proof : %v", err)
+	}
+	err = domain.VerifyMerkleConsistency(proof.TreeHead.Size, head.Size, proof.TreeHead.RootHash, head.RootHash, consistency.Hashes)
+	if err != nil {
+		t.Fatalf("invalid consistency proof : %v", err)
+	}
+	_, err = client.GetKeyLogConsistencyProof(ctx, &UserServiceSchema.KeyLogRequestConsistency{
+		FirstSize:  head.Size,
+		SecondSize: head.Size + 1,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for unknown size got %v", codes.InvalidArgument, err)
+	}
+
+	//auditors see the creation and deletion of bob
+	entries, err := client.ListKeyLogEntries(ctx, &UserServiceSchema.KeyLogRequestEntries{Start: proof.TreeHead.Size, Limit: 100})
+	if err != nil {
+		t.Fatalf("failed to list key log entries : %v", err)
+	}
+	var bobKinds []string
+	for _, v := range entries.Entries {
+		if v.Email == bobEmail {
+			bobKinds = append(bobKinds, v.Kind)
+		}
+	}
+	wantKinds := []string{string(domain.KeyLogCreateUser), string(domain.KeyLogDeleteUser)}
+	if !reflect.DeepEqual(bobKinds, wantKinds) {
+		t.Fatalf("want entries %v for deleted user got %v", wantKinds, bobKinds)
+	}
+	if _, err := client.GetUserPkWithProof(ctx, &UserServiceSchema.UserRequestEmail{Email: bobEmail}); err == nil {
+		t.Fatalf("want error for deleted user")
+	}
+}
+
+//failingKeyLogBackend fails the appends to the key log while failing is set
+type failingKeyLogBackend struct {
+	Backend
+	failing int32
+}
+
+func (f *failingKeyLogBackend) AppendKeyLogEntries(ctx context.Context, after, cursor int64, entries []*domain.KeyLogEntry) error {
+	if atomic.LoadInt32(&f.failing) == 1 {
+		return errors.New("key log unavailable")
+	}
+	return f.Backend.AppendKeyLogEntries(ctx, after, cursor, entries)
+}
+
+func testKeyLogReconciliationWithBackend(ctx context.Context, t *testing.T, backend Backend, mailDir string) {
+	failing := &failingKeyLogBackend{Backend: backend, failing: 1}
+	client := setupTestServer(ctx, failing, mailDir)
+	email := fmt.Sprintf("reconciled%v@test.com", time.Now().UnixNano())
+
+	//the user is committed although its key could not be logged
+	if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	_, err := client.GetUserPkWithProof(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v before reconciling got %v", codes.NotFound, err)
+	}
+
+	atomic.StoreInt32(&failing.failing, 0)
+	reconciler := &UserService.KeyLogReconciler{KeyLogRepo: backend, EventRepo: backend}
+	for i := 0; i < 2; i++ {
+		if err := reconciler.ReconcileOnce(ctx); err != nil {
+			t.Fatalf("failed to reconcile key log : %v", err)
+		}
+	}
+	proof, err := client.GetUserPkWithProof(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to get user pk with proof after reconciling : %v", err)
+	}
+	if proof.Entry.Kind != string(domain.KeyLogCreateUser) || !reflect.DeepEqual(proof.Entry.PublicKey, proof.UserPk.PublicKey) {
+		t.Fatalf("log entry %v does not match user pk %v", proof.Entry, proof.UserPk)
+	}
+	//reconciling again does not log the change twice
+	entries, err := client.ListKeyLogEntries(ctx, &UserServiceSchema.KeyLogRequestEntries{Start: 0, Limit: 1000})
+	if err != nil {
+		t.Fatalf("failed to list key log entries : %v", err)
+	}
+	logged := 0
+	for _, v := range entries.Entries {
+		if v.Email == email {
+			logged++
+		}
+	}
+	if logged != 1 {
+		t.Fatalf("want 1 entry of %v got %v", email, logged)
+	}
+}
+
+func TestKeyLog(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			backend, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testKeyLogWithBackend(ctx, t, setupTestServer(ctx, backend, mailDir), mailDir)
+			testKeyLogReconciliationWithBackend(ctx, t, backend, mailDir)
+		})
+	}
+}
+
+func testAttestationsWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	email := "attested@test.com"
+	if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+
+	//clients pin all published keys
+	keys, err := client.GetServiceSigningKeys(ctx, &UserServiceSchema.Empty{})
+	if err != nil {
+		t.Fatalf("failed to get service signing keys : %v", err)
+	}
+	if len(keys.Keys) != 2 || keys.Keys[0].Version != 1 || keys.Keys[1].Version != 2 || len(keys.KeyLogPublicKey) == 0 {
+		t.Fatalf("unexpected service signing keys %v", keys)
+	}
+	pinned := make(map[int64][]byte)
+	for _, v := range keys.Keys {
+		pinned[v.Version] = v.PublicKey
+	}
+
+	userPk, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to get user pk : %v", err)
+	}
+	attestation := userPk.Attestation
+	if attestation == nil || attestation.KeyVersion != 2 || attestation.Email != email ||
+		!reflect.DeepEqual(attestation.PublicKey, userPk.PublicKey) {
+		t.Fatalf("unexpected attestation %v for %v", attestation, userPk)
+	}
+	signerPk, err := x509.ParsePKIXPublicKey(pinned[attestation.KeyVersion])
+	if err != nil {
+		t.Fatalf("failed to parse pinned key : %v", err)
+	}
+	digest := domain.BindingAttestationDigest(attestation.Email, attestation.PublicKey, attestation.TimestampUnix, attestation.KeyVersion)
+	if err := domain.VerifySignature(signerPk, digest, attestation.Signature); err != nil {
+		t.Fatalf("invalid attestation signature : %v", err)
+	}
+	//the attestation can not be moved to another email
+	digest = domain.BindingAttestationDigest("mallory@test.com", attestation.PublicKey, attestation.TimestampUnix, attestation.KeyVersion)
+	if err := domain.VerifySignature(signerPk, digest, attestation.Signature); err == nil {
+		t.Fatalf("attestation is valid for another email")
+	}
+}
+
+func TestAttestations(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			client, err := setupTestENV(ctx, v, mailDir)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testAttestationsWithBackend(ctx, t, client, mailDir)
+		})
+	}
+}
+
+func TestSetupSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 2; i++ {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key : %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(sk)
+		if err != nil {
+			t.Fatalf("failed to marshal key : %v", err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("key%v.pem", i))
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatalf("failed to write key : %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	defer os.Unsetenv(EnvSigningKeys)
+	os.Setenv(EnvSigningKeys, fmt.Sprintf("1=%v, 2=%v", paths[0], paths[1]))
+	keys, err := SetupSigningKeys()
+	if err != nil {
+		t.Fatalf("failed to setup signing keys : %v", err)
+	}
+	if len(keys) != 2 || keys[0].Version != 1 || keys[1].Version != 2 {
+		t.Fatalf("unexpected signing keys %v", keys)
+	}
+
+	invalid := []string{
+		paths[0],
+		fmt.Sprintf("0=%v", paths[0]),
+		fmt.Sprintf("1=%v,1=%v", paths[0], paths[1]),
+		"1=" + filepath.Join(dir, "missing.pem"),
+	}
+	for _, v := range invalid {
+		os.Setenv(EnvSigningKeys, v)
+		if _, err := SetupSigningKeys(); err == nil {
+			t.Fatalf("want error for %q", v)
+		}
+	}
+}
+
+func testAuditLogWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	email := fmt.Sprintf("audited-%v@test.com", time.Now().UnixNano())
+	start := time.Now().Add(-time.Second)
+	if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	userPk, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to get user pk : %v", err)
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	//failed calls are audited as well
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err == nil {
+		t.Fatalf("want error for deleting a deleted user")
+	}
+
+	query := &UserServiceSchema.AuditRequestQuery{Email: email}
+	if _, err := client.QueryAuditLog(ctx, query); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v without admin token got %v", codes.PermissionDenied, err)
+	}
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	entries, err := client.QueryAuditLog(adminCtx, query)
+	if err != nil {
+		t.Fatalf("failed to query audit log : %v", err)
+	}
+	fingerprint := domain.KeyFingerprint(userPk.PublicKey)
+	want := []*UserServiceSchema.AuditEntry{
+		{Operation: "CreateUser", TargetEmail: email, KeyAfter: fingerprint, Result: codes.OK.String()},
+		{Operation: "ConfirmEmail", TargetEmail: email, KeyBefore: fingerprint, KeyAfter: fingerprint, Result: codes.OK.String()},
+		{Operation: "DeleteUserByEmail", TargetEmail: email, KeyBefore: fingerprint, Result: codes.OK.String()},
+		{Operation: "DeleteUserByEmail", TargetEmail: email, Result: codes.Unknown.String()},
+	}
+	if len(entries.Entries) != len(want) {
+		t.Fatalf("want %v audit entries got %v", len(want), entries.Entries)
+	}
+	for i, v := range entries.Entries {
+		if v.Id == "" || v.PeerAddress == "" || v.TimeUnix < start.Unix() {
+			t.Fatalf("incomplete audit entry %v", v)
+		}
+		v.Id, v.PeerAddress, v.TimeUnix = "", "", 0
+		if !reflect.DeepEqual(v, want[i]) {
+			t.Fatalf("want audit entry %v got %v", want[i], v)
+		}
+	}
+
+	//queries without email are limited to a time range
+	entries, err = client.QueryAuditLog(adminCtx, &UserServiceSchema.AuditRequestQuery{
+		FromUnix: start.Unix(),
+		ToUnix:   time.Now().Add(time.Second).Unix(),
+		Limit:    1000,
+	})
+	if err != nil {
+		t.Fatalf("failed to query audit log : %v", err)
+	}
+	if len(entries.Entries) < len(want) {
+		t.Fatalf("want at least %v audit entries got %v", len(want), len(entries.Entries))
+	}
+	if _, err := client.QueryAuditLog(adminCtx, &UserServiceSchema.AuditRequestQuery{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for unbounded query got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			client, err := setupTestENV(ctx, v, mailDir)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testAuditLogWithBackend(ctx, t, client, mailDir)
+		})
+	}
+}
+
+//recvUserEvents reads events from stream until n events of email have been received
+func recvUserEvents(stream UserServiceSchema.UserService_WatchUserEventsClient, email string, n int) ([]*UserServiceSchema.UserEvent, error) {
+	var events []*UserServiceSchema.UserEvent
+	for len(events) < n {
+		e, err := stream.Recv()
+		if err != nil {
+			return events, err
+		}
+		if e.Email == email {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func testUserEventsWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	email := fmt.Sprintf("watched-%v@test.com", time.Now().UnixNano())
+	sk, err := createActiveUser(ctx, client, mailDir, email)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	deviceSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key")
+	}
+	devicePk, err := x509.MarshalPKIXPublicKey(deviceSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding")
+	}
+	_, err = client.AddDevice(ctx, addDeviceRequest(t, sk, email, "laptop", devicePk, []byte{7, 8, 9}))
+	if err != nil {
+		t.Fatalf("failed to add device : %v", err)
+	}
+
+	//the events expose the keys of all users
+	stream, err := client.WatchUserEvents(ctx, &UserServiceSchema.UserEventRequestWatch{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v without admin token got %v", codes.PermissionDenied, err)
+	}
+
+	watchCtx, cancelWatch := context.WithTimeout(adminCtx, 10*time.Second)
+	defer cancelWatch()
+	stream, err = client.WatchUserEvents(watchCtx, &UserServiceSchema.UserEventRequestWatch{})
+	if err != nil {
+		t.Fatalf("failed to watch user events : %v", err)
+	}
+	events, err := recvUserEvents(stream, email, 3)
+	if err != nil {
+		t.Fatalf("failed to receive user events : %v", err)
+	}
+	wantKinds := []domain.UserEventKind{domain.UserEventCreated, domain.UserEventUpdated, domain.UserEventDeviceAdded}
+	for i, v := range events {
+		if v.Kind != string(wantKinds[i]) {
+			t.Fatalf("want event %v to be %v got %v", i, wantKinds[i], v.Kind)
+		}
+		if i > 0 && v.Cursor <= events[i-1].Cursor {
+			t.Fatalf("cursors are not ascending : %v", events)
+		}
+	}
+	if events[1].State != string(domain.UserStateActive) {
+		t.Fatalf("want state %v after confirmation got %v", domain.UserStateActive, events[1].State)
+	}
+
+	//changes are delivered to open streams
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	deleted, err := recvUserEvents(stream, email, 1)
+	if err != nil {
+		t.Fatalf("failed to receive delete event : %v", err)
+	}
+	if deleted[0].Kind != string(domain.UserEventDeleted) || deleted[0].Cursor <= events[2].Cursor {
+		t.Fatalf("unexpected event after delete %v", deleted[0])
+	}
+	cancelWatch()
+
+	//reconnecting resumes directly after the cursor
+	resumeCtx, cancelResume := context.WithTimeout(adminCtx, 10*time.Second)
+	defer cancelResume()
+	stream, err = client.WatchUserEvents(resumeCtx, &UserServiceSchema.UserEventRequestWatch{Cursor: events[0].Cursor})
+	if err != nil {
+		t.Fatalf("failed to resume user events : %v", err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("failed to receive resumed event : %v", err)
+	}
+	if first.Cursor != events[0].Cursor+1 {
+		t.Fatalf("want cursor %v after resuming got %v", events[0].Cursor+1, first.Cursor)
+	}
+	resumed := []*UserServiceSchema.UserEvent{first}
+	if first.Email != email {
+		resumed = nil
+	}
+	rest, err := recvUserEvents(stream, email, 3-len(resumed))
+	if err != nil {
+		t.Fatalf("failed to receive resumed events : %v", err)
+	}
+	resumed = append(resumed, rest...)
+	for i, v := range []*UserServiceSchema.UserEvent{events[1], events[2], deleted[0]} {
+		if resumed[i].Cursor != v.Cursor || resumed[i].Kind != v.Kind {
+			t.Fatalf("want resumed event %v got %v", v, resumed[i])
+		}
+	}
+
+	stream, err = client.WatchUserEvents(adminCtx, &UserServiceSchema.UserEventRequestWatch{Cursor: -1})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for negative cursor got %v", codes.InvalidArgument, err)
+	}
+}
+
+//lossyEventBackend hides the user event with sequence lost from ListUserEvents
+type lossyEventBackend struct {
+	Backend
+	lost int64
+}
+
+func (l *lossyEventBackend) ListUserEvents(ctx context.Context, after int64, limit int) ([]*domain.UserEvent, error) {
+	events, err := l.Backend.ListUserEvents(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	var kept []*domain.UserEvent
+	for _, v := range events {
+		if v.Sequence != atomic.LoadInt64(&l.lost) {
+			kept = append(kept, v)
+		}
+	}
+	return kept, nil
+}
+
+func testUserEventGapsWithBackend(ctx context.Context, t *testing.T, backend Backend, mailDir string) {
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	lossy := &lossyEventBackend{Backend: backend}
+	client := setupTestServer(ctx, lossy, mailDir)
+	email := fmt.Sprintf("gaps-%v@test.com", time.Now().UnixNano())
+	if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	watchCtx, cancelWatch := context.WithTimeout(adminCtx, 10*time.Second)
+	defer cancelWatch()
+	stream, err := client.WatchUserEvents(watchCtx, &UserServiceSchema.UserEventRequestWatch{})
+	if err != nil {
+		t.Fatalf("failed to watch user events : %v", err)
+	}
+	events, err := recvUserEvents(stream, email, 3)
+	if err != nil {
+		t.Fatalf("failed to receive user events : %v", err)
+	}
+	cancelWatch()
+
+	//a missing successor of the cursor has expired
+	atomic.StoreInt64(&lossy.lost, events[1].Cursor)
+	stream, err = client.WatchUserEvents(adminCtx, &UserServiceSchema.UserEventRequestWatch{Cursor: events[0].Cursor})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.OutOfRange {
+		t.Fatalf("want code %v for expired events got %v", codes.OutOfRange, err)
+	}
+
+	//events missing while streaming are not skipped silently
+	stream, err = client.WatchUserEvents(adminCtx, &UserServiceSchema.UserEventRequestWatch{Cursor: events[0].Cursor - 1})
+	if err != nil {
+		t.Fatalf("failed to watch user events : %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("failed to receive event before the gap : %v", err)
+	}
+	_, err = stream.Recv()
+	if status.Code(err) != codes.DataLoss {
+		t.Fatalf("want code %v for missing events got %v", codes.DataLoss, err)
+	}
+}
+
+func TestUserEvents(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			backend, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testUserEventsWithBackend(ctx, t, setupTestServer(ctx, backend, mailDir), mailDir)
+			testUserEventGapsWithBackend(ctx, t, backend, mailDir)
+		})
+	}
+}
+
+//webhookReceiver records the verified payloads posted to it
+type webhookReceiver struct {
+	mu       sync.Mutex
+	secret   []byte
+	payloads []UserService.WebhookPayload
+	errs     []error
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return
+	}
+	timestamp, err := strconv.ParseInt(req.Header.Get(UserService.WebhookHeaderTimestamp), 10, 64)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("invalid timestamp : %v", err))
+		return
+	}
+	want := "sha256=" + domain.WebhookSignature(r.secret, timestamp, body)
+	if req.Header.Get(UserService.WebhookHeaderSignature) != want {
+		r.errs = append(r.errs, fmt.Errorf("invalid signature %v", req.Header.Get(UserService.WebhookHeaderSignature)))
+		return
+	}
+	var payload UserService.WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		r.errs = append(r.errs, err)
+		return
+	}
+	r.payloads = append(r.payloads, payload)
+}
+
+//kindsOf returns the kinds of the received payloads for email
+func (r *webhookReceiver) kindsOf(email string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kinds []string
+	for _, v := range r.payloads {
+		if v.Email == email {
+			kinds = append(kinds, v.Kind)
+		}
+	}
+	return kinds
+}
+
+func testWebhooksWithBackend(ctx context.Context, t *testing.T, backend Backend, client UserServiceSchema.UserServiceClient, mailDir string) {
+	receiver := &webhookReceiver{}
+	okServer := httptest.NewServer(receiver)
+	defer okServer.Close()
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+
+	if _, err := client.CreateWebhook(ctx, &UserServiceSchema.WebhookRequestCreate{Url: okServer.URL}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v without admin token got %v", codes.PermissionDenied, err)
+	}
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	invalid := []*UserServiceSchema.WebhookRequestCreate{
+		{Url: "ftp://example.com"},
+		{Url: "/relative"},
+		{Url: okServer.URL, EventKinds: []string{"user-renamed"}},
+	}
+	for _, v := range invalid {
+		if _, err := client.CreateWebhook(adminCtx, v); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("want code %v for %v got %v", codes.InvalidArgument, v, err)
+		}
+	}
+	okHook, err := client.CreateWebhook(adminCtx, &UserServiceSchema.WebhookRequestCreate{Url: okServer.URL})
+	if err != nil {
+		t.Fatalf("failed to create webhook : %v", err)
+	}
+	receiver.secret = okHook.Secret
+	failingHook, err := client.CreateWebhook(adminCtx, &UserServiceSchema.WebhookRequestCreate{
+		Url:        failingServer.URL,
+		EventKinds: []string{string(domain.UserEventDeleted)},
+	})
+	if err != nil {
+		t.Fatalf("failed to create webhook : %v", err)
+	}
+	list, err := client.ListWebhooks(adminCtx, &UserServiceSchema.Empty{})
+	if err != nil {
+		t.Fatalf("failed to list webhooks : %v", err)
+	}
+	if len(list.Webhooks) < 2 || len(list.Webhooks[0].Secret) != 0 {
+		t.Fatalf("unexpected webhook list %v", list.Webhooks)
+	}
+
+	email := fmt.Sprintf("hooked-%v@test.com", time.Now().UnixNano())
+	if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+
+	dispatcher := &UserService.WebhookDispatcher{
+		EventRepo:   backend,
+		WebhookRepo: backend,
+		MaxAttempts: 2,
+		MinBackoff:  time.Millisecond,
+	}
+	dispatcher.DispatchOnce(ctx)
+	want := []string{string(domain.UserEventCreated), string(domain.UserEventUpdated), string(domain.UserEventDeleted)}
+	if got := receiver.kindsOf(email); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want delivered kinds %v got %v", want, got)
+	}
+	if len(receiver.errs) > 0 {
+		t.Fatalf("receiver rejected deliveries : %v", receiver.errs)
+	}
+
+	//the failing delivery is retried until it is dead. A new dispatcher resumes from the stored state
+	//without delivering events twice
+	time.Sleep(time.Second)
+	restarted := *dispatcher
+	restarted.DispatchOnce(ctx)
+	if got := receiver.kindsOf(email); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want delivered kinds %v after restart got %v", want, got)
+	}
+	dead, err := client.ListDeadWebhookDeliveries(adminCtx, &UserServiceSchema.WebhookRequestDeadLetters{WebhookId: failingHook.Id})
+	if err != nil {
+		t.Fatalf("failed to list dead deliveries : %v", err)
+	}
+	if len(dead.Deliveries) != 1 || dead.Deliveries[0].Kind != string(domain.UserEventDeleted) ||
+		dead.Deliveries[0].Attempts != 2 || !strings.Contains(dead.Deliveries[0].LastError, "500") {
+		t.Fatalf("unexpected dead deliveries %v", dead.Deliveries)
+	}
+
+	for _, id := range []string{okHook.Id, failingHook.Id} {
+		if _, err := client.DeleteWebhook(adminCtx, &UserServiceSchema.WebhookRequestId{Id: id}); err != nil {
+			t.Fatalf("failed to delete webhook : %v", err)
+		}
+	}
+	if _, err := client.DeleteWebhook(adminCtx, &UserServiceSchema.WebhookRequestId{Id: okHook.Id}); status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v deleting a deleted webhook got %v", codes.NotFound, err)
+	}
+	dead, err = client.ListDeadWebhookDeliveries(adminCtx, &UserServiceSchema.WebhookRequestDeadLetters{WebhookId: failingHook.Id})
+	if err != nil || len(dead.Deliveries) != 0 {
+		t.Fatalf("want no dead deliveries of deleted webhook got %v, %v", dead, err)
+	}
+
+	//concurrent dispatchers post each delivery once and skip the deliveries of a webhook deleted meanwhile
+	concurrentReceiver := &webhookReceiver{}
+	concurrentServer := httptest.NewServer(concurrentReceiver)
+	defer concurrentServer.Close()
+	concurrentHook, err := client.CreateWebhook(adminCtx, &UserServiceSchema.WebhookRequestCreate{Url: concurrentServer.URL})
+	if err != nil {
+		t.Fatalf("failed to create webhook : %v", err)
+	}
+	concurrentReceiver.secret = concurrentHook.Secret
+	deletedHook, err := client.CreateWebhook(adminCtx, &UserServiceSchema.WebhookRequestCreate{Url: failingServer.URL})
+	if err != nil {
+		t.Fatalf("failed to create webhook : %v", err)
+	}
+	concurrentEmail := fmt.Sprintf("hooked-concurrent-%v@test.com", time.Now().UnixNano())
+	if _, err := createActiveUser(ctx, client, mailDir, concurrentEmail); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	deleting := &deletingWebhookBackend{Backend: backend, deleted: deletedHook.Id}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			(&UserService.WebhookDispatcher{EventRepo: deleting, WebhookRepo: deleting}).DispatchOnce(ctx)
+		}()
+	}
+	wg.Wait()
+	got := concurrentReceiver.kindsOf(concurrentEmail)
+	sort.Strings(got)
+	want = []string{string(domain.UserEventCreated), string(domain.UserEventUpdated)}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want delivered kinds %v from concurrent dispatchers got %v", want, got)
+	}
+	if _, err := client.DeleteWebhook(adminCtx, &UserServiceSchema.WebhookRequestId{Id: concurrentHook.Id}); err != nil {
+		t.Fatalf("failed to delete webhook : %v", err)
+	}
+}
+
+//deletingWebhookBackend deletes the webhook with id deleted right before its deliveries are claimed, like a
+//concurrent DeleteWebhook
+type deletingWebhookBackend struct {
+	Backend
+	deleted string
+}
+
+func (d *deletingWebhookBackend) ClaimWebhookDelivery(ctx context.Context, delivery *domain.WebhookDelivery, leaseUntil time.Time) error {
+	if delivery.WebhookID == d.deleted {
+		if err := d.Backend.DeleteWebhook(ctx, d.deleted); err != nil && !errors.Is(err, userRepository.ErrNotFound) {
+			return err
+		}
+	}
+	return d.Backend.ClaimWebhookDelivery(ctx, delivery, leaseUntil)
+}
+
+func TestWebhooks(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			backend, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+			client := setupTestServer(ctx, backend, mailDir)
+
+			testWebhooksWithBackend(ctx, t, backend, client, mailDir)
+		})
+	}
+}
+
+func testUserAdminWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	tag := fmt.Sprintf("useradmin%v", time.Now().UnixNano())
+	emails := []string{tag + "-a@test.com", tag + "-b@test.com", tag + "-c@test.com"}
+	for _, email := range emails {
+		if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+			t.Fatalf("failed to create user : %v", err)
+		}
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: emails[2]}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+
+	search := &UserServiceSchema.UserRequestList{Query: tag}
+	if _, err := client.ListUsers(ctx, search); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v without admin token got %v", codes.PermissionDenied, err)
+	}
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	list, err := client.ListUsers(adminCtx, search)
+	if err != nil {
+		t.Fatalf("failed to list users : %v", err)
+	}
+	if len(list.Users) != 2 || list.Users[0].Email != emails[0] || list.Users[1].Email != emails[1] || list.NextPageToken != "" {
+		t.Fatalf("want users %v got %v", emails[:2], list)
+	}
+	if list.Users[0].State != string(domain.UserStateActive) || list.Users[0].KeyFingerprint != domain.KeyFingerprint(list.Users[0].PublicKey) {
+		t.Fatalf("unexpected summary %v", list.Users[0])
+	}
+
+	//page through all users including the deleted one
+	var paged []string
+	req := &UserServiceSchema.UserRequestList{Query: tag, IncludeDeleted: true, Limit: 2}
+	for {
+		page, err := client.ListUsers(adminCtx, req)
+		if err != nil {
+			t.Fatalf("failed to list users : %v", err)
+		}
+		for _, u := range page.Users {
+			paged = append(paged, u.Email)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		req.PageToken = page.NextPageToken
+	}
+	if !reflect.DeepEqual(paged, emails) {
+		t.Fatalf("want paged users %v got %v", emails, paged)
+	}
+	if _, err := client.ListUsers(adminCtx, &UserServiceSchema.UserRequestList{State: "deleted"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for invalid state got %v", codes.InvalidArgument, err)
+	}
+
+	summary, err := client.GetUserSummary(adminCtx, &UserServiceSchema.UserRequestEmail{Email: emails[2]})
+	if err != nil {
+		t.Fatalf("failed to get user summary : %v", err)
+	}
+	if summary.Email != emails[2] || summary.DeletedAtUnix == 0 {
+		t.Fatalf("want deleted user %v got %v", emails[2], summary)
+	}
+	if _, err := client.GetUserSummary(adminCtx, &UserServiceSchema.UserRequestEmail{Email: tag + "-x@test.com"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v for unknown user got %v", codes.NotFound, err)
+	}
+
+	//rotate the key of the first user
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	pkPKIX, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding : %v", err)
+	}
+	rotate := &UserServiceSchema.UserRequestRotateKey{
+		Email:             emails[0],
+		PublicKey:         pkPKIX,
+		WrappedPrivateKey: []byte{7, 8, 9},
+		WrappedMasterKey:  []byte{10, 11, 12},
+	}
+	if _, err := client.RotateUserKey(ctx, rotate); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v without admin token got %v", codes.PermissionDenied, err)
+	}
+	rotated, err := client.RotateUserKey(adminCtx, rotate)
+	if err != nil {
+		t.Fatalf("failed to rotate key : %v", err)
+	}
+	if !reflect.DeepEqual(rotated.PublicKey, pkPKIX) || !reflect.DeepEqual(rotated.WrappedMasterKey, rotate.WrappedMasterKey) {
+		t.Fatalf("rotated user %v does not have the new keys", rotated)
+	}
+	byPk, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: pkPKIX})
+	if err != nil || byPk.Email != emails[0] {
+		t.Fatalf("want user %v for the new key got %v, %v", emails[0], byPk, err)
+	}
+	proof, err := client.GetUserPkWithProof(ctx, &UserServiceSchema.UserRequestEmail{Email: emails[0]})
+	if err != nil {
+		t.Fatalf("failed to get user pk with proof : %v", err)
+	}
+	if proof.Entry.Kind != string(domain.KeyLogRotateKey) || !reflect.DeepEqual(proof.Entry.PublicKey, pkPKIX) {
+		t.Fatalf("want rotate entry for the new key got %v", proof.Entry)
+	}
+
+	//the key of another user can not be taken over
+	rotate.Email = emails[1]
+	if _, err := client.RotateUserKey(adminCtx, rotate); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("want code %v for a used key got %v", codes.AlreadyExists, err)
+	}
+	rotate.Email = tag + "-x@test.com"
+	if _, err := client.RotateUserKey(adminCtx, rotate); status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v for unknown user got %v", codes.NotFound, err)
+	}
+}
+
+func TestUserAdmin(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			client, err := setupTestENV(ctx, v, mailDir)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testUserAdminWithBackend(ctx, t, client, mailDir)
+		})
+	}
+}
+
+//exportUsers downloads the archive of all users
+func exportUsers(ctx context.Context, client UserServiceSchema.UserServiceClient) ([]byte, error) {
+	stream, err := client.ExportUsers(ctx, &UserServiceSchema.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	var archive []byte
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return archive, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		archive = append(archive, chunk.Data...)
+	}
+}
+
+//importUsers uploads archive in two chunks to exercise the reassembly
+func importUsers(ctx context.Context, client UserServiceSchema.UserServiceClient, archive []byte, policy domain.ImportConflictPolicy) (*UserServiceSchema.UserImportReport, error) {
+	stream, err := client.ImportUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	half := len(archive) / 2
+	if err := stream.Send(&UserServiceSchema.UserRequestImport{ConflictPolicy: string(policy), Data: archive[:half]}); err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&UserServiceSchema.UserRequestImport{Data: archive[half:]}); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
+
+func testUserArchiveWithBackend(ctx context.Context, t *testing.T, client UserServiceSchema.UserServiceClient, mailDir string) {
+	tag := fmt.Sprintf("archive%v", time.Now().UnixNano())
+	activeEmail, deletedEmail, newEmail := tag+"-a@test.com", tag+"-b@test.com", tag+"-c@test.com"
+	for _, email := range []string{activeEmail, deletedEmail} {
+		if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+			t.Fatalf("failed to create user : %v", err)
+		}
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: deletedEmail}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+
+	if _, err := exportUsers(ctx, client); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v without admin token got %v", codes.PermissionDenied, err)
+	}
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	archive, err := exportUsers(adminCtx, client)
+	if err != nil {
+		t.Fatalf("failed to export users : %v", err)
+	}
+	users, err := domain.ReadUserArchive(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("failed to read exported archive : %v", err)
+	}
+	exported := make(map[string]*domain.User)
+	for _, u := range users {
+		exported[u.Email] = u
+	}
+	if u := exported[activeEmail]; u == nil || u.IsDeleted() || !u.IsActive() || len(u.WrappedPrivateKey) == 0 {
+		t.Fatalf("want active user %v in archive got %v", activeEmail, u)
+	}
+	if u := exported[deletedEmail]; u == nil || !u.IsDeleted() {
+		t.Fatalf("want deleted user %v in archive got %v", deletedEmail, u)
+	}
+
+	//a modified or truncated archive is rejected before anything is written
+	tampered := bytes.Replace(archive, []byte(activeEmail), []byte(newEmail), 1)
+	if _, err := importUsers(adminCtx, client, tampered, domain.ImportConflictSkip); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for tampered archive got %v", codes.InvalidArgument, err)
+	}
+	if _, err := importUsers(adminCtx, client, archive[:len(archive)-10], domain.ImportConflictSkip); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for truncated archive got %v", codes.InvalidArgument, err)
+	}
+	if _, err := importUsers(adminCtx, client, archive, "merge"); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for unknown policy got %v", codes.InvalidArgument, err)
+	}
+
+	//re-importing the own export only conflicts
+	if _, err := importUsers(adminCtx, client, archive, domain.ImportConflictFail); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("want code %v for existing users got %v", codes.AlreadyExists, err)
+	}
+	report, err := importUsers(adminCtx, client, archive, domain.ImportConflictSkip)
+	if err != nil {
+		t.Fatalf("failed to import users : %v", err)
+	}
+	if report.Skipped != int64(len(users)) || report.Imported != 0 || report.Overwritten != 0 {
+		t.Fatalf("want all %v users skipped got %v", len(users), report)
+	}
+
+	//import a new user and overwrite the name of an existing one
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	createdAt := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	renamed := *exported[activeEmail]
+	renamed.Name = "Renamed"
+	var buf bytes.Buffer
+	aw, err := domain.NewUserArchiveWriter(&buf)
+	if err != nil {
+		t.Fatalf("failed to create archive : %v", err)
+	}
+	for _, u := range []*domain.User{
+		{
+			Email:             newEmail,
+			CreatedAt:         createdAt,
+			UpdatedAt:         createdAt,
+			Name:              "Imported",
+			State:             domain.UserStateActive,
+			PublicKey:         sk.Public(),
+			WrappedPrivateKey: []byte{1, 2, 3},
+			WrappedMasterKey:  []byte{4, 5, 6},
+		},
+		&renamed,
+	} {
+		if err := aw.Write(u); err != nil {
+			t.Fatalf("failed to write archive : %v", err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("failed to write archive : %v", err)
+	}
+	report, err = importUsers(adminCtx, client, buf.Bytes(), domain.ImportConflictOverwrite)
+	if err != nil {
+		t.Fatalf("failed to import users : %v", err)
+	}
+	if report.Imported != 1 || report.Overwritten != 1 || report.Skipped != 0 {
+		t.Fatalf("want 1 imported and 1 overwritten user got %v", report)
+	}
+	imported, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: newEmail})
+	if err != nil {
+		t.Fatalf("failed to get imported user : %v", err)
+	}
+	if imported.CreatedAtUnix != createdAt.Unix() || !reflect.DeepEqual(imported.WrappedMasterKey, []byte{4, 5, 6}) {
+		t.Fatalf("imported user %v does not keep the archived fields", imported)
+	}
+	summary, err := client.GetUserSummary(adminCtx, &UserServiceSchema.UserRequestEmail{Email: activeEmail})
+	if err != nil || summary.Name != "Renamed" {
+		t.Fatalf("want overwritten name got %v, %v", summary, err)
+	}
+	proof, err := client.GetUserPkWithProof(ctx, &UserServiceSchema.UserRequestEmail{Email: newEmail})
+	if err != nil {
+		t.Fatalf("failed to get user pk with proof : %v", err)
+	}
+	if proof.Entry.Kind != string(domain.KeyLogImportUser) {
+		t.Fatalf("want import entry in key log got %v", proof.Entry)
+	}
+}
+
+func TestUserArchive(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			client, err := setupTestENV(ctx, v, mailDir)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+
+			testUserArchiveWithBackend(ctx, t, client, mailDir)
+		})
+	}
+}
+
+func testUserMirrorWithBackend(ctx context.Context, t *testing.T, primary, secondary Backend, mirror *userRepository.MirrorRepo, client UserServiceSchema.UserServiceClient, mailDir string) {
+	//copy the users created by earlier tests
+	report, err := userRepository.BackfillMirror(ctx, mirror.Primary, mirror.Secondary)
+	if err != nil {
+		t.Fatalf("failed to backfill mirror : %v", err)
+	}
+	if !report.InSync() {
+		t.Fatalf("backfill left drift %v", report)
+	}
+
+	tag := fmt.Sprintf("mirror%v", time.Now().UnixNano())
+	emails := []string{tag + "-a@test.com", tag + "-b@test.com", tag + "-c@test.com"}
+	for _, email := range emails {
+		if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+			t.Fatalf("failed to create user : %v", err)
+		}
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: emails[1]}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	pkPKIX, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding : %v", err)
+	}
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	_, err = client.RotateUserKey(adminCtx, &UserServiceSchema.UserRequestRotateKey{
+		Email:             emails[2],
+		PublicKey:         pkPKIX,
+		WrappedPrivateKey: []byte{7, 8, 9},
+		WrappedMasterKey:  []byte{10, 11, 12},
+	})
+	if err != nil {
+		t.Fatalf("failed to rotate key : %v", err)
+	}
+
+	//all writes through the service have been mirrored
+	report, err = userRepository.VerifyMirror(ctx, mirror.Primary, mirror.Secondary)
+	if err != nil {
+		t.Fatalf("failed to verify mirror : %v", err)
+	}
+	if len(report.Drift) != 0 {
+		t.Fatalf("want no drift got %v", report.Drift)
+	}
+	rotated, err := mirror.Secondary.GetByPk(ctx, pkPKIX)
+	if err != nil || rotated.Email != emails[2] {
+		t.Fatalf("want rotated user %v in mirror got %v, %v", emails[2], rotated, err)
+	}
+
+	//writes that bypass the mirror are reported as drift and repaired by the backfill
+	missing := tag + "-d@test.com"
+	missingSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	_, err = primary.Create(ctx, &domain.User{
+		Email:             missing,
+		State:             domain.UserStateActive,
+		PublicKey:         missingSk.Public(),
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	})
+	if err != nil {
+		t.Fatalf("failed to create user in primary : %v", err)
+	}
+	if err := mirror.Secondary.PurgeByEmail(ctx, emails[0]); err != nil {
+		t.Fatalf("failed to purge user from mirror : %v", err)
+	}
+	changed := *rotated
+	changed.Name = "Drifted"
+	if _, err := mirror.Secondary.Update(ctx, &changed); err != nil {
+		t.Fatalf("failed to update user in mirror : %v", err)
+	}
+	report, err = userRepository.VerifyMirror(ctx, mirror.Primary, mirror.Secondary)
+	if err != nil {
+		t.Fatalf("failed to verify mirror : %v", err)
+	}
+	want := map[string]userRepository.UserDriftKind{
+		emails[0]: userRepository.UserDriftMissing,
+		emails[2]: userRepository.UserDriftChanged,
+		missing:   userRepository.UserDriftMissing,
+	}
+	if len(report.Drift) != len(want) || report.InSync() {
+		t.Fatalf("want drift of %v got %v", want, report.Drift)
+	}
+	for _, v := range report.Drift {
+		if want[v.Email] != v.Kind {
+			t.Fatalf("want drift of %v got %v", want, report.Drift)
+		}
+	}
+	report, err = userRepository.BackfillMirror(ctx, mirror.Primary, mirror.Secondary)
+	if err != nil {
+		t.Fatalf("failed to backfill mirror : %v", err)
+	}
+	if report.Repaired != len(want) {
+		t.Fatalf("want %v repaired users got %v", len(want), report)
+	}
+	report, err = userRepository.VerifyMirror(ctx, mirror.Primary, mirror.Secondary)
+	if err != nil || len(report.Drift) != 0 {
+		t.Fatalf("want no drift after backfill got %v, %v", report, err)
+	}
+
+	//reads can be cut over to the mirror
+	mirror.ReadFromSecondary = true
+	u, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: missing})
+	if err != nil || u.Email != missing {
+		t.Fatalf("want user %v from mirror got %v, %v", missing, u, err)
+	}
+
+	//devices and verification tokens are mirrored along with the users
+	ownerEmail, pendingEmail, bypassedEmail := tag+"-e@test.com", tag+"-f@test.com", tag+"-g@test.com"
+	ownerSk, err := createActiveUser(ctx, client, mailDir, ownerEmail)
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	laptopSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	laptopPk, err := x509.MarshalPKIXPublicKey(laptopSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding : %v", err)
+	}
+	if _, err := client.AddDevice(ctx, addDeviceRequest(t, ownerSk, ownerEmail, "laptop", laptopPk, []byte{7, 8, 9})); err != nil {
+		t.Fatalf("failed to add device : %v", err)
+	}
+	pendingSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	pendingPk, err := x509.MarshalPKIXPublicKey(pendingSk.Public())
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa pubkey encoding : %v", err)
+	}
+	_, err = client.CreateUser(ctx, &UserServiceSchema.UserRequestCreate{
+		Email:             pendingEmail,
+		PublicKey:         pendingPk,
+		WrappedPrivateKey: []byte{1, 2, 3},
+		WrappedMasterKey:  []byte{4, 5, 6},
+	})
+	if err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+
+	//devices, users and tokens written bypassing the mirror are copied by the backfill
+	phoneSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	_, err = primary.AddDevice(ctx, &domain.Device{
+		ID:               tag + "-phone",
+		OwnerEmail:       ownerEmail,
+		Name:             "phone",
+		PublicKey:        phoneSk.Public(),
+		WrappedMasterKey: []byte{10, 11},
+		CreatedAt:        time.Now(),
+		LastSeenAt:       time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add device in primary : %v", err)
+	}
+	bypassedSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	_, err = primary.Create(ctx, &domain.User{
+		Email:             bypassedEmail,
+		State:             domain.UserStatePending,
+		PublicKey:         bypassedSk.Public(),
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	})
+	if err != nil {
+		t.Fatalf("failed to create user in primary : %v", err)
+	}
+	err = primary.CreateToken(ctx, &domain.VerificationToken{
+		TokenHash: domain.HashToken(tag),
+		Email:     bypassedEmail,
+		Purpose:   domain.VerificationPurposeEmail,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("failed to create token in primary : %v", err)
+	}
+	report, err = userRepository.VerifyMirror(ctx, mirror.Primary, mirror.Secondary)
+	if err != nil {
+		t.Fatalf("failed to verify mirror : %v", err)
+	}
+	if len(report.Drift) != 2 || len(report.TokenDrift) != 1 || report.TokenDrift[0].Email != bypassedEmail {
+		t.Fatalf("want drift of %v and %v got %v", ownerEmail, bypassedEmail, report)
+	}
+	for _, v := range report.Drift {
+		if v.Email == ownerEmail && !reflect.DeepEqual(v.Fields, []string{"Devices"}) {
+			t.Fatalf("want drifted devices of %v got %v", ownerEmail, v)
+		}
+	}
+	report, err = userRepository.BackfillMirror(ctx, mirror.Primary, mirror.Secondary)
+	if err != nil || !report.InSync() {
+		t.Fatalf("failed to backfill mirror : %v, %v", report, err)
+	}
+	report, err = userRepository.VerifyMirror(ctx, mirror.Primary, mirror.Secondary)
+	if err != nil || len(report.Drift) != 0 || len(report.TokenDrift) != 0 {
+		t.Fatalf("want no drift after backfill got %v, %v", report, err)
+	}
+
+	//once in sync the server can be switched to the mirror
+	switched := setupTestServer(ctx, secondary, mailDir)
+	u, err = switched.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: ownerEmail})
+	if err != nil || u.Email != ownerEmail {
+		t.Fatalf("want user %v after the switch got %v, %v", ownerEmail, u, err)
+	}
+	devices, err := switched.ListDevices(ctx, &UserServiceSchema.UserRequestEmail{Email: ownerEmail})
+	if err != nil || len(devices.Devices) != 2 {
+		t.Fatalf("want both devices of %v after the switch got %v, %v", ownerEmail, devices, err)
+	}
+	if _, err := confirmEmail(ctx, switched, mailDir, pendingEmail); err != nil {
+		t.Fatalf("failed to confirm email with a mirrored token : %v", err)
+	}
+	if _, err := switched.ConfirmEmail(ctx, &UserServiceSchema.UserRequestConfirmEmail{Email: bypassedEmail, Token: tag}); err != nil {
+		t.Fatalf("failed to confirm email with a backfilled token : %v", err)
+	}
+}
+
+func TestUserMirror(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			primary, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+			//the mirror is a separate in memory sqlite db
+			db, err := SetupGormDB(fmt.Sprintf("file:mirror%v?mode=memory&cache=shared", time.Now().UnixNano()))
+			if err != nil {
+				t.Fatalf("failed to setup mirror : %v", err)
+			}
+			secondary := &userRepository.DefaultRepo{DB: db}
+			mirror := &userRepository.MirrorRepo{
+				Primary:   primary,
+				Secondary: secondary,
+			}
+			client := setupTestServer(ctx, backendSetup.WithMirror(primary, mirror), mailDir)
+
+			testUserMirrorWithBackend(ctx, t, primary, secondary, mirror, client, mailDir)
+		})
+	}
+}
+
+func testUserResidencyWithBackend(ctx context.Context, t *testing.T, eu, us Backend, residency *userRepository.ResidencyRepo, client UserServiceSchema.UserServiceClient, mailDir string) {
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	tag := fmt.Sprintf("residency%v", time.Now().UnixNano())
+	usEmail, euEmail := tag+"-us@test.com", tag+"-eu@test.com"
+
+	//users are stored in the region requested at creation, or in the default region
+	createInRegion := func(email, region string) []byte {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to setup test ecdsa key : %v", err)
+		}
+		pkPKIX, err := x509.MarshalPKIXPublicKey(sk.Public())
+		if err != nil {
+			t.Fatalf("failed to encode test public key : %v", err)
+		}
+		_, err = client.CreateUser(ctx, &UserServiceSchema.UserRequestCreate{
+			Email:             email,
+			PublicKey:         pkPKIX,
+			WrappedPrivateKey: []byte{1, 2, 3},
+			WrappedMasterKey:  []byte{4, 5, 6},
+			Region:            region,
+		})
+		if err != nil {
+			t.Fatalf("failed to create user in %q : %v", region, err)
+		}
+		if _, err := confirmEmail(ctx, client, mailDir, email); err != nil {
+			t.Fatalf("failed to confirm email : %v", err)
+		}
+		return pkPKIX
+	}
+	usPk := createInRegion(usEmail, "us")
+	createInRegion(euEmail, "")
+	if _, err := us.GetByEmail(ctx, usEmail); err != nil {
+		t.Fatalf("want user in us backend got %v", err)
+	}
+	if _, err := eu.GetByEmail(ctx, usEmail); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want no user in eu backend got %v", err)
+	}
+	if _, err := eu.GetByEmail(ctx, euEmail); err != nil {
+		t.Fatalf("want user of default region in eu backend got %v", err)
+	}
+	_, err := client.CreateUser(ctx, &UserServiceSchema.UserRequestCreate{
+		Email:             tag + "-mars@test.com",
+		PublicKey:         usPk,
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+		Region:            "mars",
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for unknown region got %v", codes.InvalidArgument, err)
+	}
+
+	//lookups are forwarded to the region of the user
+	if _, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: usEmail}); err != nil {
+		t.Fatalf("failed to get user by email : %v", err)
+	}
+	if got, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: usPk}); err != nil || got.Email != usEmail {
+		t.Fatalf("want user %v by key got %v : %v", usEmail, got, err)
+	}
+	list, err := client.ListUsers(adminCtx, &UserServiceSchema.UserRequestList{Query: tag})
+	if err != nil {
+		t.Fatalf("failed to list users : %v", err)
+	}
+	regions := []string{}
+	for _, v := range list.Users {
+		regions = append(regions, v.Email+"@"+v.Region)
+	}
+	if want := []string{euEmail + "@eu", usEmail + "@us"}; !reflect.DeepEqual(regions, want) {
+		t.Fatalf("want users %v got %v", want, regions)
+	}
+
+	//keys are unique across regions
+	_, err = residency.Create(ctx, &domain.User{
+		Email:             tag + "-copy@test.com",
+		State:             domain.UserStateActive,
+		PublicKey:         mustParsePk(t, usPk),
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	})
+	if !errors.Is(err, userRepository.ErrAlreadyExists) {
+		t.Fatalf("want %v for key of another region got %v", userRepository.ErrAlreadyExists, err)
+	}
+
+	//moving a user cuts reads and writes over to the new region
+	if _, err := client.MoveUser(ctx, &UserServiceSchema.UserRequestMove{Email: usEmail, Region: "eu"}); err == nil {
+		t.Fatalf("want MoveUser to require the admin token")
+	}
+	moved, err := client.MoveUser(adminCtx, &UserServiceSchema.UserRequestMove{Email: usEmail, Region: "eu"})
+	if err != nil || moved.Region != "eu" {
+		t.Fatalf("want user moved to eu got %v : %v", moved, err)
+	}
+	if _, err := eu.GetByEmail(ctx, usEmail); err != nil {
+		t.Fatalf("want moved user in eu backend got %v", err)
+	}
+	if _, err := us.GetByEmail(ctx, usEmail); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want moved user removed from us backend got %v", err)
+	}
+	if got, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: usPk}); err != nil || got.Email != usEmail {
+		t.Fatalf("want moved user by key got %v : %v", got, err)
+	}
+
+	//writes are rejected while a user is moved, reads are served by the old region. A move that did not
+	//finish is resumed
+	normalized, err := domain.NormalizeEmail(usEmail)
+	if err != nil {
+		t.Fatalf("failed to normalize email : %v", err)
+	}
+	if err := eu.SwapResidency(ctx,
+		&domain.UserResidency{Email: normalized, Region: "eu"},
+		&domain.UserResidency{Email: normalized, Region: "eu", MovingTo: "us"},
+	); err != nil {
+		t.Fatalf("failed to mark user as moving : %v", err)
+	}
+	if err := residency.DeleteByEmail(ctx, usEmail); !errors.Is(err, userRepository.ErrUserMoving) {
+		t.Fatalf("want %v got %v", userRepository.ErrUserMoving, err)
+	}
+	if _, err := client.GetUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: usEmail}); err != nil {
+		t.Fatalf("want reads during the move got %v", err)
+	}
+	if _, err := client.MoveUser(adminCtx, &UserServiceSchema.UserRequestMove{Email: usEmail, Region: "eu"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("want code %v for conflicting move got %v", codes.FailedPrecondition, err)
+	}
+	if moved, err := client.MoveUser(adminCtx, &UserServiceSchema.UserRequestMove{Email: usEmail, Region: "us"}); err != nil || moved.Region != "us" {
+		t.Fatalf("want resumed move to us got %v : %v", moved, err)
+	}
+	if err := residency.DeleteByEmail(ctx, usEmail); err != nil {
+		t.Fatalf("want writes after the move got %v", err)
+	}
+
+	//purging removes the residency, so the email can be used in any region again
+	if err := residency.PurgeByEmail(ctx, usEmail); err != nil {
+		t.Fatalf("failed to purge user : %v", err)
+	}
+	if _, err := eu.GetResidency(ctx, normalized); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want residency removed got %v", err)
+	}
+	if _, err := client.MoveUser(adminCtx, &UserServiceSchema.UserRequestMove{Email: usEmail, Region: "eu"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("want code %v got %v", codes.NotFound, err)
+	}
+	createInRegion(usEmail, "eu")
+}
+
+func mustParsePk(t *testing.T, pkPKIX []byte) crypto.PublicKey {
+	pk, err := x509.ParsePKIXPublicKey(pkPKIX)
+	if err != nil {
+		t.Fatalf("failed to parse public key : %v", err)
+	}
+	return pk
+}
+
+func TestUserResidency(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			//the backend under test serves eu and holds the index, us is a separate in memory sqlite db
+			eu, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+			db, err := SetupGormDB(fmt.Sprintf("file:us%v?mode=memory&cache=shared", time.Now().UnixNano()))
+			if err != nil {
+				t.Fatalf("failed to setup us backend : %v", err)
+			}
+			us := &userRepository.DefaultRepo{DB: db}
+			residency, err := userRepository.NewResidencyRepo(eu, eu, map[string]userRepository.RegionBackend{"eu": eu, "us": us}, "eu")
+			if err != nil {
+				t.Fatalf("failed to setup residency : %v", err)
+			}
+			client := setupTestServer(ctx, backendSetup.WithResidency(eu, residency), mailDir, func(cfg *ServerConfig) {
+				cfg.Residency = residency
+			})
+
+			testUserResidencyWithBackend(ctx, t, eu, us, residency, client, mailDir)
+		})
+	}
+}
+
+//TestUserResidencyIndex keeps the index in a backend no user lives in, so the UserData and the events of
+//the users have to be served by the regions
+func TestUserResidencyIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	index, err := setupTestBackend(gormDbImpl)
+	if err != nil {
+		t.Fatalf("failed to setup env : %v", err)
+	}
+	tag := fmt.Sprintf("residencyindex%v", time.Now().UnixNano())
+	regions := make(map[string]userRepository.RegionBackend)
+	for _, name := range []string{"eu", "us"} {
+		db, err := SetupGormDB(fmt.Sprintf("file:%v%v?mode=memory&cache=shared", tag, name))
+		if err != nil {
+			t.Fatalf("failed to setup %v backend : %v", name, err)
+		}
+		regions[name] = &userRepository.DefaultRepo{DB: db}
+	}
+	eu, us := regions["eu"], regions["us"]
+	residency, err := userRepository.NewResidencyRepo(index, index, regions, "eu")
+	if err != nil {
+		t.Fatalf("failed to setup residency : %v", err)
+	}
+	backend := backendSetup.WithResidency(index, residency)
+	newKey := func() (crypto.PublicKey, []byte) {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to setup test ecdsa key : %v", err)
+		}
+		pkPKIX, err := x509.MarshalPKIXPublicKey(sk.Public())
+		if err != nil {
+			t.Fatalf("failed to encode test public key : %v", err)
+		}
+		return sk.Public(), pkPKIX
+	}
+
+	//the user and its devices and group keys are stored in us only
+	email := tag + "@test.com"
+	userPk, _ := newKey()
+	if _, err := backend.Create(ctx, &domain.User{
+		Email:             email,
+		State:             domain.UserStateActive,
+		PublicKey:         userPk,
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+		Region:            "us",
+	}); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	devicePk, devicePkPKIX := newKey()
+	if _, err := backend.AddDevice(ctx, &domain.Device{
+		ID:               tag + "-device",
+		OwnerEmail:       email,
+		Name:             "laptop",
+		PublicKey:        devicePk,
+		WrappedMasterKey: []byte{3},
+	}); err != nil {
+		t.Fatalf("failed to add device : %v", err)
+	}
+	group, err := backend.CreateGroup(ctx, &domain.Group{ID: tag + "-group", Name: "team", OwnerEmail: email, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("failed to create group : %v", err)
+	}
+	wrapping := &domain.GroupKeyWrapping{GroupID: group.ID, Epoch: group.KeyEpoch, MemberEmail: email, WrappedGroupKey: []byte{4}, UploaderEmail: email}
+	if err := backend.PutGroupKeyWrappings(ctx, group.ID, group.KeyEpoch+1, []*domain.GroupKeyWrapping{wrapping}); !errors.Is(err, userRepository.ErrStaleEpoch) {
+		t.Fatalf("want %v got %v", userRepository.ErrStaleEpoch, err)
+	}
+	if err := backend.PutGroupKeyWrappings(ctx, group.ID, group.KeyEpoch, []*domain.GroupKeyWrapping{wrapping}); err != nil {
+		t.Fatalf("failed to store group key wrappings : %v", err)
+	}
+	for name, repo := range map[string]interface {
+		userRepository.DeviceRepo
+		userRepository.GroupKeyRepo
+	}{"index": index, "eu": eu} {
+		if devices, err := repo.ListDevices(ctx, email); err != nil || len(devices) != 0 {
+			t.Fatalf("want no devices in %v got %v : %v", name, devices, err)
+		}
+		if _, err := repo.GetGroupKeyWrapping(ctx, group.ID, group.KeyEpoch, email); !errors.Is(err, userRepository.ErrNotFound) {
+			t.Fatalf("want no group key in %v got %v", name, err)
+		}
+	}
+	if devices, err := us.ListDevices(ctx, email); err != nil || len(devices) != 1 {
+		t.Fatalf("want device in us got %v : %v", devices, err)
+	}
+	if d, err := backend.GetDeviceByPk(ctx, devicePkPKIX); err != nil || d.OwnerEmail != email {
+		t.Fatalf("want device by key got %v : %v", d, err)
+	}
+
+	//the events of the regions are relayed to the outbox of the index, which the key log is built from
+	if events, err := index.ListUserEvents(ctx, 0, 1000); err != nil {
+		t.Fatalf("failed to list events : %v", err)
+	} else {
+		for _, e := range events {
+			if e.Email == email {
+				t.Fatalf("want no events of %v before the relay got %v", email, e)
+			}
+		}
+	}
+	sources := residency.UserEventSources()
+	if len(sources) != 2 {
+		t.Fatalf("want the outboxes of both regions got %v", sources)
+	}
+	relay := &UserService.UserEventRelay{Sources: sources, Target: index}
+	if err := relay.RelayOnce(ctx); err != nil {
+		t.Fatalf("failed to relay : %v", err)
+	}
+	reconciler := &UserService.KeyLogReconciler{KeyLogRepo: index, EventRepo: index}
+	if err := reconciler.ReconcileOnce(ctx); err != nil {
+		t.Fatalf("failed to reconcile key log : %v", err)
+	}
+	entries, err := index.ListKeyLogEntries(ctx, 0, 10000)
+	if err != nil {
+		t.Fatalf("failed to list key log : %v", err)
+	}
+	logged := map[domain.KeyLogKind]int{}
+	for _, e := range entries {
+		if e.Email == email {
+			logged[e.Kind]++
+		}
+	}
+	if logged[domain.KeyLogCreateUser] != 1 || logged[domain.KeyLogAddDevice] != 1 {
+		t.Fatalf("want created and device added entries got %v", logged)
+	}
+
+	//writes to a fenced user fail in the backend itself, not only through the residency
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		t.Fatalf("failed to normalize email : %v", err)
+	}
+	if err := us.FenceUser(ctx, normalized); err != nil {
+		t.Fatalf("failed to fence user : %v", err)
+	}
+	if err := us.RevokeDevice(ctx, email, tag+"-device"); !errors.Is(err, userRepository.ErrUserMoving) {
+		t.Fatalf("want %v for fenced user got %v", userRepository.ErrUserMoving, err)
+	}
+	if err := us.UnfenceUser(ctx, normalized); err != nil {
+		t.Fatalf("failed to unfence user : %v", err)
+	}
+
+	//a move copies the UserData and removes it from the old region
+	if _, err := residency.MoveUser(ctx, email, "eu"); err != nil {
+		t.Fatalf("failed to move user : %v", err)
+	}
+	if devices, err := eu.ListDevices(ctx, email); err != nil || len(devices) != 1 {
+		t.Fatalf("want device moved to eu got %v : %v", devices, err)
+	}
+	if _, err := eu.GetGroupKeyWrapping(ctx, group.ID, group.KeyEpoch, email); err != nil {
+		t.Fatalf("want group key moved to eu got %v", err)
+	}
+	if devices, err := us.ListDevices(ctx, email); err != nil || len(devices) != 0 {
+		t.Fatalf("want devices removed from us got %v : %v", devices, err)
+	}
+	if _, err := us.FindByEmail(ctx, email); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want user removed from us got %v", err)
+	}
+	if w, err := backend.ListGroupKeyWrappings(ctx, group.ID, group.KeyEpoch); err != nil || len(w) != 1 {
+		t.Fatalf("want one group key wrapping got %v : %v", w, err)
+	}
+
+	//a move whose copy fails is rolled back
+	if err := us.FenceUser(ctx, normalized); err != nil {
+		t.Fatalf("failed to fence user : %v", err)
+	}
+	if _, err := residency.MoveUser(ctx, email, "us"); !errors.Is(err, userRepository.ErrUserMoving) {
+		t.Fatalf("want failed copy got %v", err)
+	}
+	if r, err := index.GetResidency(ctx, normalized); err != nil || r.Region != "eu" || r.IsMoving() {
+		t.Fatalf("want residency in eu got %v : %v", r, err)
+	}
+	if _, err := us.FindByEmail(ctx, email); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want partial copy removed got %v", err)
+	}
+	if err := backend.RevokeDevice(ctx, email, tag+"-device"); err != nil {
+		t.Fatalf("want writes after the rollback got %v", err)
+	}
+
+	//purging removes the memberships kept with the index, also for deleted users purged in bulk
+	deletedEmail := tag + "-deleted@test.com"
+	deletedPk, _ := newKey()
+	if _, err := backend.Create(ctx, &domain.User{
+		Email:             deletedEmail,
+		State:             domain.UserStateActive,
+		PublicKey:         deletedPk,
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+		Region:            "us",
+	}); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if err := backend.AddGroupMember(ctx, &domain.GroupMember{GroupID: group.ID, MemberEmail: deletedEmail, AddedAt: time.Now()}); err != nil {
+		t.Fatalf("failed to add group member : %v", err)
+	}
+	if err := backend.DeleteByEmail(ctx, deletedEmail); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	if n, err := backend.PurgeDeleted(ctx, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Fatalf("want 1 purged user got %v : %v", n, err)
+	}
+	if groups, err := index.ListGroupsOfMember(ctx, deletedEmail); err != nil || len(groups) != 0 {
+		t.Fatalf("want no memberships of purged user got %v : %v", groups, err)
+	}
+	if err := backend.PurgeByEmail(ctx, email); err != nil {
+		t.Fatalf("failed to purge user : %v", err)
+	}
+	if groups, err := index.ListGroupsOfMember(ctx, normalized); err != nil || len(groups) != 0 {
+		t.Fatalf("want no memberships got %v : %v", groups, err)
+	}
+}
+
+//slowUserRepo delays lookups by email and counts the calls reaching the backend
+type slowUserRepo struct {
+	userRepository.UserDirectoryRepo
+	delay time.Duration
+	calls int32
+}
+
+func (s *slowUserRepo) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(s.delay)
+	return s.UserDirectoryRepo.GetByEmail(ctx, email)
+}
+
+func testUserCacheWithBackend(ctx context.Context, t *testing.T, primary Backend, cache *userRepository.CachedUserRepo, client UserServiceSchema.UserServiceClient, mailDir string) {
+	tag := fmt.Sprintf("cache%v", time.Now().UnixNano())
+	cachedEmail, lateEmail := tag+"-a@test.com", tag+"-b@test.com"
+	if _, err := createActiveUser(ctx, client, mailDir, cachedEmail); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+
+	before := cache.Stats()
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: cachedEmail}); err != nil {
+			t.Fatalf("failed to get user pk : %v", err)
+		}
+	}
+	if hits := cache.Stats().Hits - before.Hits; hits < 2 {
+		t.Fatalf("want at least 2 cache hits got %v", hits)
+	}
+
+	//misses are cached until the user is created through the cache
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: lateEmail}); err == nil {
+			t.Fatalf("want error for unknown user")
+		}
+	}
+	if cache.Stats().NegativeHits == before.NegativeHits {
+		t.Fatalf("want negative cache hit")
+	}
+	if _, err := createActiveUser(ctx, client, mailDir, lateEmail); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: lateEmail}); err != nil {
+		t.Fatalf("want created user after invalidation got %v", err)
+	}
+
+	//writes bypassing the cache are only seen after expiry, writes through the cache right away
+	if err := primary.DeleteByEmail(ctx, lateEmail); err != nil {
+		t.Fatalf("failed to delete user in backend : %v", err)
+	}
+	if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: lateEmail}); err != nil {
+		t.Fatalf("want cached user got %v", err)
+	}
+	if _, err := client.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: cachedEmail}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: cachedEmail}); err == nil {
+		t.Fatalf("want error for deleted user")
+	}
+
+	if _, err := client.GetUserCacheStats(ctx, &UserServiceSchema.Empty{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v without admin token got %v", codes.PermissionDenied, err)
+	}
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	stats, err := client.GetUserCacheStats(adminCtx, &UserServiceSchema.Empty{})
+	if err != nil {
+		t.Fatalf("failed to get cache stats : %v", err)
+	}
+	if stats.Hits < 2 || stats.NegativeHits < 1 || stats.Misses < 1 || stats.Size < 1 {
+		t.Fatalf("unexpected cache stats %v", stats)
+	}
+
+	//the least recently used lookup is evicted
+	tiny := userRepository.NewCachedUserRepo(primary, userRepository.UserCacheConfig{Size: 1, TTL: time.Minute, NegativeTTL: time.Minute})
+	for _, email := range []string{cachedEmail, lateEmail, cachedEmail} {
+		_, _ = tiny.GetByEmail(ctx, email)
+	}
+	if s := tiny.Stats(); s.Evictions != 2 || s.Size != 1 || s.Hits != 0 {
+		t.Fatalf("want 2 evictions and no hits got %v", s)
+	}
+
+	//concurrent lookups of the same user are collapsed into one backend call
+	activeEmail := tag + "-c@test.com"
+	if _, err := createActiveUser(ctx, client, mailDir, activeEmail); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	slow := &slowUserRepo{UserDirectoryRepo: primary, delay: 50 * time.Millisecond}
+	collapsing := userRepository.NewCachedUserRepo(slow, userRepository.UserCacheConfig{Size: 10, TTL: time.Minute, Singleflight: true})
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := collapsing.GetByEmail(ctx, activeEmail); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("failed to get user : %v", err)
+	}
+	if calls := atomic.LoadInt32(&slow.calls); calls != 1 {
+		t.Fatalf("want 1 backend call got %v", calls)
+	}
+	if s := collapsing.Stats(); s.Collapsed != 9 {
+		t.Fatalf("want 9 collapsed lookups got %v", s)
+	}
+}
+
+func TestUserCache(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mailDir := t.TempDir()
+			primary, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+			cache := userRepository.NewCachedUserRepo(primary, userRepository.UserCacheConfig{
+				Size:        1000,
+				TTL:         time.Minute,
+				NegativeTTL: time.Minute,
+			})
+			client := setupTestServer(ctx, &backendSetup.UserDirectoryBackend{Backend: primary, Users: cache}, mailDir, func(cfg *ServerConfig) {
+				cfg.UserCache = cache
+			})
+
+			testUserCacheWithBackend(ctx, t, primary, cache, client, mailDir)
+		})
+	}
+}
+
+func testUserCacheInvalidationWithBackend(ctx context.Context, t *testing.T, primary Backend, mailDir string) {
+	//two replicas sharing the backend, each with its own cache
+	cacheConfig := userRepository.UserCacheConfig{Size: 1000, TTL: time.Hour, NegativeTTL: time.Hour}
+	caches := make([]*userRepository.CachedUserRepo, 2)
+	buses := make([]*UserService.PeerInvalidationBus, 2)
+	clients := make([]UserServiceSchema.UserServiceClient, 2)
+	for i := range caches {
+		caches[i] = userRepository.NewCachedUserRepo(primary, cacheConfig)
+		buses[i] = UserService.NewPeerInvalidationBus(testAdminToken, time.Second)
+		if _, err := caches[i].UseInvalidationBus(buses[i]); err != nil {
+			t.Fatalf("failed to use invalidation bus : %v", err)
+		}
+		bus := buses[i]
+		clients[i] = setupTestServer(ctx, &backendSetup.UserDirectoryBackend{Backend: primary, Users: caches[i]}, mailDir, func(cfg *ServerConfig) {
+			cfg.UserCache = caches[i]
+			cfg.CacheBus = bus
+		})
+	}
+	buses[0].AddPeer("replica1", clients[1])
+	buses[1].AddPeer("replica0", clients[0])
+
+	tag := fmt.Sprintf("peers%v", time.Now().UnixNano())
+	email, lateEmail := tag+"-a@test.com", tag+"-b@test.com"
+	if _, err := createActiveUser(ctx, clients[0], mailDir, email); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	buses[0].Wait()
+	//cache the user and the miss on both replicas
+	for _, client := range clients {
+		if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+			t.Fatalf("failed to get user pk : %v", err)
+		}
+		if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: lateEmail}); err == nil {
+			t.Fatalf("want error for unknown user")
+		}
+	}
+
+	//writes on one replica invalidate the cache of the other one
+	if _, err := clients[0].DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	if _, err := createActiveUser(ctx, clients[0], mailDir, lateEmail); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	buses[0].Wait()
+	if _, err := clients[1].GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err == nil {
+		t.Fatalf("want error for user deleted on the other replica")
+	}
+	if _, err := clients[1].GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: lateEmail}); err != nil {
+		t.Fatalf("want user created on the other replica got %v", err)
+	}
+
+	//purges flush all caches
+	if _, err := clients[1].GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: lateEmail}); err != nil {
+		t.Fatalf("failed to get user pk : %v", err)
+	}
+	if _, err := caches[0].PurgeDeleted(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("failed to purge users : %v", err)
+	}
+	buses[0].Wait()
+	if size := caches[1].Stats().Size; size != 0 {
+		t.Fatalf("want flushed cache got %v entries", size)
+	}
+
+	if _, err := clients[1].InvalidateUserCache(ctx, &UserServiceSchema.UserCacheInvalidation{Origin: "test", Flush: true}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("want code %v without admin token got %v", codes.PermissionDenied, err)
+	}
+	adminCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAdminToken)
+	if _, err := clients[1].InvalidateUserCache(adminCtx, &UserServiceSchema.UserCacheInvalidation{Origin: "test"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("want code %v for empty invalidation got %v", codes.InvalidArgument, err)
+	}
+	if _, err := clients[1].InvalidateUserCache(adminCtx, &UserServiceSchema.UserCacheInvalidation{Origin: "test", Email: lateEmail}); err != nil {
+		t.Fatalf("failed to invalidate cache : %v", err)
+	}
+
+	//caches in one process can share a local bus
+	local := userRepository.NewLocalInvalidationBus()
+	first := userRepository.NewCachedUserRepo(primary, cacheConfig)
+	second := userRepository.NewCachedUserRepo(primary, cacheConfig)
+	for _, cache := range []*userRepository.CachedUserRepo{first, second} {
+		stop, err := cache.UseInvalidationBus(local)
+		if err != nil {
+			t.Fatalf("failed to use invalidation bus : %v", err)
+		}
+		defer stop()
+	}
+	if _, err := second.GetByEmail(ctx, lateEmail); err != nil {
+		t.Fatalf("failed to get user : %v", err)
+	}
+	if err := first.DeleteByEmail(ctx, lateEmail); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	if _, err := second.GetByEmail(ctx, lateEmail); err == nil {
+		t.Fatalf("want error for user deleted through the other cache")
+	}
+}
+
+func TestUserCacheInvalidation(t *testing.T) {
+	backends := []dbImpl{dynamoDbImpl, gormDbImpl}
+	for _, v := range backends {
+		t.Run(fmt.Sprintf("%v", v), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			primary, err := setupTestBackend(v)
+			if err != nil {
+				t.Fatalf("failed to setup env : %v", err)
+			}
+			testUserCacheInvalidationWithBackend(ctx, t, primary, t.TempDir())
+		})
+	}
+}
+
+func TestDynamoResilience(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+	unavailable := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), http.StatusServiceUnavailable, "id")
+	conflict := &dynamodb.TransactionCanceledException{CancellationReasons: []*dynamodb.CancellationReason{
+		{Code: aws.String("None")}, {Code: aws.String("TransactionConflict")},
+	}}
+	conditionFailed := &dynamodb.TransactionCanceledException{CancellationReasons: []*dynamodb.CancellationReason{
+		{Code: aws.String("ConditionalCheckFailed")}, {Code: aws.String("TransactionConflict")},
+	}}
+	classes := []struct {
+		err  error
+		want userRepository.DynamoFailure
+	}{
+		{nil, userRepository.DynamoPermanent},
+		{throttled, userRepository.DynamoRejected},
+		{awserr.New(dynamodb.ErrCodeRequestLimitExceeded, "limit", nil), userRepository.DynamoRejected},
+		{conflict, userRepository.DynamoRejected},
+		{conditionFailed, userRepository.DynamoPermanent},
+		{unavailable, userRepository.DynamoTransient},
+		{awserr.New(dynamodb.ErrCodeInternalServerError, "internal", nil), userRepository.DynamoTransient},
+		{awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition", nil), userRepository.DynamoPermanent},
+		{context.Canceled, userRepository.DynamoPermanent},
+	}
+	for _, v := range classes {
+		if got := userRepository.ClassifyDynamoError(v.err); got != v.want {
+			t.Errorf("want class %v for %v got %v", v.want, v.err, got)
+		}
+	}
+
+	ctx := context.Background()
+	sleeps := 0
+	noSleep := func(ctx context.Context, d time.Duration) error {
+		sleeps++
+		return ctx.Err()
+	}
+	idempotent := func() bool { return true }
+	notIdempotent := func() bool { return false }
+	//failing returns a call failing with errs before succeeding, counting the attempts
+	failing := func(attempts *int, errs ...error) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			*attempts++
+			if *attempts <= len(errs) {
+				return errs[*attempts-1]
+			}
+			return nil
+		}
+	}
+
+	//rejected calls are retried, transient ones only if idempotent
+	r := &userRepository.DynamoResilience{MaxAttempts: 4, Sleep: noSleep}
+	attempts := 0
+	if err := r.Do(ctx, notIdempotent, failing(&attempts, throttled, conflict)); err != nil || attempts != 3 {
+		t.Fatalf("want success after 3 attempts got %v after %v", err, attempts)
+	}
+	attempts = 0
+	if err := r.Do(ctx, notIdempotent, failing(&attempts, unavailable)); err != unavailable || attempts != 1 {
+		t.Fatalf("want transient error after 1 attempt got %v after %v", err, attempts)
+	}
+	attempts = 0
+	if err := r.Do(ctx, idempotent, failing(&attempts, unavailable, unavailable)); err != nil || attempts != 3 {
+		t.Fatalf("want success after 3 attempts got %v after %v", err, attempts)
+	}
+	attempts = 0
+	if err := r.Do(ctx, idempotent, failing(&attempts, throttled, throttled, throttled, throttled, throttled)); err != throttled || attempts != 4 {
+		t.Fatalf("want throttling error after 4 attempts got %v after %v", err, attempts)
+	}
+	if sleeps != 7 {
+		t.Fatalf("want 7 backoffs got %v", sleeps)
+	}
+	//retries stop at the deadline of the caller
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	attempts = 0
+	if err := r.Do(canceled, idempotent, failing(&attempts, throttled, throttled)); err != throttled || attempts != 1 {
+		t.Fatalf("want throttling error after 1 attempt got %v after %v", err, attempts)
+	}
+
+	//consecutive failures open the breaker, a successful probe closes it
+	r = &userRepository.DynamoResilience{MaxAttempts: 1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}
+	for i := 0; i < 2; i++ {
+		attempts = 0
+		if err := r.Do(ctx, idempotent, failing(&attempts, unavailable)); err != unavailable {
+			t.Fatalf("want transient error got %v", err)
+		}
+	}
+	attempts = 0
+	if err := r.Do(ctx, idempotent, failing(&attempts)); !errors.Is(err, userRepository.ErrUnavailable) || attempts != 0 {
+		t.Fatalf("want %v without calling the backend got %v after %v attempts", userRepository.ErrUnavailable, err, attempts)
+	}
+	if err := r.Healthy(); !errors.Is(err, userRepository.ErrUnavailable) {
+		t.Fatalf("want unhealthy backend got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := r.Do(ctx, idempotent, failing(&attempts)); err != nil || attempts != 1 {
+		t.Fatalf("want successful probe got %v after %v attempts", err, attempts)
+	}
+	if err := r.Healthy(); err != nil {
+		t.Fatalf("want healthy backend got %v", err)
+	}
+	//permanent errors do not open the breaker
+	for i := 0; i < 3; i++ {
+		attempts = 0
+		if err := r.Do(ctx, idempotent, failing(&attempts, conditionFailed)); err != conditionFailed {
+			t.Fatalf("want permanent error got %v", err)
+		}
+	}
+	if err := r.Healthy(); err != nil {
+		t.Fatalf("want healthy backend after permanent errors got %v", err)
+	}
+
+	//the service fails fast while the backend is unhealthy
+	backend, err := setupTestBackend(gormDbImpl)
+	if err != nil {
+		t.Fatalf("failed to setup env : %v", err)
+	}
+	var healthErr error
+	var healthMu sync.Mutex
+	client := setupTestServer(ctx, backend, t.TempDir(), func(cfg *ServerConfig) {
+		cfg.BackendHealth = func() error {
+			healthMu.Lock()
+			defer healthMu.Unlock()
+			return healthErr
+		}
+	})
+	email := fmt.Sprintf("resilience%v@test.com", time.Now().UnixNano())
+	if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); status.Code(err) == codes.Unavailable {
+		t.Fatalf("want call of healthy backend got %v", err)
+	}
+	healthMu.Lock()
+	healthErr = userRepository.ErrUnavailable
+	healthMu.Unlock()
+	if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("want code %v got %v", codes.Unavailable, err)
+	}
+}
+
+func TestFakeDynamo(t *testing.T) {
+	ctx := context.Background()
+	mailDir := t.TempDir()
+	noSleep := func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	fake := userRepository.NewFakeDynamo()
+	repo := userRepository.NewAwsDynamoUserRepoWithClient(fake, &userRepository.DynamoResilience{Sleep: noSleep})
+	client := setupTestServer(ctx, repo, mailDir)
+
+	//a lost response of an applied transaction is retried with the same client request token
+	lost := false
+	fake.SetFault(func(operation string, input interface{}, applied bool) error {
+		in, ok := input.(*dynamodb.TransactWriteItemsInput)
+		if !ok || !applied || lost {
+			return nil
+		}
+		for _, v := range in.TransactItems {
+			if v.Put != nil && aws.StringValue(v.Put.TableName) == userRepository.TableUser {
+				lost = true
+				return awserr.NewRequestFailure(awserr.New("InternalServerError", "lost response", nil), http.StatusInternalServerError, "id")
+			}
+		}
+		return nil
+	})
+	email := "fake.dynamo@test.com"
+	if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if !lost {
+		t.Fatalf("want lost response of the user creation")
+	}
+	pk, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+	if err != nil {
+		t.Fatalf("failed to get user pk : %v", err)
+	}
+
+	//throttled reads are retried
+	throttles := 0
+	fake.SetFault(func(operation string, input interface{}, applied bool) error {
+		if operation == "GetItem" && !applied && throttles < 2 {
+			throttles++
+			return awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+		}
+		return nil
+	})
+	if _, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil || throttles != 2 {
+		t.Fatalf("want user after 2 throttled reads got %v after %v", err, throttles)
+	}
+	fake.SetFault(nil)
+
+	//failed conditions cancel the whole transaction with a reason per item
+	otherEmail := "fake.dynamo.other@test.com"
+	_, err = fake.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []*dynamodb.TransactWriteItem{
+		{Put: &dynamodb.Put{
+			TableName: aws.String(userRepository.TableEmailToPublicKey),
+			Item: map[string]*dynamodb.AttributeValue{
+				userRepository.TableEmailToPublicKeyPkName: {S: aws.String(otherEmail)},
+			},
+		}},
+		{Put: &dynamodb.Put{
+			TableName: aws.String(userRepository.TableEmailToPublicKey),
+			Item: map[string]*dynamodb.AttributeValue{
+				userRepository.TableEmailToPublicKeyPkName: {S: aws.String(email)},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(" + userRepository.TableEmailToPublicKeyPkName + ")"),
+		}},
+	}})
+	canceled, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		t.Fatalf("want canceled transaction got %v", err)
+	}
+	reasons := []string{}
+	for _, v := range canceled.CancellationReasons {
+		reasons = append(reasons, aws.StringValue(v.Code))
+	}
+	if !reflect.DeepEqual(reasons, []string{"None", "ConditionalCheckFailed"}) {
+		t.Fatalf("unexpected cancellation reasons %v", reasons)
+	}
+	if _, err := repo.GetByEmail(ctx, otherEmail); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want %v for write of canceled transaction got %v", userRepository.ErrNotFound, err)
+	}
+
+	//batch reads return the keys exceeding the limit as unprocessed
+	fake.SetMaxBatchGetKeys(1)
+	batch, err := fake.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{RequestItems: map[string]*dynamodb.KeysAndAttributes{
+		userRepository.TableEmailToPublicKey: {Keys: []map[string]*dynamodb.AttributeValue{
+			{userRepository.TableEmailToPublicKeyPkName: {S: aws.String(email)}},
+			{userRepository.TableEmailToPublicKeyPkName: {S: aws.String(otherEmail)}},
+		}},
+		userRepository.TableUser: {Keys: []map[string]*dynamodb.AttributeValue{
+			{userRepository.TableUserPkName: {B: pk.PublicKey}},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("failed to batch get : %v", err)
+	}
+	served := len(batch.Responses[userRepository.TableEmailToPublicKey]) + len(batch.Responses[userRepository.TableUser])
+	unprocessed := 0
+	for _, v := range batch.UnprocessedKeys {
+		unprocessed += len(v.Keys)
+	}
+	if served != 1 || unprocessed != 2 {
+		t.Fatalf("want 1 served and 2 unprocessed keys got %v and %v", served, unprocessed)
+	}
+
+	//paginated reads resume after the delivered pages when a later page is throttled
+	if _, err := createActiveUser(ctx, client, mailDir, "fake.dynamo.paged@test.com"); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	fake.SetPageSize(1)
+	scanUsers := func() (map[string]int, error) {
+		seen := map[string]int{}
+		err := repo.ScanUsers(ctx, func(u *domain.User) error {
+			seen[u.Email]++
+			return nil
+		})
+		return seen, err
+	}
+	wantScanned, err := scanUsers()
+	if err != nil || len(wantScanned) < 2 {
+		t.Fatalf("want several users got %v : %v", wantScanned, err)
+	}
+	wantEvents, err := repo.ListUserEvents(ctx, 0, 1000)
+	if err != nil || len(wantEvents) < 2 {
+		t.Fatalf("want several events got %v : %v", len(wantEvents), err)
+	}
+	pages := map[string]int{}
+	fake.SetFault(func(operation string, input interface{}, applied bool) error {
+		if applied || (operation != "Scan" && operation != "Query") {
+			return nil
+		}
+		pages[operation]++
+		if pages[operation] == 2 {
+			return awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+		}
+		return nil
+	})
+	if gotScanned, err := scanUsers(); err != nil || !reflect.DeepEqual(gotScanned, wantScanned) {
+		t.Fatalf("want scanned users %v got %v : %v", wantScanned, gotScanned, err)
+	}
+	gotEvents, err := repo.ListUserEvents(ctx, 0, 1000)
+	if err != nil || len(gotEvents) != len(wantEvents) {
+		t.Fatalf("want %v events got %v : %v", len(wantEvents), len(gotEvents), err)
+	}
+	for i := range gotEvents {
+		if gotEvents[i].Sequence != wantEvents[i].Sequence {
+			t.Fatalf("want event %v got %v at %v", wantEvents[i].Sequence, gotEvents[i].Sequence, i)
+		}
+	}
+	if pages["Scan"] < 3 || pages["Query"] < 3 {
+		t.Fatalf("want retried pages got %v", pages)
+	}
+	fake.SetFault(nil)
+	fake.SetPageSize(0)
+
+	//only failed conditions are reported as existing users, not conflicts or throttling
+	impatient := userRepository.NewAwsDynamoUserRepoWithClient(fake, &userRepository.DynamoResilience{MaxAttempts: 1, Sleep: noSleep})
+	fake.SetFault(func(operation string, input interface{}, applied bool) error {
+		if operation != "TransactWriteItems" || applied {
+			return nil
+		}
+		reasons := []*dynamodb.CancellationReason{{Code: aws.String("None")}}
+		for range input.(*dynamodb.TransactWriteItemsInput).TransactItems[1:] {
+			reasons = append(reasons, &dynamodb.CancellationReason{Code: aws.String("TransactionConflict")})
+		}
+		return &dynamodb.TransactionCanceledException{CancellationReasons: reasons}
+	})
+	newSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key : %v", err)
+	}
+	conflicting := &domain.User{
+		Email:             "fake.dynamo.conflict@test.com",
+		State:             domain.UserStateActive,
+		PublicKey:         newSk.Public(),
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	}
+	if _, err := impatient.Create(ctx, conflicting); err == nil || errors.Is(err, userRepository.ErrAlreadyExists) {
+		t.Fatalf("want conflict error other than %v got %v", userRepository.ErrAlreadyExists, err)
+	}
+	rotated := &domain.User{
+		Email:             email,
+		State:             domain.UserStateActive,
+		PublicKey:         newSk.Public(),
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	}
+	if _, err := impatient.RotateUserKey(ctx, rotated); err == nil || errors.Is(err, userRepository.ErrAlreadyExists) {
+		t.Fatalf("want conflict error other than %v got %v", userRepository.ErrAlreadyExists, err)
+	}
+	fake.SetFault(nil)
+	if _, err := impatient.Create(ctx, conflicting); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if _, err := impatient.RotateUserKey(ctx, rotated); !errors.Is(err, userRepository.ErrAlreadyExists) {
+		t.Fatalf("want %v for key of another user got %v", userRepository.ErrAlreadyExists, err)
+	}
+
+	//a backend failing persistently trips the breaker and calls fail fast
+	fragile := userRepository.NewAwsDynamoUserRepoWithClient(fake, &userRepository.DynamoResilience{
+		MaxAttempts:      2,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+		Sleep:            noSleep,
+	})
+	fragileClient := setupTestServer(ctx, fragile, mailDir, func(cfg *ServerConfig) {
+		cfg.BackendHealth = fragile.Healthy
+	})
+	calls := 0
+	fake.SetFault(func(operation string, input interface{}, applied bool) error {
+		if !applied {
+			calls++
+		}
+		return awserr.New(dynamodb.ErrCodeRequestLimitExceeded, "throttled", nil)
+	})
+	if _, err := fragileClient.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("want code %v got %v", codes.Unavailable, err)
+	}
+	before := calls
+	if _, err := fragileClient.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("want code %v got %v", codes.Unavailable, err)
+	}
+	if calls != before {
+		t.Fatalf("want no backend calls while the breaker is open got %v", calls-before)
+	}
+}
+
+func TestDynamoRegions(t *testing.T) {
+	ctx := context.Background()
+	mailDir := t.TempDir()
+	clock := time.Now()
+	now := func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	euFake, usFake := userRepository.NewFakeDynamo(), userRepository.NewFakeDynamo()
+	regions := map[string]userRepository.DynamoClient{"eu": euFake, "us": usFake}
+	euRepo := userRepository.NewAwsRegionalDynamoUserRepoWithClient(&userRepository.RegionalDynamo{Region: "eu", Client: euFake, Now: now}, euFake, nil)
+	usRepo := userRepository.NewAwsRegionalDynamoUserRepoWithClient(&userRepository.RegionalDynamo{Region: "us", Client: usFake, Now: now}, euFake, nil)
+	euClient := setupTestServer(ctx, euRepo, mailDir)
+
+	driftKinds := func(report *userRepository.RegionReport) []string {
+		kinds := []string{}
+		for _, v := range report.Drift {
+			kinds = append(kinds, fmt.Sprintf("%v %v %v", v.Kind, v.Table, v.Region))
+		}
+		return kinds
+	}
+	driftOf := func(report *userRepository.RegionReport, email string) []string {
+		kinds := []string{}
+		for _, v := range report.Drift {
+			if v.Email == email {
+				kinds = append(kinds, fmt.Sprintf("%v %v %v", v.Kind, v.Table, v.Region))
+			}
+		}
+		return kinds
+	}
+	newUser := func(email string) (*domain.User, string) {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to setup test ecdsa key : %v", err)
+		}
+		pkPKIX, err := x509.MarshalPKIXPublicKey(sk.Public())
+		if err != nil {
+			t.Fatalf("failed to encode test public key : %v", err)
+		}
+		return &domain.User{
+			Email:             email,
+			State:             domain.UserStateActive,
+			PublicKey:         sk.Public(),
+			WrappedPrivateKey: []byte{1},
+			WrappedMasterKey:  []byte{2},
+		}, domain.KeyFingerprint(pkPKIX)
+	}
+
+	//users created in one region are missing in the others until replicated
+	email := "regions@test.com"
+	if _, err := createActiveUser(ctx, euClient, mailDir, email); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	report, err := userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{})
+	if err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	want := []string{
+		"missing " + userRepository.TableUser + " us",
+		"missing " + userRepository.TableEmailToPublicKey + " us",
+	}
+	if got := driftKinds(report); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want drift %v got %v", want, got)
+	}
+	report, err = userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{CopyMissing: true})
+	if err != nil || report.Repaired != 2 {
+		t.Fatalf("want 2 copied items got %v : %v", report.Repaired, err)
+	}
+	if report, err = userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{}); err != nil || !report.InSync() {
+		t.Fatalf("want regions in sync after copy got %v : %v", driftKinds(report), err)
+	}
+
+	//concurrent updates in both regions are resolved in favor of the last write
+	usUser, err := usRepo.GetByEmail(ctx, email)
+	if err != nil {
+		t.Fatalf("failed to get replicated user : %v", err)
+	}
+	usUser.Name = "us"
+	if _, err := usRepo.Update(ctx, usUser); err != nil {
+		t.Fatalf("failed to update user in us : %v", err)
+	}
+	euUser, err := euRepo.GetByEmail(ctx, email)
+	if err != nil {
+		t.Fatalf("failed to get user : %v", err)
+	}
+	euUser.Name = "eu"
+	if _, err := euRepo.Update(ctx, euUser); err != nil {
+		t.Fatalf("failed to update user in eu : %v", err)
+	}
+	report, err = userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{})
+	if err != nil || len(report.Drift) != 1 || report.Drift[0].Kind != userRepository.RegionDriftDiverged ||
+		report.Drift[0].Region != "us" || report.Drift[0].Winner != "eu" {
+		t.Fatalf("want user in us diverged from eu got %v : %v", driftKinds(report), err)
+	}
+	if report, err = userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{Repair: true}); err != nil || report.Repaired != 1 {
+		t.Fatalf("want 1 repaired item got %v : %v", report.Repaired, err)
+	}
+	if u, err := usRepo.GetByEmail(ctx, email); err != nil || u.Name != "eu" {
+		t.Fatalf("want last written name %q in us got %v : %v", "eu", u, err)
+	}
+
+	//writes of a region with a clock behind do not replace later writes
+	skewedRepo := userRepository.NewAwsRegionalDynamoUserRepoWithClient(&userRepository.RegionalDynamo{
+		Region: "us",
+		Client: usFake,
+		Now:    func() time.Time { return clock.Add(-time.Hour) },
+	}, euFake, nil)
+	usUser.Name = "stale"
+	if _, err := skewedRepo.Update(ctx, usUser); err == nil {
+		t.Fatalf("want stale write to fail")
+	}
+	if u, err := usRepo.GetByEmail(ctx, email); err != nil || u.Name != "eu" {
+		t.Fatalf("want name %q after stale write got %v : %v", "eu", u, err)
+	}
+
+	//concurrent creates of the same email leave the user of the first write orphaned
+	conflict := "regions.conflict@test.com"
+	fingerprints := map[string]string{}
+	for _, v := range []struct {
+		region string
+		repo   *userRepository.AwsDynamoUserRepo
+	}{{"us", usRepo}, {"eu", euRepo}} {
+		u, fingerprint := newUser(conflict)
+		fingerprints[v.region] = fingerprint
+		if _, err := v.repo.Create(ctx, u); err != nil {
+			t.Fatalf("failed to create user in %v : %v", v.region, err)
+		}
+	}
+	if _, err := userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{Repair: true, CopyMissing: true}); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	report, err = userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{})
+	if err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	want = []string{
+		"orphan " + userRepository.TableUser + " eu",
+		"orphan " + userRepository.TableUser + " us",
+	}
+	if got := driftKinds(report); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want drift %v got %v", want, got)
+	}
+	for _, v := range report.Drift {
+		if v.Email != conflict || v.KeyFingerprint != fingerprints["us"] {
+			t.Fatalf("want orphaned user of the first write got %v", v)
+		}
+	}
+	if u, err := usRepo.GetByEmail(ctx, conflict); err != nil || userPkFingerprint(t, u) != fingerprints["eu"] {
+		t.Fatalf("want user of the last write got %v : %v", u, err)
+	}
+
+	//reads can be pinned to another region, the event sequences are still read where they are written
+	pinned := userRepository.NewAwsRegionalDynamoUserRepoWithClient(&userRepository.RegionalDynamo{Region: "us", Client: usFake, ReadClient: euFake, Now: now}, euFake, nil)
+	euOnly := "regions.pinned@test.com"
+	if _, err := createActiveUser(ctx, euClient, mailDir, euOnly); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if _, err := usRepo.GetByEmail(ctx, euOnly); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want %v in us got %v", userRepository.ErrNotFound, err)
+	}
+	if _, err := pinned.GetByEmail(ctx, euOnly); err != nil {
+		t.Fatalf("want user from pinned region got %v", err)
+	}
+	for _, email := range []string{"regions.pinned.1@test.com", "regions.pinned.2@test.com"} {
+		u, _ := newUser(email)
+		if _, err := pinned.Create(ctx, u); err != nil {
+			t.Fatalf("failed to create user with pinned reads : %v", err)
+		}
+	}
+
+	//a delete wins over the writes before it, whichever region made them
+	deleted := "regions.deleted@test.com"
+	u, _ := newUser(deleted)
+	if _, err := euRepo.Create(ctx, u); err != nil {
+		t.Fatalf("failed to create user : %v", err)
+	}
+	if _, err := userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{CopyMissing: true}); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	usUser, err = usRepo.GetByEmail(ctx, deleted)
+	if err != nil {
+		t.Fatalf("failed to get copied user : %v", err)
+	}
+	usUser.Name = "before delete"
+	if _, err := usRepo.Update(ctx, usUser); err != nil {
+		t.Fatalf("failed to update user in us : %v", err)
+	}
+	if err := euRepo.PurgeByEmail(ctx, deleted); err != nil {
+		t.Fatalf("failed to purge user in eu : %v", err)
+	}
+	report, err = userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{CopyMissing: true})
+	if err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	want = []string{
+		"deleted " + userRepository.TableUser + " us",
+		"deleted " + userRepository.TableEmailToPublicKey + " us",
+	}
+	if got := driftOf(report, deleted); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want drift %v got %v", want, got)
+	}
+	if report, err = userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{Repair: true}); err != nil || len(driftOf(report, deleted)) != 0 {
+		t.Fatalf("want deleted user removed got %v : %v", driftOf(report, deleted), err)
+	}
+	if _, err := usRepo.GetByEmail(ctx, deleted); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want %v in us after repair got %v", userRepository.ErrNotFound, err)
+	}
+
+	//items without stamp, e.g. written before the regions were stamped, are older than stamped items and
+	//are only replaced while they are unstamped
+	euUser, err = euRepo.GetByEmail(ctx, euOnly)
+	if err != nil {
+		t.Fatalf("failed to get user : %v", err)
+	}
+	pkPKIX, err := x509.MarshalPKIXPublicKey(euUser.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to encode public key : %v", err)
+	}
+	userKey := map[string]*dynamodb.AttributeValue{userRepository.TableUserPkName: {B: pkPKIX}}
+	stamped, err := euFake.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String(userRepository.TableUser), Key: userKey})
+	if err != nil {
+		t.Fatalf("failed to get user item : %v", err)
+	}
+	unstamped := func(name string) map[string]*dynamodb.AttributeValue {
+		item := map[string]*dynamodb.AttributeValue{}
+		for k, v := range stamped.Item {
+			if k != userRepository.AttributeWriteVersion && k != userRepository.AttributeWriteRegion {
+				item[k] = v
+			}
+		}
+		item["Name"] = &dynamodb.AttributeValue{S: aws.String(name)}
+		return item
+	}
+	putItem := func(client userRepository.DynamoClient, item map[string]*dynamodb.AttributeValue) {
+		if _, err := client.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String(userRepository.TableUser), Item: item}); err != nil {
+			t.Fatalf("failed to put user item : %v", err)
+		}
+	}
+	getItem := func(client userRepository.DynamoClient) map[string]*dynamodb.AttributeValue {
+		result, err := client.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String(userRepository.TableUser), Key: userKey})
+		if err != nil {
+			t.Fatalf("failed to get user item : %v", err)
+		}
+		return result.Item
+	}
+	putItem(usFake, unstamped("unstamped"))
+	if _, err := userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{Repair: true, CopyMissing: true}); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	if got := getItem(usFake); !reflect.DeepEqual(got, stamped.Item) {
+		t.Fatalf("want unstamped item replaced by %v got %v", stamped.Item, got)
+	}
+	putItem(euFake, unstamped("eu"))
+	putItem(usFake, unstamped("us"))
+	report, err = userRepository.ReconcileRegions(ctx, regions, userRepository.RegionReconcileOptions{Repair: true})
+	if err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	want = []string{"diverged " + userRepository.TableUser + " us"}
+	if got := driftOf(report, euOnly); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want drift %v got %v", want, got)
+	}
+	if got := getItem(usFake); !reflect.DeepEqual(got, unstamped("us")) {
+		t.Fatalf("want unstamped items kept got %v", got)
+	}
+}
+
+//TestDynamoRegionEvents appends key changes made in two regions of global tables to the key log
+func TestDynamoRegionEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mailDir := t.TempDir()
+	euFake, usFake := userRepository.NewFakeDynamo(), userRepository.NewFakeDynamo()
+	euRepo := userRepository.NewAwsRegionalDynamoUserRepoWithClient(&userRepository.RegionalDynamo{Region: "eu", Client: euFake}, euFake, nil)
+	usRepo := userRepository.NewAwsRegionalDynamoUserRepoWithClient(&userRepository.RegionalDynamo{Region: "us", Client: usFake}, euFake, nil)
+	euClient := setupTestServer(ctx, euRepo, mailDir)
+	usClient := setupTestServer(ctx, usRepo, mailDir)
+
+	emails := map[string]UserServiceSchema.UserServiceClient{
+		"region.events.eu@test.com":   euClient,
+		"region.events.us@test.com":   usClient,
+		"region.events.us.2@test.com": usClient,
+	}
+	for email, client := range emails {
+		if _, err := createActiveUser(ctx, client, mailDir, email); err != nil {
+			t.Fatalf("failed to create user : %v", err)
+		}
+	}
+
+	//the events stay in the region until they are relayed to the home region
+	if events, err := usRepo.ListUserEvents(ctx, 0, 1000); err != nil || len(events) != 0 {
+		t.Fatalf("want no events before the relay got %v : %v", len(events), err)
+	}
+	sources := map[string]userRepository.UserEventRepo{}
+	for _, repo := range []*userRepository.AwsDynamoUserRepo{euRepo, usRepo} {
+		for name, source := range repo.UserEventSources() {
+			sources[name] = source
+		}
+	}
+	if len(sources) != 2 {
+		t.Fatalf("want a source per region got %v", sources)
+	}
+	//both regions relay concurrently
+	var wg sync.WaitGroup
+	for _, repo := range []*userRepository.AwsDynamoUserRepo{euRepo, usRepo} {
+		relay := &UserService.UserEventRelay{Sources: sources, Target: repo}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := relay.RelayOnce(ctx); err != nil {
+				t.Errorf("failed to relay : %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	events, err := usRepo.ListUserEvents(ctx, 0, 1000)
+	if err != nil {
+		t.Fatalf("failed to list events : %v", err)
+	}
+	created := map[string]int{}
+	for i, e := range events {
+		if e.Sequence != int64(i+1) {
+			t.Fatalf("want sequence %v got %v", i+1, e.Sequence)
+		}
+		if e.Kind == domain.UserEventCreated {
+			created[e.Email]++
+		}
+	}
+	for email := range emails {
+		if created[email] != 1 {
+			t.Fatalf("want one created event of %v got %v", email, created[email])
+		}
+	}
+
+	//the key log is appended to by both regions, it is kept in the home region only
+	for _, repo := range []*userRepository.AwsDynamoUserRepo{usRepo, euRepo} {
+		reconciler := &UserService.KeyLogReconciler{KeyLogRepo: repo, EventRepo: repo}
+		if err := reconciler.ReconcileOnce(ctx); err != nil {
+			t.Fatalf("failed to reconcile key log : %v", err)
+		}
+	}
+	entries, err := euClient.ListKeyLogEntries(ctx, &UserServiceSchema.KeyLogRequestEntries{Start: 0, Limit: 100})
+	if err != nil {
+		t.Fatalf("failed to list key log : %v", err)
+	}
+	logged := map[string]int{}
+	for i, e := range entries.Entries {
+		if e.Index != int64(i) {
+			t.Fatalf("want index %v got %v", i, e.Index)
+		}
+		logged[e.Email]++
+	}
+	for email := range emails {
+		if logged[email] != 1 {
+			t.Fatalf("want one key log entry of %v got %v", email, logged[email])
+		}
+	}
+	local := userRepository.NewAwsDynamoUserRepoWithClient(usFake, nil)
+	if local, err := local.ListKeyLogEntries(ctx, 0, 100); err != nil || len(local) != 0 {
+		t.Fatalf("want no key log in us got %v : %v", len(local), err)
+	}
+	for email, client := range emails {
+		if _, err := client.GetUserPkWithProof(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+			t.Fatalf("failed to get proof of %v : %v", email, err)
+		}
+	}
+}
+
+//legacyUserStore is a backend with users stored with their verbatim emails, before MigrateEmailKeys
+type legacyUserStore struct {
+	migrator userRepository.EmailKeyMigrator
+	users    userRepository.UserRepo
+	//insert stores a user with the verbatim email and a fresh key in the legacy layout
+	insert func(email string)
+}
+
+func newLegacyTestKey(t *testing.T) []byte {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to setup test ecdsa key : %v", err)
+	}
+	pkPKIX, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatalf("failed to encode test public key : %v", err)
+	}
+	return pkPKIX
+}
+
+func testMigrateEmailKeysWithBackend(ctx context.Context, t *testing.T, newStore func() *legacyUserStore) {
+	//emails differing in case only are reported and nothing is written, not even with apply
+	colliding := newStore()
+	colliding.insert("Alice@X.com")
+	colliding.insert("alice@x.com")
+	for _, apply := range []bool{false, true} {
+		report, err := colliding.migrator.MigrateEmailKeys(ctx, apply)
+		if err != nil {
+			t.Fatalf("failed to migrate with apply %v : %v", apply, err)
+		}
+		want := []userRepository.EmailCollision{{NormalizedEmail: "alice@x.com", Emails: []string{"Alice@X.com", "alice@x.com"}}}
+		if len(report.Collisions) == 1 {
+			sort.Strings(report.Collisions[0].Emails)
+		}
+		if !reflect.DeepEqual(report.Collisions, want) || report.NeedsRewrite != 2 || report.Rewritten != 0 {
+			t.Fatalf("want collision %v and no rewrite with apply %v got %+v", want, apply, report)
+		}
+	}
+
+	//a dry run reports the users to rewrite without writing them
+	clean := newStore()
+	clean.insert("Bob@X.com")
+	clean.insert("carol@y.com")
+	for i := 0; i < 2; i++ {
+		report, err := clean.migrator.MigrateEmailKeys(ctx, false)
+		if err != nil || report.Scanned != 2 || report.NeedsRewrite != 2 || report.Rewritten != 0 {
+			t.Fatalf("want 2 users to rewrite in dry run got %+v : %v", report, err)
+		}
+	}
+	report, err := clean.migrator.MigrateEmailKeys(ctx, true)
+	if err != nil || report.Rewritten != 2 || len(report.Collisions) != 0 {
+		t.Fatalf("want 2 rewritten users got %+v : %v", report, err)
+	}
+	for lookup, email := range map[string]string{"BOB@x.com": "Bob@X.com", "Carol@Y.com": "carol@y.com"} {
+		u, err := clean.users.GetByEmail(ctx, lookup)
+		if err != nil || u.Email != email {
+			t.Fatalf("want %v by %v got %v : %v", email, lookup, u, err)
+		}
+		pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
+		if err != nil {
+			t.Fatalf("failed to encode public key : %v", err)
+		}
+		if byPk, err := clean.users.GetByPk(ctx, pkPKIX); err != nil || byPk.Email != email {
+			t.Fatalf("want %v by key got %v : %v", email, byPk, err)
+		}
+	}
+	//a rerun finds nothing to do
+	report, err = clean.migrator.MigrateEmailKeys(ctx, true)
+	if err != nil || report.Scanned != 2 || report.NeedsRewrite != 0 || report.Rewritten != 0 {
+		t.Fatalf("want no rewrite on rerun got %+v : %v", report, err)
+	}
+}
+
+func TestMigrateEmailKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run(fmt.Sprintf("%v", gormDbImpl), func(t *testing.T) {
+		var db *gorm.DB
+		newStore := func() *legacyUserStore {
+			var err error
+			db, err = SetupGormDB(fmt.Sprintf("file:emails%v?mode=memory&cache=shared", time.Now().UnixNano()))
+			if err != nil {
+				t.Fatalf("failed to setup db : %v", err)
+			}
+			//the legacy layout had the verbatim email as primary key
+			if err := db.Migrator().DropTable(&userRepository.UserDTODB{}); err != nil {
+				t.Fatalf("failed to drop users : %v", err)
+			}
+			err = db.Exec(`CREATE TABLE user_dtodbs (created_at datetime, updated_at datetime, email text, name text,
+				public_key_pkix blob, wrapped_private_key blob, wrapped_master_key blob, deleted_at datetime, PRIMARY KEY (email))`).Error
+			if err != nil {
+				t.Fatalf("failed to create legacy users : %v", err)
+			}
+			if err := db.Exec("CREATE INDEX idx_user_dtodbs_deleted_at ON user_dtodbs(deleted_at)").Error; err != nil {
+				t.Fatalf("failed to index legacy users : %v", err)
+			}
+			repo := &userRepository.DefaultRepo{DB: db}
+			return &legacyUserStore{migrator: repo, users: repo, insert: func(email string) {
+				err := db.Exec("INSERT INTO user_dtodbs (created_at, updated_at, email, name, public_key_pkix, wrapped_private_key, wrapped_master_key) VALUES (?, ?, ?, ?, ?, ?, ?)",
+					time.Now(), time.Now(), email, "", newLegacyTestKey(t), []byte{1}, []byte{2}).Error
+				if err != nil {
+					t.Fatalf("failed to insert legacy user : %v", err)
+				}
+			}}
+		}
+		testMigrateEmailKeysWithBackend(ctx, t, newStore)
+
+		//another rewrite keeps the copy of the first one
+		err := db.Exec("INSERT INTO user_dtodbs (created_at, updated_at, normalized_email, email, name, state, public_key_pkix, wrapped_private_key, wrapped_master_key) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			time.Now(), time.Now(), "Dave@Z.com", "Dave@Z.com", "", string(domain.UserStateActive), newLegacyTestKey(t), []byte{1}, []byte{2}).Error
+		if err != nil {
+			t.Fatalf("failed to insert user : %v", err)
+		}
+		repo := &userRepository.DefaultRepo{DB: db}
+		if report, err := repo.MigrateEmailKeys(ctx, true); err != nil || report.Rewritten != 1 {
+			t.Fatalf("want second rewrite got %+v : %v", report, err)
+		}
+		for _, table := range []string{"user_dtodbs_legacy", "user_dtodbs_legacy_2"} {
+			if !db.Migrator().HasTable(table) {
+				t.Fatalf("want copy %v kept", table)
+			}
+		}
+		if u, err := repo.GetByEmail(ctx, "dave@z.com"); err != nil || u.Email != "Dave@Z.com" {
+			t.Fatalf("want rewritten user got %v : %v", u, err)
+		}
+	})
+
+	t.Run(fmt.Sprintf("%v", dynamoDbImpl), func(t *testing.T) {
+		newStore := func() *legacyUserStore {
+			fake := userRepository.NewFakeDynamo()
+			repo := userRepository.NewAwsDynamoUserRepoWithClient(fake, nil)
+			return &legacyUserStore{migrator: repo, users: repo, insert: func(email string) {
+				pkPKIX := newLegacyTestKey(t)
+				//legacy items have no NormalizedEmail and are found by the verbatim email
+				_, err := fake.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String(userRepository.TableUser), Item: map[string]*dynamodb.AttributeValue{
+					userRepository.TableUserPkName: {B: pkPKIX},
+					"Email":                        {S: aws.String(email)},
+					"WrappedPrivateKey":            {B: []byte{1}},
+					"WrappedMasterKey":             {B: []byte{2}},
+				}})
+				if err != nil {
+					t.Fatalf("failed to insert legacy user : %v", err)
+				}
+				_, err = fake.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String(userRepository.TableEmailToPublicKey), Item: map[string]*dynamodb.AttributeValue{
+					userRepository.TableEmailToPublicKeyPkName: {S: aws.String(email)},
+					"PrimaryKey": {B: pkPKIX},
+				}})
+				if err != nil {
+					t.Fatalf("failed to insert legacy email entry : %v", err)
+				}
+			}}
+		}
+		testMigrateEmailKeysWithBackend(ctx, t, newStore)
+	})
+}
+
+func userPkFingerprint(t *testing.T, u *domain.User) string {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to encode public key : %v", err)
+	}
+	return domain.KeyFingerprint(pkPKIX)
+}
+
+func TestUserShards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mailDir := t.TempDir()
+	primary, err := setupTestBackend(gormDbImpl)
+	if err != nil {
+		t.Fatalf("failed to setup env : %v", err)
+	}
+	tag := fmt.Sprintf("shards%v", time.Now().UnixNano())
+	shards := make(map[string]userRepository.ShardBackend)
+	for _, name := range []string{"s1", "s2", "s3"} {
+		db, err := SetupGormDB(fmt.Sprintf("file:%v%v?mode=memory&cache=shared", tag, name))
+		if err != nil {
+			t.Fatalf("failed to setup shard %v : %v", name, err)
+		}
+		shards[name] = &userRepository.DefaultRepo{DB: db}
+	}
+	twoShards, err := userRepository.NewShardedRepo(map[string]userRepository.ShardBackend{"s1": shards["s1"], "s2": shards["s2"]}, nil, primary)
+	if err != nil {
+		t.Fatalf("failed to setup shards : %v", err)
+	}
+	client := setupTestServer(ctx, &backendSetup.UserDirectoryBackend{Backend: primary, Users: twoShards}, mailDir)
+
+	//users are distributed by their email, their keys are found through the key index
+	emails := make([]string, 20)
+	pks := make(map[string][]byte)
+	for i := range emails {
+		emails[i] = fmt.Sprintf("%v-%v@test.com", tag, i)
+		if _, err := createActiveUser(ctx, client, mailDir, emails[i]); err != nil {
+			t.Fatalf("failed to create user : %v", err)
+		}
+		pk, err := client.GetUserPkByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: emails[i]})
+		if err != nil {
+			t.Fatalf("failed to get user pk : %v", err)
+		}
+		pks[emails[i]] = pk.PublicKey
+	}
+	perShard := map[string]int{}
+	for _, email := range emails {
+		owner := twoShards.ShardOf(email)
+		if _, err := shards[owner].GetByEmail(ctx, email); err != nil {
+			t.Fatalf("want %v in shard %v got %v", email, owner, err)
+		}
+		perShard[owner]++
+		if got, err := client.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: pks[email]}); err != nil || got.Email != email {
+			t.Fatalf("want %v by key got %v : %v", email, got, err)
+		}
+	}
+	if perShard["s1"] == 0 || perShard["s2"] == 0 {
+		t.Fatalf("want users in both shards got %v", perShard)
+	}
+	_, err = twoShards.Create(ctx, &domain.User{
+		Email:             tag + "-copy@test.com",
+		State:             domain.UserStateActive,
+		PublicKey:         mustParsePk(t, pks[emails[0]]),
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	})
+	if !errors.Is(err, userRepository.ErrAlreadyExists) {
+		t.Fatalf("want %v for key of another shard got %v", userRepository.ErrAlreadyExists, err)
+	}
+
+	//the events of the shards are relayed to the central backend, which the key log is built from
+	relayShards := func(sharded *userRepository.ShardedRepo) map[string][]domain.UserEventKind {
+		relay := &UserService.UserEventRelay{Sources: sharded.UserEventSources(), Target: primary}
+		if err := relay.RelayOnce(ctx); err != nil {
+			t.Fatalf("failed to relay : %v", err)
+		}
+		events, err := primary.ListUserEvents(ctx, 0, 100000)
+		if err != nil {
+			t.Fatalf("failed to list events : %v", err)
+		}
+		kinds := map[string][]domain.UserEventKind{}
+		for _, e := range events {
+			kinds[e.Email] = append(kinds[e.Email], e.Kind)
+		}
+		return kinds
+	}
+	relayed := relayShards(twoShards)
+	reconciler := &UserService.KeyLogReconciler{KeyLogRepo: primary, EventRepo: primary}
+	if err := reconciler.ReconcileOnce(ctx); err != nil {
+		t.Fatalf("failed to reconcile key log : %v", err)
+	}
+	for _, email := range emails {
+		if len(relayed[email]) == 0 || relayed[email][0] != domain.UserEventCreated {
+			t.Fatalf("want relayed created event of %v got %v", email, relayed[email])
+		}
+		if _, err := client.GetUserPkWithProof(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+			t.Fatalf("failed to get proof of %v : %v", email, err)
+		}
+	}
+
+	//adding a shard only moves the users hashed to it. Reads find all users while they are moved
+	resharded, err := userRepository.NewShardedRepo(shards, []string{"s1", "s2"}, primary)
+	if err != nil {
+		t.Fatalf("failed to setup shards : %v", err)
+	}
+	var moving []string
+	for _, email := range emails {
+		if owner := resharded.ShardOf(email); owner != twoShards.ShardOf(email) {
+			if owner != "s3" {
+				t.Fatalf("want %v moved to s3 only got %v", email, owner)
+			}
+			moving = append(moving, email)
+		}
+	}
+	if len(moving) == 0 {
+		t.Fatalf("want users hashed to the new shard")
+	}
+	reshardedClient := setupTestServer(ctx, &backendSetup.UserDirectoryBackend{Backend: primary, Users: resharded}, mailDir)
+	//writes move the user first
+	written, err := resharded.GetByEmail(ctx, moving[0])
+	if err != nil {
+		t.Fatalf("failed to get user on previous shard : %v", err)
+	}
+	written.Name = "moved"
+	if _, err := resharded.Update(ctx, written); err != nil {
+		t.Fatalf("failed to update user : %v", err)
+	}
+	if u, err := shards["s3"].GetByEmail(ctx, moving[0]); err != nil || u.Name != "moved" {
+		t.Fatalf("want written user on new shard got %v : %v", u, err)
+	}
+	//scans visit users copied but not yet removed from their previous shard once
+	if len(moving) > 1 {
+		copied, err := shards[twoShards.ShardOf(moving[1])].GetByEmail(ctx, moving[1])
+		if err != nil {
+			t.Fatalf("failed to get user on previous shard : %v", err)
+		}
+		if _, err := shards["s3"].ImportUser(ctx, copied, false); err != nil {
+			t.Fatalf("failed to copy user to new shard : %v", err)
+		}
+	}
+	scanned := map[string]int{}
+	err = resharded.ScanUsers(ctx, func(u *domain.User) error {
+		if strings.HasPrefix(u.Email, tag+"-") {
+			scanned[u.Email]++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to scan users : %v", err)
+	}
+	for _, email := range emails {
+		if scanned[email] != 1 {
+			t.Fatalf("want %v scanned once got %v", email, scanned[email])
+		}
+	}
+
+	readErrs := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(readErrs)
+		for {
+			for _, email := range emails {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if got, err := reshardedClient.GetUserByPk(ctx, &UserServiceSchema.UserRequestPk{PublicKey: pks[email]}); err != nil || got.Email != email {
+					readErrs <- fmt.Errorf("failed to read %v while resharding : %v", email, err)
+					return
+				}
+			}
+		}
+	}()
+	report, err := resharded.Reshard(ctx)
+	close(done)
+	if err != nil {
+		t.Fatalf("failed to reshard : %v", err)
+	}
+	if err := <-readErrs; err != nil {
+		t.Fatalf("%v", err)
+	}
+	if report.MovedUsers != len(moving)-1 {
+		t.Fatalf("want %v moved users got %v", len(moving)-1, report.MovedUsers)
+	}
+	//moves are announced as imports, not as purges
+	relayed = relayShards(resharded)
+	for _, email := range moving {
+		for _, kind := range relayed[email] {
+			if kind == domain.UserEventPurged {
+				t.Fatalf("want no purge event of moved user %v got %v", email, relayed[email])
+			}
+		}
+	}
+
+	//afterwards the users are found without the previous shards
+	threeShards, err := userRepository.NewShardedRepo(shards, nil, primary)
+	if err != nil {
+		t.Fatalf("failed to setup shards : %v", err)
+	}
+	for _, email := range emails {
+		owner := threeShards.ShardOf(email)
+		for name, shard := range shards {
+			_, err := shard.GetByEmail(ctx, email)
+			if name == owner && err != nil {
+				t.Fatalf("want %v in shard %v got %v", email, name, err)
+			}
+			if name != owner && !errors.Is(err, userRepository.ErrNotFound) {
+				t.Fatalf("want %v only in shard %v, found in %v : %v", email, owner, name, err)
+			}
+		}
+		if got, err := threeShards.GetByPk(ctx, pks[email]); err != nil || got.Email != email {
+			t.Fatalf("want %v by key got %v : %v", email, got, err)
+		}
+	}
+	users, err := threeShards.ListUsers(ctx, domain.UserFilter{Query: tag, Limit: 100})
+	if err != nil || len(users) != len(emails) {
+		t.Fatalf("want %v users got %v : %v", len(emails), len(users), err)
+	}
+
+	//the other data of the users is kept in the central backend and removed with the users
+	central := backendSetup.WithUsers(primary, threeShards)
+	addCentralData := func(email string) {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to setup test ecdsa key : %v", err)
+		}
+		if _, err := central.AddDevice(ctx, &domain.Device{ID: email + "-device", OwnerEmail: email, Name: "laptop", PublicKey: sk.Public(), WrappedMasterKey: []byte{1}}); err != nil {
+			t.Fatalf("failed to add device : %v", err)
+		}
+		if _, err := central.CreateGroup(ctx, &domain.Group{ID: email + "-group", Name: "team", OwnerEmail: email, CreatedAt: time.Now()}); err != nil {
+			t.Fatalf("failed to create group : %v", err)
+		}
+		if devices, err := primary.ListDevices(ctx, email); err != nil || len(devices) != 1 {
+			t.Fatalf("want device in central backend got %v : %v", devices, err)
+		}
+	}
+	checkCentralDataRemoved := func(email string) {
+		if devices, err := primary.ListDevices(ctx, email); err != nil || len(devices) != 0 {
+			t.Fatalf("want devices of %v removed got %v : %v", email, devices, err)
+		}
+		if groups, err := primary.ListGroupsOfMember(ctx, email); err != nil || len(groups) != 0 {
+			t.Fatalf("want memberships of %v removed got %v : %v", email, groups, err)
+		}
+	}
+	addCentralData(emails[0])
+	addCentralData(emails[1])
+	if err := threeShards.DeleteByEmail(ctx, emails[1]); err != nil {
+		t.Fatalf("failed to delete user : %v", err)
+	}
+	if n, err := threeShards.PurgeDeleted(ctx, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Fatalf("want 1 purged user got %v : %v", n, err)
+	}
+	checkCentralDataRemoved(emails[1])
+
+	//purged users release their keys
+	if err := threeShards.PurgeByEmail(ctx, emails[0]); err != nil {
+		t.Fatalf("failed to purge user : %v", err)
+	}
+	checkCentralDataRemoved(emails[0])
+	if _, err := threeShards.GetByPk(ctx, pks[emails[0]]); !errors.Is(err, userRepository.ErrNotFound) {
+		t.Fatalf("want %v for key of purged user got %v", userRepository.ErrNotFound, err)
+	}
+	_, err = threeShards.Create(ctx, &domain.User{
+		Email:             tag + "-copy@test.com",
+		State:             domain.UserStateActive,
+		PublicKey:         mustParsePk(t, pks[emails[0]]),
+		WrappedPrivateKey: []byte{1},
+		WrappedMasterKey:  []byte{2},
+	})
+	if err != nil {
+		t.Fatalf("want key of purged user reusable got %v", err)
+	}
 }
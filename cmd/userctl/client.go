@@ -0,0 +1,310 @@
+package main
+
+import (
+	"UserService/adapters/mailer"
+	"UserService/adapters/userRepository"
+	"UserService/cmd/internal/backendSetup"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"UserService/services/UserService"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"os"
+	"time"
+)
+
+//userAPI is the subset of the UserService RPCs used by userctl
+type userAPI interface {
+	GetUserSummary(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.UserSummary, error)
+	ListUsers(ctx context.Context, req *UserServiceSchema.UserRequestList) (*UserServiceSchema.UserSummaryList, error)
+	CreateUser(ctx context.Context, req *UserServiceSchema.UserRequestCreate) (*UserServiceSchema.User, error)
+	DeleteUserByEmail(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.Empty, error)
+	RestoreUser(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.User, error)
+	RotateUserKey(ctx context.Context, req *UserServiceSchema.UserRequestRotateKey) (*UserServiceSchema.User, error)
+	ListDevices(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.DeviceList, error)
+	//ExportUsers writes the archive of all users to w
+	ExportUsers(ctx context.Context, w io.Writer) error
+	//ImportUsers replays the archive read from r
+	ImportUsers(ctx context.Context, r io.Reader, policy domain.ImportConflictPolicy) (*UserServiceSchema.UserImportReport, error)
+}
+
+//importChunkSize is the size of the chunks archives are uploaded in
+const importChunkSize = 64 * 1024
+
+//grpcAPI calls a running server, passing the admin token as bearer token
+type grpcAPI struct {
+	client UserServiceSchema.UserServiceClient
+	token  string
+}
+
+func (g grpcAPI) withToken(ctx context.Context) context.Context {
+	if g.token == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+g.token)
+}
+
+func (g grpcAPI) GetUserSummary(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.UserSummary, error) {
+	return g.client.GetUserSummary(g.withToken(ctx), req)
+}
+
+func (g grpcAPI) ListUsers(ctx context.Context, req *UserServiceSchema.UserRequestList) (*UserServiceSchema.UserSummaryList, error) {
+	return g.client.ListUsers(g.withToken(ctx), req)
+}
+
+func (g grpcAPI) CreateUser(ctx context.Context, req *UserServiceSchema.UserRequestCreate) (*UserServiceSchema.User, error) {
+	return g.client.CreateUser(g.withToken(ctx), req)
+}
+
+func (g grpcAPI) DeleteUserByEmail(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.Empty, error) {
+	return g.client.DeleteUserByEmail(g.withToken(ctx), req)
+}
+
+func (g grpcAPI) RestoreUser(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.User, error) {
+	return g.client.RestoreUser(g.withToken(ctx), req)
+}
+
+func (g grpcAPI) RotateUserKey(ctx context.Context, req *UserServiceSchema.UserRequestRotateKey) (*UserServiceSchema.User, error) {
+	return g.client.RotateUserKey(g.withToken(ctx), req)
+}
+
+func (g grpcAPI) ListDevices(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.DeviceList, error) {
+	return g.client.ListDevices(g.withToken(ctx), req)
+}
+
+func (g grpcAPI) ExportUsers(ctx context.Context, w io.Writer) error {
+	stream, err := g.client.ExportUsers(g.withToken(ctx), &UserServiceSchema.Empty{})
+	if err != nil {
+		return err
+	}
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return fmt.Errorf("failed to write archive : %v", err)
+		}
+	}
+}
+
+func (g grpcAPI) ImportUsers(ctx context.Context, r io.Reader, policy domain.ImportConflictPolicy) (*UserServiceSchema.UserImportReport, error) {
+	stream, err := g.client.ImportUsers(g.withToken(ctx))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, importChunkSize)
+	first := true
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 || first {
+			req := &UserServiceSchema.UserRequestImport{Data: append([]byte(nil), buf[:n]...)}
+			if first {
+				req.ConflictPolicy = string(policy)
+				first = false
+			}
+			if sendErr := stream.Send(req); sendErr != nil {
+				//the server closed the stream, its error is returned by CloseAndRecv
+				break
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive : %v", err)
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+func dialAPI(addr, token string) (userAPI, func() error, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial %v : %v", addr, err)
+	}
+	return grpcAPI{client: UserServiceSchema.NewUserServiceClient(conn), token: token}, conn.Close, nil
+}
+
+//directBackend is implemented by all repositories and covers everything userctl needs in direct mode
+type directBackend interface {
+	userRepository.UserRepo
+	userRepository.VerificationTokenRepo
+	userRepository.DeviceRepo
+	userRepository.OrganizationRepo
+	userRepository.KeyLogRepo
+	userRepository.UserEventRepo
+	userRepository.AuditRepo
+	userRepository.UserAdminRepo
+}
+
+//setupBackend builds the backend like the server, including the residency, the shards or the mirror
+//configured by the environment. Direct mode is refused while the servers cache users, because their caches
+//would keep serving the users userctl changed
+func setupBackend(dsn string, retention, eventRetention time.Duration) (directBackend, error) {
+	if v := os.Getenv(EnvUserCacheSize); v != "" && v != "0" {
+		return nil, fmt.Errorf("%v is set, the caches of the servers would not see direct writes. Use -addr", EnvUserCacheSize)
+	}
+	backend, err := backendSetup.SetupBackend(dsn, retention, eventRetention)
+	if err != nil {
+		return nil, err
+	}
+	directory, err := backendSetup.SetupDirectory(backend, retention, eventRetention)
+	if err != nil {
+		return nil, err
+	}
+	return backendSetup.WithUsers(backendSetup.WithMirror(backendSetup.WithResidency(backend, directory.Residency), directory.Mirror), directory.Users), nil
+}
+
+//directAPI runs the service in process on top of the configured repository. Calls pass through the
+//audit interceptor like on the server, authorized with a random admin token
+type directAPI struct {
+	us    *UserService.UserService
+	token string
+}
+
+func newDirectAPI(dsn string) (userAPI, error) {
+	retention := userRepository.DefaultRetention
+	if v := os.Getenv(EnvRetention); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v : %v", EnvRetention, err)
+		}
+		retention = d
+	}
+	eventRetention := userRepository.DefaultEventRetention
+	if v := os.Getenv(EnvEventRetention); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v : %v", EnvEventRetention, err)
+		}
+		eventRetention = d
+	}
+	backend, err := setupBackend(dsn, retention, eventRetention)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup db : %v", err)
+	}
+	//the signer only signs tree heads, which userctl never hands out
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key log signer : %v", err)
+	}
+	rawToken := make([]byte, 32)
+	if _, err := rand.Read(rawToken); err != nil {
+		return nil, fmt.Errorf("failed to generate admin token : %v", err)
+	}
+	token := hex.EncodeToString(rawToken)
+	us := UserService.NewUserService(backend,
+		UserService.WithVerification(backend, mailer.LogSender{}, UserService.DefaultVerificationTTL),
+		UserService.WithRetention(retention),
+		UserService.WithDevices(backend),
+		UserService.WithOrganizations(backend),
+		UserService.WithKeyLog(backend, backend, signer),
+		UserService.WithAuditLog(backend, token),
+		UserService.WithUserAdmin(backend),
+	)
+	return directAPI{us: us, token: token}, nil
+}
+
+//call invokes handler through the audit interceptor of the service
+func (d directAPI) call(ctx context.Context, method string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+d.token))
+	return d.us.AuditInterceptor(ctx, req, &grpc.UnaryServerInfo{Server: d.us, FullMethod: "/userctl/" + method}, handler)
+}
+
+func (d directAPI) GetUserSummary(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.UserSummary, error) {
+	resp, err := d.call(ctx, "GetUserSummary", req, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return d.us.GetUserSummary(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*UserServiceSchema.UserSummary), nil
+}
+
+func (d directAPI) ListUsers(ctx context.Context, req *UserServiceSchema.UserRequestList) (*UserServiceSchema.UserSummaryList, error) {
+	resp, err := d.call(ctx, "ListUsers", req, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return d.us.ListUsers(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*UserServiceSchema.UserSummaryList), nil
+}
+
+func (d directAPI) CreateUser(ctx context.Context, req *UserServiceSchema.UserRequestCreate) (*UserServiceSchema.User, error) {
+	resp, err := d.call(ctx, "CreateUser", req, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return d.us.CreateUser(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*UserServiceSchema.User), nil
+}
+
+func (d directAPI) DeleteUserByEmail(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.Empty, error) {
+	resp, err := d.call(ctx, "DeleteUserByEmail", req, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return d.us.DeleteUserByEmail(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*UserServiceSchema.Empty), nil
+}
+
+func (d directAPI) RestoreUser(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.User, error) {
+	resp, err := d.call(ctx, "RestoreUser", req, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return d.us.RestoreUser(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*UserServiceSchema.User), nil
+}
+
+func (d directAPI) RotateUserKey(ctx context.Context, req *UserServiceSchema.UserRequestRotateKey) (*UserServiceSchema.User, error) {
+	resp, err := d.call(ctx, "RotateUserKey", req, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return d.us.RotateUserKey(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*UserServiceSchema.User), nil
+}
+
+func (d directAPI) ExportUsers(ctx context.Context, w io.Writer) error {
+	_, err := d.us.ExportUserArchive(ctx, w)
+	return err
+}
+
+func (d directAPI) ImportUsers(ctx context.Context, r io.Reader, policy domain.ImportConflictPolicy) (*UserServiceSchema.UserImportReport, error) {
+	report, err := d.us.ImportUserArchive(ctx, r, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &UserServiceSchema.UserImportReport{
+		Imported:    int64(report.Imported),
+		Overwritten: int64(report.Overwritten),
+		Skipped:     int64(report.Skipped),
+	}, nil
+}
+
+func (d directAPI) ListDevices(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.DeviceList, error) {
+	resp, err := d.call(ctx, "ListDevices", req, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return d.us.ListDevices(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*UserServiceSchema.DeviceList), nil
+}
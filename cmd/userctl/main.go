@@ -0,0 +1,382 @@
+//userctl administers users of the UserService. With -addr it talks to a running server and
+//authenticates with the admin token, otherwise it works directly on the databases configured by the
+//same envvars as the server, DSN and e.g. RESIDENCY_REGIONS or USER_SHARDS. Direct mode is refused if
+//USER_CACHE_SIZE is set, the caches of the servers would not notice the changes.
+//
+//Usage: userctl [-addr host:port] [-token token] [-o table|json] command [args]
+//
+//Commands:
+//
+//	get EMAIL                      show a user, also if it has been deleted
+//	list [-state s] [-deleted]     list users ordered by email
+//	search QUERY                   list users whose email or name contains QUERY
+//	create -email e -public-key f -wrapped-private-key f -wrapped-master-key f
+//	delete EMAIL                   soft delete a user
+//	restore EMAIL                  restore a deleted user within the retention window
+//	rotate-key -email e -public-key f -wrapped-private-key f -wrapped-master-key f
+//	fingerprints EMAIL             show the fingerprints of the primary and device keys
+//	export [-f file]               write an archive of all users, including deleted ones
+//	import [-policy p] FILE        import an archive, p is skip, overwrite or fail on existing users
+//
+//Users are moved between backends by exporting from one DSN and importing into another.
+package main
+
+import (
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	//EnvDSN connection string for database, used if -addr is not set
+	EnvDSN string = "DSN"
+	//EnvRetention duration in which deleted users can be restored, e.g. "720h"
+	EnvRetention string = "DELETE_RETENTION"
+	//EnvEventRetention duration user events are kept, e.g. "168h"
+	EnvEventRetention string = "EVENT_RETENTION"
+	//EnvUserCacheSize size of the user caches of the servers, direct mode requires it to be unset or 0
+	EnvUserCacheSize string = "USER_CACHE_SIZE"
+	//EnvAdminToken default of -token
+	EnvAdminToken string = "ADMIN_TOKEN"
+)
+
+//printer renders command results either as aligned table or as JSON
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+//print writes v as JSON or, in table mode, the rows with header as first row
+func (p printer) print(v interface{}, header []string, rows [][]string) error {
+	if p.json {
+		raw, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize result : %v", err)
+		}
+		_, err = fmt.Fprintln(p.w, string(raw))
+		return err
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func formatUnix(sec int64) string {
+	if sec == 0 {
+		return "-"
+	}
+	return time.Unix(sec, 0).UTC().Format(time.RFC3339)
+}
+
+func summaryRow(u *UserServiceSchema.UserSummary) []string {
+	return []string{u.Email, u.Name, u.State, u.KeyFingerprint, formatUnix(u.CreatedAtUnix), formatUnix(u.DeletedAtUnix)}
+}
+
+var summaryHeader = []string{"EMAIL", "NAME", "STATE", "FINGERPRINT", "CREATED", "DELETED"}
+
+func userRow(u *UserServiceSchema.User) []string {
+	return []string{u.Email, domain.KeyFingerprint(u.PublicKey), formatUnix(u.CreatedAtUnix), formatUnix(u.UpdatedAtUnix)}
+}
+
+var userHeader = []string{"EMAIL", "FINGERPRINT", "CREATED", "UPDATED"}
+
+func readPublicKeyPEM(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%v contains no PEM encoded PUBLIC KEY", path)
+	}
+	return block.Bytes, nil
+}
+
+//keyFiles holds the flags shared by create and rotate-key
+type keyFiles struct {
+	email             *string
+	publicKey         *string
+	wrappedPrivateKey *string
+	wrappedMasterKey  *string
+}
+
+func newKeyFiles(fs *flag.FlagSet) keyFiles {
+	return keyFiles{
+		email:             fs.String("email", "", "email of the user"),
+		publicKey:         fs.String("public-key", "", "path of the PEM encoded PKIX public key"),
+		wrappedPrivateKey: fs.String("wrapped-private-key", "", "path of the wrapped private key"),
+		wrappedMasterKey:  fs.String("wrapped-master-key", "", "path of the wrapped master key"),
+	}
+}
+
+//read returns the public key as PKIX and the contents of the wrapped key files
+func (k keyFiles) read() (pkPKIX, wrappedPrivateKey, wrappedMasterKey []byte, err error) {
+	if *k.email == "" || *k.publicKey == "" || *k.wrappedPrivateKey == "" || *k.wrappedMasterKey == "" {
+		return nil, nil, nil, fmt.Errorf("specify -email, -public-key, -wrapped-private-key and -wrapped-master-key")
+	}
+	if pkPKIX, err = readPublicKeyPEM(*k.publicKey); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read public key : %v", err)
+	}
+	if wrappedPrivateKey, err = ioutil.ReadFile(*k.wrappedPrivateKey); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read wrapped private key : %v", err)
+	}
+	if wrappedMasterKey, err = ioutil.ReadFile(*k.wrappedMasterKey); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read wrapped master key : %v", err)
+	}
+	return pkPKIX, wrappedPrivateKey, wrappedMasterKey, nil
+}
+
+//singleArg parses fs and returns its only positional argument
+func singleArg(fs *flag.FlagSet, args []string, name string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("usage: %v %v", fs.Name(), name)
+	}
+	return fs.Arg(0), nil
+}
+
+func runCommand(ctx context.Context, api userAPI, p printer, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	switch cmd {
+	case "get":
+		email, err := singleArg(fs, args, "EMAIL")
+		if err != nil {
+			return err
+		}
+		u, err := api.GetUserSummary(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+		if err != nil {
+			return err
+		}
+		return p.print(u, summaryHeader, [][]string{summaryRow(u)})
+	case "list", "search":
+		req := &UserServiceSchema.UserRequestList{}
+		state := fs.String("state", "", "only list users in this state, pending or active")
+		deleted := fs.Bool("deleted", false, "include deleted users")
+		limit := fs.Int("limit", 0, "maximum number of users per page")
+		page := fs.String("page", "", "page token printed by the previous call")
+		if cmd == "search" {
+			query, err := singleArg(fs, args, "QUERY")
+			if err != nil {
+				return err
+			}
+			req.Query = query
+		} else if err := fs.Parse(args); err != nil {
+			return err
+		}
+		req.State = *state
+		req.IncludeDeleted = *deleted
+		req.Limit = int64(*limit)
+		req.PageToken = *page
+		list, err := api.ListUsers(ctx, req)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(list.Users))
+		for _, u := range list.Users {
+			rows = append(rows, summaryRow(u))
+		}
+		if err := p.print(list, summaryHeader, rows); err != nil {
+			return err
+		}
+		if !p.json && list.NextPageToken != "" {
+			fmt.Fprintf(p.w, "next page: -page %v\n", list.NextPageToken)
+		}
+		return nil
+	case "create":
+		keys := newKeyFiles(fs)
+		escrow := fs.String("escrow-wrapped-master-key", "", "path of the master key wrapped for the organization escrow key")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		pkPKIX, wrappedPrivateKey, wrappedMasterKey, err := keys.read()
+		if err != nil {
+			return err
+		}
+		req := &UserServiceSchema.UserRequestCreate{
+			Email:             *keys.email,
+			PublicKey:         pkPKIX,
+			WrappedPrivateKey: wrappedPrivateKey,
+			WrappedMasterKey:  wrappedMasterKey,
+		}
+		if *escrow != "" {
+			if req.EscrowWrappedMasterKey, err = ioutil.ReadFile(*escrow); err != nil {
+				return fmt.Errorf("failed to read escrow wrapped master key : %v", err)
+			}
+		}
+		u, err := api.CreateUser(ctx, req)
+		if err != nil {
+			return err
+		}
+		return p.print(u, userHeader, [][]string{userRow(u)})
+	case "delete":
+		email, err := singleArg(fs, args, "EMAIL")
+		if err != nil {
+			return err
+		}
+		if _, err := api.DeleteUserByEmail(ctx, &UserServiceSchema.UserRequestEmail{Email: email}); err != nil {
+			return err
+		}
+		log.Printf("Deleted %v", email)
+		return nil
+	case "restore":
+		email, err := singleArg(fs, args, "EMAIL")
+		if err != nil {
+			return err
+		}
+		u, err := api.RestoreUser(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+		if err != nil {
+			return err
+		}
+		return p.print(u, userHeader, [][]string{userRow(u)})
+	case "rotate-key":
+		keys := newKeyFiles(fs)
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		pkPKIX, wrappedPrivateKey, wrappedMasterKey, err := keys.read()
+		if err != nil {
+			return err
+		}
+		u, err := api.RotateUserKey(ctx, &UserServiceSchema.UserRequestRotateKey{
+			Email:             *keys.email,
+			PublicKey:         pkPKIX,
+			WrappedPrivateKey: wrappedPrivateKey,
+			WrappedMasterKey:  wrappedMasterKey,
+		})
+		if err != nil {
+			return err
+		}
+		return p.print(u, userHeader, [][]string{userRow(u)})
+	case "fingerprints":
+		email, err := singleArg(fs, args, "EMAIL")
+		if err != nil {
+			return err
+		}
+		u, err := api.GetUserSummary(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+		if err != nil {
+			return err
+		}
+		type keyFingerprint struct {
+			Kind        string
+			Name        string
+			Fingerprint string
+			Revoked     bool
+		}
+		keys := []keyFingerprint{{Kind: "primary", Name: u.Name, Fingerprint: u.KeyFingerprint}}
+		devices, err := api.ListDevices(ctx, &UserServiceSchema.UserRequestEmail{Email: email})
+		if err != nil {
+			return fmt.Errorf("failed to list devices : %v", err)
+		}
+		for _, d := range devices.Devices {
+			keys = append(keys, keyFingerprint{
+				Kind:        "device",
+				Name:        d.Name,
+				Fingerprint: domain.KeyFingerprint(d.PublicKey),
+				Revoked:     d.RevokedAtUnix != 0,
+			})
+		}
+		rows := make([][]string, 0, len(keys))
+		for _, k := range keys {
+			rows = append(rows, []string{k.Kind, k.Name, k.Fingerprint, fmt.Sprint(k.Revoked)})
+		}
+		return p.print(keys, []string{"KIND", "NAME", "FINGERPRINT", "REVOKED"}, rows)
+	case "export":
+		file := fs.String("f", "", "path of the archive, stdout if empty")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *file == "" {
+			return api.ExportUsers(ctx, p.w)
+		}
+		f, err := os.Create(*file)
+		if err != nil {
+			return fmt.Errorf("failed to create archive : %v", err)
+		}
+		if err := api.ExportUsers(ctx, f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case "import":
+		policy := fs.String("policy", string(domain.ImportConflictFail), "how to treat existing users, skip, overwrite or fail")
+		path, err := singleArg(fs, args, "FILE")
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open archive : %v", err)
+		}
+		defer f.Close()
+		report, err := api.ImportUsers(ctx, f, domain.ImportConflictPolicy(*policy))
+		if err != nil {
+			return err
+		}
+		row := []string{fmt.Sprint(report.Imported), fmt.Sprint(report.Overwritten), fmt.Sprint(report.Skipped)}
+		return p.print(report, []string{"IMPORTED", "OVERWRITTEN", "SKIPPED"}, [][]string{row})
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "", "host:port of the server, the database from the DSN envvar is used if empty")
+	token := flag.String("token", os.Getenv(EnvAdminToken), "admin token for -addr")
+	output := flag.String("o", "table", "output format, table or json")
+	timeout := flag.Duration("timeout", 5*time.Minute, "timeout of the command")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		log.Fatalf("Specify a command: get, list, search, create, delete, restore, rotate-key, fingerprints, export or import")
+	}
+	if *output != "table" && *output != "json" {
+		log.Fatalf("Invalid -o %q, want table or json", *output)
+	}
+
+	var api userAPI
+	if *addr != "" {
+		grpcAPI, closeConn, err := dialAPI(*addr, *token)
+		if err != nil {
+			log.Fatalf("Failed to connect : %v", err)
+		}
+		defer closeConn()
+		api = grpcAPI
+	} else {
+		dsn := os.Getenv(EnvDSN)
+		if dsn == "" {
+			log.Fatalf("Specify -addr or the %v envvar!", EnvDSN)
+		}
+		directAPI, err := newDirectAPI(dsn)
+		if err != nil {
+			log.Fatalf("Failed to setup service : %v", err)
+		}
+		api = directAPI
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	p := printer{w: os.Stdout, json: *output == "json"}
+	if err := runCommand(ctx, api, p, flag.Arg(0), flag.Args()[1:]); err != nil {
+		log.Fatalf("%v failed : %v", flag.Arg(0), err)
+	}
+}
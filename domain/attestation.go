@@ -0,0 +1,16 @@
+package domain
+
+import "crypto"
+
+//ServiceSigningKey is a key the service signs attestations with. Clients pin the public keys by Version,
+//so a key may be rotated by adding one with a higher version while the old one is still published
+type ServiceSigningKey struct {
+	Version int64
+	Signer  crypto.Signer
+}
+
+//BindingAttestationDigest is the digest the service signs to attest that the normalized email was bound
+//to the public key at timestampUnix. keyVersion is the version of the signing key
+func BindingAttestationDigest(email string, pkPKIX []byte, timestampUnix, keyVersion int64) []byte {
+	return signedDigest("email-key-binding", []byte(email), pkPKIX, unixField(timestampUnix), unixField(keyVersion))
+}
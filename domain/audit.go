@@ -0,0 +1,43 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+//AuditEntry records a call of a mutating RPC. Requests are not authenticated as a whole, so the actor
+//is identified by the acting email and signing key named in the request, if any, and the peer address
+type AuditEntry struct {
+	ID          string
+	Time        time.Time
+	Operation   string //name of the RPC
+	ActorEmail  string //normalized email of the acting user, empty if the request names none
+	ActorKey    string //fingerprint of the key the request has been signed with, empty if unsigned
+	TargetEmail string //normalized email of the affected user, empty if the request names none
+	PeerAddress string
+	KeyBefore   string //fingerprint of the primary key of the target before the call, empty if there was none
+	KeyAfter    string //fingerprint of the primary key of the target after the call, empty if there is none
+	Result      string //grpc status code of the call
+}
+
+func (a AuditEntry) String() string {
+	return fmt.Sprintf("AuditEntry{ID: %v, Time: %v, Operation: %v, ActorEmail: %v, ActorKey: %v, TargetEmail: %v, PeerAddress: %v, KeyBefore: %v, KeyAfter: %v, Result: %v}",
+		a.ID, a.Time, a.Operation, a.ActorEmail, a.ActorKey, a.TargetEmail, a.PeerAddress, a.KeyBefore, a.KeyAfter, a.Result)
+}
+
+//AuditFilter selects audit entries. The zero value of a field matches all entries
+type AuditFilter struct {
+	//Email matches entries with the normalized email as actor or target
+	Email string
+	From  time.Time //inclusive
+	To    time.Time //exclusive
+	Limit int
+}
+
+//KeyFingerprint is the hex encoded sha256 hash of the PKIX encoded public key
+func KeyFingerprint(pkPKIX []byte) string {
+	h := sha256.Sum256(pkPKIX)
+	return hex.EncodeToString(h[:])
+}
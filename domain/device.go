@@ -0,0 +1,39 @@
+package domain
+
+import (
+	"crypto"
+	"fmt"
+	"time"
+)
+
+//Device is a client of a user with its own key pair. WrappedMasterKey is the users master key
+//wrapped for PublicKey
+type Device struct {
+	ID               string
+	OwnerEmail       string //normalized email of the owning user
+	Name             string
+	PublicKey        crypto.PublicKey
+	WrappedMasterKey []byte
+	CreatedAt        time.Time
+	LastSeenAt       time.Time
+	RevokedAt        *time.Time
+}
+
+//actions of SignedRequestDigest for device management
+const (
+	//ActionAddDevice is signed over the owner email, the device name, the public key and the wrapped master
+	//key of the new device
+	ActionAddDevice = "add-device"
+	//ActionRevokeDevice is signed over the owner email and the device id
+	ActionRevokeDevice = "revoke-device"
+)
+
+//IsRevoked returns true if the device must no longer be used
+func (d Device) IsRevoked() bool {
+	return d.RevokedAt != nil
+}
+
+func (d Device) String() string {
+	return fmt.Sprintf("Device{ID: %v, OwnerEmail: %v, Name: %v, CreatedAt: %v, LastSeenAt: %v, RevokedAt: %v}",
+		d.ID, d.OwnerEmail, d.Name, d.CreatedAt, d.LastSeenAt, d.RevokedAt)
+}
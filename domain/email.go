@@ -0,0 +1,56 @@
+package domain
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"strings"
+)
+
+const (
+	//MaxEmailLength is the maximal length of an address according to RFC 5321
+	MaxEmailLength      = 254
+	maxEmailLocalLength = 64
+)
+
+//idnaProfile converts the domain part of an email address to its ASCII form
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.Transitional(false))
+
+//NormalizeEmail returns the canonical form of email that is used as lookup key. The local part is
+//case folded and the domain is converted to lower case ASCII (punycode for IDNs)
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", fmt.Errorf("email must not be empty")
+	}
+	if len(email) > MaxEmailLength {
+		return "", fmt.Errorf("email must not be longer than %v bytes", MaxEmailLength)
+	}
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", fmt.Errorf("email must have the form local@domain")
+	}
+	local, domain := email[:at], email[at+1:]
+	if len(local) > maxEmailLocalLength {
+		return "", fmt.Errorf("local part of email must not be longer than %v bytes", maxEmailLocalLength)
+	}
+	if strings.ContainsAny(local, " \t\r\n\"<>(),;:@[]\\") {
+		return "", fmt.Errorf("local part of email contains invalid characters")
+	}
+	asciiDomain, err := idnaProfile.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid email domain : %v", err)
+	}
+	if !strings.Contains(asciiDomain, ".") {
+		return "", fmt.Errorf("email domain must be fully qualified")
+	}
+	normalized := strings.ToLower(local) + "@" + strings.ToLower(asciiDomain)
+	if len(normalized) > MaxEmailLength {
+		return "", fmt.Errorf("email must not be longer than %v bytes", MaxEmailLength)
+	}
+	return normalized, nil
+}
+
+//EmailDomain returns the domain part of the normalized email
+func EmailDomain(normalizedEmail string) string {
+	return normalizedEmail[strings.LastIndex(normalizedEmail, "@")+1:]
+}
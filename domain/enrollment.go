@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"crypto"
+	"time"
+)
+
+//EnrollmentState is the state of a device enrollment
+type EnrollmentState string
+
+const (
+	//EnrollmentStatePending enrollments wait for the approval of an existing device
+	EnrollmentStatePending EnrollmentState = "pending"
+	//EnrollmentStateApproved enrollments have been turned into a device
+	EnrollmentStateApproved EnrollmentState = "approved"
+)
+
+//Enrollment is the request of a new device to be added to the user with OwnerEmail. An existing
+//device approves it by uploading the master key wrapped for PublicKey
+type Enrollment struct {
+	ID         string
+	OwnerEmail string //normalized email of the owning user
+	DeviceName string
+	PublicKey  crypto.PublicKey
+	State      EnrollmentState
+	DeviceID   string //set once the enrollment has been approved
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+//Expired returns true if the enrollment can no longer be approved at now
+func (e Enrollment) Expired(now time.Time) bool {
+	return !now.Before(e.ExpiresAt)
+}
+
+//EnrollmentApprovalDigest is the digest an approving device signs. It binds the approval to the
+//enrollment, the key of the new device and the uploaded wrapped master key
+func EnrollmentApprovalDigest(enrollmentID string, devicePkPKIX, wrappedMasterKey []byte) []byte {
+	return signedDigest("approve-enrollment", []byte(enrollmentID), devicePkPKIX, wrappedMasterKey)
+}
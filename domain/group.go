@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+//Group is a team of users that is shared with as a whole. Groups created by members of an organization
+//belong to it and may only contain members of the same organization
+type Group struct {
+	ID             string
+	Name           string
+	OrganizationID string //empty for groups outside of an organization
+	OwnerEmail     string //normalized email of the user managing the group
+	//KeyEpoch is the current epoch of the group key. It starts at 1 and is incremented whenever a
+	//member is removed, as the removed member knows the old key
+	KeyEpoch  int64
+	CreatedAt time.Time
+}
+
+func (g Group) String() string {
+	return fmt.Sprintf("Group{ID: %v, Name: %v, OrganizationID: %v, OwnerEmail: %v, KeyEpoch: %v, CreatedAt: %v}",
+		g.ID, g.Name, g.OrganizationID, g.OwnerEmail, g.KeyEpoch, g.CreatedAt)
+}
+
+//GroupMember is the membership of the user with MemberEmail in GroupID
+type GroupMember struct {
+	GroupID     string
+	MemberEmail string //normalized email of the member
+	AddedAt     time.Time
+}
+
+//GroupKeyWrapping is the symmetric key of GroupID in Epoch wrapped for the public key of MemberEmail
+type GroupKeyWrapping struct {
+	GroupID              string
+	Epoch                int64
+	MemberEmail          string //normalized email of the member the key is wrapped for
+	MemberKeyFingerprint string //KeyFingerprint of the public key of the member the key is wrapped for
+	WrappedGroupKey      []byte
+	UploaderEmail        string
+	UploadedAt           time.Time
+}
+
+//IsWrappedFor returns false if the key was wrapped for another public key than the one with fingerprint,
+//e.g. before the member rotated the key. Wrappings stored without a fingerprint are accepted
+func (w *GroupKeyWrapping) IsWrappedFor(fingerprint string) bool {
+	return w.MemberKeyFingerprint == "" || w.MemberKeyFingerprint == fingerprint
+}
+
+//actions of SignedRequestDigest for group management
+const (
+	ActionCreateGroup       = "create-group"
+	ActionAddGroupMember    = "add-group-member"
+	ActionRemoveGroupMember = "remove-group-member"
+	//ActionUploadGroupKeys is signed over the group id, the epoch and the member emails each followed
+	//by the wrapped group key, in the order of the request
+	ActionUploadGroupKeys = "upload-group-keys"
+)
+
+//SignedRequestDigest is the digest a key of the acting user signs for the request action. fields are
+//the request parameters that must not be altered
+func SignedRequestDigest(action string, timestampUnix int64, fields ...string) []byte {
+	raw := [][]byte{unixField(timestampUnix)}
+	for _, v := range fields {
+		raw = append(raw, []byte(v))
+	}
+	return signedDigest(action, raw...)
+}
@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+//KeyLogKind describes the key change recorded by a KeyLogEntry. KeyLogRotateKey entries hold the new
+//primary key, which replaces the previous key of the user. KeyLogImportUser entries bind the primary key
+//of a user imported from an archive
+type KeyLogKind string
+
+const (
+	KeyLogCreateUser   KeyLogKind = "create-user"
+	KeyLogDeleteUser   KeyLogKind = "delete-user"
+	KeyLogRestoreUser  KeyLogKind = "restore-user"
+	KeyLogAddDevice    KeyLogKind = "add-device"
+	KeyLogRevokeDevice KeyLogKind = "revoke-device"
+	KeyLogRotateKey    KeyLogKind = "rotate-key"
+	KeyLogImportUser   KeyLogKind = "import-user"
+)
+
+//KeyLogEntry is a leaf of the append only key transparency log. Every change of the keys bound to an
+//email is recorded, so that clients can detect if the server hands out a key it did not publish
+type KeyLogEntry struct {
+	Index         int64 //position in the log, starting at 0
+	Kind          KeyLogKind
+	Email         string //normalized email of the user
+	PublicKeyPKIX []byte //the key that has been bound to or removed from the email
+	CreatedAt     time.Time
+}
+
+func (e KeyLogEntry) String() string {
+	return fmt.Sprintf("KeyLogEntry{Index: %v, Kind: %v, Email: %v, CreatedAt: %v}", e.Index, e.Kind, e.Email, e.CreatedAt)
+}
+
+//LeafHash is the hash of the entry in the Merkle tree of the log. The index is implied by the position
+//of the leaf
+func (e *KeyLogEntry) LeafHash() []byte {
+	data := signedDigest("key-log-entry", []byte(e.Kind), []byte(e.Email), e.PublicKeyPKIX, unixField(e.CreatedAt.Unix()))
+	return MerkleLeafHash(data)
+}
+
+//SignedTreeHead is the root of the key log with Size entries signed by the server
+type SignedTreeHead struct {
+	Size      int64
+	RootHash  []byte
+	Timestamp time.Time
+	Signature []byte
+}
+
+//TreeHeadDigest is the digest the server signs for a SignedTreeHead
+func TreeHeadDigest(size int64, rootHash []byte, timestampUnix int64) []byte {
+	return signedDigest("key-log-tree-head", unixField(size), rootHash, unixField(timestampUnix))
+}
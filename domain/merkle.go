@@ -0,0 +1,273 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+//The Merkle tree functions follow RFC 6962. Leaves and inner nodes are hashed with different prefixes,
+//so that a leaf can not be passed off as an inner node
+
+var ErrInvalidProof = errors.New("invalid merkle proof")
+
+//MerkleLeafHash returns the hash of the leaf with data
+func MerkleLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+//splitPoint returns the largest power of two smaller than n
+func splitPoint(n int64) int64 {
+	k := int64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+//MerkleRoot returns the root hash of the tree with leafHashes
+func MerkleRoot(leafHashes [][]byte) []byte {
+	switch n := int64(len(leafHashes)); n {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leafHashes[0]
+	default:
+		k := splitPoint(n)
+		return merkleNodeHash(MerkleRoot(leafHashes[:k]), MerkleRoot(leafHashes[k:]))
+	}
+}
+
+//MerkleInclusionProof returns the audit path of the leaf at index in the tree with leafHashes
+func MerkleInclusionProof(index int64, leafHashes [][]byte) ([][]byte, error) {
+	n := int64(len(leafHashes))
+	if index < 0 || index >= n {
+		return nil, fmt.Errorf("index %v out of range for tree of size %v", index, n)
+	}
+	return inclusionPath(index, leafHashes), nil
+}
+
+func inclusionPath(index int64, leafHashes [][]byte) [][]byte {
+	n := int64(len(leafHashes))
+	if n <= 1 {
+		return nil
+	}
+	k := splitPoint(n)
+	if index < k {
+		return append(inclusionPath(index, leafHashes[:k]), MerkleRoot(leafHashes[k:]))
+	}
+	return append(inclusionPath(index-k, leafHashes[k:]), MerkleRoot(leafHashes[:k]))
+}
+
+//MerkleConsistencyProof proves that the tree of size first is a prefix of the tree with leafHashes
+func MerkleConsistencyProof(first int64, leafHashes [][]byte) ([][]byte, error) {
+	n := int64(len(leafHashes))
+	if first <= 0 || first > n {
+		return nil, fmt.Errorf("size %v out of range for tree of size %v", first, n)
+	}
+	return consistencySubproof(first, leafHashes, true), nil
+}
+
+func consistencySubproof(m int64, leafHashes [][]byte, complete bool) [][]byte {
+	n := int64(len(leafHashes))
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{MerkleRoot(leafHashes)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(consistencySubproof(m, leafHashes[:k], complete), MerkleRoot(leafHashes[k:]))
+	}
+	return append(consistencySubproof(m-k, leafHashes[k:], false), MerkleRoot(leafHashes[:k]))
+}
+
+//VerifyMerkleInclusion checks that leafHash is at index in the tree of size with root
+func VerifyMerkleInclusion(index, size int64, leafHash []byte, proof [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return ErrInvalidProof
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+//VerifyMerkleConsistency checks that the tree of size first with firstRoot is a prefix of the tree of
+//size second with secondRoot
+func VerifyMerkleConsistency(first, second int64, firstRoot, secondRoot []byte, proof [][]byte) error {
+	if first <= 0 || first > second {
+		return ErrInvalidProof
+	}
+	if first == second {
+		if len(proof) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return ErrInvalidProof
+		}
+		return nil
+	}
+	//the proof omits the root of the first tree if it is a complete subtree of the second one
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return ErrInvalidProof
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+//MerkleTree is an append only tree that caches the hashes of its complete subtrees. These never change
+//once all their leaves are appended, so roots and proofs only hash along the right edge of the tree
+type MerkleTree struct {
+	//levels[l][i] is the hash of the complete subtree of the leaves i<<l up to (i+1)<<l
+	levels [][][]byte
+}
+
+//Append adds leafHash as the last leaf
+func (t *MerkleTree) Append(leafHash []byte) {
+	if len(t.levels) == 0 {
+		t.levels = append(t.levels, nil)
+	}
+	t.levels[0] = append(t.levels[0], leafHash)
+	for l := 0; len(t.levels[l])%2 == 0; l++ {
+		if l+1 == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		n := len(t.levels[l])
+		t.levels[l+1] = append(t.levels[l+1], merkleNodeHash(t.levels[l][n-2], t.levels[l][n-1]))
+	}
+}
+
+//Size returns the number of leaves
+func (t *MerkleTree) Size() int64 {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return int64(len(t.levels[0]))
+}
+
+//subtreeHash returns the hash of the n leaves starting at start, which have to be appended already
+func (t *MerkleTree) subtreeHash(start, n int64) []byte {
+	if n == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	//complete subtrees are aligned to their size
+	if n&(n-1) == 0 && start%n == 0 {
+		l := 0
+		for int64(1)<<l < n {
+			l++
+		}
+		return t.levels[l][start>>l]
+	}
+	k := splitPoint(n)
+	return merkleNodeHash(t.subtreeHash(start, k), t.subtreeHash(start+k, n-k))
+}
+
+//Root returns the root hash of the tree of the first size leaves, like MerkleRoot
+func (t *MerkleTree) Root(size int64) ([]byte, error) {
+	if size < 0 || size > t.Size() {
+		return nil, fmt.Errorf("size %v out of range for tree of size %v", size, t.Size())
+	}
+	return t.subtreeHash(0, size), nil
+}
+
+//InclusionProof returns the audit path of the leaf at index in the tree of the first size leaves, like
+//MerkleInclusionProof
+func (t *MerkleTree) InclusionProof(index, size int64) ([][]byte, error) {
+	if size > t.Size() || index < 0 || index >= size {
+		return nil, fmt.Errorf("index %v out of range for tree of size %v", index, size)
+	}
+	return t.inclusionPath(index, 0, size), nil
+}
+
+func (t *MerkleTree) inclusionPath(index, start, n int64) [][]byte {
+	if n <= 1 {
+		return nil
+	}
+	k := splitPoint(n)
+	if index < k {
+		return append(t.inclusionPath(index, start, k), t.subtreeHash(start+k, n-k))
+	}
+	return append(t.inclusionPath(index-k, start+k, n-k), t.subtreeHash(start, k))
+}
+
+//ConsistencyProof proves that the tree of size first is a prefix of the tree of size second, like
+//MerkleConsistencyProof
+func (t *MerkleTree) ConsistencyProof(first, second int64) ([][]byte, error) {
+	if second > t.Size() || first <= 0 || first > second {
+		return nil, fmt.Errorf("size %v out of range for tree of size %v", first, second)
+	}
+	return t.consistencySubproof(first, 0, second, true), nil
+}
+
+func (t *MerkleTree) consistencySubproof(m, start, n int64, complete bool) [][]byte {
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{t.subtreeHash(start, n)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(t.consistencySubproof(m, start, k, complete), t.subtreeHash(start+k, n-k))
+	}
+	return append(t.consistencySubproof(m-k, start+k, n-k, false), t.subtreeHash(start, k))
+}
@@ -0,0 +1,45 @@
+package domain
+
+import (
+	"crypto"
+	"fmt"
+	"time"
+)
+
+//Organization owns all users with an email in EmailDomain. Members have to escrow their master key
+//for EscrowPublicKey, so that admins can recover their files
+type Organization struct {
+	ID              string
+	Name            string
+	EmailDomain     string //normalized domain part of member emails
+	EscrowPublicKey crypto.PublicKey
+	CreatedAt       time.Time
+}
+
+func (o Organization) String() string {
+	return fmt.Sprintf("Organization{ID: %v, Name: %v, EmailDomain: %v, CreatedAt: %v}",
+		o.ID, o.Name, o.EmailDomain, o.CreatedAt)
+}
+
+//EscrowWrapping is the master key of a member wrapped for the escrow key of its organization. It is
+//kept apart from the user and only handed out to holders of the escrow key
+type EscrowWrapping struct {
+	OwnerEmail       string //normalized email of the member
+	OrganizationID   string
+	EscrowPublicKey  crypto.PublicKey //escrow key at the time of wrapping
+	WrappedMasterKey []byte
+	UpdatedAt        time.Time
+}
+
+//UserUpdateDigest is the digest a key of the user signs to update its wrapped keys. updatedAtUnix is
+//the update time of the version being replaced, which prevents replaying old updates
+func UserUpdateDigest(normalizedEmail string, updatedAtUnix int64, wrappedPrivateKey, wrappedMasterKey, escrowWrappedMasterKey []byte) []byte {
+	return signedDigest("update-user", []byte(normalizedEmail), unixField(updatedAtUnix),
+		wrappedPrivateKey, wrappedMasterKey, escrowWrappedMasterKey)
+}
+
+//EscrowAccessDigest is the digest the escrow key of organizationID signs to fetch the escrow wrapping
+//of normalizedEmail
+func EscrowAccessDigest(organizationID, normalizedEmail string, timestampUnix int64) []byte {
+	return signedDigest("escrow-access", []byte(organizationID), []byte(normalizedEmail), unixField(timestampUnix))
+}
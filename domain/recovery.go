@@ -0,0 +1,53 @@
+package domain
+
+import (
+	"crypto"
+	"fmt"
+	"time"
+)
+
+//RecoveryKind describes the secret a RecoveryWrapping has been created for
+type RecoveryKind string
+
+const (
+	//RecoveryKindCode wrappings are encrypted under a key derived from a printed recovery code
+	RecoveryKindCode RecoveryKind = "recovery-code"
+	//RecoveryKindEscrow wrappings are encrypted for the escrow public key of an organization
+	RecoveryKindEscrow RecoveryKind = "escrow"
+)
+
+//actions of SignedRequestDigest for recovery wrappings
+const (
+	//ActionAddRecoveryWrapping is signed over the owner email, the kind, the label, the escrow public key
+	//and the wrapped master key of the new wrapping
+	ActionAddRecoveryWrapping = "add-recovery-wrapping"
+	//ActionDeleteRecoveryWrapping is signed over the owner email and the wrapping id
+	ActionDeleteRecoveryWrapping = "delete-recovery-wrapping"
+)
+
+//RecoveryWrapping is an additional wrapping of the users master key that allows to regain access
+//once all devices are lost
+type RecoveryWrapping struct {
+	ID         string
+	OwnerEmail string //normalized email of the owning user
+	Kind       RecoveryKind
+	Label      string
+	//EscrowPublicKey is the key WrappedMasterKey has been wrapped for. Only set for RecoveryKindEscrow
+	EscrowPublicKey  crypto.PublicKey
+	WrappedMasterKey []byte
+	CreatedAt        time.Time
+}
+
+func (w RecoveryWrapping) String() string {
+	return fmt.Sprintf("RecoveryWrapping{ID: %v, OwnerEmail: %v, Kind: %v, Label: %v, CreatedAt: %v}",
+		w.ID, w.OwnerEmail, w.Kind, w.Label, w.CreatedAt)
+}
+
+//RecoveryAudit records that WrappingID has been handed out during an account recovery
+type RecoveryAudit struct {
+	ID          string
+	OwnerEmail  string
+	WrappingID  string
+	Kind        RecoveryKind
+	RecoveredAt time.Time
+}
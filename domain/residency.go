@@ -0,0 +1,18 @@
+package domain
+
+import "time"
+
+//UserResidency records the region whose backend stores the data of a user
+type UserResidency struct {
+	//Email is the normalized email of the user
+	Email  string
+	Region string
+	//MovingTo is set while the user is moved to another region, writes to the user are rejected meanwhile
+	MovingTo  string
+	UpdatedAt time.Time
+}
+
+//IsMoving returns true while the user is moved to another region
+func (r UserResidency) IsMoving() bool {
+	return r.MovingTo != ""
+}
@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+//VerifySignature checks a signature by pk over the sha256 digest. ecdsa signatures are ASN.1 encoded,
+//rsa signatures use PSS. ed25519 signs the digest itself
+func VerifySignature(pk crypto.PublicKey, digest, signature []byte) error {
+	switch k := pk.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, signature) {
+			return ErrInvalidSignature
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPSS(k, crypto.SHA256, digest, signature, nil); err != nil {
+			return ErrInvalidSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, signature) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", pk)
+	}
+	return nil
+}
+
+//signedDigest hashes label and fields with length prefixes, so that no two different inputs share a digest
+func signedDigest(label string, fields ...[]byte) []byte {
+	h := sha256.New()
+	for _, v := range append([][]byte{[]byte(label)}, fields...) {
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(len(v)))
+		h.Write(l[:])
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+//unixField encodes t as signedDigest field
+func unixField(t int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t))
+	return b[:]
+}
+
+//Sign creates a signature over digest that VerifySignature accepts for the public key of signer
+func Sign(signer crypto.Signer, digest []byte) ([]byte, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}
+	case ed25519.PublicKey:
+		opts = crypto.Hash(0)
+	}
+	return signer.Sign(rand.Reader, digest, opts)
+}
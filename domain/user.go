@@ -3,20 +3,68 @@ package domain
 import (
 	"crypto"
 	"fmt"
+	"strings"
 	"time"
 )
 
+//UserState is the lifecycle state of a user account
+type UserState string
+
+const (
+	//UserStatePending accounts have been created but the email address is not yet verified
+	UserStatePending UserState = "pending"
+	//UserStateActive accounts have a verified email address and are visible in the directory
+	UserStateActive UserState = "active"
+)
+
 type User struct {
 	Email             string
 	CreatedAt         time.Time
 	UpdatedAt         time.Time
 	Name              string
+	State             UserState
+	DeletedAt         *time.Time //set for deleted users that can still be restored
 	PublicKey         crypto.PublicKey
 	WrappedPrivateKey []byte
 	WrappedMasterKey  []byte
+	Region            string //region storing the user if data residency is configured, not stored by the backends
+}
+
+//IsActive returns true if the email of the user has been verified
+func (u User) IsActive() bool {
+	return u.State == UserStateActive
+}
+
+//IsDeleted returns true if the user has been deleted but not yet purged
+func (u User) IsDeleted() bool {
+	return u.DeletedAt != nil
 }
 
 func (u User) String() string {
-	return fmt.Sprintf("User{CreatedAt %v, Email: %v, Name: %v, PublicKey: %v, WrappedPrivateKey: %v, WrappedMasterKey: %v}",
-		u.CreatedAt, u.Email, u.Name, u.PublicKey, u.WrappedMasterKey, u.WrappedMasterKey)
+	return fmt.Sprintf("User{CreatedAt %v, Email: %v, Name: %v, State: %v, PublicKey: %v, WrappedPrivateKey: %v, WrappedMasterKey: %v}",
+		u.CreatedAt, u.Email, u.Name, u.State, u.PublicKey, u.WrappedMasterKey, u.WrappedMasterKey)
+}
+
+//UserFilter selects users for the admin tooling. The zero value of a field matches all users
+type UserFilter struct {
+	//Query matches users whose normalized email or name contains it, ignoring case
+	Query string
+	State UserState
+	//IncludeDeleted also matches deleted users that have not been purged yet
+	IncludeDeleted bool
+	//After only matches users with a larger normalized email, for paging
+	After string
+	Limit int
+}
+
+//Matches returns true if u with the normalized email matches all fields of f except After and Limit
+func (f UserFilter) Matches(normalizedEmail string, u *User) bool {
+	if f.State != "" && u.State != f.State {
+		return false
+	}
+	if !f.IncludeDeleted && u.IsDeleted() {
+		return false
+	}
+	query := strings.ToLower(f.Query)
+	return query == "" || strings.Contains(normalizedEmail, query) || strings.Contains(strings.ToLower(u.Name), query)
 }
@@ -0,0 +1,220 @@
+package domain
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+const (
+	//UserArchiveFormat identifies user archives in their header
+	UserArchiveFormat = "UserService/users"
+	//UserArchiveVersion is the version of the archive layout written by UserArchiveWriter
+	UserArchiveVersion = 1
+	//maxUserArchiveLine bounds a single line of an archive, users are far smaller
+	maxUserArchiveLine = 1 << 20
+)
+
+//ImportConflictPolicy decides how an import treats users that already exist in the target
+type ImportConflictPolicy string
+
+const (
+	//ImportConflictSkip keeps the existing user
+	ImportConflictSkip ImportConflictPolicy = "skip"
+	//ImportConflictOverwrite replaces the existing user with the same email
+	ImportConflictOverwrite ImportConflictPolicy = "overwrite"
+	//ImportConflictFail aborts the import at the first conflict
+	ImportConflictFail ImportConflictPolicy = "fail"
+)
+
+//UserImportReport summarizes an import of a user archive
+type UserImportReport struct {
+	Imported    int
+	Overwritten int
+	Skipped     int
+}
+
+//A user archive is a JSON lines file. The first line is a header, followed by one line per user and a
+//trailer with the number of users and the SHA256 of all preceding bytes, so truncated or modified
+//archives are detected
+type userArchiveHeader struct {
+	Format    string
+	Version   int
+	CreatedAt time.Time
+}
+
+type userArchiveRecord struct {
+	Email             string
+	Name              string
+	State             UserState
+	PublicKeyPKIX     []byte
+	WrappedPrivateKey []byte
+	WrappedMasterKey  []byte
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	DeletedAt         *time.Time `json:",omitempty"`
+}
+
+type userArchiveTrailer struct {
+	Count  int
+	SHA256 string
+}
+
+//userArchiveLine holds exactly one of its fields
+type userArchiveLine struct {
+	Header  *userArchiveHeader  `json:",omitempty"`
+	User    *userArchiveRecord  `json:",omitempty"`
+	Trailer *userArchiveTrailer `json:",omitempty"`
+}
+
+//UserArchiveWriter writes a user archive. The archive is only complete once Close has been called
+type UserArchiveWriter struct {
+	w     io.Writer
+	sum   hash.Hash
+	count int
+}
+
+//NewUserArchiveWriter writes the archive header to w
+func NewUserArchiveWriter(w io.Writer) (*UserArchiveWriter, error) {
+	aw := &UserArchiveWriter{w: w, sum: sha256.New()}
+	header := &userArchiveHeader{Format: UserArchiveFormat, Version: UserArchiveVersion, CreatedAt: time.Now().UTC()}
+	if err := aw.writeLine(&userArchiveLine{Header: header}); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (aw *UserArchiveWriter) writeLine(line *userArchiveLine) error {
+	raw, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("failed to serialize archive line : %v", err)
+	}
+	raw = append(raw, '\n')
+	if _, err := aw.w.Write(raw); err != nil {
+		return fmt.Errorf("failed to write archive : %v", err)
+	}
+	aw.sum.Write(raw)
+	return nil
+}
+
+//Write appends u including its wrapped keys and timestamps
+func (aw *UserArchiveWriter) Write(u *User) error {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal public key of %v : %v", u.Email, err)
+	}
+	err = aw.writeLine(&userArchiveLine{User: &userArchiveRecord{
+		Email:             u.Email,
+		Name:              u.Name,
+		State:             u.State,
+		PublicKeyPKIX:     pkPKIX,
+		WrappedPrivateKey: u.WrappedPrivateKey,
+		WrappedMasterKey:  u.WrappedMasterKey,
+		CreatedAt:         u.CreatedAt,
+		UpdatedAt:         u.UpdatedAt,
+		DeletedAt:         u.DeletedAt,
+	}})
+	if err != nil {
+		return err
+	}
+	aw.count++
+	return nil
+}
+
+//Count returns the number of users written so far
+func (aw *UserArchiveWriter) Count() int {
+	return aw.count
+}
+
+//Close writes the trailer. It does not close the underlying writer
+func (aw *UserArchiveWriter) Close() error {
+	return aw.writeLine(&userArchiveLine{Trailer: &userArchiveTrailer{
+		Count:  aw.count,
+		SHA256: hex.EncodeToString(aw.sum.Sum(nil)),
+	}})
+}
+
+//ReadUserArchive reads all users of an archive written by UserArchiveWriter. It fails if the archive is
+//truncated, its checksum does not match or a user is malformed, so no user is returned in that case
+func ReadUserArchive(r io.Reader) ([]*User, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxUserArchiveLine)
+	sum := sha256.New()
+	var users []*User
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		raw := scanner.Bytes()
+		line := &userArchiveLine{}
+		if err := json.Unmarshal(raw, line); err != nil {
+			return nil, fmt.Errorf("malformed archive line %v : %v", lineNo, err)
+		}
+		switch {
+		case lineNo == 1:
+			if line.Header == nil || line.Header.Format != UserArchiveFormat {
+				return nil, fmt.Errorf("not a user archive")
+			}
+			if line.Header.Version != UserArchiveVersion {
+				return nil, fmt.Errorf("unsupported archive version %v", line.Header.Version)
+			}
+		case line.User != nil:
+			u, err := line.User.toUser()
+			if err != nil {
+				return nil, fmt.Errorf("invalid user in archive line %v : %v", lineNo, err)
+			}
+			users = append(users, u)
+		case line.Trailer != nil:
+			if line.Trailer.Count != len(users) {
+				return nil, fmt.Errorf("archive trailer announces %v users but contains %v", line.Trailer.Count, len(users))
+			}
+			if line.Trailer.SHA256 != hex.EncodeToString(sum.Sum(nil)) {
+				return nil, fmt.Errorf("archive checksum mismatch")
+			}
+			if scanner.Scan() {
+				return nil, fmt.Errorf("unexpected data after archive trailer")
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("failed to read archive : %v", err)
+			}
+			return users, nil
+		default:
+			return nil, fmt.Errorf("unexpected archive line %v", lineNo)
+		}
+		sum.Write(raw)
+		sum.Write([]byte{'\n'})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read archive : %v", err)
+	}
+	return nil, fmt.Errorf("archive is truncated")
+}
+
+func (r *userArchiveRecord) toUser() (*User, error) {
+	if _, err := NormalizeEmail(r.Email); err != nil {
+		return nil, err
+	}
+	if r.State != UserStatePending && r.State != UserStateActive {
+		return nil, fmt.Errorf("unknown state %q of %v", r.State, r.Email)
+	}
+	pk, err := x509.ParsePKIXPublicKey(r.PublicKeyPKIX)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of %v : %v", r.Email, err)
+	}
+	return &User{
+		Email:             r.Email,
+		CreatedAt:         r.CreatedAt,
+		UpdatedAt:         r.UpdatedAt,
+		Name:              r.Name,
+		State:             r.State,
+		DeletedAt:         r.DeletedAt,
+		PublicKey:         pk,
+		WrappedPrivateKey: r.WrappedPrivateKey,
+		WrappedMasterKey:  r.WrappedMasterKey,
+	}, nil
+}
@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+//UserEventKind describes the change announced by a UserEvent
+type UserEventKind string
+
+const (
+	UserEventCreated       UserEventKind = "user-created"
+	UserEventUpdated       UserEventKind = "user-updated"
+	UserEventDeleted       UserEventKind = "user-deleted"
+	UserEventRestored      UserEventKind = "user-restored"
+	UserEventPurged        UserEventKind = "user-purged"
+	UserEventDeviceAdded   UserEventKind = "device-added"
+	UserEventDeviceRevoked UserEventKind = "device-revoked"
+	UserEventKeyRotated    UserEventKind = "key-rotated"
+	UserEventImported      UserEventKind = "user-imported"
+)
+
+//UserEventKinds lists all kinds of user events
+var UserEventKinds = []UserEventKind{
+	UserEventCreated,
+	UserEventUpdated,
+	UserEventDeleted,
+	UserEventRestored,
+	UserEventPurged,
+	UserEventDeviceAdded,
+	UserEventDeviceRevoked,
+	UserEventKeyRotated,
+	UserEventImported,
+}
+
+//UserEvent announces a change of a user to downstream services. Events are written to an outbox in the
+//same transaction as the change
+type UserEvent struct {
+	//Sequence orders all events without gaps, starting at 1. Subscribers resume after the last
+	//sequence they have processed
+	Sequence      int64
+	Kind          UserEventKind
+	Email         string    //normalized email of the user
+	PublicKeyPKIX []byte    //primary key of the user, or the key of the device for device events
+	State         UserState //state of the user after the change, empty for device events
+	CreatedAt     time.Time
+}
+
+func (e UserEvent) String() string {
+	return fmt.Sprintf("UserEvent{Sequence: %v, Kind: %v, Email: %v, State: %v, CreatedAt: %v}",
+		e.Sequence, e.Kind, e.Email, e.State, e.CreatedAt)
+}
@@ -0,0 +1,37 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"time"
+)
+
+//VerificationPurpose describes what a VerificationToken may be used for
+type VerificationPurpose string
+
+const (
+	//VerificationPurposeEmail tokens confirm the email address of a pending user
+	VerificationPurposeEmail VerificationPurpose = "verify-email"
+	//VerificationPurposeRecovery tokens prove control of the email during an account recovery
+	VerificationPurposeRecovery VerificationPurpose = "recover-account"
+)
+
+//VerificationToken is a single use secret that has been mailed to Email. Only the hash of the token is stored
+type VerificationToken struct {
+	TokenHash []byte
+	//Email is the normalized email the token has been sent to
+	Email     string
+	Purpose   VerificationPurpose
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+//Expired returns true if the token is no longer valid at now
+func (t VerificationToken) Expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+//HashToken returns the value stored as VerificationToken.TokenHash for the secret token
+func HashToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
@@ -0,0 +1,75 @@
+package domain
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+//Webhook is an http endpoint registered by an admin that receives user events as JSON posts
+type Webhook struct {
+	ID  string
+	URL string
+	//Secret is the HMAC key of the delivery signatures, see WebhookSignature
+	Secret []byte
+	//EventKinds limits the delivered events, an empty list subscribes to all kinds
+	EventKinds []UserEventKind
+	CreatedAt  time.Time
+}
+
+func (w Webhook) String() string {
+	return fmt.Sprintf("Webhook{ID: %v, URL: %v, EventKinds: %v, CreatedAt: %v}", w.ID, w.URL, w.EventKinds, w.CreatedAt)
+}
+
+//Subscribes returns true if events of kind are delivered to the webhook
+func (w Webhook) Subscribes(kind UserEventKind) bool {
+	if len(w.EventKinds) == 0 {
+		return true
+	}
+	for _, v := range w.EventKinds {
+		if v == kind {
+			return true
+		}
+	}
+	return false
+}
+
+//WebhookDeliveryState is the state of a WebhookDelivery. Successful deliveries are removed
+type WebhookDeliveryState string
+
+const (
+	//WebhookDeliveryPending deliveries are attempted once NextAttemptAt has passed
+	WebhookDeliveryPending WebhookDeliveryState = "pending"
+	//WebhookDeliveryDead deliveries have exhausted their attempts and are kept in the dead letter list
+	WebhookDeliveryDead WebhookDeliveryState = "dead"
+)
+
+//WebhookDelivery is the delivery of a single user event to a webhook
+type WebhookDelivery struct {
+	WebhookID     string
+	EventSequence int64
+	EventKind     UserEventKind
+	//Payload is the JSON body posted to the webhook
+	Payload       []byte
+	State         WebhookDeliveryState
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+}
+
+func (d WebhookDelivery) String() string {
+	return fmt.Sprintf("WebhookDelivery{WebhookID: %v, EventSequence: %v, EventKind: %v, State: %v, Attempts: %v, NextAttemptAt: %v, LastError: %v}",
+		d.WebhookID, d.EventSequence, d.EventKind, d.State, d.Attempts, d.NextAttemptAt, d.LastError)
+}
+
+//WebhookSignature is the hex encoded HMAC-SHA256 of the timestamp and the payload of a delivery. Receivers
+//should reject old timestamps to prevent replays
+func WebhookSignature(secret []byte, timestampUnix int64, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "%d.", timestampUnix)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
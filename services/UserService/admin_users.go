@@ -0,0 +1,196 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultListUsersLimit = 100
+	maxListUsersLimit     = 1000
+)
+
+var errUserAdminNotConfigured = status.Error(codes.FailedPrecondition, "user administration is not configured")
+
+//authorizeUserAdmin checks that user administration is configured and the caller is an admin
+func (us *UserService) authorizeUserAdmin(ctx context.Context) error {
+	if us.userAdminRepo == nil {
+		return errUserAdminNotConfigured
+	}
+	return us.authorizeAdmin(ctx)
+}
+
+func userToSummaryDTOGRPC(u *domain.User) (*UserServiceSchema.UserSummary, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .PublicKey field : %v", err)
+	}
+	summary := &UserServiceSchema.UserSummary{
+		Email:          u.Email,
+		Name:           u.Name,
+		State:          string(u.State),
+		PublicKey:      pkPKIX,
+		KeyFingerprint: domain.KeyFingerprint(pkPKIX),
+		CreatedAtUnix:  u.CreatedAt.Unix(),
+		UpdatedAtUnix:  u.UpdatedAt.Unix(),
+		Region:         u.Region,
+	}
+	if u.DeletedAt != nil {
+		summary.DeletedAtUnix = u.DeletedAt.Unix()
+	}
+	return summary, nil
+}
+
+//GetUserSummary returns the user with the email including its state, also if it has been deleted
+func (us *UserService) GetUserSummary(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.UserSummary, error) {
+	if err := us.authorizeUserAdmin(ctx); err != nil {
+		return nil, err
+	}
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	users, err := us.userAdminRepo.ListUsers(ctx, domain.UserFilter{Query: email, IncludeDeleted: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user :%v", err)
+	}
+	for _, u := range users {
+		if normalized, err := domain.NormalizeEmail(u.Email); err == nil && normalized == email {
+			return userToSummaryDTOGRPC(u)
+		}
+	}
+	return nil, errUserNotFound
+}
+
+//ListUsers pages through the users matching the request ordered by normalized email. The returned
+//NextPageToken is empty on the last page
+func (us *UserService) ListUsers(ctx context.Context, req *UserServiceSchema.UserRequestList) (*UserServiceSchema.UserSummaryList, error) {
+	if err := us.authorizeUserAdmin(ctx); err != nil {
+		return nil, err
+	}
+	filter := domain.UserFilter{
+		Query:          req.Query,
+		State:          domain.UserState(req.State),
+		IncludeDeleted: req.IncludeDeleted,
+		Limit:          defaultListUsersLimit,
+	}
+	var v violations
+	if filter.State != "" && filter.State != domain.UserStatePending && filter.State != domain.UserStateActive {
+		v.add("state", fmt.Errorf("must be empty, %v or %v", domain.UserStatePending, domain.UserStateActive))
+	}
+	if req.PageToken != "" {
+		after, err := base64.RawURLEncoding.DecodeString(req.PageToken)
+		if err != nil {
+			v.add("page_token", fmt.Errorf("malformed page token"))
+		}
+		filter.After = string(after)
+	}
+	if req.Limit < 0 || req.Limit > maxListUsersLimit {
+		v.add("limit", fmt.Errorf("must be between 0 and %v", maxListUsersLimit))
+	} else if req.Limit > 0 {
+		filter.Limit = int(req.Limit)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	//fetch one more user to learn whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	users, err := us.userAdminRepo.ListUsers(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users :%v", err)
+	}
+	list := &UserServiceSchema.UserSummaryList{}
+	if len(users) > limit {
+		users = users[:limit]
+		last, err := domain.NormalizeEmail(users[limit-1].Email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to normalize email :%v", err)
+		}
+		list.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	for _, u := range users {
+		summary, err := userToSummaryDTOGRPC(u)
+		if err != nil {
+			return nil, err
+		}
+		list.Users = append(list.Users, summary)
+	}
+	return list, nil
+}
+
+//RotateUserKey replaces the primary key of a user together with the wrapped keys, e.g. after the
+//user lost its private key. The new key is recorded in the key log
+func (us *UserService) RotateUserKey(ctx context.Context, req *UserServiceSchema.UserRequestRotateKey) (*UserServiceSchema.User, error) {
+	if err := us.authorizeUserAdmin(ctx); err != nil {
+		return nil, err
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	pk, err := parsePublicKey(req.PublicKey)
+	if err != nil {
+		v.add("public_key", err)
+	}
+	if err := validateBlob(req.WrappedPrivateKey, maxWrappedPrivateKeyLength); err != nil {
+		v.add("wrapped_private_key", err)
+	}
+	if err := validateBlob(req.WrappedMasterKey, maxWrappedMasterKeyLength); err != nil {
+		v.add("wrapped_master_key", err)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	domainUser, err := us.userAdminRepo.RotateUserKey(ctx, &domain.User{
+		Email:             email,
+		PublicKey:         pk,
+		WrappedPrivateKey: req.WrappedPrivateKey,
+		WrappedMasterKey:  req.WrappedMasterKey,
+	})
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errUserNotFound
+		}
+		if errors.Is(err, userRepository.ErrAlreadyExists) {
+			return nil, status.Error(codes.AlreadyExists, "key is already in use")
+		}
+		return nil, fmt.Errorf("failed to rotate key :%v", err)
+	}
+	us.syncKeyLog(ctx)
+	grpcUser, err := userToDTOGRPC(domainUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user :%v", err)
+	}
+	return grpcUser, nil
+}
+
+//GetUserCacheStats returns the counters of the user cache for tuning its size and TTLs
+func (us *UserService) GetUserCacheStats(ctx context.Context, _ *UserServiceSchema.Empty) (*UserServiceSchema.UserCacheStats, error) {
+	if us.userCache == nil {
+		return nil, status.Error(codes.FailedPrecondition, "user cache is not configured")
+	}
+	if err := us.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+	stats := us.userCache.Stats()
+	return &UserServiceSchema.UserCacheStats{
+		Hits:         stats.Hits,
+		NegativeHits: stats.NegativeHits,
+		Misses:       stats.Misses,
+		Collapsed:    stats.Collapsed,
+		Evictions:    stats.Evictions,
+		Size:         int64(stats.Size),
+	}, nil
+}
@@ -0,0 +1,58 @@
+package UserService
+
+import (
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+//attestBinding signs with the newest signing key that the normalized email is bound to pkPKIX. Clients
+//can cache the attestation and present it to peers
+func (us *UserService) attestBinding(email string, pkPKIX []byte) (*UserServiceSchema.KeyAttestation, error) {
+	key := us.signingKeys[len(us.signingKeys)-1]
+	attestation := &UserServiceSchema.KeyAttestation{
+		Email:         email,
+		PublicKey:     pkPKIX,
+		TimestampUnix: time.Now().Unix(),
+		KeyVersion:    key.Version,
+	}
+	digest := domain.BindingAttestationDigest(email, pkPKIX, attestation.TimestampUnix, key.Version)
+	sig, err := domain.Sign(key.Signer, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign attestation : %v", err)
+	}
+	attestation.Signature = sig
+	return attestation, nil
+}
+
+//GetServiceSigningKeys returns the public keys of all configured signing keys, including the ones that
+//have been rotated out, as well as the key signing the tree heads of the key log
+func (us *UserService) GetServiceSigningKeys(ctx context.Context, _ *UserServiceSchema.Empty) (*UserServiceSchema.ServiceSigningKeys, error) {
+	if len(us.signingKeys) == 0 && us.keyLog == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no service signing keys are configured")
+	}
+	keys := &UserServiceSchema.ServiceSigningKeys{}
+	for _, v := range us.signingKeys {
+		pkPKIX, err := x509.MarshalPKIXPublicKey(v.Signer.Public())
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal signing key %v : %v", v.Version, err)
+		}
+		keys.Keys = append(keys.Keys, &UserServiceSchema.ServiceSigningKey{
+			Version:   v.Version,
+			PublicKey: pkPKIX,
+		})
+	}
+	if us.keyLog != nil {
+		pkPKIX, err := x509.MarshalPKIXPublicKey(us.keyLog.signer.Public())
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal key log signing key : %v", err)
+		}
+		keys.KeyLogPublicKey = pkPKIX
+	}
+	return keys, nil
+}
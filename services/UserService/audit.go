@@ -0,0 +1,247 @@
+package UserService
+
+import (
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+	//maxAuditQueryRange bounds the time range of queries that are not filtered by user
+	maxAuditQueryRange = 31 * 24 * time.Hour
+)
+
+//readOnlyPrefixes are the name prefixes of RPCs that do not change any state. All other RPCs are
+//audited, so that new RPCs are audited by default
+var readOnlyPrefixes = []string{"Get", "List", "Query", "Watch"}
+
+//unauditedOperations are RPCs between replicas that only drop cached state
+var unauditedOperations = map[string]bool{"InvalidateUserCache": true}
+
+func isReadOnly(operation string) bool {
+	if unauditedOperations[operation] {
+		return true
+	}
+	for _, v := range readOnlyPrefixes {
+		if strings.HasPrefix(operation, v) {
+			return true
+		}
+	}
+	return false
+}
+
+//requestActor extracts the acting email and the fingerprint of the signing key named in req
+func requestActor(req interface{}) (actorEmail, actorKey string) {
+	switch r := req.(type) {
+	case interface{ GetActorEmail() string }:
+		actorEmail = r.GetActorEmail()
+	case interface{ GetOwnerEmail() string }:
+		actorEmail = r.GetOwnerEmail()
+	}
+	var signerPk []byte
+	switch r := req.(type) {
+	case interface {
+		GetSignature() *UserServiceSchema.RequestSignature
+	}:
+		signerPk = r.GetSignature().GetSignerPublicKey()
+	case interface{ GetSignerPublicKey() []byte }:
+		signerPk = r.GetSignerPublicKey()
+	case interface{ GetApproverPublicKey() []byte }:
+		signerPk = r.GetApproverPublicKey()
+	}
+	if normalized, err := domain.NormalizeEmail(actorEmail); err == nil {
+		actorEmail = normalized
+	}
+	if len(signerPk) > 0 {
+		actorKey = domain.KeyFingerprint(signerPk)
+	}
+	return actorEmail, actorKey
+}
+
+//primaryKeyFingerprint returns the fingerprint of the primary key of the user with the normalized
+//email or an empty string if there is no such user
+func (us *UserService) primaryKeyFingerprint(ctx context.Context, email string) string {
+	if email == "" {
+		return ""
+	}
+	u, err := us.userRepo.GetByEmail(ctx, email)
+	if err != nil {
+		return ""
+	}
+	pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return domain.KeyFingerprint(pkPKIX)
+}
+
+//AuditInterceptor is a grpc.UnaryServerInterceptor recording all calls of mutating RPCs in the audit
+//log, no matter if they succeed
+func (us *UserService) AuditInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	operation := path.Base(info.FullMethod)
+	if us.auditRepo == nil || isReadOnly(operation) {
+		return handler(ctx, req)
+	}
+	entry := &domain.AuditEntry{
+		Time:      time.Now(),
+		Operation: operation,
+	}
+	entry.ActorEmail, entry.ActorKey = requestActor(req)
+	if r, ok := req.(interface{ GetEmail() string }); ok {
+		if email, err := domain.NormalizeEmail(r.GetEmail()); err == nil {
+			entry.TargetEmail = email
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.PeerAddress = p.Addr.String()
+	}
+	entry.KeyBefore = us.primaryKeyFingerprint(ctx, entry.TargetEmail)
+
+	resp, err := handler(ctx, req)
+
+	entry.Result = status.Code(err).String()
+	//signed requests without an acting email are signed by a key of the target, which the handler
+	//verified if the call succeeded
+	if entry.ActorEmail == "" && entry.ActorKey != "" && err == nil {
+		entry.ActorEmail = entry.TargetEmail
+	}
+	//the entry is written even if the client went away, as the call may have changed state
+	auditCtx := context.Background()
+	entry.KeyAfter = us.primaryKeyFingerprint(auditCtx, entry.TargetEmail)
+	id, idErr := newID()
+	if idErr != nil {
+		log.Printf("failed to audit %v : %v", entry, idErr)
+		return resp, err
+	}
+	entry.ID = id
+	if auditErr := us.auditRepo.AppendAuditEntry(auditCtx, entry); auditErr != nil {
+		log.Printf("failed to audit %v : %v", entry, auditErr)
+	}
+	return resp, err
+}
+
+//authorizeAdmin checks that the call carries the admin token as bearer token in the authorization metadata
+func (us *UserService) authorizeAdmin(ctx context.Context) error {
+	if us.adminToken == "" {
+		return status.Error(codes.FailedPrecondition, "admin access is not configured")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token := strings.TrimPrefix(v, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(us.adminToken)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.PermissionDenied, "admin token required")
+}
+
+func auditEntryToDTOGRPC(e *domain.AuditEntry) *UserServiceSchema.AuditEntry {
+	return &UserServiceSchema.AuditEntry{
+		Id:          e.ID,
+		TimeUnix:    e.Time.Unix(),
+		Operation:   e.Operation,
+		ActorEmail:  e.ActorEmail,
+		ActorKey:    e.ActorKey,
+		TargetEmail: e.TargetEmail,
+		PeerAddress: e.PeerAddress,
+		KeyBefore:   e.KeyBefore,
+		KeyAfter:    e.KeyAfter,
+		Result:      e.Result,
+	}
+}
+
+//QueryAuditLog returns the audit entries of a user, as actor or target, or of a time range. It requires
+//the admin token
+func (us *UserService) QueryAuditLog(ctx context.Context, req *UserServiceSchema.AuditRequestQuery) (*UserServiceSchema.AuditEntryList, error) {
+	if us.auditRepo == nil {
+		return nil, status.Error(codes.FailedPrecondition, "audit log is not configured")
+	}
+	if err := us.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	filter := domain.AuditFilter{Limit: defaultAuditQueryLimit}
+	var v violations
+	if req.Email != "" {
+		email, err := domain.NormalizeEmail(req.Email)
+		if err != nil {
+			v.add("email", err)
+		}
+		filter.Email = email
+	}
+	if req.FromUnix != 0 {
+		filter.From = time.Unix(req.FromUnix, 0)
+	}
+	if req.ToUnix != 0 {
+		filter.To = time.Unix(req.ToUnix, 0)
+	}
+	if !filter.To.IsZero() && filter.To.Before(filter.From) {
+		v.add("to_unix", fmt.Errorf("must not be before from_unix"))
+	}
+	if filter.Email == "" {
+		to := filter.To
+		if to.IsZero() {
+			to = time.Now()
+		}
+		if filter.From.IsZero() || to.Sub(filter.From) > maxAuditQueryRange {
+			v.add("from_unix", fmt.Errorf("must be set and within %v of to_unix if no email is given", maxAuditQueryRange))
+		}
+	}
+	if req.Limit < 0 || req.Limit > maxAuditQueryLimit {
+		v.add("limit", fmt.Errorf("must be between 0 and %v", maxAuditQueryLimit))
+	} else if req.Limit > 0 {
+		filter.Limit = int(req.Limit)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	entries, err := us.auditRepo.QueryAuditEntries(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log :%v", err)
+	}
+	list := &UserServiceSchema.AuditEntryList{}
+	for _, e := range entries {
+		list.Entries = append(list.Entries, auditEntryToDTOGRPC(e))
+	}
+	return list, nil
+}
+
+//auditOperation records a call of an admin operation that is not seen by AuditInterceptor, like
+//streaming RPCs
+func (us *UserService) auditOperation(ctx context.Context, operation string, err error) {
+	if us.auditRepo == nil {
+		return
+	}
+	entry := &domain.AuditEntry{
+		Time:      time.Now(),
+		Operation: operation,
+		Result:    status.Code(err).String(),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.PeerAddress = p.Addr.String()
+	}
+	id, idErr := newID()
+	if idErr != nil {
+		log.Printf("failed to audit %v : %v", entry, idErr)
+		return
+	}
+	entry.ID = id
+	if auditErr := us.auditRepo.AppendAuditEntry(context.Background(), entry); auditErr != nil {
+		log.Printf("failed to audit %v : %v", entry, auditErr)
+	}
+}
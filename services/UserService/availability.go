@@ -0,0 +1,29 @@
+package UserService
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+)
+
+//AvailabilityInterceptor is a grpc.UnaryServerInterceptor failing calls fast with Unavailable while
+//the backend reports to be unhealthy, see WithBackendHealth. Calls failing with an unknown error while
+//the backend turned unhealthy are reported as Unavailable as well, so that clients know to retry
+func (us *UserService) AvailabilityInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if us.backendHealth == nil {
+		return handler(ctx, req)
+	}
+	if err := us.backendHealth(); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+	resp, err := handler(ctx, req)
+	if err != nil && status.Code(err) == codes.Unknown {
+		if healthErr := us.backendHealth(); healthErr != nil {
+			log.Printf("%v failed while the backend is unhealthy : %v", info.FullMethod, err)
+			return nil, status.Errorf(codes.Unavailable, "%v", healthErr)
+		}
+	}
+	return resp, err
+}
@@ -0,0 +1,146 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultPeerInvalidationTimeout bounds the delivery of an invalidation to a peer, including retries
+	DefaultPeerInvalidationTimeout = 5 * time.Second
+	//peerInvalidationMinBackoff is the delay before the first retry, it doubles with each further attempt
+	peerInvalidationMinBackoff = 100 * time.Millisecond
+)
+
+//PeerInvalidationBus is an InvalidationBus spanning the replicas of the service. Invalidations are
+//delivered to the subscribers of this process right away and to the peers with the InvalidateUserCache
+//RPC, authorized by the admin token all replicas share. Deliveries to unreachable peers are retried
+//until the timeout, afterwards the peer sees the write once its cached lookups expire
+type PeerInvalidationBus struct {
+	local      *userRepository.LocalInvalidationBus
+	adminToken string
+	timeout    time.Duration
+
+	mu    sync.Mutex
+	peers map[string]UserServiceSchema.UserServiceClient
+	//pending tracks the deliveries to peers
+	pending sync.WaitGroup
+}
+
+//NewPeerInvalidationBus creates a bus without peers. A zero timeout selects DefaultPeerInvalidationTimeout
+func NewPeerInvalidationBus(adminToken string, timeout time.Duration) *PeerInvalidationBus {
+	if timeout <= 0 {
+		timeout = DefaultPeerInvalidationTimeout
+	}
+	return &PeerInvalidationBus{
+		local:      userRepository.NewLocalInvalidationBus(),
+		adminToken: adminToken,
+		timeout:    timeout,
+		peers:      make(map[string]UserServiceSchema.UserServiceClient),
+	}
+}
+
+//AddPeer delivers all further invalidations to the replica served by client. name identifies the
+//peer in logs, adding a name again replaces the client
+func (b *PeerInvalidationBus) AddPeer(name string, client UserServiceSchema.UserServiceClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.peers[name] = client
+}
+
+//Publish delivers inv to the local subscribers and starts the deliveries to the peers
+func (b *PeerInvalidationBus) Publish(ctx context.Context, inv userRepository.CacheInvalidation) error {
+	if err := b.local.Publish(ctx, inv); err != nil {
+		return err
+	}
+	req := &UserServiceSchema.UserCacheInvalidation{
+		Origin:     inv.Origin,
+		Email:      inv.Email,
+		PublicKeys: inv.PublicKeys,
+		Flush:      inv.Flush,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, client := range b.peers {
+		b.pending.Add(1)
+		go func(name string, client UserServiceSchema.UserServiceClient) {
+			defer b.pending.Done()
+			if err := b.deliver(client, req); err != nil {
+				log.Printf("failed to deliver cache invalidation of %q to peer %v : %v", req.Email, name, err)
+			}
+		}(name, client)
+	}
+	return nil
+}
+
+//deliver sends req to a peer, retrying until the timeout
+func (b *PeerInvalidationBus) deliver(client UserServiceSchema.UserServiceClient, req *UserServiceSchema.UserCacheInvalidation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+b.adminToken)
+	delay := peerInvalidationMinBackoff
+	for {
+		_, err := client.InvalidateUserCache(ctx, req)
+		switch status.Code(err) {
+		case codes.OK:
+			return nil
+		//retrying does not help with a misconfigured peer
+		case codes.InvalidArgument, codes.PermissionDenied, codes.FailedPrecondition, codes.Unimplemented:
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up after %v : %v", b.timeout, err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (b *PeerInvalidationBus) Subscribe(fn func(inv userRepository.CacheInvalidation)) func() {
+	return b.local.Subscribe(fn)
+}
+
+//Wait blocks until all deliveries to peers started so far finished
+func (b *PeerInvalidationBus) Wait() {
+	b.pending.Wait()
+}
+
+//InvalidateUserCache applies an invalidation published by a peer to the local subscribers, without
+//forwarding it to further peers. It requires the admin token
+func (us *UserService) InvalidateUserCache(ctx context.Context, req *UserServiceSchema.UserCacheInvalidation) (*UserServiceSchema.Empty, error) {
+	if us.cacheBus == nil {
+		return nil, status.Error(codes.FailedPrecondition, "cache invalidation is not configured")
+	}
+	if err := us.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+	var v violations
+	if req.Origin == "" {
+		v.add("origin", fmt.Errorf("must be set"))
+	}
+	if !req.Flush && req.Email == "" && len(req.PublicKeys) == 0 {
+		v.add("email", fmt.Errorf("must be set if neither public_keys nor flush are set"))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	inv := userRepository.CacheInvalidation{
+		Origin:     req.Origin,
+		Email:      req.Email,
+		PublicKeys: req.PublicKeys,
+		Flush:      req.Flush,
+	}
+	if err := us.cacheBus.local.Publish(ctx, inv); err != nil {
+		return nil, fmt.Errorf("failed to apply cache invalidation : %v", err)
+	}
+	return &UserServiceSchema.Empty{}, nil
+}
@@ -0,0 +1,271 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+const (
+	maxDeviceNameLength = 64
+	idBytes             = 16
+	//deviceTouchInterval bounds how often lookups update the last seen time of a device, so that reads
+	//do not turn into writes
+	deviceTouchInterval = time.Minute
+)
+
+var errDevicesNotConfigured = status.Error(codes.FailedPrecondition, "device support is not configured")
+
+//newID returns a random hex encoded identifier
+func newID() (string, error) {
+	buf := make([]byte, idBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to read randomness : %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func deviceToDTOGRPC(d *domain.Device) (*UserServiceSchema.Device, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(d.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .PublicKey field : %v", err)
+	}
+	grpcDevice := &UserServiceSchema.Device{
+		Id:               d.ID,
+		Email:            d.OwnerEmail,
+		Name:             d.Name,
+		PublicKey:        pkPKIX,
+		WrappedMasterKey: d.WrappedMasterKey,
+		CreatedAtUnix:    d.CreatedAt.Unix(),
+		LastSeenAtUnix:   d.LastSeenAt.Unix(),
+	}
+	if d.RevokedAt != nil {
+		grpcDevice.RevokedAtUnix = d.RevokedAt.Unix()
+	}
+	return grpcDevice, nil
+}
+
+//activeUserByEmail returns the active user for email or errUserNotFound
+func (us *UserService) activeUserByEmail(ctx context.Context, email string) (*domain.User, error) {
+	domainUser, err := us.userRepo.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errUserNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch user :%v", err)
+	}
+	if !domainUser.IsActive() {
+		return nil, errUserNotFound
+	}
+	return domainUser, nil
+}
+
+//isDeviceOf returns true if device is an active device of owner. Devices left over from a previous user
+//with the same email, e.g. by a purge that has not completed, are older than owner and not accepted
+func isDeviceOf(device *domain.Device, owner *domain.User, ownerEmail string) bool {
+	return device.OwnerEmail == ownerEmail && !device.IsRevoked() && !device.CreatedAt.Before(owner.CreatedAt)
+}
+
+//userByDevicePk resolves the public key of an active device to its owning user
+func (us *UserService) userByDevicePk(ctx context.Context, pkPKIX []byte) (*domain.User, error) {
+	if us.deviceRepo == nil {
+		return nil, errUserNotFound
+	}
+	device, err := us.deviceRepo.GetDeviceByPk(ctx, pkPKIX)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errUserNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch device :%v", err)
+	}
+	if device.IsRevoked() {
+		return nil, errUserNotFound
+	}
+	owner, err := us.activeUserByEmail(ctx, device.OwnerEmail)
+	if err != nil {
+		return nil, err
+	}
+	if !isDeviceOf(device, owner, device.OwnerEmail) {
+		return nil, errUserNotFound
+	}
+	if now := time.Now(); now.Sub(device.LastSeenAt) >= deviceTouchInterval {
+		if err := us.deviceRepo.TouchDevice(ctx, device.OwnerEmail, device.ID, now); err != nil {
+			return nil, fmt.Errorf("failed to update device :%v", err)
+		}
+	}
+	return owner, nil
+}
+
+//isKeyInUse returns true if pkPKIX already belongs to a user or a device
+func (us *UserService) isKeyInUse(ctx context.Context, pkPKIX []byte) (bool, error) {
+	if _, err := us.userRepo.GetByPk(ctx, pkPKIX); err == nil {
+		return true, nil
+	}
+	_, err := us.deviceRepo.GetDeviceByPk(ctx, pkPKIX)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, userRepository.ErrNotFound) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to fetch device :%v", err)
+}
+
+func validateDeviceName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if len(name) > maxDeviceNameLength {
+		return fmt.Errorf("must not be longer than %v bytes", maxDeviceNameLength)
+	}
+	return nil
+}
+
+//AddDevice registers a device of the user. The request has to be signed by the primary key or an active
+//device of the user
+func (us *UserService) AddDevice(ctx context.Context, req *UserServiceSchema.UserRequestAddDevice) (*UserServiceSchema.Device, error) {
+	if us.deviceRepo == nil {
+		return nil, errDevicesNotConfigured
+	}
+	if req.Signature == nil {
+		return nil, errUnsignedRequest
+	}
+	var v violations
+	if _, err := domain.NormalizeEmail(req.Email); err != nil {
+		v.add("email", err)
+	}
+	if err := validateDeviceName(req.Name); err != nil {
+		v.add("name", err)
+	}
+	pk, err := parsePublicKey(req.PublicKey)
+	if err != nil {
+		v.add("public_key", err)
+	}
+	if err := validateBlob(req.WrappedMasterKey, maxWrappedMasterKeyLength); err != nil {
+		v.add("wrapped_master_key", err)
+	}
+	validateRequestSignature(&v, req.Signature)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	owner, err := us.activeUserByEmail(ctx, req.Email)
+	if err != nil {
+		return nil, err
+	}
+	ownerEmail, err := domain.NormalizeEmail(owner.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email :%v", err)
+	}
+	name := strings.TrimSpace(req.Name)
+	ok, err := us.signedBy(ctx, ownerEmail, req.Signature, domain.ActionAddDevice,
+		ownerEmail, name, string(req.PublicKey), string(req.WrappedMasterKey))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidRequestSignature
+	}
+	inUse, err := us.isKeyInUse(ctx, req.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		return nil, status.Error(codes.AlreadyExists, "public key is already in use")
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	device, err := us.deviceRepo.AddDevice(ctx, &domain.Device{
+		ID:               id,
+		OwnerEmail:       ownerEmail,
+		Name:             name,
+		PublicKey:        pk,
+		WrappedMasterKey: req.WrappedMasterKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add device :%v", err)
+	}
+	us.syncKeyLog(ctx)
+	grpcDevice, err := deviceToDTOGRPC(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize device :%v", err)
+	}
+	return grpcDevice, nil
+}
+
+func (us *UserService) ListDevices(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.DeviceList, error) {
+	if us.deviceRepo == nil {
+		return nil, errDevicesNotConfigured
+	}
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := us.activeUserByEmail(ctx, email); err != nil {
+		return nil, err
+	}
+	devices, err := us.deviceRepo.ListDevices(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices :%v", err)
+	}
+	list := &UserServiceSchema.DeviceList{}
+	for _, d := range devices {
+		grpcDevice, err := deviceToDTOGRPC(d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize device :%v", err)
+		}
+		list.Devices = append(list.Devices, grpcDevice)
+	}
+	return list, nil
+}
+
+//RevokeDevice revokes a device of the user. The request has to be signed by the primary key or an active
+//device of the user
+func (us *UserService) RevokeDevice(ctx context.Context, req *UserServiceSchema.UserRequestRevokeDevice) (*UserServiceSchema.Empty, error) {
+	if us.deviceRepo == nil {
+		return nil, errDevicesNotConfigured
+	}
+	if req.Signature == nil {
+		return nil, errUnsignedRequest
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if req.DeviceId == "" {
+		v.add("device_id", fmt.Errorf("must not be empty"))
+	}
+	validateRequestSignature(&v, req.Signature)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	ok, err := us.signedBy(ctx, email, req.Signature, domain.ActionRevokeDevice, email, req.DeviceId)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidRequestSignature
+	}
+	if err := us.deviceRepo.RevokeDevice(ctx, email, req.DeviceId); err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "device not found")
+		}
+		return nil, fmt.Errorf("failed to revoke device :%v", err)
+	}
+	us.syncKeyLog(ctx)
+	return &UserServiceSchema.Empty{}, nil
+}
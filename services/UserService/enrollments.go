@@ -0,0 +1,268 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+var errEnrollmentsNotConfigured = status.Error(codes.FailedPrecondition, "device enrollment is not configured")
+var errEnrollmentNotFound = status.Error(codes.NotFound, "enrollment not found")
+
+func enrollmentToDTOGRPC(e *domain.Enrollment) (*UserServiceSchema.Enrollment, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(e.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .PublicKey field : %v", err)
+	}
+	return &UserServiceSchema.Enrollment{
+		Id:            e.ID,
+		Email:         e.OwnerEmail,
+		DeviceName:    e.DeviceName,
+		PublicKey:     pkPKIX,
+		State:         string(e.State),
+		DeviceId:      e.DeviceID,
+		CreatedAtUnix: e.CreatedAt.Unix(),
+		ExpiresAtUnix: e.ExpiresAt.Unix(),
+	}, nil
+}
+
+func (us *UserService) enrollmentsConfigured() bool {
+	return us.enrollmentRepo != nil && us.deviceRepo != nil
+}
+
+//isUserKey returns true if pk is the primary key of owner or the key of one of its active devices
+func (us *UserService) isUserKey(ctx context.Context, owner *domain.User, ownerEmail string, pkPKIX []byte) (bool, error) {
+	pk, err := x509.ParsePKIXPublicKey(pkPKIX)
+	if err != nil {
+		return false, nil
+	}
+	if samePublicKey(owner.PublicKey, pk) {
+		return true, nil
+	}
+	if us.deviceRepo == nil {
+		return false, nil
+	}
+	device, err := us.deviceRepo.GetDeviceByPk(ctx, pkPKIX)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to fetch device :%v", err)
+	}
+	return isDeviceOf(device, owner, ownerEmail), nil
+}
+
+//RequestEnrollment is called by a new device to ask the existing devices of the user for approval
+func (us *UserService) RequestEnrollment(ctx context.Context, req *UserServiceSchema.UserRequestEnrollment) (*UserServiceSchema.Enrollment, error) {
+	if !us.enrollmentsConfigured() {
+		return nil, errEnrollmentsNotConfigured
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if err := validateDeviceName(req.DeviceName); err != nil {
+		v.add("device_name", err)
+	}
+	pk, err := parsePublicKey(req.PublicKey)
+	if err != nil {
+		v.add("public_key", err)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := us.activeUserByEmail(ctx, email); err != nil {
+		return nil, err
+	}
+	inUse, err := us.isKeyInUse(ctx, req.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		return nil, status.Error(codes.AlreadyExists, "public key is already in use")
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	enrollment, err := us.enrollmentRepo.CreateEnrollment(ctx, &domain.Enrollment{
+		ID:         id,
+		OwnerEmail: email,
+		DeviceName: strings.TrimSpace(req.DeviceName),
+		PublicKey:  pk,
+		State:      domain.EnrollmentStatePending,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(us.enrollmentTTL),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create enrollment :%v", err)
+	}
+	grpcEnrollment, err := enrollmentToDTOGRPC(enrollment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize enrollment :%v", err)
+	}
+	return grpcEnrollment, nil
+}
+
+//ListPendingEnrollments returns the enrollments of the user that still wait for approval
+func (us *UserService) ListPendingEnrollments(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.EnrollmentList, error) {
+	if !us.enrollmentsConfigured() {
+		return nil, errEnrollmentsNotConfigured
+	}
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := us.activeUserByEmail(ctx, email); err != nil {
+		return nil, err
+	}
+	enrollments, err := us.enrollmentRepo.ListEnrollments(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enrollments :%v", err)
+	}
+	now := time.Now()
+	list := &UserServiceSchema.EnrollmentList{}
+	for _, e := range enrollments {
+		//expired enrollments may linger until the backend removes them
+		if e.State != domain.EnrollmentStatePending || e.Expired(now) {
+			continue
+		}
+		grpcEnrollment, err := enrollmentToDTOGRPC(e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize enrollment :%v", err)
+		}
+		list.Enrollments = append(list.Enrollments, grpcEnrollment)
+	}
+	return list, nil
+}
+
+//GetEnrollment is polled by the new device until its enrollment has been approved
+func (us *UserService) GetEnrollment(ctx context.Context, req *UserServiceSchema.UserRequestEnrollmentStatus) (*UserServiceSchema.Enrollment, error) {
+	if !us.enrollmentsConfigured() {
+		return nil, errEnrollmentsNotConfigured
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if req.EnrollmentId == "" {
+		v.add("enrollment_id", fmt.Errorf("must not be empty"))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	enrollment, err := us.enrollmentRepo.GetEnrollment(ctx, email, req.EnrollmentId)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errEnrollmentNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch enrollment :%v", err)
+	}
+	grpcEnrollment, err := enrollmentToDTOGRPC(enrollment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize enrollment :%v", err)
+	}
+	return grpcEnrollment, nil
+}
+
+//ApproveEnrollment turns a pending enrollment into an active device. The approving device has to
+//sign domain.EnrollmentApprovalDigest with its key
+func (us *UserService) ApproveEnrollment(ctx context.Context, req *UserServiceSchema.UserRequestApproveEnrollment) (*UserServiceSchema.Device, error) {
+	if !us.enrollmentsConfigured() {
+		return nil, errEnrollmentsNotConfigured
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if req.EnrollmentId == "" {
+		v.add("enrollment_id", fmt.Errorf("must not be empty"))
+	}
+	approverPk, err := parsePublicKey(req.ApproverPublicKey)
+	if err != nil {
+		v.add("approver_public_key", err)
+	}
+	if err := validateBlob(req.WrappedMasterKey, maxWrappedMasterKeyLength); err != nil {
+		v.add("wrapped_master_key", err)
+	}
+	if len(req.Signature) == 0 {
+		v.add("signature", fmt.Errorf("must not be empty"))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	owner, err := us.activeUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	enrollment, err := us.enrollmentRepo.GetEnrollment(ctx, email, req.EnrollmentId)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errEnrollmentNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch enrollment :%v", err)
+	}
+	if enrollment.State != domain.EnrollmentStatePending || enrollment.Expired(time.Now()) {
+		return nil, status.Error(codes.FailedPrecondition, "enrollment is no longer pending")
+	}
+
+	ok, err := us.isUserKey(ctx, owner, email, req.ApproverPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "approver is not a device of the user")
+	}
+	devicePkPKIX, err := x509.MarshalPKIXPublicKey(enrollment.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .PublicKey field : %v", err)
+	}
+	digest := domain.EnrollmentApprovalDigest(enrollment.ID, devicePkPKIX, req.WrappedMasterKey)
+	if err := domain.VerifySignature(approverPk, digest, req.Signature); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "invalid approval signature")
+	}
+
+	//the device is added first, the unique device key guarantees that concurrent approvals
+	//create at most one device
+	deviceID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	device, err := us.deviceRepo.AddDevice(ctx, &domain.Device{
+		ID:               deviceID,
+		OwnerEmail:       email,
+		Name:             enrollment.DeviceName,
+		PublicKey:        enrollment.PublicKey,
+		WrappedMasterKey: req.WrappedMasterKey,
+	})
+	if err != nil {
+		if errors.Is(err, userRepository.ErrAlreadyExists) {
+			return nil, status.Error(codes.AlreadyExists, "public key is already in use")
+		}
+		return nil, fmt.Errorf("failed to add device :%v", err)
+	}
+	us.syncKeyLog(ctx)
+	if err := us.enrollmentRepo.ApproveEnrollment(ctx, email, enrollment.ID, device.ID); err != nil {
+		return nil, fmt.Errorf("failed to approve enrollment :%v", err)
+	}
+	grpcDevice, err := deviceToDTOGRPC(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize device :%v", err)
+	}
+	return grpcDevice, nil
+}
@@ -0,0 +1,454 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxGroupNameLength       = 128
+	maxWrappedGroupKeyLength = 1024
+)
+
+var errGroupsNotConfigured = status.Error(codes.FailedPrecondition, "groups are not configured")
+var errGroupNotFound = status.Error(codes.NotFound, "group not found")
+
+func groupToDTOGRPC(g *domain.Group) *UserServiceSchema.Group {
+	return &UserServiceSchema.Group{
+		Id:             g.ID,
+		Name:           g.Name,
+		OrganizationId: g.OrganizationID,
+		OwnerEmail:     g.OwnerEmail,
+		KeyEpoch:       g.KeyEpoch,
+		CreatedAtUnix:  g.CreatedAt.Unix(),
+	}
+}
+
+//getGroup returns the group with id or errGroupNotFound
+func (us *UserService) getGroup(ctx context.Context, id string) (*domain.Group, error) {
+	group, err := us.groupRepo.GetGroup(ctx, id)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errGroupNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch group :%v", err)
+	}
+	return group, nil
+}
+
+//organizationID returns the id of the organization of email or "" if there is none
+func (us *UserService) organizationID(ctx context.Context, email string) (string, error) {
+	org, err := us.organizationOf(ctx, email)
+	if err != nil || org == nil {
+		return "", err
+	}
+	return org.ID, nil
+}
+
+//memberKeyFingerprint returns the KeyFingerprint of the current public key of the active user email
+func (us *UserService) memberKeyFingerprint(ctx context.Context, email string) (string, error) {
+	member, err := us.activeUserByEmail(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	pkPKIX, err := x509.MarshalPKIXPublicKey(member.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert .PublicKey field : %v", err)
+	}
+	return domain.KeyFingerprint(pkPKIX), nil
+}
+
+//CreateGroup creates a group managed by OwnerEmail. The owner is the first member
+func (us *UserService) CreateGroup(ctx context.Context, req *UserServiceSchema.GroupRequestCreate) (*UserServiceSchema.Group, error) {
+	if us.groupRepo == nil {
+		return nil, errGroupsNotConfigured
+	}
+	var v violations
+	ownerEmail, err := domain.NormalizeEmail(req.OwnerEmail)
+	if err != nil {
+		v.add("owner_email", err)
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		v.add("name", fmt.Errorf("must not be empty"))
+	} else if len(name) > maxGroupNameLength {
+		v.add("name", fmt.Errorf("must not be longer than %v bytes", maxGroupNameLength))
+	}
+	validateRequestSignature(&v, req.Signature)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	ok, err := us.signedBy(ctx, ownerEmail, req.Signature, domain.ActionCreateGroup, ownerEmail, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidRequestSignature
+	}
+	orgID, err := us.organizationID(ctx, ownerEmail)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	group, err := us.groupRepo.CreateGroup(ctx, &domain.Group{
+		ID:             id,
+		Name:           name,
+		OrganizationID: orgID,
+		OwnerEmail:     ownerEmail,
+		CreatedAt:      time.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group :%v", err)
+	}
+	return groupToDTOGRPC(group), nil
+}
+
+//validateMemberRequest returns the group and the normalized member and actor emails of req
+func (us *UserService) validateMemberRequest(ctx context.Context, req *UserServiceSchema.GroupRequestMember) (*domain.Group, string, string, error) {
+	if us.groupRepo == nil {
+		return nil, "", "", errGroupsNotConfigured
+	}
+	var v violations
+	if req.GroupId == "" {
+		v.add("group_id", fmt.Errorf("must not be empty"))
+	}
+	memberEmail, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	actorEmail, err := domain.NormalizeEmail(req.ActorEmail)
+	if err != nil {
+		v.add("actor_email", err)
+	}
+	validateRequestSignature(&v, req.Signature)
+	if err := v.err(); err != nil {
+		return nil, "", "", err
+	}
+	group, err := us.getGroup(ctx, req.GroupId)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return group, memberEmail, actorEmail, nil
+}
+
+//AddGroupMember adds an active user to the group. Only the owner of the group may add members
+func (us *UserService) AddGroupMember(ctx context.Context, req *UserServiceSchema.GroupRequestMember) (*UserServiceSchema.Empty, error) {
+	group, memberEmail, actorEmail, err := us.validateMemberRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	if actorEmail == group.OwnerEmail {
+		ok, err = us.signedBy(ctx, actorEmail, req.Signature, domain.ActionAddGroupMember, group.ID, memberEmail)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, errInvalidRequestSignature
+	}
+
+	if _, err := us.activeUserByEmail(ctx, memberEmail); err != nil {
+		return nil, err
+	}
+	orgID, err := us.organizationID(ctx, memberEmail)
+	if err != nil {
+		return nil, err
+	}
+	if orgID != group.OrganizationID {
+		return nil, status.Error(codes.FailedPrecondition, "member has to belong to the organization of the group")
+	}
+	err = us.groupRepo.AddGroupMember(ctx, &domain.GroupMember{
+		GroupID:     group.ID,
+		MemberEmail: memberEmail,
+		AddedAt:     time.Now(),
+	})
+	if err != nil {
+		if errors.Is(err, userRepository.ErrAlreadyExists) {
+			return nil, status.Error(codes.AlreadyExists, "user already is a member of the group")
+		}
+		return nil, fmt.Errorf("failed to add group member :%v", err)
+	}
+	return &UserServiceSchema.Empty{}, nil
+}
+
+//RemoveGroupMember removes a member from the group. The owner may remove anybody except itself,
+//members may leave the group. The key epoch of the group is incremented, so the remaining members have
+//to upload wrappings of a new group key
+func (us *UserService) RemoveGroupMember(ctx context.Context, req *UserServiceSchema.GroupRequestMember) (*UserServiceSchema.Empty, error) {
+	group, memberEmail, actorEmail, err := us.validateMemberRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if memberEmail == group.OwnerEmail {
+		return nil, status.Error(codes.FailedPrecondition, "the owner can not be removed from the group")
+	}
+	ok := false
+	if actorEmail == group.OwnerEmail || actorEmail == memberEmail {
+		ok, err = us.signedBy(ctx, actorEmail, req.Signature, domain.ActionRemoveGroupMember, group.ID, memberEmail)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, errInvalidRequestSignature
+	}
+	if err := us.groupRepo.RemoveGroupMember(ctx, group.ID, memberEmail); err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "user is no member of the group")
+		}
+		return nil, fmt.Errorf("failed to remove group member :%v", err)
+	}
+	return &UserServiceSchema.Empty{}, nil
+}
+
+//ListGroupMembers resolves a group into its active members and their public keys. HasCurrentKey tells
+//for which members the group key of the current epoch still has to be uploaded, either because it is
+//missing or because it was wrapped for a key the member has rotated since
+func (us *UserService) ListGroupMembers(ctx context.Context, req *UserServiceSchema.GroupRequestId) (*UserServiceSchema.GroupMemberList, error) {
+	if us.groupRepo == nil {
+		return nil, errGroupsNotConfigured
+	}
+	if req.GroupId == "" {
+		var v violations
+		v.add("group_id", fmt.Errorf("must not be empty"))
+		return nil, v.err()
+	}
+	group, err := us.getGroup(ctx, req.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	members, err := us.groupRepo.ListGroupMembers(ctx, group.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list group members :%v", err)
+	}
+	wrappings, err := us.groupRepo.ListGroupKeyWrappings(ctx, group.ID, group.KeyEpoch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list group keys :%v", err)
+	}
+	currentKeys := make(map[string]*domain.GroupKeyWrapping, len(wrappings))
+	for _, w := range wrappings {
+		currentKeys[w.MemberEmail] = w
+	}
+	list := &UserServiceSchema.GroupMemberList{Group: groupToDTOGRPC(group)}
+	for _, m := range members {
+		member, err := us.activeUserByEmail(ctx, m.MemberEmail)
+		if status.Code(err) == codes.NotFound {
+			//deleted users keep their membership until they are purged or restored
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		pkPKIX, err := x509.MarshalPKIXPublicKey(member.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert .PublicKey field : %v", err)
+		}
+		currentKey := currentKeys[m.MemberEmail]
+		list.Members = append(list.Members, &UserServiceSchema.GroupMember{
+			Email:         member.Email,
+			PublicKey:     pkPKIX,
+			AddedAtUnix:   m.AddedAt.Unix(),
+			HasCurrentKey: currentKey != nil && currentKey.IsWrappedFor(domain.KeyFingerprint(pkPKIX)),
+		})
+	}
+	return list, nil
+}
+
+func (us *UserService) ListGroupsOfUser(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.GroupList, error) {
+	if us.groupRepo == nil {
+		return nil, errGroupsNotConfigured
+	}
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	memberships, err := us.groupRepo.ListGroupsOfMember(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups :%v", err)
+	}
+	list := &UserServiceSchema.GroupList{}
+	for _, m := range memberships {
+		group, err := us.getGroup(ctx, m.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		list.Groups = append(list.Groups, groupToDTOGRPC(group))
+	}
+	return list, nil
+}
+
+//memberSet returns the normalized emails of all members of the group
+func (us *UserService) memberSet(ctx context.Context, groupID string) (map[string]bool, error) {
+	members, err := us.groupRepo.ListGroupMembers(ctx, groupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list group members :%v", err)
+	}
+	set := make(map[string]bool, len(members))
+	for _, m := range members {
+		set[m.MemberEmail] = true
+	}
+	return set, nil
+}
+
+//UploadGroupKeys stores wrappings of the group key of the current epoch for members of the group.
+//Uploads for any other epoch are refused, as they may be readable by removed members
+func (us *UserService) UploadGroupKeys(ctx context.Context, req *UserServiceSchema.GroupRequestUploadKeys) (*UserServiceSchema.Empty, error) {
+	if us.groupRepo == nil {
+		return nil, errGroupsNotConfigured
+	}
+	var v violations
+	if req.GroupId == "" {
+		v.add("group_id", fmt.Errorf("must not be empty"))
+	}
+	actorEmail, err := domain.NormalizeEmail(req.ActorEmail)
+	if err != nil {
+		v.add("actor_email", err)
+	}
+	if len(req.Wrappings) == 0 {
+		v.add("wrappings", fmt.Errorf("must not be empty"))
+	}
+	signedFields := []string{req.GroupId, strconv.FormatInt(req.Epoch, 10)}
+	memberEmails := make([]string, len(req.Wrappings))
+	seen := make(map[string]bool, len(req.Wrappings))
+	for i, w := range req.Wrappings {
+		field := fmt.Sprintf("wrappings[%v]", i)
+		if w == nil {
+			v.add(field, fmt.Errorf("must be set"))
+			continue
+		}
+		memberEmail, err := domain.NormalizeEmail(w.Email)
+		if err != nil {
+			v.add(field+".email", err)
+		} else if seen[memberEmail] {
+			v.add(field+".email", fmt.Errorf("duplicate member %v", memberEmail))
+		}
+		seen[memberEmail] = true
+		memberEmails[i] = memberEmail
+		if err := validateBlob(w.WrappedGroupKey, maxWrappedGroupKeyLength); err != nil {
+			v.add(field+".wrapped_group_key", err)
+		}
+		signedFields = append(signedFields, memberEmail, string(w.WrappedGroupKey))
+	}
+	validateRequestSignature(&v, req.Signature)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	group, err := us.getGroup(ctx, req.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	members, err := us.memberSet(ctx, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	if members[actorEmail] {
+		ok, err = us.signedBy(ctx, actorEmail, req.Signature, domain.ActionUploadGroupKeys, signedFields...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, errInvalidRequestSignature
+	}
+	if req.Epoch != group.KeyEpoch {
+		return nil, status.Errorf(codes.FailedPrecondition, "stale epoch %v, the current key epoch is %v", req.Epoch, group.KeyEpoch)
+	}
+
+	now := time.Now()
+	wrappings := make([]*domain.GroupKeyWrapping, 0, len(req.Wrappings))
+	for i, w := range req.Wrappings {
+		if !members[memberEmails[i]] {
+			return nil, status.Errorf(codes.FailedPrecondition, "%v is no member of the group", memberEmails[i])
+		}
+		fingerprint, err := us.memberKeyFingerprint(ctx, memberEmails[i])
+		if err != nil {
+			return nil, err
+		}
+		wrappings = append(wrappings, &domain.GroupKeyWrapping{
+			GroupID:              group.ID,
+			Epoch:                req.Epoch,
+			MemberEmail:          memberEmails[i],
+			MemberKeyFingerprint: fingerprint,
+			WrappedGroupKey:      w.WrappedGroupKey,
+			UploaderEmail:        actorEmail,
+			UploadedAt:           now,
+		})
+	}
+	if err := us.groupRepo.PutGroupKeyWrappings(ctx, group.ID, req.Epoch, wrappings); err != nil {
+		if errors.Is(err, userRepository.ErrStaleEpoch) {
+			//a member has been removed concurrently
+			return nil, status.Errorf(codes.FailedPrecondition, "stale epoch %v", req.Epoch)
+		}
+		return nil, fmt.Errorf("failed to store group keys :%v", err)
+	}
+	return &UserServiceSchema.Empty{}, nil
+}
+
+//GetGroupKey returns the group key wrapped for a member. Epoch 0 selects the current epoch, older
+//epochs remain available to decrypt old files. Keys wrapped for a rotated key of the member are
+//rejected with FailedPrecondition
+func (us *UserService) GetGroupKey(ctx context.Context, req *UserServiceSchema.GroupRequestKey) (*UserServiceSchema.GroupKeyWrapping, error) {
+	if us.groupRepo == nil {
+		return nil, errGroupsNotConfigured
+	}
+	var v violations
+	if req.GroupId == "" {
+		v.add("group_id", fmt.Errorf("must not be empty"))
+	}
+	memberEmail, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if req.Epoch < 0 {
+		v.add("epoch", fmt.Errorf("must not be negative"))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	group, err := us.getGroup(ctx, req.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	epoch := req.Epoch
+	if epoch == 0 {
+		epoch = group.KeyEpoch
+	}
+	wrapping, err := us.groupRepo.GetGroupKeyWrapping(ctx, group.ID, epoch, memberEmail)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "group key not found")
+		}
+		return nil, fmt.Errorf("failed to fetch group key :%v", err)
+	}
+	fingerprint, err := us.memberKeyFingerprint(ctx, memberEmail)
+	if err != nil {
+		return nil, err
+	}
+	if !wrapping.IsWrappedFor(fingerprint) {
+		return nil, status.Errorf(codes.FailedPrecondition, "group key of epoch %v was wrapped for a previous key of the member and has to be uploaded again", wrapping.Epoch)
+	}
+	return &UserServiceSchema.GroupKeyWrapping{
+		GroupId:         wrapping.GroupID,
+		Epoch:           wrapping.Epoch,
+		Email:           wrapping.MemberEmail,
+		WrappedGroupKey: wrapping.WrappedGroupKey,
+		UploaderEmail:   wrapping.UploaderEmail,
+		UploadedAtUnix:  wrapping.UploadedAt.Unix(),
+	}, nil
+}
@@ -0,0 +1,367 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	//keyLogPageSize is the number of entries fetched at once when syncing the key log
+	keyLogPageSize = 1000
+	//maxKeyLogEntriesLimit bounds the entries returned by a single ListKeyLogEntries call
+	maxKeyLogEntriesLimit = 1000
+	//keyLogEventPageSize is the number of user events taken into the log at once. It stays below the
+	//items of a dynamodb transaction
+	keyLogEventPageSize = 50
+	//treeHeadMaxAge is the time a signed tree head is handed out for an unchanged log before it is
+	//signed again with a fresh timestamp
+	treeHeadMaxAge = time.Minute
+	//DefaultKeyLogInterval is the time between the runs of the KeyLogReconciler
+	DefaultKeyLogInterval = 10 * time.Second
+)
+
+var errKeyLogNotConfigured = status.Error(codes.FailedPrecondition, "key transparency log is not configured")
+
+//keyLogKindOf returns the kind of the key log entry recording e, false for events that do not change keys
+func keyLogKindOf(e *domain.UserEvent) (domain.KeyLogKind, bool) {
+	switch e.Kind {
+	case domain.UserEventCreated:
+		return domain.KeyLogCreateUser, true
+	case domain.UserEventDeleted:
+		return domain.KeyLogDeleteUser, true
+	case domain.UserEventRestored:
+		return domain.KeyLogRestoreUser, true
+	case domain.UserEventDeviceAdded:
+		return domain.KeyLogAddDevice, true
+	case domain.UserEventDeviceRevoked:
+		return domain.KeyLogRevokeDevice, true
+	case domain.UserEventKeyRotated:
+		return domain.KeyLogRotateKey, true
+	case domain.UserEventImported:
+		return domain.KeyLogImportUser, true
+	}
+	return "", false
+}
+
+//appendKeyChanges appends the key changes announced by the user events after the cursor of the key log.
+//The events are written in the same transaction as the changes, so the log catches up with every
+//committed change, even if the call making it failed right after the commit
+func appendKeyChanges(ctx context.Context, keyLogRepo userRepository.KeyLogRepo, eventRepo userRepository.UserEventRepo) error {
+	for {
+		after, err := keyLogRepo.GetKeyLogCursor(ctx)
+		if err != nil {
+			return err
+		}
+		events, err := eventRepo.ListUserEvents(ctx, after, keyLogEventPageSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		if after > 0 && events[0].Sequence != after+1 {
+			log.Printf("key log misses the user events %v to %v, they expired before they were logged", after+1, events[0].Sequence-1)
+		}
+		var entries []*domain.KeyLogEntry
+		for _, e := range events {
+			kind, ok := keyLogKindOf(e)
+			if !ok {
+				continue
+			}
+			entries = append(entries, &domain.KeyLogEntry{
+				Kind:          kind,
+				Email:         e.Email,
+				PublicKeyPKIX: e.PublicKeyPKIX,
+				CreatedAt:     e.CreatedAt,
+			})
+		}
+		err = keyLogRepo.AppendKeyLogEntries(ctx, after, events[len(events)-1].Sequence, entries)
+		//another instance took the events into the log, continue after them
+		if err != nil && !errors.Is(err, userRepository.ErrCursorMoved) {
+			return err
+		}
+	}
+}
+
+//KeyLogReconciler periodically appends the key changes to the key log, which the instances making them
+//failed to append. Multiple instances may run concurrently
+type KeyLogReconciler struct {
+	KeyLogRepo userRepository.KeyLogRepo
+	EventRepo  userRepository.UserEventRepo
+	Interval   time.Duration
+}
+
+//ReconcileOnce appends all key changes that are missing in the log
+func (r *KeyLogReconciler) ReconcileOnce(ctx context.Context) error {
+	if err := appendKeyChanges(ctx, r.KeyLogRepo, r.EventRepo); err != nil {
+		return fmt.Errorf("failed to reconcile key log : %v", err)
+	}
+	return nil
+}
+
+//Run reconciles every Interval until ctx is done
+func (r *KeyLogReconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.ReconcileOnce(ctx); err != nil {
+			log.Printf("%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//keyLog mirrors the leaf hashes of the append only key log in memory to compute proofs. Other instances
+//may append concurrently, so it is synced with the repository before each use
+type keyLog struct {
+	repo   userRepository.KeyLogRepo
+	events userRepository.UserEventRepo
+	signer crypto.Signer
+
+	//appendMu keeps the requests of this instance from racing each other for the cursor
+	appendMu sync.Mutex
+
+	mu   sync.Mutex
+	tree domain.MerkleTree
+	//userEntries maps normalized emails to the index of their latest create, restore, rotate or import entry
+	userEntries map[string]int64
+	//head is the latest signed tree head, see treeHeadMaxAge
+	head *UserServiceSchema.SignedTreeHead
+}
+
+func newKeyLog(repo userRepository.KeyLogRepo, events userRepository.UserEventRepo, signer crypto.Signer) *keyLog {
+	return &keyLog{
+		repo:        repo,
+		events:      events,
+		signer:      signer,
+		userEntries: make(map[string]int64),
+	}
+}
+
+//sync fetches the entries appended since the last sync. The caller has to hold mu
+func (l *keyLog) sync(ctx context.Context) error {
+	for {
+		entries, err := l.repo.ListKeyLogEntries(ctx, l.tree.Size(), keyLogPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to sync key log : %v", err)
+		}
+		for _, e := range entries {
+			if e.Index != l.tree.Size() {
+				return fmt.Errorf("failed to sync key log : expected index %v got %v", l.tree.Size(), e.Index)
+			}
+			l.tree.Append(e.LeafHash())
+			switch e.Kind {
+			case domain.KeyLogCreateUser, domain.KeyLogRestoreUser, domain.KeyLogRotateKey, domain.KeyLogImportUser:
+				l.userEntries[e.Email] = e.Index
+			}
+		}
+		if len(entries) < keyLogPageSize {
+			return nil
+		}
+	}
+}
+
+//treeHead returns a signed tree head of the whole tree. The caller has to hold mu
+func (l *keyLog) treeHead() (*UserServiceSchema.SignedTreeHead, error) {
+	now := time.Now()
+	if l.head != nil && l.head.Size == l.tree.Size() && now.Sub(time.Unix(l.head.TimestampUnix, 0)) < treeHeadMaxAge {
+		return l.head, nil
+	}
+	root, err := l.tree.Root(l.tree.Size())
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute root : %v", err)
+	}
+	head := &UserServiceSchema.SignedTreeHead{
+		Size:          l.tree.Size(),
+		RootHash:      root,
+		TimestampUnix: now.Unix(),
+	}
+	sig, err := domain.Sign(l.signer, domain.TreeHeadDigest(head.Size, head.RootHash, head.TimestampUnix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign tree head : %v", err)
+	}
+	head.Signature = sig
+	l.head = head
+	return head, nil
+}
+
+//currentHead syncs the log and returns a signed tree head
+func (l *keyLog) currentHead(ctx context.Context) (*UserServiceSchema.SignedTreeHead, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.sync(ctx); err != nil {
+		return nil, err
+	}
+	return l.treeHead()
+}
+
+//userProof syncs the log and returns the index of the latest create, restore, rotate or import entry of
+//the user with the normalized email, its inclusion proof and the signed tree head the proof refers to
+func (l *keyLog) userProof(ctx context.Context, email string) (int64, [][]byte, *UserServiceSchema.SignedTreeHead, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.sync(ctx); err != nil {
+		return 0, nil, nil, false, err
+	}
+	index, ok := l.userEntries[email]
+	if !ok {
+		return 0, nil, nil, false, nil
+	}
+	head, err := l.treeHead()
+	if err != nil {
+		return 0, nil, nil, false, err
+	}
+	proof, err := l.tree.InclusionProof(index, head.Size)
+	if err != nil {
+		return 0, nil, nil, false, fmt.Errorf("failed to compute inclusion proof : %v", err)
+	}
+	return index, proof, head, true, nil
+}
+
+//consistencyProof syncs the log and proves that the log of size first is a prefix of the log of size second
+func (l *keyLog) consistencyProof(ctx context.Context, first, second int64) ([][]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.sync(ctx); err != nil {
+		return nil, err
+	}
+	var v violations
+	if first <= 0 || first > second {
+		v.add("first_size", fmt.Errorf("must be positive and not larger than second_size"))
+	}
+	if second > l.tree.Size() {
+		v.add("second_size", fmt.Errorf("must not be larger than the log size %v", l.tree.Size()))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	proof, err := l.tree.ConsistencyProof(first, second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute consistency proof : %v", err)
+	}
+	return proof, nil
+}
+
+func keyLogEntryToDTOGRPC(e *domain.KeyLogEntry) *UserServiceSchema.KeyLogEntry {
+	return &UserServiceSchema.KeyLogEntry{
+		Index:         e.Index,
+		Kind:          string(e.Kind),
+		Email:         e.Email,
+		PublicKey:     e.PublicKeyPKIX,
+		CreatedAtUnix: e.CreatedAt.Unix(),
+	}
+}
+
+//syncKeyLog appends the key change just made by the caller to the key log, if configured. The change
+//has been committed already, so a failure is only logged and left to the KeyLogReconciler
+func (us *UserService) syncKeyLog(ctx context.Context) {
+	if us.keyLog == nil {
+		return
+	}
+	us.keyLog.appendMu.Lock()
+	defer us.keyLog.appendMu.Unlock()
+	if err := appendKeyChanges(ctx, us.keyLog.repo, us.keyLog.events); err != nil {
+		log.Printf("failed to append key change to key log : %v", err)
+	}
+}
+
+//GetKeyLogTreeHead returns a signed tree head of the current key log
+func (us *UserService) GetKeyLogTreeHead(ctx context.Context, _ *UserServiceSchema.Empty) (*UserServiceSchema.SignedTreeHead, error) {
+	if us.keyLog == nil {
+		return nil, errKeyLogNotConfigured
+	}
+	return us.keyLog.currentHead(ctx)
+}
+
+//GetUserPkWithProof works like GetUserPkByEmail and additionally proves that the key has been published
+//in the key log
+func (us *UserService) GetUserPkWithProof(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.UserPkProof, error) {
+	if us.keyLog == nil {
+		return nil, errKeyLogNotConfigured
+	}
+	userPk, err := us.GetUserPkByEmail(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	email, err := domain.NormalizeEmail(userPk.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize email :%v", err)
+	}
+	index, proof, head, ok, err := us.keyLog.userProof(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, status.Error(codes.NotFound, "key of user has not been logged")
+	}
+	entries, err := us.keyLog.repo.ListKeyLogEntries(ctx, index, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key log entry : %v", err)
+	}
+	if len(entries) != 1 || !bytes.Equal(entries[0].PublicKeyPKIX, userPk.PublicKey) {
+		return nil, status.Error(codes.NotFound, "key of user has not been logged")
+	}
+	return &UserServiceSchema.UserPkProof{
+		UserPk:         userPk,
+		Entry:          keyLogEntryToDTOGRPC(entries[0]),
+		InclusionProof: proof,
+		TreeHead:       head,
+	}, nil
+}
+
+//GetKeyLogConsistencyProof proves that the key log of FirstSize is a prefix of the key log of SecondSize
+func (us *UserService) GetKeyLogConsistencyProof(ctx context.Context, req *UserServiceSchema.KeyLogRequestConsistency) (*UserServiceSchema.KeyLogConsistencyProof, error) {
+	if us.keyLog == nil {
+		return nil, errKeyLogNotConfigured
+	}
+	proof, err := us.keyLog.consistencyProof(ctx, req.FirstSize, req.SecondSize)
+	if err != nil {
+		return nil, err
+	}
+	return &UserServiceSchema.KeyLogConsistencyProof{
+		FirstSize:  req.FirstSize,
+		SecondSize: req.SecondSize,
+		Hashes:     proof,
+	}, nil
+}
+
+//ListKeyLogEntries returns the entries of the key log, so that auditors can monitor the keys of an email
+func (us *UserService) ListKeyLogEntries(ctx context.Context, req *UserServiceSchema.KeyLogRequestEntries) (*UserServiceSchema.KeyLogEntryList, error) {
+	if us.keyLog == nil {
+		return nil, errKeyLogNotConfigured
+	}
+	var v violations
+	if req.Start < 0 {
+		v.add("start", fmt.Errorf("must not be negative"))
+	}
+	if req.Limit <= 0 || req.Limit > maxKeyLogEntriesLimit {
+		v.add("limit", fmt.Errorf("must be between 1 and %v", maxKeyLogEntriesLimit))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	entries, err := us.keyLog.repo.ListKeyLogEntries(ctx, req.Start, int(req.Limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key log entries : %v", err)
+	}
+	list := &UserServiceSchema.KeyLogEntryList{}
+	for _, e := range entries {
+		list.Entries = append(list.Entries, keyLogEntryToDTOGRPC(e))
+	}
+	return list, nil
+}
@@ -0,0 +1,163 @@
+package UserService
+
+import (
+	"UserService/adapters/mailer"
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"crypto"
+	"sort"
+	"time"
+)
+
+//DefaultVerificationTTL is the lifetime of email verification tokens
+const DefaultVerificationTTL = 24 * time.Hour
+
+//DefaultEnrollmentTTL is the time an existing device has to approve an enrollment
+const DefaultEnrollmentTTL = 15 * time.Minute
+
+//DefaultEventPollInterval is the time between polls of the event outbox by WatchUserEvents subscribers
+const DefaultEventPollInterval = time.Second
+
+//Option configures optional dependencies of UserService
+type Option func(us *UserService)
+
+//WithVerification enables the email verification flow. It is required for CreateUser, as accounts
+//are only activated once the emailed token has been confirmed
+func WithVerification(tokenRepo userRepository.VerificationTokenRepo, sender mailer.Sender, ttl time.Duration) Option {
+	return func(us *UserService) {
+		us.tokenRepo = tokenRepo
+		us.mailSender = sender
+		us.verificationTTL = ttl
+	}
+}
+
+//WithRetention sets the time window in which deleted users can be restored
+func WithRetention(retention time.Duration) Option {
+	return func(us *UserService) {
+		us.retention = retention
+	}
+}
+
+//WithDevices enables the device RPCs and resolving device keys in GetUserByPk
+func WithDevices(deviceRepo userRepository.DeviceRepo) Option {
+	return func(us *UserService) {
+		us.deviceRepo = deviceRepo
+	}
+}
+
+//WithEnrollments enables enrolling new devices through the approval of an existing device. It
+//requires WithDevices
+func WithEnrollments(enrollmentRepo userRepository.EnrollmentRepo, ttl time.Duration) Option {
+	return func(us *UserService) {
+		us.enrollmentRepo = enrollmentRepo
+		us.enrollmentTTL = ttl
+	}
+}
+
+//WithRecovery enables storing recovery wrappings of the master key and the account recovery flow. It
+//requires WithVerification to mail recovery tokens
+func WithRecovery(recoveryRepo userRepository.RecoveryRepo) Option {
+	return func(us *UserService) {
+		us.recoveryRepo = recoveryRepo
+	}
+}
+
+//WithOrganizations enables organizations. Members of an organization have to escrow their master key
+//for the escrow key of the organization
+func WithOrganizations(organizationRepo userRepository.OrganizationRepo) Option {
+	return func(us *UserService) {
+		us.organizationRepo = organizationRepo
+	}
+}
+
+//WithGroups enables groups and their membership management
+func WithGroups(groupRepo userRepository.GroupRepo) Option {
+	return func(us *UserService) {
+		us.groupRepo = groupRepo
+	}
+}
+
+//WithKeyLog enables the key transparency log. The key changes announced by the events of userEventRepo
+//are appended to the log and tree heads are signed with signer. Run a KeyLogReconciler as well, to append
+//the changes whose append failed
+func WithKeyLog(keyLogRepo userRepository.KeyLogRepo, userEventRepo userRepository.UserEventRepo, signer crypto.Signer) Option {
+	return func(us *UserService) {
+		us.keyLog = newKeyLog(keyLogRepo, userEventRepo, signer)
+	}
+}
+
+//WithAttestations makes GetUserPkByEmail attest the returned binding with the signing key of the highest
+//version. Keys with lower versions are still published, so that older attestations remain verifiable
+func WithAttestations(keys []domain.ServiceSigningKey) Option {
+	return func(us *UserService) {
+		us.signingKeys = append([]domain.ServiceSigningKey(nil), keys...)
+		sort.Slice(us.signingKeys, func(i, j int) bool {
+			return us.signingKeys[i].Version < us.signingKeys[j].Version
+		})
+	}
+}
+
+//WithAuditLog records all mutating calls in auditRepo, if AuditInterceptor is installed. The log can be
+//queried with adminToken, an empty token disables QueryAuditLog
+func WithAuditLog(auditRepo userRepository.AuditRepo, adminToken string) Option {
+	return func(us *UserService) {
+		us.auditRepo = auditRepo
+		us.adminToken = adminToken
+	}
+}
+
+//WithUserEvents enables WatchUserEvents for admins, which polls userEventRepo every pollInterval for new
+//events. A zero pollInterval keeps DefaultEventPollInterval, see WithAuditLog for the admin token
+func WithUserEvents(userEventRepo userRepository.UserEventRepo, pollInterval time.Duration) Option {
+	return func(us *UserService) {
+		us.userEventRepo = userEventRepo
+		if pollInterval > 0 {
+			us.eventPollInterval = pollInterval
+		}
+	}
+}
+
+//WithWebhooks enables the admin RPCs managing webhooks. Deliveries are made by a WebhookDispatcher
+func WithWebhooks(webhookRepo userRepository.WebhookRepo) Option {
+	return func(us *UserService) {
+		us.webhookRepo = webhookRepo
+	}
+}
+
+//WithUserAdmin enables the admin RPCs listing users and rotating their keys, see WithAuditLog for the
+//admin token
+func WithUserAdmin(userAdminRepo userRepository.UserAdminRepo) Option {
+	return func(us *UserService) {
+		us.userAdminRepo = userAdminRepo
+	}
+}
+
+//WithUserCache serves the counters of the user cache to admins. A nil cache disables the RPC
+func WithUserCache(userCache *userRepository.CachedUserRepo) Option {
+	return func(us *UserService) {
+		us.userCache = userCache
+	}
+}
+
+//WithCacheInvalidation applies the cache invalidations of peers received by InvalidateUserCache to the
+//subscribers of bus. A nil bus disables the RPC
+func WithCacheInvalidation(bus *PeerInvalidationBus) Option {
+	return func(us *UserService) {
+		us.cacheBus = bus
+	}
+}
+
+//WithBackendHealth fails calls fast while check returns an error, see AvailabilityInterceptor
+func WithBackendHealth(check func() error) Option {
+	return func(us *UserService) {
+		us.backendHealth = check
+	}
+}
+
+//WithResidency enables choosing the region of new users in CreateUser and moving users between regions
+//with MoveUser. residency has to be the repo serving the users, or be wrapped by it
+func WithResidency(residency *userRepository.ResidencyRepo) Option {
+	return func(us *UserService) {
+		us.residency = residency
+	}
+}
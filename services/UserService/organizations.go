@@ -0,0 +1,242 @@
+package UserService
+
+import (
+	"UserService/adapters/mailer"
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"strings"
+	"time"
+)
+
+const maxOrganizationNameLength = 128
+
+var errOrganizationsNotConfigured = status.Error(codes.FailedPrecondition, "organizations are not configured")
+var errOrganizationNotFound = status.Error(codes.NotFound, "organization not found")
+
+func organizationToDTOGRPC(o *domain.Organization) (*UserServiceSchema.Organization, error) {
+	pkPKIX, err := x509.MarshalPKIXPublicKey(o.EscrowPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .EscrowPublicKey field : %v", err)
+	}
+	return &UserServiceSchema.Organization{
+		Id:              o.ID,
+		Name:            o.Name,
+		EmailDomain:     o.EmailDomain,
+		EscrowPublicKey: pkPKIX,
+		CreatedAtUnix:   o.CreatedAt.Unix(),
+	}, nil
+}
+
+//organizationOf returns the organization the user with the email belongs to or nil if there is none
+func (us *UserService) organizationOf(ctx context.Context, email string) (*domain.Organization, error) {
+	if us.organizationRepo == nil {
+		return nil, nil
+	}
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	org, err := us.organizationRepo.GetOrganizationByDomain(ctx, domain.EmailDomain(normalizedEmail))
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch organization :%v", err)
+	}
+	return org, nil
+}
+
+//validateEscrowWrapping checks that members of org provide an escrow wrapping and everybody else does not
+func validateEscrowWrapping(org *domain.Organization, escrowWrappedMasterKey []byte) error {
+	var v violations
+	if org != nil && len(escrowWrappedMasterKey) == 0 {
+		v.add("escrow_wrapped_master_key", fmt.Errorf("required for members of organization %v", org.Name))
+	}
+	if org == nil && len(escrowWrappedMasterKey) != 0 {
+		v.add("escrow_wrapped_master_key", fmt.Errorf("must be empty for users outside of an organization"))
+	}
+	return v.err()
+}
+
+//storeEscrowWrapping stores the escrow wrapping of a member of org. It is a no-op for org nil
+func (us *UserService) storeEscrowWrapping(ctx context.Context, org *domain.Organization, email string, escrowWrappedMasterKey []byte) error {
+	if org == nil {
+		return nil
+	}
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return fmt.Errorf("failed to normalize email :%v", err)
+	}
+	err = us.organizationRepo.PutEscrowWrapping(ctx, &domain.EscrowWrapping{
+		OwnerEmail:       normalizedEmail,
+		OrganizationID:   org.ID,
+		EscrowPublicKey:  org.EscrowPublicKey,
+		WrappedMasterKey: escrowWrappedMasterKey,
+		UpdatedAt:        time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store escrow wrapping :%v", err)
+	}
+	return nil
+}
+
+//CreateOrganization registers an organization for all users with an email in emailDomain. It is not
+//exposed via grpc, as claiming a domain has to be checked by an operator
+func (us *UserService) CreateOrganization(ctx context.Context, name, emailDomain string, escrowPkPKIX []byte) (*domain.Organization, error) {
+	if us.organizationRepo == nil {
+		return nil, errOrganizationsNotConfigured
+	}
+	var v violations
+	name = strings.TrimSpace(name)
+	if name == "" {
+		v.add("name", fmt.Errorf("must not be empty"))
+	} else if len(name) > maxOrganizationNameLength {
+		v.add("name", fmt.Errorf("must not be longer than %v bytes", maxOrganizationNameLength))
+	}
+	//normalize the domain like the domain part of member emails
+	normalized, err := domain.NormalizeEmail("admin@" + strings.TrimSpace(emailDomain))
+	if err != nil {
+		v.add("email_domain", err)
+	}
+	pk, err := parsePublicKey(escrowPkPKIX)
+	if err != nil {
+		v.add("escrow_public_key", err)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	org, err := us.organizationRepo.CreateOrganization(ctx, &domain.Organization{
+		ID:              id,
+		Name:            name,
+		EmailDomain:     domain.EmailDomain(normalized),
+		EscrowPublicKey: pk,
+		CreatedAt:       time.Now(),
+	})
+	if err != nil {
+		if errors.Is(err, userRepository.ErrAlreadyExists) {
+			return nil, status.Error(codes.AlreadyExists, "email domain already belongs to an organization")
+		}
+		return nil, fmt.Errorf("failed to create organization :%v", err)
+	}
+	return org, nil
+}
+
+//GetOrganizationByEmail returns the organization of the user with the email. Clients need its escrow
+//key to create the escrow wrapping required by CreateUser and UpdateUser
+func (us *UserService) GetOrganizationByEmail(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.Organization, error) {
+	if us.organizationRepo == nil {
+		return nil, errOrganizationsNotConfigured
+	}
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	org, err := us.organizationOf(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if org == nil {
+		return nil, errOrganizationNotFound
+	}
+	grpcOrg, err := organizationToDTOGRPC(org)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize organization :%v", err)
+	}
+	return grpcOrg, nil
+}
+
+//GetEscrowWrapping hands out the escrow wrapping of a member to the holder of the escrow key. The
+//request is signed with the escrow key over domain.EscrowAccessDigest. Every access is audited and
+//announced to the member by mail
+func (us *UserService) GetEscrowWrapping(ctx context.Context, req *UserServiceSchema.UserRequestEscrowAccess) (*UserServiceSchema.EscrowWrapping, error) {
+	if us.organizationRepo == nil {
+		return nil, errOrganizationsNotConfigured
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	now := time.Now()
+	if err := validateTimestamp(req.TimestampUnix, now); err != nil {
+		v.add("timestamp_unix", err)
+	}
+	if len(req.Signature) == 0 {
+		v.add("signature", fmt.Errorf("must not be empty"))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	org, err := us.organizationOf(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if org == nil {
+		return nil, errOrganizationNotFound
+	}
+	digest := domain.EscrowAccessDigest(org.ID, email, req.TimestampUnix)
+	if err := domain.VerifySignature(org.EscrowPublicKey, digest, req.Signature); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "invalid escrow access signature")
+	}
+	wrapping, err := us.organizationRepo.GetEscrowWrapping(ctx, email)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "escrow wrapping not found")
+		}
+		return nil, fmt.Errorf("failed to fetch escrow wrapping :%v", err)
+	}
+
+	if us.recoveryRepo != nil {
+		auditID, err := newID()
+		if err != nil {
+			return nil, err
+		}
+		err = us.recoveryRepo.AddRecoveryAudit(ctx, &domain.RecoveryAudit{
+			ID:          auditID,
+			OwnerEmail:  email,
+			WrappingID:  org.ID,
+			Kind:        domain.RecoveryKindEscrow,
+			RecoveredAt: now,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to audit escrow access :%v", err)
+		}
+	}
+	if us.mailSender != nil {
+		err = us.mailSender.Send(ctx, &mailer.Message{
+			To:      email,
+			Subject: "Your master key has been recovered by your organization",
+			Body: fmt.Sprintf("An admin of %v has recovered your master key at %v.\n",
+				org.Name, now.UTC().Format(time.RFC1123)),
+		})
+		if err != nil {
+			log.Printf("failed to send escrow access notification to %v : %v", email, err)
+		}
+	}
+
+	pkPKIX, err := x509.MarshalPKIXPublicKey(wrapping.EscrowPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert .EscrowPublicKey field : %v", err)
+	}
+	return &UserServiceSchema.EscrowWrapping{
+		Email:            wrapping.OwnerEmail,
+		OrganizationId:   wrapping.OrganizationID,
+		EscrowPublicKey:  pkPKIX,
+		WrappedMasterKey: wrapping.WrappedMasterKey,
+		UpdatedAtUnix:    wrapping.UpdatedAt.Unix(),
+	}, nil
+}
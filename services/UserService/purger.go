@@ -0,0 +1,61 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"context"
+	"log"
+	"time"
+)
+
+//Purger periodically removes deleted users after their retention window as well as expired
+//verification tokens, enrollments and user events. It is required for all backends, backends with native
+//expiry like dynamodb only need it to remove deleted users together with their devices and wrappings
+type Purger struct {
+	UserRepo       userRepository.UserRepo
+	TokenRepo      userRepository.VerificationTokenRepo
+	EnrollmentRepo userRepository.EnrollmentRepo
+	EventRepo      userRepository.UserEventRepo
+	Retention      time.Duration
+	EventRetention time.Duration
+	Interval       time.Duration
+}
+
+//PurgeOnce runs a single purge pass
+func (p *Purger) PurgeOnce(ctx context.Context) {
+	now := time.Now()
+	users, err := p.UserRepo.PurgeDeleted(ctx, now.Add(-p.Retention))
+	if err != nil {
+		log.Printf("failed to purge deleted users : %v", err)
+	} else if users > 0 {
+		log.Printf("purged %v deleted users", users)
+	}
+	if p.TokenRepo != nil {
+		if _, err := p.TokenRepo.PurgeExpiredTokens(ctx, now); err != nil {
+			log.Printf("failed to purge expired tokens : %v", err)
+		}
+	}
+	if p.EnrollmentRepo != nil {
+		if _, err := p.EnrollmentRepo.PurgeExpiredEnrollments(ctx, now); err != nil {
+			log.Printf("failed to purge expired enrollments : %v", err)
+		}
+	}
+	if p.EventRepo != nil {
+		if _, err := p.EventRepo.PurgeUserEvents(ctx, now.Add(-p.EventRetention)); err != nil {
+			log.Printf("failed to purge expired user events : %v", err)
+		}
+	}
+}
+
+//Run purges every Interval until ctx is done
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		p.PurgeOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
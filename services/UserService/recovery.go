@@ -0,0 +1,309 @@
+package UserService
+
+import (
+	"UserService/adapters/mailer"
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"strings"
+	"time"
+)
+
+const maxRecoveryLabelLength = 64
+
+var errRecoveryNotConfigured = status.Error(codes.FailedPrecondition, "account recovery is not configured")
+var errRecoveryWrappingNotFound = status.Error(codes.NotFound, "recovery wrapping not found")
+
+//recoveryWrappingToDTOGRPC converts w. The wrapped master key is only included if withBlob is set
+func recoveryWrappingToDTOGRPC(w *domain.RecoveryWrapping, withBlob bool) (*UserServiceSchema.RecoveryWrapping, error) {
+	grpcWrapping := &UserServiceSchema.RecoveryWrapping{
+		Id:            w.ID,
+		Email:         w.OwnerEmail,
+		Kind:          string(w.Kind),
+		Label:         w.Label,
+		CreatedAtUnix: w.CreatedAt.Unix(),
+	}
+	if w.EscrowPublicKey != nil {
+		pkPKIX, err := x509.MarshalPKIXPublicKey(w.EscrowPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert .EscrowPublicKey field : %v", err)
+		}
+		grpcWrapping.EscrowPublicKey = pkPKIX
+	}
+	if withBlob {
+		grpcWrapping.WrappedMasterKey = w.WrappedMasterKey
+	}
+	return grpcWrapping, nil
+}
+
+//recoveryConfigured returns true if wrappings can be stored and recovery mails can be sent
+func (us *UserService) recoveryConfigured() bool {
+	return us.recoveryRepo != nil && us.tokenRepo != nil && us.mailSender != nil
+}
+
+//AddRecoveryWrapping stores an additional wrapping of the master key under a recovery secret. The request
+//has to be signed by the primary key or an active device of the user
+func (us *UserService) AddRecoveryWrapping(ctx context.Context, req *UserServiceSchema.UserRequestAddRecoveryWrapping) (*UserServiceSchema.RecoveryWrapping, error) {
+	if !us.recoveryConfigured() {
+		return nil, errRecoveryNotConfigured
+	}
+	if req.Signature == nil {
+		return nil, errUnsignedRequest
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	kind := domain.RecoveryKind(req.Kind)
+	wrapping := &domain.RecoveryWrapping{
+		Kind:             kind,
+		Label:            strings.TrimSpace(req.Label),
+		WrappedMasterKey: req.WrappedMasterKey,
+	}
+	switch kind {
+	case domain.RecoveryKindCode:
+		if len(req.EscrowPublicKey) != 0 {
+			v.add("escrow_public_key", fmt.Errorf("must be empty for kind %v", kind))
+		}
+	case domain.RecoveryKindEscrow:
+		if wrapping.EscrowPublicKey, err = parsePublicKey(req.EscrowPublicKey); err != nil {
+			v.add("escrow_public_key", err)
+		}
+	default:
+		v.add("kind", fmt.Errorf("must be %v or %v", domain.RecoveryKindCode, domain.RecoveryKindEscrow))
+	}
+	if len(wrapping.Label) > maxRecoveryLabelLength {
+		v.add("label", fmt.Errorf("must not be longer than %v bytes", maxRecoveryLabelLength))
+	}
+	if err := validateBlob(req.WrappedMasterKey, maxWrappedMasterKeyLength); err != nil {
+		v.add("wrapped_master_key", err)
+	}
+	validateRequestSignature(&v, req.Signature)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := us.activeUserByEmail(ctx, email); err != nil {
+		return nil, err
+	}
+	ok, err := us.signedBy(ctx, email, req.Signature, domain.ActionAddRecoveryWrapping,
+		email, string(kind), wrapping.Label, string(req.EscrowPublicKey), string(req.WrappedMasterKey))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidRequestSignature
+	}
+	if wrapping.ID, err = newID(); err != nil {
+		return nil, err
+	}
+	wrapping.OwnerEmail = email
+	wrapping.CreatedAt = time.Now()
+	wrapping, err = us.recoveryRepo.AddRecoveryWrapping(ctx, wrapping)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add recovery wrapping :%v", err)
+	}
+	grpcWrapping, err := recoveryWrappingToDTOGRPC(wrapping, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize recovery wrapping :%v", err)
+	}
+	return grpcWrapping, nil
+}
+
+//ListRecoveryWrappings returns the recovery wrappings of the user without their wrapped master keys
+func (us *UserService) ListRecoveryWrappings(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.RecoveryWrappingList, error) {
+	if !us.recoveryConfigured() {
+		return nil, errRecoveryNotConfigured
+	}
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := us.activeUserByEmail(ctx, email); err != nil {
+		return nil, err
+	}
+	wrappings, err := us.recoveryRepo.ListRecoveryWrappings(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recovery wrappings :%v", err)
+	}
+	list := &UserServiceSchema.RecoveryWrappingList{}
+	for _, w := range wrappings {
+		grpcWrapping, err := recoveryWrappingToDTOGRPC(w, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize recovery wrapping :%v", err)
+		}
+		list.Wrappings = append(list.Wrappings, grpcWrapping)
+	}
+	return list, nil
+}
+
+//DeleteRecoveryWrapping removes a recovery wrapping of the user. The request has to be signed by the
+//primary key or an active device of the user
+func (us *UserService) DeleteRecoveryWrapping(ctx context.Context, req *UserServiceSchema.UserRequestRecoveryWrapping) (*UserServiceSchema.Empty, error) {
+	if !us.recoveryConfigured() {
+		return nil, errRecoveryNotConfigured
+	}
+	if req.Signature == nil {
+		return nil, errUnsignedRequest
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if req.WrappingId == "" {
+		v.add("wrapping_id", fmt.Errorf("must not be empty"))
+	}
+	validateRequestSignature(&v, req.Signature)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	ok, err := us.signedBy(ctx, email, req.Signature, domain.ActionDeleteRecoveryWrapping, email, req.WrappingId)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidRequestSignature
+	}
+	if err := us.recoveryRepo.DeleteRecoveryWrapping(ctx, email, req.WrappingId); err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errRecoveryWrappingNotFound
+		}
+		return nil, fmt.Errorf("failed to delete recovery wrapping :%v", err)
+	}
+	return &UserServiceSchema.Empty{}, nil
+}
+
+//StartRecovery mails a recovery token to the user. It is required by RecoverAccount
+func (us *UserService) StartRecovery(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.Empty, error) {
+	if !us.recoveryConfigured() {
+		return nil, errRecoveryNotConfigured
+	}
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	domainUser, err := us.activeUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	token, err := us.issueToken(ctx, domainUser, domain.VerificationPurposeRecovery)
+	if err != nil {
+		return nil, err
+	}
+	err = us.mailSender.Send(ctx, &mailer.Message{
+		To:      domainUser.Email,
+		Subject: "Recover your account",
+		Body: fmt.Sprintf("Someone requested to recover your account. If this was not you, ignore this mail. "+
+			"The following code is valid until %v.\n\n%v\n",
+			time.Now().Add(us.verificationTTL).UTC().Format(time.RFC1123), token),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send recovery mail :%v", err)
+	}
+	return &UserServiceSchema.Empty{}, nil
+}
+
+//RecoverAccount returns the requested recovery wrapping including its wrapped master key once the
+//user proved control of the email with the token sent by StartRecovery. Every recovery is audited
+//and announced to the user by mail
+func (us *UserService) RecoverAccount(ctx context.Context, req *UserServiceSchema.UserRequestRecoverAccount) (*UserServiceSchema.RecoveryWrapping, error) {
+	if !us.recoveryConfigured() {
+		return nil, errRecoveryNotConfigured
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if strings.TrimSpace(req.Token) == "" {
+		v.add("token", fmt.Errorf("must not be empty"))
+	}
+	if req.WrappingId == "" {
+		v.add("wrapping_id", fmt.Errorf("must not be empty"))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	domainUser, err := us.activeUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	//look up the wrapping first to not waste the token on a typo
+	wrapping, err := us.recoveryRepo.GetRecoveryWrapping(ctx, email, req.WrappingId)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errRecoveryWrappingNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch recovery wrapping :%v", err)
+	}
+	if err := us.consumeToken(ctx, email, req.Token, domain.VerificationPurposeRecovery); err != nil {
+		return nil, err
+	}
+
+	auditID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = us.recoveryRepo.AddRecoveryAudit(ctx, &domain.RecoveryAudit{
+		ID:          auditID,
+		OwnerEmail:  email,
+		WrappingID:  wrapping.ID,
+		Kind:        wrapping.Kind,
+		RecoveredAt: now,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to audit recovery :%v", err)
+	}
+	err = us.mailSender.Send(ctx, &mailer.Message{
+		To:      domainUser.Email,
+		Subject: "Your account has been recovered",
+		Body: fmt.Sprintf("Your account has been recovered with %v %q at %v.\n",
+			wrapping.Kind, wrapping.Label, now.UTC().Format(time.RFC1123)),
+	})
+	if err != nil {
+		//the recovery has been audited already, do not fail it because of the notification
+		log.Printf("failed to send recovery notification to %v : %v", domainUser.Email, err)
+	}
+
+	grpcWrapping, err := recoveryWrappingToDTOGRPC(wrapping, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize recovery wrapping :%v", err)
+	}
+	return grpcWrapping, nil
+}
+
+func (us *UserService) ListRecoveryAudits(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.RecoveryAuditList, error) {
+	if !us.recoveryConfigured() {
+		return nil, errRecoveryNotConfigured
+	}
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	audits, err := us.recoveryRepo.ListRecoveryAudits(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recovery audits :%v", err)
+	}
+	list := &UserServiceSchema.RecoveryAuditList{}
+	for _, a := range audits {
+		list.Audits = append(list.Audits, &UserServiceSchema.RecoveryAudit{
+			Id:              a.ID,
+			Email:           a.OwnerEmail,
+			WrappingId:      a.WrappingID,
+			Kind:            string(a.Kind),
+			RecoveredAtUnix: a.RecoveredAt.Unix(),
+		})
+	}
+	return list, nil
+}
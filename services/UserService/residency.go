@@ -0,0 +1,66 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+var errResidencyNotConfigured = status.Error(codes.FailedPrecondition, "data residency is not configured")
+
+//validateRegion checks the region requested for a new user. An empty region selects the default region
+func (us *UserService) validateRegion(region string) error {
+	if region == "" {
+		return nil
+	}
+	var v violations
+	if us.residency == nil {
+		v.add("region", fmt.Errorf("data residency is not configured"))
+	} else if !us.residency.HasRegion(region) {
+		v.add("region", fmt.Errorf("must be one of %v", strings.Join(us.residency.Regions(), ", ")))
+	}
+	return v.err()
+}
+
+//MoveUser moves the user with the email to the storage of another region. Writes to the user fail
+//while it is moved, reads are served throughout. A failed move can be resumed by calling MoveUser again
+func (us *UserService) MoveUser(ctx context.Context, req *UserServiceSchema.UserRequestMove) (*UserServiceSchema.UserSummary, error) {
+	if us.residency == nil {
+		return nil, errResidencyNotConfigured
+	}
+	if err := us.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if !us.residency.HasRegion(req.Region) {
+		v.add("region", fmt.Errorf("must be one of %v", strings.Join(us.residency.Regions(), ", ")))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	moved, err := us.residency.MoveUser(ctx, email, req.Region)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, errUserNotFound
+		}
+		if errors.Is(err, userRepository.ErrUserMoving) {
+			return nil, status.Error(codes.FailedPrecondition, "user is moved to another region")
+		}
+		return nil, fmt.Errorf("failed to move user :%v", err)
+	}
+	if us.userCache != nil {
+		us.userCache.Invalidate(moved)
+	}
+	return userToSummaryDTOGRPC(moved)
+}
@@ -0,0 +1,66 @@
+package UserService
+
+import (
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+//maxRequestSkew is the maximal difference between the timestamp of a signed request and the server time
+const maxRequestSkew = 5 * time.Minute
+
+var errInvalidRequestSignature = status.Error(codes.PermissionDenied, "request is not signed by a permitted user")
+var errUnsignedRequest = status.Error(codes.Unauthenticated, "request has to be signed by a key of the user")
+
+//validateTimestamp checks that the signed timestamp of a request is close to now. This bounds the
+//time in which a captured request can be replayed
+func validateTimestamp(timestampUnix int64, now time.Time) error {
+	requestedAt := time.Unix(timestampUnix, 0)
+	if requestedAt.Before(now.Add(-maxRequestSkew)) || requestedAt.After(now.Add(maxRequestSkew)) {
+		return fmt.Errorf("must be within %v of the server time", maxRequestSkew)
+	}
+	return nil
+}
+
+//validateRequestSignature adds violations for malformed request signatures
+func validateRequestSignature(v *violations, sig *UserServiceSchema.RequestSignature) {
+	if sig == nil {
+		v.add("signature", fmt.Errorf("must be set"))
+		return
+	}
+	if _, err := parsePublicKey(sig.SignerPublicKey); err != nil {
+		v.add("signature.signer_public_key", err)
+	}
+	if err := validateTimestamp(sig.TimestampUnix, time.Now()); err != nil {
+		v.add("signature.timestamp_unix", err)
+	}
+	if len(sig.Signature) == 0 {
+		v.add("signature.signature", fmt.Errorf("must not be empty"))
+	}
+}
+
+//signedBy returns true if sig has been created with a key of the active user with email over
+//domain.SignedRequestDigest of action and fields. sig has to be validated by validateRequestSignature
+func (us *UserService) signedBy(ctx context.Context, email string, sig *UserServiceSchema.RequestSignature, action string, fields ...string) (bool, error) {
+	actor, err := us.activeUserByEmail(ctx, email)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	ok, err := us.isUserKey(ctx, actor, email, sig.SignerPublicKey)
+	if err != nil || !ok {
+		return false, err
+	}
+	signerPk, err := parsePublicKey(sig.SignerPublicKey)
+	if err != nil {
+		return false, nil
+	}
+	digest := domain.SignedRequestDigest(action, sig.TimestampUnix, fields...)
+	return domain.VerifySignature(signerPk, digest, sig.Signature) == nil, nil
+}
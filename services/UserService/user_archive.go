@@ -0,0 +1,173 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+)
+
+//archiveChunkSize is the size of the chunks ExportUsers streams the archive in
+const archiveChunkSize = 64 * 1024
+
+//ExportUserArchive writes all users including deleted ones as archive to w, see
+//domain.NewUserArchiveWriter. It returns the number of exported users
+func (us *UserService) ExportUserArchive(ctx context.Context, w io.Writer) (count int, err error) {
+	if us.userAdminRepo == nil {
+		return 0, errUserAdminNotConfigured
+	}
+	defer func() { us.auditOperation(ctx, "ExportUsers", err) }()
+
+	aw, err := domain.NewUserArchiveWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	if err := us.userAdminRepo.ScanUsers(ctx, aw.Write); err != nil {
+		return aw.Count(), fmt.Errorf("failed to export users :%v", err)
+	}
+	return aw.Count(), aw.Close()
+}
+
+//ImportUserArchive replays an archive written by ExportUserArchive. The whole archive is verified before
+//the first user is written. Users conflicting with existing users are handled according to policy, a
+//key that belongs to another user is a conflict under every policy except skip
+func (us *UserService) ImportUserArchive(ctx context.Context, r io.Reader, policy domain.ImportConflictPolicy) (report *domain.UserImportReport, err error) {
+	if us.userAdminRepo == nil {
+		return nil, errUserAdminNotConfigured
+	}
+	if policy != domain.ImportConflictSkip && policy != domain.ImportConflictOverwrite && policy != domain.ImportConflictFail {
+		var v violations
+		v.add("conflict_policy", fmt.Errorf("must be %v, %v or %v", domain.ImportConflictSkip, domain.ImportConflictOverwrite, domain.ImportConflictFail))
+		return nil, v.err()
+	}
+	defer func() { us.auditOperation(ctx, "ImportUsers", err) }()
+
+	users, err := domain.ReadUserArchive(r)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid archive : %v", err)
+	}
+	report = &domain.UserImportReport{}
+	//the users imported before a failure are logged as well
+	defer us.syncKeyLog(ctx)
+	for _, u := range users {
+		replaced, err := us.userAdminRepo.ImportUser(ctx, u, policy == domain.ImportConflictOverwrite)
+		if err != nil {
+			if errors.Is(err, userRepository.ErrAlreadyExists) {
+				if policy == domain.ImportConflictSkip {
+					report.Skipped++
+					continue
+				}
+				return report, status.Errorf(codes.AlreadyExists, "%v conflicts with an existing user or device", u.Email)
+			}
+			return report, fmt.Errorf("failed to import %v :%v", u.Email, err)
+		}
+		if replaced {
+			report.Overwritten++
+		} else {
+			report.Imported++
+		}
+	}
+	return report, nil
+}
+
+func importReportToDTOGRPC(r *domain.UserImportReport) *UserServiceSchema.UserImportReport {
+	return &UserServiceSchema.UserImportReport{
+		Imported:    int64(r.Imported),
+		Overwritten: int64(r.Overwritten),
+		Skipped:     int64(r.Skipped),
+	}
+}
+
+//chunkSender streams the bytes written to it as UserArchiveChunk messages
+type chunkSender struct {
+	stream UserServiceSchema.UserService_ExportUsersServer
+	buf    []byte
+}
+
+func (c *chunkSender) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for len(c.buf) >= archiveChunkSize {
+		if err := c.stream.Send(&UserServiceSchema.UserArchiveChunk{Data: c.buf[:archiveChunkSize]}); err != nil {
+			return 0, err
+		}
+		c.buf = append([]byte(nil), c.buf[archiveChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (c *chunkSender) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	err := c.stream.Send(&UserServiceSchema.UserArchiveChunk{Data: c.buf})
+	c.buf = nil
+	return err
+}
+
+//ExportUsers streams the archive of all users in chunks. The archive ends with a trailer, so a stream
+//that breaks off is detected on import
+func (us *UserService) ExportUsers(_ *UserServiceSchema.Empty, stream UserServiceSchema.UserService_ExportUsersServer) error {
+	if err := us.authorizeUserAdmin(stream.Context()); err != nil {
+		return err
+	}
+	sender := &chunkSender{stream: stream}
+	if _, err := us.ExportUserArchive(stream.Context(), sender); err != nil {
+		return err
+	}
+	return sender.flush()
+}
+
+//chunkReader reads the archive from the chunks of an ImportUsers stream
+type chunkReader struct {
+	stream UserServiceSchema.UserService_ImportUsersServer
+	policy string
+	buf    []byte
+}
+
+//next receives the next chunk. The conflict policy is taken from the first chunk
+func (c *chunkReader) next() error {
+	req, err := c.stream.Recv()
+	if err != nil {
+		return err
+	}
+	if c.policy == "" {
+		c.policy = req.ConflictPolicy
+	}
+	c.buf = req.Data
+	return nil
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+//ImportUsers imports an archive streamed in chunks. The conflict policy is set in the first chunk
+func (us *UserService) ImportUsers(stream UserServiceSchema.UserService_ImportUsersServer) error {
+	if err := us.authorizeUserAdmin(stream.Context()); err != nil {
+		return err
+	}
+	reader := &chunkReader{stream: stream}
+	if err := reader.next(); err != nil {
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "empty import")
+		}
+		return err
+	}
+	report, err := us.ImportUserArchive(stream.Context(), reader, domain.ImportConflictPolicy(reader.policy))
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(importReportToDTOGRPC(report))
+}
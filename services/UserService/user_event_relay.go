@@ -0,0 +1,92 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	//DefaultUserEventRelayInterval is the time between the runs of the UserEventRelay
+	DefaultUserEventRelayInterval = 5 * time.Second
+	//relayEventPageSize is the number of events relayed at once. It stays below the items of a dynamodb
+	//transaction
+	relayEventPageSize = 50
+)
+
+//UserEventRelay appends the events of the outboxes in Sources to the outbox of Target, which the key log,
+//the webhooks and the event stream read. It is needed when users are written to backends whose outbox
+//can not share a transaction with Target, e.g. the regions of global tables. A cursor per source keeps
+//track of the relayed events, so multiple instances may run concurrently
+type UserEventRelay struct {
+	Sources  map[string]userRepository.UserEventRepo
+	Target   userRepository.UserEventRelayRepo
+	Interval time.Duration
+}
+
+//relaySource appends the events of source after its cursor to the target
+func relaySource(ctx context.Context, target userRepository.UserEventRelayRepo, name string, source userRepository.UserEventRepo) error {
+	for {
+		after, err := target.GetRelayCursor(ctx, name)
+		if err != nil {
+			return err
+		}
+		events, err := source.ListUserEvents(ctx, after, relayEventPageSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		if after > 0 && events[0].Sequence != after+1 {
+			log.Printf("relay of %v misses the user events %v to %v, they expired before they were relayed", name, after+1, events[0].Sequence-1)
+		}
+		relayed := make([]*domain.UserEvent, 0, len(events))
+		for _, e := range events {
+			copied := *e
+			copied.Sequence = 0
+			relayed = append(relayed, &copied)
+		}
+		err = target.RelayUserEvents(ctx, name, after, events[len(events)-1].Sequence, relayed)
+		//another instance relayed the events, continue after them
+		if err != nil && !errors.Is(err, userRepository.ErrCursorMoved) {
+			return err
+		}
+	}
+}
+
+//RelayOnce relays all events of the sources that have not been relayed yet
+func (r *UserEventRelay) RelayOnce(ctx context.Context) error {
+	names := make([]string, 0, len(r.Sources))
+	for name := range r.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := relaySource(ctx, r.Target, name, r.Sources[name]); err != nil {
+			return fmt.Errorf("failed to relay user events of %v : %v", name, err)
+		}
+	}
+	return nil
+}
+
+//Run relays every Interval until ctx is done
+func (r *UserEventRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.RelayOnce(ctx); err != nil {
+			log.Printf("%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package UserService
+
+import (
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"time"
+)
+
+//userEventPageSize is the number of events fetched from the outbox at once
+const userEventPageSize = 100
+
+func userEventToDTOGRPC(e *domain.UserEvent) *UserServiceSchema.UserEvent {
+	return &UserServiceSchema.UserEvent{
+		Cursor:        e.Sequence,
+		Kind:          string(e.Kind),
+		Email:         e.Email,
+		PublicKey:     e.PublicKeyPKIX,
+		State:         string(e.State),
+		CreatedAtUnix: e.CreatedAt.Unix(),
+	}
+}
+
+//WatchUserEvents streams all user events after req.Cursor in order and keeps the stream open for new
+//events. It is restricted to admins, as the events expose the keys of all users. Subscribers reconnect
+//with the cursor of the last event they have processed. If events after the cursor have already expired
+//OutOfRange is returned, if events go missing while streaming DataLoss, as the subscriber would miss them
+func (us *UserService) WatchUserEvents(req *UserServiceSchema.UserEventRequestWatch, stream UserServiceSchema.UserService_WatchUserEventsServer) error {
+	if us.userEventRepo == nil {
+		return status.Error(codes.FailedPrecondition, "user events are not configured")
+	}
+	ctx := stream.Context()
+	if err := us.authorizeAdmin(ctx); err != nil {
+		return err
+	}
+	cursor := req.GetCursor()
+	if cursor < 0 {
+		return status.Error(codes.InvalidArgument, "cursor must not be negative")
+	}
+
+	ticker := time.NewTicker(us.eventPollInterval)
+	defer ticker.Stop()
+	//a new subscriber starts at the oldest event that has not expired
+	checkGap := cursor > 0
+	sent := false
+	for {
+		events, err := us.userEventRepo.ListUserEvents(ctx, cursor, userEventPageSize)
+		if err != nil {
+			log.Printf("failed to list user events : %v", err)
+			return status.Error(codes.Internal, "failed to list user events")
+		}
+		for _, v := range events {
+			//sequences have no gaps, so a missing successor has been purged before it could be sent
+			if checkGap && v.Sequence != cursor+1 {
+				if !sent {
+					return status.Errorf(codes.OutOfRange, "events after cursor %v have expired", cursor)
+				}
+				return status.Errorf(codes.DataLoss, "events %v to %v are missing", cursor+1, v.Sequence-1)
+			}
+			if err := stream.Send(userEventToDTOGRPC(v)); err != nil {
+				return err
+			}
+			cursor = v.Sequence
+			checkGap = true
+			sent = true
+		}
+		if len(events) == userEventPageSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,25 +1,64 @@
 package UserService
 
 import (
+	"UserService/adapters/mailer"
 	"UserService/adapters/userRepository"
 	"UserService/domain"
 	"UserService/protobufs/UserServiceSchema"
 	"context"
+	"crypto"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
 )
 
-func NewUserService(userRepo userRepository.UserRepo) *UserService {
-	return &UserService{
-		userRepo: userRepo,
+func NewUserService(userRepo userRepository.UserRepo, opts ...Option) *UserService {
+	us := &UserService{
+		userRepo:          userRepo,
+		verificationTTL:   DefaultVerificationTTL,
+		enrollmentTTL:     DefaultEnrollmentTTL,
+		eventPollInterval: DefaultEventPollInterval,
+		retention:         userRepository.DefaultRetention,
 	}
+	for _, opt := range opts {
+		opt(us)
+	}
+	return us
 }
 
 type UserService struct {
 	UserServiceSchema.UnimplementedUserServiceServer
-	userRepo userRepository.UserRepo
+	userRepo          userRepository.UserRepo
+	tokenRepo         userRepository.VerificationTokenRepo
+	deviceRepo        userRepository.DeviceRepo
+	enrollmentRepo    userRepository.EnrollmentRepo
+	recoveryRepo      userRepository.RecoveryRepo
+	organizationRepo  userRepository.OrganizationRepo
+	groupRepo         userRepository.GroupRepo
+	keyLog            *keyLog
+	signingKeys       []domain.ServiceSigningKey
+	auditRepo         userRepository.AuditRepo
+	adminToken        string
+	userEventRepo     userRepository.UserEventRepo
+	webhookRepo       userRepository.WebhookRepo
+	userAdminRepo     userRepository.UserAdminRepo
+	userCache         *userRepository.CachedUserRepo
+	cacheBus          *PeerInvalidationBus
+	backendHealth     func() error
+	residency         *userRepository.ResidencyRepo
+	mailSender        mailer.Sender
+	verificationTTL   time.Duration
+	enrollmentTTL     time.Duration
+	retention         time.Duration
+	eventPollInterval time.Duration
 }
 
+//errUserNotFound is returned for unknown users as well as users that are not visible in the directory
+var errUserNotFound = status.Error(codes.NotFound, "user not found")
+
 func userToDTOGRPC(u *domain.User) (*UserServiceSchema.User, error) {
 	pkPKIX, err := x509.MarshalPKIXPublicKey(u.PublicKey)
 	if err != nil {
@@ -36,11 +75,29 @@ func userToDTOGRPC(u *domain.User) (*UserServiceSchema.User, error) {
 	return grpcUser, nil
 }
 
+//samePublicKey returns true if a and b are the same key
+func samePublicKey(a, b crypto.PublicKey) bool {
+	aEq, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && aEq.Equal(b)
+}
+
 func (us *UserService) GetUserByPk(ctx context.Context, userRequest *UserServiceSchema.UserRequestPk) (*UserServiceSchema.User, error) {
+	if err := validatePkRequest(userRequest.PublicKey); err != nil {
+		return nil, err
+	}
 	domainUser, err := us.userRepo.GetByPk(ctx, userRequest.PublicKey)
-	if err != nil {
+	if errors.Is(err, userRepository.ErrNotFound) {
+		//the key may belong to one of the users devices
+		domainUser, err = us.userByDevicePk(ctx, userRequest.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to fetch user :%v", err)
 	}
+	if !domainUser.IsActive() {
+		return nil, errUserNotFound
+	}
 	grpcUser, err := userToDTOGRPC(domainUser)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert domain user to dto : %v", err)
@@ -49,10 +106,17 @@ func (us *UserService) GetUserByPk(ctx context.Context, userRequest *UserService
 
 }
 func (us *UserService) GetUserByEmail(ctx context.Context, userRequest *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.User, error) {
-	domainUser, err := us.userRepo.GetByEmail(ctx, userRequest.Email)
+	email, err := validateEmailRequest(userRequest.Email)
+	if err != nil {
+		return nil, err
+	}
+	domainUser, err := us.userRepo.GetByEmail(ctx, email)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch user :%v", err)
 	}
+	if !domainUser.IsActive() {
+		return nil, errUserNotFound
+	}
 	grpcUser, err := userToDTOGRPC(domainUser)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert domain user to dto : %v", err)
@@ -61,20 +125,147 @@ func (us *UserService) GetUserByEmail(ctx context.Context, userRequest *UserServ
 }
 
 func (us *UserService) CreateUser(ctx context.Context, req *UserServiceSchema.UserRequestCreate) (*UserServiceSchema.User, error) {
-	genericPK, err := x509.ParsePKIXPublicKey(req.PublicKey)
+	validReq, err := validateCreateRequest(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key : %v", err)
+		return nil, err
 	}
 
+	if us.tokenRepo == nil || us.mailSender == nil {
+		return nil, status.Error(codes.FailedPrecondition, "email verification is not configured")
+	}
+	org, err := us.organizationOf(ctx, validReq.email)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateEscrowWrapping(org, validReq.escrowWrappedMasterKey); err != nil {
+		return nil, err
+	}
+
+	if err := us.validateRegion(validReq.region); err != nil {
+		return nil, err
+	}
 	domainUser := &domain.User{
-		Email:             req.Email,
-		PublicKey:         genericPK,
-		WrappedPrivateKey: req.WrappedPrivateKey,
-		WrappedMasterKey:  req.WrappedMasterKey,
+		Email:             validReq.email,
+		State:             domain.UserStatePending,
+		PublicKey:         validReq.publicKey,
+		WrappedPrivateKey: validReq.wrappedPrivateKey,
+		WrappedMasterKey:  validReq.wrappedMasterKey,
+		Region:            validReq.region,
 	}
-	domainUser, err = us.userRepo.Create(ctx, domainUser)
+
+	//a pending user may repeat the request to get a new token. Pending users whose tokens expired
+	//are dropped, so nobody can block an email address forever
+	existing, err := us.userRepo.GetByEmail(ctx, validReq.email)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user :%v", err)
+		if !errors.Is(err, userRepository.ErrNotFound) {
+			return nil, fmt.Errorf("failed to fetch user :%v", err)
+		}
+		existing = nil
+	} else if us.isStalePending(existing) {
+		if err := us.userRepo.PurgeByEmail(ctx, existing.Email); err != nil {
+			return nil, fmt.Errorf("failed to delete stale pending user :%v", err)
+		}
+		existing = nil
+	}
+
+	if existing != nil && !existing.IsActive() && samePublicKey(existing.PublicKey, validReq.publicKey) {
+		//updating records the time of the request for isStalePending
+		domainUser, err = us.userRepo.Update(ctx, existing)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update pending user :%v", err)
+		}
+	} else {
+		//the keys of all users are public, so a key must not be taken over by another email
+		inUse, err := us.isKeyInUse(ctx, req.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if inUse {
+			return nil, status.Error(codes.AlreadyExists, "public key is already in use")
+		}
+		domainUser, err = us.userRepo.Create(ctx, domainUser)
+		if err != nil {
+			//e.g. the key of a deleted user, which is kept until the user is purged
+			if errors.Is(err, userRepository.ErrAlreadyExists) {
+				return nil, status.Error(codes.AlreadyExists, "user or public key already exists")
+			}
+			return nil, fmt.Errorf("failed to create user :%v", err)
+		}
+		us.syncKeyLog(ctx)
+	}
+	if err := us.storeEscrowWrapping(ctx, org, validReq.email, validReq.escrowWrappedMasterKey); err != nil {
+		return nil, err
+	}
+
+	if err := us.sendVerificationMail(ctx, domainUser); err != nil {
+		return nil, fmt.Errorf("failed to send verification mail :%v", err)
+	}
+	grpcUser, err := userToDTOGRPC(domainUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user :%v", err)
+	}
+	return grpcUser, nil
+}
+
+//UpdateUser replaces the wrapped keys of the user. The request has to be signed by the primary key or
+//an active device of the user over domain.UserUpdateDigest
+func (us *UserService) UpdateUser(ctx context.Context, req *UserServiceSchema.UserRequestUpdate) (*UserServiceSchema.User, error) {
+	var v violations
+	email, err := domain.NormalizeEmail(req.Email)
+	if err != nil {
+		v.add("email", err)
+	}
+	if err := validateBlob(req.WrappedPrivateKey, maxWrappedPrivateKeyLength); err != nil {
+		v.add("wrapped_private_key", err)
+	}
+	if err := validateBlob(req.WrappedMasterKey, maxWrappedMasterKeyLength); err != nil {
+		v.add("wrapped_master_key", err)
+	}
+	if len(req.EscrowWrappedMasterKey) > maxWrappedMasterKeyLength {
+		v.add("escrow_wrapped_master_key", fmt.Errorf("must not be longer than %v bytes", maxWrappedMasterKeyLength))
+	}
+	signerPk, err := parsePublicKey(req.SignerPublicKey)
+	if err != nil {
+		v.add("signer_public_key", err)
+	}
+	if len(req.Signature) == 0 {
+		v.add("signature", fmt.Errorf("must not be empty"))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	domainUser, err := us.activeUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := us.isUserKey(ctx, domainUser, email, req.SignerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "signer is no key of the user")
+	}
+	digest := domain.UserUpdateDigest(email, domainUser.UpdatedAt.Unix(), req.WrappedPrivateKey, req.WrappedMasterKey, req.EscrowWrappedMasterKey)
+	if err := domain.VerifySignature(signerPk, digest, req.Signature); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "invalid update signature")
+	}
+	org, err := us.organizationOf(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateEscrowWrapping(org, req.EscrowWrappedMasterKey); err != nil {
+		return nil, err
+	}
+
+	domainUser.WrappedPrivateKey = req.WrappedPrivateKey
+	domainUser.WrappedMasterKey = req.WrappedMasterKey
+	domainUser, err = us.userRepo.Update(ctx, domainUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user :%v", err)
+	}
+	if err := us.storeEscrowWrapping(ctx, org, email, req.EscrowWrappedMasterKey); err != nil {
+		return nil, err
 	}
 	grpcUser, err := userToDTOGRPC(domainUser)
 	if err != nil {
@@ -84,17 +275,50 @@ func (us *UserService) CreateUser(ctx context.Context, req *UserServiceSchema.Us
 }
 
 func (us *UserService) DeleteUserByEmail(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.Empty, error) {
-	if err := us.userRepo.DeleteByEmail(ctx, req.Email); err != nil {
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	if err := us.userRepo.DeleteByEmail(ctx, email); err != nil {
 		return nil, err
 	}
+	us.syncKeyLog(ctx)
 	return &UserServiceSchema.Empty{}, nil
 }
 
+//RestoreUser undoes DeleteUserByEmail if the user has been deleted within the retention window
+func (us *UserService) RestoreUser(ctx context.Context, req *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.User, error) {
+	email, err := validateEmailRequest(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	domainUser, err := us.userRepo.Restore(ctx, email, time.Now().Add(-us.retention))
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "no restorable user found")
+		}
+		return nil, fmt.Errorf("failed to restore user :%v", err)
+	}
+	us.syncKeyLog(ctx)
+	grpcUser, err := userToDTOGRPC(domainUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user :%v", err)
+	}
+	return grpcUser, nil
+}
+
 func (us *UserService) GetUserPkByEmail(ctx context.Context, userRequest *UserServiceSchema.UserRequestEmail) (*UserServiceSchema.UserPk, error) {
-	domainUser, err := us.userRepo.GetByEmail(ctx, userRequest.Email)
+	email, err := validateEmailRequest(userRequest.Email)
+	if err != nil {
+		return nil, err
+	}
+	domainUser, err := us.userRepo.GetByEmail(ctx, email)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch user :%v", err)
 	}
+	if !domainUser.IsActive() {
+		return nil, errUserNotFound
+	}
 	grpcUser, err := userToDTOGRPC(domainUser)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert domain user to dto : %v", err)
@@ -103,5 +327,11 @@ func (us *UserService) GetUserPkByEmail(ctx context.Context, userRequest *UserSe
 		Email:     grpcUser.Email,
 		PublicKey: grpcUser.PublicKey,
 	}
+	if len(us.signingKeys) > 0 {
+		userPK.Attestation, err = us.attestBinding(email, grpcUser.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return userPK, nil
 }
@@ -0,0 +1,166 @@
+package UserService
+
+import (
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+const (
+	//maxPublicKeyLength bounds the PKIX encoding, large enough for RSA 8192
+	maxPublicKeyLength         = 2048
+	maxWrappedPrivateKeyLength = 16 * 1024
+	maxWrappedMasterKeyLength  = 1024
+	minRSAKeyBits              = 2048
+)
+
+//allowedCurves are the ecdsa curves accepted for user keys
+var allowedCurves = map[elliptic.Curve]bool{
+	elliptic.P256(): true,
+	elliptic.P384(): true,
+	elliptic.P521(): true,
+}
+
+//violations collects field level errors and converts them to an InvalidArgument status
+type violations []*errdetails.BadRequest_FieldViolation
+
+func (v *violations) add(field string, err error) {
+	*v = append(*v, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: err.Error(),
+	})
+}
+
+//err returns nil if no violations have been recorded
+func (v violations) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("invalid request : %v", v[0].Description))
+	stWithDetails, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: v})
+	if err != nil {
+		return st.Err()
+	}
+	return stWithDetails.Err()
+}
+
+//validatePublicKey checks that pk uses an allowed algorithm and key size
+func validatePublicKey(pk crypto.PublicKey) error {
+	switch k := pk.(type) {
+	case *ecdsa.PublicKey:
+		if !allowedCurves[k.Curve] {
+			return fmt.Errorf("ecdsa curve %v is not allowed", k.Curve.Params().Name)
+		}
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("rsa keys must have at least %v bits, got %v", minRSAKeyBits, k.N.BitLen())
+		}
+	case ed25519.PublicKey:
+	default:
+		return fmt.Errorf("key type %T is not allowed", pk)
+	}
+	return nil
+}
+
+//parsePublicKey parses and validates a PKIX encoded public key
+func parsePublicKey(pkPKIX []byte) (crypto.PublicKey, error) {
+	if len(pkPKIX) == 0 {
+		return nil, fmt.Errorf("public key must not be empty")
+	}
+	if len(pkPKIX) > maxPublicKeyLength {
+		return nil, fmt.Errorf("public key must not be longer than %v bytes", maxPublicKeyLength)
+	}
+	pk, err := x509.ParsePKIXPublicKey(pkPKIX)
+	if err != nil {
+		return nil, fmt.Errorf("public key is no valid PKIX key : %v", err)
+	}
+	if err := validatePublicKey(pk); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+//validateBlob checks that a wrapped key blob is present and not larger than maxLen
+func validateBlob(blob []byte, maxLen int) error {
+	if len(blob) == 0 {
+		return fmt.Errorf("must not be empty")
+	}
+	if len(blob) > maxLen {
+		return fmt.Errorf("must not be longer than %v bytes, got %v", maxLen, len(blob))
+	}
+	return nil
+}
+
+//validateEmailRequest returns the normalized email or an InvalidArgument status
+func validateEmailRequest(email string) (string, error) {
+	var v violations
+	normalized, err := domain.NormalizeEmail(email)
+	if err != nil {
+		v.add("email", err)
+	}
+	return normalized, v.err()
+}
+
+//validatePkRequest returns an InvalidArgument status if pkPKIX is not a well formed public key
+func validatePkRequest(pkPKIX []byte) error {
+	var v violations
+	if _, err := parsePublicKey(pkPKIX); err != nil {
+		v.add("public_key", err)
+	}
+	return v.err()
+}
+
+//validatedCreateRequest holds the validated fields of a UserRequestCreate
+type validatedCreateRequest struct {
+	//email is the display form, the repositories derive the normalized lookup key from it
+	email             string
+	publicKey         crypto.PublicKey
+	wrappedPrivateKey []byte
+	wrappedMasterKey  []byte
+	//escrowWrappedMasterKey is optional here, whether it is required depends on the organization
+	escrowWrappedMasterKey []byte
+	//region is optional, it is checked against the configured regions by the service
+	region string
+}
+
+func validateCreateRequest(req *UserServiceSchema.UserRequestCreate) (*validatedCreateRequest, error) {
+	var v violations
+	email := strings.TrimSpace(req.Email)
+	if _, err := domain.NormalizeEmail(email); err != nil {
+		v.add("email", err)
+	}
+	pk, err := parsePublicKey(req.PublicKey)
+	if err != nil {
+		v.add("public_key", err)
+	}
+	if err := validateBlob(req.WrappedPrivateKey, maxWrappedPrivateKeyLength); err != nil {
+		v.add("wrapped_private_key", err)
+	}
+	if err := validateBlob(req.WrappedMasterKey, maxWrappedMasterKeyLength); err != nil {
+		v.add("wrapped_master_key", err)
+	}
+	if len(req.EscrowWrappedMasterKey) > maxWrappedMasterKeyLength {
+		v.add("escrow_wrapped_master_key", fmt.Errorf("must not be longer than %v bytes", maxWrappedMasterKeyLength))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return &validatedCreateRequest{
+		email:                  email,
+		publicKey:              pk,
+		wrappedPrivateKey:      req.WrappedPrivateKey,
+		wrappedMasterKey:       req.WrappedMasterKey,
+		escrowWrappedMasterKey: req.EscrowWrappedMasterKey,
+		region:                 strings.TrimSpace(req.Region),
+	}, nil
+}
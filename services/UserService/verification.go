@@ -0,0 +1,130 @@
+package UserService
+
+import (
+	"UserService/adapters/mailer"
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+const verificationTokenBytes = 32
+
+var errInvalidToken = status.Error(codes.PermissionDenied, "invalid or expired verification token")
+
+//newVerificationToken returns a random url safe token
+func newVerificationToken() (string, error) {
+	buf := make([]byte, verificationTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to read randomness : %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+//issueToken stores a new token for u with purpose and returns the secret that has to be sent to the user
+func (us *UserService) issueToken(ctx context.Context, u *domain.User, purpose domain.VerificationPurpose) (string, error) {
+	normalizedEmail, err := domain.NormalizeEmail(u.Email)
+	if err != nil {
+		return "", fmt.Errorf("failed to normalize email : %v", err)
+	}
+	token, err := newVerificationToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = us.tokenRepo.CreateToken(ctx, &domain.VerificationToken{
+		TokenHash: domain.HashToken(token),
+		Email:     normalizedEmail,
+		Purpose:   purpose,
+		CreatedAt: now,
+		ExpiresAt: now.Add(us.verificationTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store token : %v", err)
+	}
+	return token, nil
+}
+
+//sendVerificationMail mails a new email verification token to the pending user u
+func (us *UserService) sendVerificationMail(ctx context.Context, u *domain.User) error {
+	token, err := us.issueToken(ctx, u, domain.VerificationPurposeEmail)
+	if err != nil {
+		return err
+	}
+	return us.mailSender.Send(ctx, &mailer.Message{
+		To:      u.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Confirm your email address with the following code. It is valid until %v.\n\n%v\n",
+			time.Now().Add(us.verificationTTL).UTC().Format(time.RFC1123), token),
+	})
+}
+
+//consumeToken invalidates token if it has been issued for email and purpose. Tokens presented for another
+//email or purpose stay valid
+func (us *UserService) consumeToken(ctx context.Context, email, token string, purpose domain.VerificationPurpose) error {
+	if us.tokenRepo == nil {
+		return status.Error(codes.FailedPrecondition, "email verification is not configured")
+	}
+	normalizedEmail, err := domain.NormalizeEmail(email)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	stored, err := us.tokenRepo.ConsumeToken(ctx, domain.HashToken(strings.TrimSpace(token)), normalizedEmail, purpose)
+	if err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return errInvalidToken
+		}
+		return fmt.Errorf("failed to consume token : %v", err)
+	}
+	if stored.Expired(time.Now()) {
+		return errInvalidToken
+	}
+	return nil
+}
+
+//isStalePending returns true for pending users whose verification tokens have all expired. Repeated
+//requests update the pending user, so its last token has been issued at UpdatedAt
+func (us *UserService) isStalePending(u *domain.User) bool {
+	return u.State == domain.UserStatePending && time.Since(u.UpdatedAt) > us.verificationTTL
+}
+
+func (us *UserService) ConfirmEmail(ctx context.Context, req *UserServiceSchema.UserRequestConfirmEmail) (*UserServiceSchema.User, error) {
+	var v violations
+	if _, err := domain.NormalizeEmail(req.Email); err != nil {
+		v.add("email", err)
+	}
+	if strings.TrimSpace(req.Token) == "" {
+		v.add("token", fmt.Errorf("must not be empty"))
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	if err := us.consumeToken(ctx, req.Email, req.Token, domain.VerificationPurposeEmail); err != nil {
+		return nil, err
+	}
+	domainUser, err := us.userRepo.GetByEmail(ctx, req.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user :%v", err)
+	}
+	if !domainUser.IsActive() {
+		domainUser.State = domain.UserStateActive
+		domainUser, err = us.userRepo.Update(ctx, domainUser)
+		if err != nil {
+			return nil, fmt.Errorf("failed to activate user :%v", err)
+		}
+	}
+	grpcUser, err := userToDTOGRPC(domainUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize user :%v", err)
+	}
+	return grpcUser, nil
+}
@@ -0,0 +1,289 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWebhookInterval    = 5 * time.Second
+	DefaultWebhookMaxAttempts = 8
+	//DefaultWebhookMinBackoff is the delay before the first retry, it doubles with each further attempt
+	DefaultWebhookMinBackoff = 10 * time.Second
+	DefaultWebhookMaxBackoff = time.Hour
+	DefaultWebhookTimeout    = 10 * time.Second
+	//DefaultWebhookLease is the time a claimed delivery is hidden from other dispatchers. It has to exceed
+	//the timeout of the client
+	DefaultWebhookLease = time.Minute
+	//DefaultWebhookConcurrency bounds the webhooks that are posted to at the same time
+	DefaultWebhookConcurrency = 8
+	//webhookPageSize is the number of events or deliveries processed at once
+	webhookPageSize = 100
+	//maxWebhookErrorLength bounds the stored error of a failed attempt
+	maxWebhookErrorLength = 512
+)
+
+//Headers of webhook deliveries. The signature is domain.WebhookSignature of the timestamp and the body
+const (
+	WebhookHeaderID        = "X-Webhook-Id"
+	WebhookHeaderCursor    = "X-Webhook-Cursor"
+	WebhookHeaderTimestamp = "X-Webhook-Timestamp"
+	WebhookHeaderSignature = "X-Webhook-Signature"
+)
+
+//WebhookPayload is the JSON body of a webhook delivery
+type WebhookPayload struct {
+	Cursor        int64  `json:"cursor"`
+	Kind          string `json:"kind"`
+	Email         string `json:"email"`
+	PublicKey     []byte `json:"public_key"`
+	State         string `json:"state,omitempty"`
+	CreatedAtUnix int64  `json:"created_at_unix"`
+}
+
+//WebhookDispatcher fans user events out to the registered webhooks. The progress is stored in
+//WebhookRepo, so multiple instances may run concurrently and restarts do not drop events. Deliveries are
+//claimed for Lease before they are posted, so that each is posted by a single instance unless it crashes.
+//The webhooks are posted to concurrently, the deliveries of a webhook in order. Zero fields select the
+//defaults
+type WebhookDispatcher struct {
+	EventRepo   userRepository.UserEventRepo
+	WebhookRepo userRepository.WebhookRepo
+	Client      *http.Client
+	Interval    time.Duration
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	Lease       time.Duration
+	Concurrency int
+}
+
+func (w *WebhookDispatcher) client() *http.Client {
+	if w.Client != nil {
+		return w.Client
+	}
+	return &http.Client{Timeout: DefaultWebhookTimeout}
+}
+
+//backoff returns the delay after the given number of failed attempts
+func (w *WebhookDispatcher) backoff(attempts int) time.Duration {
+	minBackoff, maxBackoff := w.MinBackoff, w.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultWebhookMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultWebhookMaxBackoff
+	}
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+//enqueue creates the deliveries of all events after the stored cursor
+func (w *WebhookDispatcher) enqueue(ctx context.Context) error {
+	cursor, err := w.WebhookRepo.GetWebhookCursor(ctx)
+	if err != nil {
+		return err
+	}
+	var webhooks []*domain.Webhook
+	for {
+		events, err := w.EventRepo.ListUserEvents(ctx, cursor, webhookPageSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		if webhooks == nil {
+			if webhooks, err = w.WebhookRepo.ListWebhooks(ctx); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		var deliveries []*domain.WebhookDelivery
+		for _, e := range events {
+			payload, err := json.Marshal(&WebhookPayload{
+				Cursor:        e.Sequence,
+				Kind:          string(e.Kind),
+				Email:         e.Email,
+				PublicKey:     e.PublicKeyPKIX,
+				State:         string(e.State),
+				CreatedAtUnix: e.CreatedAt.Unix(),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to encode webhook payload : %v", err)
+			}
+			for _, v := range webhooks {
+				//webhooks only receive events that happened after their registration
+				if !v.Subscribes(e.Kind) || e.CreatedAt.Before(v.CreatedAt) {
+					continue
+				}
+				deliveries = append(deliveries, &domain.WebhookDelivery{
+					WebhookID:     v.ID,
+					EventSequence: e.Sequence,
+					EventKind:     e.Kind,
+					Payload:       payload,
+					State:         domain.WebhookDeliveryPending,
+					NextAttemptAt: now,
+					CreatedAt:     now,
+				})
+			}
+		}
+		cursor = events[len(events)-1].Sequence
+		if err := w.WebhookRepo.EnqueueWebhookDeliveries(ctx, cursor, deliveries); err != nil {
+			return err
+		}
+	}
+}
+
+//post sends a single delivery to webhook
+func (w *WebhookDispatcher) post(ctx context.Context, webhook *domain.Webhook, d *domain.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderID, webhook.ID)
+	req.Header.Set(WebhookHeaderCursor, strconv.FormatInt(d.EventSequence, 10))
+	req.Header.Set(WebhookHeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookHeaderSignature, "sha256="+domain.WebhookSignature(webhook.Secret, timestamp, d.Payload))
+	resp, err := w.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+//deliver attempts all due deliveries once
+func (w *WebhookDispatcher) deliver(ctx context.Context) error {
+	deliveries, err := w.WebhookRepo.ListDueWebhookDeliveries(ctx, time.Now(), webhookPageSize)
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+	webhooks, err := w.WebhookRepo.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	byWebhook := make(map[string][]*domain.WebhookDelivery, len(webhooks))
+	for _, d := range deliveries {
+		byWebhook[d.WebhookID] = append(byWebhook[d.WebhookID], d)
+	}
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultWebhookConcurrency
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	//deliveries of webhooks deleted concurrently are skipped
+	for _, webhook := range webhooks {
+		pending := byWebhook[webhook.ID]
+		if len(pending) == 0 {
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(webhook *domain.Webhook, pending []*domain.WebhookDelivery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			for _, d := range pending {
+				if err := w.attempt(ctx, webhook, d); err != nil {
+					log.Printf("failed to deliver %v : %v", d, err)
+				}
+			}
+		}(webhook, pending)
+	}
+	wg.Wait()
+	return nil
+}
+
+//attempt claims d and posts it once. Deliveries claimed by another dispatcher or removed together with
+//their webhook in the meantime are skipped
+func (w *WebhookDispatcher) attempt(ctx context.Context, webhook *domain.Webhook, d *domain.WebhookDelivery) error {
+	lease := w.Lease
+	if lease <= 0 {
+		lease = DefaultWebhookLease
+	}
+	err := w.WebhookRepo.ClaimWebhookDelivery(ctx, d, time.Now().Add(lease))
+	if errors.Is(err, userRepository.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	postErr := w.post(ctx, webhook, d)
+	if postErr == nil {
+		return w.WebhookRepo.CompleteWebhookDelivery(ctx, d.WebhookID, d.EventSequence)
+	}
+	maxAttempts := w.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultWebhookMaxAttempts
+	}
+	d.Attempts++
+	d.LastError = postErr.Error()
+	if len(d.LastError) > maxWebhookErrorLength {
+		d.LastError = d.LastError[:maxWebhookErrorLength]
+	}
+	if d.Attempts >= maxAttempts {
+		d.State = domain.WebhookDeliveryDead
+		log.Printf("webhook delivery %v failed permanently : %v", d, postErr)
+	} else {
+		d.NextAttemptAt = time.Now().Add(w.backoff(d.Attempts))
+	}
+	err = w.WebhookRepo.UpdateWebhookDelivery(ctx, d)
+	if errors.Is(err, userRepository.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+//DispatchOnce enqueues the deliveries of new events and attempts all due deliveries
+func (w *WebhookDispatcher) DispatchOnce(ctx context.Context) {
+	if err := w.enqueue(ctx); err != nil {
+		log.Printf("failed to enqueue webhook deliveries : %v", err)
+	}
+	if err := w.deliver(ctx); err != nil {
+		log.Printf("failed to deliver webhooks : %v", err)
+	}
+}
+
+//Run dispatches every Interval until ctx is done
+func (w *WebhookDispatcher) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWebhookInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.DispatchOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package UserService
+
+import (
+	"UserService/adapters/userRepository"
+	"UserService/domain"
+	"UserService/protobufs/UserServiceSchema"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/url"
+)
+
+const (
+	//webhookSecretLength is the number of random bytes of the HMAC key of a webhook
+	webhookSecretLength     = 32
+	maxWebhookURLLength     = 2048
+	defaultDeadLettersLimit = 100
+	maxDeadLettersLimit     = 1000
+)
+
+var errWebhooksNotConfigured = status.Error(codes.FailedPrecondition, "webhooks are not configured")
+
+//authorizeWebhooks checks that webhooks are configured and the caller is an admin
+func (us *UserService) authorizeWebhooks(ctx context.Context) error {
+	if us.webhookRepo == nil {
+		return errWebhooksNotConfigured
+	}
+	return us.authorizeAdmin(ctx)
+}
+
+func webhookToDTOGRPC(w *domain.Webhook) *UserServiceSchema.Webhook {
+	grpcWebhook := &UserServiceSchema.Webhook{
+		Id:            w.ID,
+		Url:           w.URL,
+		CreatedAtUnix: w.CreatedAt.Unix(),
+	}
+	for _, v := range w.EventKinds {
+		grpcWebhook.EventKinds = append(grpcWebhook.EventKinds, string(v))
+	}
+	return grpcWebhook
+}
+
+func webhookDeliveryToDTOGRPC(d *domain.WebhookDelivery) *UserServiceSchema.WebhookDelivery {
+	return &UserServiceSchema.WebhookDelivery{
+		WebhookId:     d.WebhookID,
+		Cursor:        d.EventSequence,
+		Kind:          string(d.EventKind),
+		Payload:       d.Payload,
+		Attempts:      int64(d.Attempts),
+		LastError:     d.LastError,
+		CreatedAtUnix: d.CreatedAt.Unix(),
+	}
+}
+
+//validateWebhookURL checks that raw is an absolute http or https url
+func validateWebhookURL(raw string) error {
+	if len(raw) > maxWebhookURLLength {
+		return fmt.Errorf("must be at most %v bytes", maxWebhookURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url : %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host must not be empty")
+	}
+	return nil
+}
+
+//parseUserEventKinds converts kinds to known event kinds
+func parseUserEventKinds(kinds []string) ([]domain.UserEventKind, error) {
+	var parsed []domain.UserEventKind
+	for _, v := range kinds {
+		known := false
+		for _, k := range domain.UserEventKinds {
+			if string(k) == v {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event kind %q", v)
+		}
+		parsed = append(parsed, domain.UserEventKind(v))
+	}
+	return parsed, nil
+}
+
+//CreateWebhook registers an endpoint for the given event kinds, or all kinds if none are given. Only
+//events created after the registration are delivered. The response is the only one containing the
+//signing secret
+func (us *UserService) CreateWebhook(ctx context.Context, req *UserServiceSchema.WebhookRequestCreate) (*UserServiceSchema.Webhook, error) {
+	if err := us.authorizeWebhooks(ctx); err != nil {
+		return nil, err
+	}
+	var v violations
+	if err := validateWebhookURL(req.Url); err != nil {
+		v.add("url", err)
+	}
+	kinds, err := parseUserEventKinds(req.EventKinds)
+	if err != nil {
+		v.add("event_kinds", err)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, webhookSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate webhook secret : %v", err)
+	}
+	webhook, err := us.webhookRepo.CreateWebhook(ctx, &domain.Webhook{
+		ID:         id,
+		URL:        req.Url,
+		Secret:     secret,
+		EventKinds: kinds,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook : %v", err)
+	}
+	grpcWebhook := webhookToDTOGRPC(webhook)
+	grpcWebhook.Secret = webhook.Secret
+	return grpcWebhook, nil
+}
+
+func (us *UserService) ListWebhooks(ctx context.Context, _ *UserServiceSchema.Empty) (*UserServiceSchema.WebhookList, error) {
+	if err := us.authorizeWebhooks(ctx); err != nil {
+		return nil, err
+	}
+	webhooks, err := us.webhookRepo.ListWebhooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks : %v", err)
+	}
+	list := &UserServiceSchema.WebhookList{}
+	for _, w := range webhooks {
+		list.Webhooks = append(list.Webhooks, webhookToDTOGRPC(w))
+	}
+	return list, nil
+}
+
+//DeleteWebhook removes the webhook including its pending and dead deliveries
+func (us *UserService) DeleteWebhook(ctx context.Context, req *UserServiceSchema.WebhookRequestId) (*UserServiceSchema.Empty, error) {
+	if err := us.authorizeWebhooks(ctx); err != nil {
+		return nil, err
+	}
+	if err := us.webhookRepo.DeleteWebhook(ctx, req.Id); err != nil {
+		if errors.Is(err, userRepository.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "webhook not found")
+		}
+		return nil, fmt.Errorf("failed to delete webhook : %v", err)
+	}
+	return &UserServiceSchema.Empty{}, nil
+}
+
+//ListDeadWebhookDeliveries returns the deliveries that exhausted their attempts, optionally of a single webhook
+func (us *UserService) ListDeadWebhookDeliveries(ctx context.Context, req *UserServiceSchema.WebhookRequestDeadLetters) (*UserServiceSchema.WebhookDeliveryList, error) {
+	if err := us.authorizeWebhooks(ctx); err != nil {
+		return nil, err
+	}
+	limit := defaultDeadLettersLimit
+	if req.Limit < 0 || req.Limit > maxDeadLettersLimit {
+		var v violations
+		v.add("limit", fmt.Errorf("must be between 0 and %v", maxDeadLettersLimit))
+		return nil, v.err()
+	} else if req.Limit > 0 {
+		limit = int(req.Limit)
+	}
+	deliveries, err := us.webhookRepo.ListDeadWebhookDeliveries(ctx, req.WebhookId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead webhook deliveries : %v", err)
+	}
+	list := &UserServiceSchema.WebhookDeliveryList{}
+	for _, d := range deliveries {
+		list.Deliveries = append(list.Deliveries, webhookDeliveryToDTOGRPC(d))
+	}
+	return list, nil
+}
@@ -1,13 +1,5 @@
 #!/bin/bash
 
-
-#setup environment
-if ! sudo docker-compose -f ./docker/docker-compose.yml  up -d; then
-  echo "Failed to setup local dynamo db"
-  exit
-fi
-
-#run tests
+#the dynamo tests run against the in-memory fake, docker/ only starts DynamoDB Local for servers run with
+#DSN=dynamo-local
 go test ./...
-
-sudo docker-compose -f ./docker/docker-compose.yml  down
\ No newline at end of file